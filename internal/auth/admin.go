@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+)
+
+type (
+	userResponseJSON struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+
+	createUserRequestJSON struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+
+	createUserResponseJSON struct {
+		userResponseJSON
+		StreamKey string `json:"streamKey"`
+	}
+
+	resetPasswordRequestJSON struct {
+		Password string `json:"password"`
+	}
+
+	changeRoleRequestJSON struct {
+		Role string `json:"role"`
+	}
+)
+
+func newUserResponse(u *User) userResponseJSON {
+	return userResponseJSON{ID: u.ID(), Username: u.Name(), Role: u.Role()}
+}
+
+// getUserFromPath loads the user named by the {username} path value, writing
+// an error response if it can't.
+func (ctx *AuthContext) getUserFromPath(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, err := GetUser(r.Context(), ctx.Db, r.PathValue("username"))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, errors.New("User does not exist.").Error(), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (ctx *AuthContext) AdminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := ListUsers(r.Context(), ctx.Db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]userResponseJSON, 0, len(users))
+	for _, u := range users {
+		res = append(res, newUserResponse(u))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Username < res[j].Username })
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// AdminCreateUserHandler creates a user with a generated stream key, the key
+// is only ever returned in this response.
+func (ctx *AuthContext) AdminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req createUserRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = RoleBroadcaster
+	}
+
+	switch {
+	case req.Username == "" || req.Password == "":
+		http.Error(w, errors.New("Username and password are required.").Error(), http.StatusBadRequest)
+		return
+	case !ValidUsername(req.Username):
+		http.Error(w, errors.New("Username can't be blank, '.' or '..' or contain '/' or '\\'.").Error(), http.StatusBadRequest)
+		return
+	case !validRole(req.Role):
+		http.Error(w, errors.New("Unknown role.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := GetUser(r.Context(), ctx.Db, req.Username); err == nil {
+		http.Error(w, errors.New("User already exists.").Error(), http.StatusConflict)
+		return
+	}
+
+	streamKey := GenerateStreamKey()
+	user, err := NewUser(r.Context(), ctx.Db, req.Username, req.Password, streamKey, req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Audit(r, AuditAdminUserCreate, UserFromRequest(r).Name(), user.Name(), "role "+user.Role())
+	writeJSON(w, http.StatusCreated, createUserResponseJSON{userResponseJSON: newUserResponse(&user), StreamKey: streamKey})
+}
+
+func (ctx *AuthContext) AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := ctx.getUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID() == UserFromRequest(r).ID() {
+		http.Error(w, errors.New("You can't delete yourself.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := RemoveUser(r.Context(), ctx.Db, user.Name()); errors.Is(err, ErrLastAdmin) {
+		http.Error(w, errors.New("You can't delete the last admin.").Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Audit(r, AuditAdminUserDelete, UserFromRequest(r).Name(), user.Name(), "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ctx *AuthContext) AdminResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Password == "" {
+		http.Error(w, errors.New("Password is empty.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := ctx.getUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := user.SetPassword(r.Context(), ctx.Db, req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := ctx.Db.DeleteUserSessions(r.Context(), database.DeleteUserSessionsParams{UserID: user.ID()}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Audit(r, AuditAdminPasswordReset, UserFromRequest(r).Name(), user.Name(), "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminRotateStreamKeyHandler replaces the stream key of a user, the new key is
+// only ever returned in this response.
+func (ctx *AuthContext) AdminRotateStreamKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := ctx.getUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	streamKey := GenerateStreamKey()
+	if err := user.ChangeStreamkey(r.Context(), ctx.Db, streamKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Audit(r, AuditAdminStreamKeyRotate, UserFromRequest(r).Name(), user.Name(), "")
+	ctx.streamKeyRotated(user.Name())
+
+	writeJSON(w, http.StatusOK, streamKeyResponseJSON{StreamKey: streamKey})
+}
+
+func (ctx *AuthContext) AdminChangeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req changeRoleRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !validRole(req.Role) {
+		http.Error(w, errors.New("Unknown role.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := ctx.getUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID() == UserFromRequest(r).ID() {
+		http.Error(w, errors.New("You can't change your own role.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	previous := user.Role()
+	if err := user.ChangeRole(r.Context(), ctx.Db, req.Role); errors.Is(err, ErrLastAdmin) {
+		http.Error(w, errors.New("You can't demote the last admin.").Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Audit(r, AuditAdminRoleChange, UserFromRequest(r).Name(), user.Name(), previous+" to "+req.Role)
+
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
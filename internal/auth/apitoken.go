@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/google/uuid"
+)
+
+const apiTokenPrefix = "bb_"
+
+type (
+	// APIToken authenticates scripts as its user with `Authorization: Bearer`.
+	APIToken struct {
+		ID         string     `json:"id"`
+		Name       string     `json:"name"`
+		CreatedAt  time.Time  `json:"createdAt"`
+		LastUsedAt *time.Time `json:"lastUsedAt"`
+	}
+
+	createAPITokenRequestJSON struct {
+		Name string `json:"name"`
+	}
+
+	createAPITokenResponseJSON struct {
+		APIToken
+		Token string `json:"token"`
+	}
+)
+
+func newAPIToken(t database.ApiToken) APIToken {
+	res := APIToken{ID: t.ID, Name: t.Name, CreatedAt: t.CreatedAt}
+	if t.LastUsedAt.Valid {
+		res.LastUsedAt = &t.LastUsedAt.Time
+	}
+
+	return res
+}
+
+// IsAPIToken reports if a bearer token is an API token, as opposed to a stream
+// key or viewer token.
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// API tokens are random, a fast hash is enough to not store them in plain text
+func hashAPIToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// apiTokenUser returns the user of the API token in the Authorization header.
+func (ctx *AuthContext) apiTokenUser(r *http.Request) (*User, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !IsAPIToken(token) {
+		return nil, false
+	}
+
+	t, err := ctx.Db.GetAPITokenByHash(r.Context(), hashAPIToken(token))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println(err)
+		}
+		return nil, false
+	}
+
+	u, err := ctx.Db.GetUserByID(r.Context(), t.UserID)
+	if err != nil {
+		return nil, false
+	}
+
+	if err = ctx.Db.TouchAPIToken(r.Context(), database.TouchAPITokenParams{
+		LastUsedAt: sql.NullTime{Time: time.Now().UTC(), Valid: true},
+		ID:         t.ID,
+	}); err != nil {
+		log.Println(err)
+	}
+
+	return &User{user: &u}, true
+}
+
+func (ctx *AuthContext) ListAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := ctx.Db.ListAPITokens(r.Context(), UserFromRequest(r).ID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]APIToken, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, newAPIToken(t))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// CreateAPITokenHandler creates a named token for the logged in user. The
+// token is only ever returned in this response.
+func (ctx *AuthContext) CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req createAPITokenRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, errors.New("Name is empty.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token := apiTokenPrefix + GenerateStreamKey()
+	t, err := ctx.Db.CreateAPIToken(r.Context(), database.CreateAPITokenParams{
+		ID:        id.String(),
+		UserID:    UserFromRequest(r).ID(),
+		Name:      req.Name,
+		TokenHash: hashAPIToken(token),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		http.Error(w, errors.New("Token with this name already exists.").Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, createAPITokenResponseJSON{APIToken: newAPIToken(t), Token: token})
+}
+
+func (ctx *AuthContext) RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	deleted, err := ctx.Db.DeleteAPIToken(r.Context(), database.DeleteAPITokenParams{ID: r.PathValue("id"), UserID: UserFromRequest(r).ID()})
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case deleted == 0:
+		http.Error(w, errors.New("API token does not exist.").Error(), http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+)
+
+const (
+	AuditLogin                = "login"
+	AuditLoginFailed          = "login.failed"
+	AuditPublish              = "whip.publish"
+	AuditPublishRejected      = "whip.rejected"
+	AuditRTMPPublish          = "rtmp.publish"
+	AuditRTMPPublishRejected  = "rtmp.rejected"
+	AuditSRTPublish           = "srt.publish"
+	AuditSRTPublishRejected   = "srt.rejected"
+	AuditPasswordChange       = "password.change"
+	AuditStreamKeyRotate      = "streamkey.rotate"
+	AuditAdminUserCreate      = "admin.user.create"
+	AuditAdminUserDelete      = "admin.user.delete"
+	AuditAdminPasswordReset   = "admin.password.reset"
+	AuditAdminStreamKeyRotate = "admin.streamkey.rotate"
+	AuditAdminRoleChange      = "admin.role.change"
+	AuditAdminGroupsChange    = "admin.groups.change"
+
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// AuditEvent is an entry of the audit log. Actor is the user who acted, or
+// tried to, and Target the user or stream acted on.
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+	Details   string    `json:"details"`
+}
+
+// Audit records an event of the request in the audit log. Failing to record
+// it is logged but doesn't fail the request.
+func (ctx *AuthContext) Audit(r *http.Request, action, actor, target, details string) {
+	ctx.AuditIP(r.Context(), ctx.ClientIP(r), action, actor, target, details)
+}
+
+// AuditIP records an event that didn't come with an HTTP request, like an RTMP
+// broadcast, from the client at ip.
+func (ctx *AuthContext) AuditIP(c context.Context, ip, action, actor, target, details string) {
+	if err := ctx.Db.CreateAuditEvent(c, database.CreateAuditEventParams{
+		CreatedAt: time.Now().UTC(),
+		Action:    action,
+		Actor:     actor,
+		Target:    target,
+		Ip:        ip,
+		Details:   details,
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// AdminAuditLogHandler lists the audit log newest first. It can be filtered by
+// the action and actor query parameters, and paged by passing the smallest ID
+// seen as before.
+func (ctx *AuthContext) AdminAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	params := database.ListAuditEventsParams{
+		Action: sql.NullString{String: query.Get("action"), Valid: query.Has("action")},
+		Actor:  sql.NullString{String: query.Get("actor"), Valid: query.Has("actor")},
+		Before: math.MaxInt64,
+		Limit:  defaultAuditPageSize,
+	}
+
+	var err error
+	if query.Has("before") {
+		if params.Before, err = strconv.ParseInt(query.Get("before"), 10, 64); err != nil {
+			http.Error(w, errors.New("before must be an event ID.").Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Has("limit") {
+		if params.Limit, err = strconv.ParseInt(query.Get("limit"), 10, 64); err != nil || params.Limit < 1 || params.Limit > maxAuditPageSize {
+			http.Error(w, errors.New("limit is out of range.").Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := ctx.Db.ListAuditEvents(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]AuditEvent, 0, len(events))
+	for _, e := range events {
+		res = append(res, AuditEvent{
+			ID:        e.ID,
+			CreatedAt: e.CreatedAt,
+			Action:    e.Action,
+			Actor:     e.Actor,
+			Target:    e.Target,
+			IP:        e.Ip,
+			Details:   e.Details,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -1,8 +1,11 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"net/netip"
 
 	"github.com/glimesh/broadcast-box/internal/database"
 	"github.com/gorilla/sessions"
@@ -10,31 +13,53 @@ import (
 )
 
 const (
-	authedValue   = "authenticated"
 	sessionName   = "broadcast-box"
 	usernameValue = "username"
 	passwordValue = "password"
 )
 
+type contextKey int
+
+const userContextKey contextKey = iota
+
+type (
+	changePasswordRequestJSON struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+
+	streamKeyResponseJSON struct {
+		StreamKey string `json:"streamKey"`
+	}
+)
+
 type AuthContext struct {
-	Db    *database.Queries
-	store sessions.Store
+	Db             *database.Queries
+	store          sessions.Store
+	Throttle       *Throttle
+	viewerTokenKey []byte
+	oidc           *oidcProvider
+
+	// Reverse proxies whose X-Forwarded-For is trusted, see ClientIP
+	TrustedProxies []netip.Prefix
+
+	// OnStreamKeyRotate is called with the user whose stream key was replaced
+	OnStreamKeyRotate func(username string)
 }
 
-func NewContext(db *database.Queries, sessionKey []byte) AuthContext {
+func NewContext(db *database.Queries, store sessions.Store, viewerTokenKey []byte) AuthContext {
 	return AuthContext{
-		Db:    db,
-		store: sessions.NewCookieStore(sessionKey),
+		Db:             db,
+		store:          store,
+		Throttle:       NewThrottle(),
+		viewerTokenKey: viewerTokenKey,
 	}
 }
 
 func (ctx *AuthContext) AuthHandler(next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session, _ := ctx.store.Get(r, sessionName)
-		authenticated := session.Values[authedValue]
-
-		if authenticated != nil && authenticated != false {
-			next(w, r)
+		if user, ok := ctx.requestUser(r); ok {
+			next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
 			return
 		}
 
@@ -43,10 +68,58 @@ func (ctx *AuthContext) AuthHandler(next func(w http.ResponseWriter, r *http.Req
 	}
 }
 
+// MaybeAuthHandler is like AuthHandler but also calls next for anonymous
+// requests. UserFromRequest returns an empty user for them.
+func (ctx *AuthContext) MaybeAuthHandler(next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := ctx.requestUser(r); ok {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		}
+
+		next(w, r)
+	}
+}
+
+// requestUser authenticates a request by its session cookie or API token.
+func (ctx *AuthContext) requestUser(r *http.Request) (*User, bool) {
+	if user, ok := ctx.apiTokenUser(r); ok {
+		return user, true
+	}
+
+	return ctx.sessionUser(r)
+}
+
+func (ctx *AuthContext) sessionUser(r *http.Request) (*User, bool) {
+	session, err := ctx.store.Get(r, sessionName)
+	if err != nil {
+		return nil, false
+	}
+
+	userID, ok := session.Values[userIDValue].(string)
+	if !ok {
+		return nil, false
+	}
+
+	u, err := ctx.Db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		return nil, false
+	}
+
+	return &User{user: &u}, true
+}
+
+// UserFromRequest returns the user authenticated by AuthHandler.
+func UserFromRequest(r *http.Request) *User {
+	user, ok := r.Context().Value(userContextKey).(*User)
+	if !ok {
+		return &User{user: &database.User{}}
+	}
+
+	return user
+}
+
 func (ctx *AuthContext) UserInfoHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := ctx.store.Get(r, sessionName)
-	username := session.Values[usernameValue].(string)
-	_, err := w.Write([]byte(username))
+	_, err := w.Write([]byte(UserFromRequest(r).Name()))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -58,14 +131,30 @@ func (ctx *AuthContext) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.PostForm.Get(usernameValue)
 	pwd := r.PostForm.Get(passwordValue)
 
+	// Checked before bcrypt so guessing can't exhaust the CPU either
+	throttleKeys := []string{"ip:" + ctx.ClientIP(r), "user:" + username}
+	if wait, ok := ctx.Throttle.Allow(throttleKeys...); !ok {
+		TooManyAttempts(w, wait)
+		return
+	}
+
 	user, err := GetUser(r.Context(), ctx.Db, username)
 	if err != nil {
+		VerifyUnknownUser(pwd)
+		ctx.Audit(r, AuditLoginFailed, username, username, "unknown user")
+		ctx.FailAttempt(r.Context(), ctx.ClientIP(r), AuditLoginFailed, username, throttleKeys...)
 		http.Error(w, errors.New("Invalid login data.").Error(), http.StatusUnauthorized)
 		return
 	}
 
 	if user.VerifyPassword(pwd) {
-		ctx.setAuthed(username, true, w, r)
+		ctx.Throttle.Reset(throttleKeys...)
+		if err = ctx.logIn(user, w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx.Audit(r, AuditLogin, username, username, "password")
+
 		_, err := w.Write([]byte(username))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -73,22 +162,92 @@ func (ctx *AuthContext) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx.Audit(r, AuditLoginFailed, username, username, "invalid password")
+	ctx.FailAttempt(r.Context(), ctx.ClientIP(r), AuditLoginFailed, username, throttleKeys...)
 	http.Error(w, errors.New("Invalid login data.").Error(), http.StatusUnauthorized)
 }
 
-func (ctx *AuthContext) LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	ctx.setAuthed("", false, w, r)
-}
+// ChangePasswordHandler lets a logged in user change their own password.
+func (ctx *AuthContext) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.NewPassword == "" {
+		http.Error(w, errors.New("New password is empty.").Error(), http.StatusBadRequest)
+		return
+	}
 
-func (ctx *AuthContext) setAuthed(username string, isAuthed bool, w http.ResponseWriter, r *http.Request) {
+	user := UserFromRequest(r)
+	if err := user.ChangePassword(r.Context(), ctx.Db, req.CurrentPassword, req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Everyone who knew the old password is logged out, except for this session
 	session, _ := ctx.store.Get(r, sessionName)
-	session.Values[authedValue] = isAuthed
-	session.Values[usernameValue] = username
-	err := session.Save(r, w)
-	if err != nil {
+	if err := ctx.Db.DeleteUserSessions(r.Context(), database.DeleteUserSessionsParams{UserID: user.ID(), ID: session.ID}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Audit(r, AuditPasswordChange, user.Name(), user.Name(), "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateStreamKeyHandler replaces the stream key of the logged in user. The
+// new key is only ever returned in this response.
+func (ctx *AuthContext) RegenerateStreamKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := UserFromRequest(r)
+	streamKey := GenerateStreamKey()
+	if err := user.ChangeStreamkey(r.Context(), ctx.Db, streamKey); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	ctx.Audit(r, AuditStreamKeyRotate, user.Name(), user.Name(), "")
+	ctx.streamKeyRotated(user.Name())
+
+	writeJSON(w, http.StatusOK, streamKeyResponseJSON{StreamKey: streamKey})
+}
+
+func (ctx *AuthContext) streamKeyRotated(username string) {
+	if ctx.OnStreamKeyRotate != nil {
+		ctx.OnStreamKeyRotate(username)
+	}
+}
+
+func (ctx *AuthContext) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := ctx.store.Get(r, sessionName)
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// logIn starts a new session for user, ending the one the request had so its
+// ID can't be fixated before logging in.
+func (ctx *AuthContext) logIn(user *User, w http.ResponseWriter, r *http.Request) error {
+	session, _ := ctx.store.New(r, sessionName)
+	if session.ID != "" {
+		userID, _ := session.Values[userIDValue].(string)
+		if _, err := ctx.Db.DeleteSession(r.Context(), database.DeleteSessionParams{ID: session.ID, UserID: userID}); err != nil {
+			return err
+		}
+	}
+
+	session.ID = ""
+	session.Values = map[any]any{userIDValue: user.ID()}
+	return session.Save(r, w)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func verifyPassword(password string, hash []byte) bool {
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	AuthorizeActionPublish = "publish"
+	AuthorizeActionWatch   = "watch"
+)
+
+type (
+	// Authorizer decides about publish and watch requests, for deployments
+	// whose entitlements live outside of the user database. Publish requests
+	// are decided by it alone, watch requests only after the stream's policy
+	// let them through.
+	Authorizer interface {
+		Authorize(ctx context.Context, req AuthorizeRequest) (Decision, error)
+	}
+
+	AuthorizeRequest struct {
+		Action string `json:"action"`
+		// whip or whep
+		Protocol string `json:"protocol"`
+		Stream   string `json:"stream"`
+		// Stream key of publish requests
+		StreamKey string `json:"streamKey,omitempty"`
+		// Logged in user of watch requests, or the viewer of a viewer token
+		User string `json:"user,omitempty"`
+		// If the local checks allow the request, like the stream key matching
+		// the one of the stream's user
+		LocalAllowed bool        `json:"localAllowed"`
+		ClientIP     string      `json:"clientIp"`
+		SDP          *SDPSummary `json:"sdp,omitempty"`
+	}
+
+	// SDPSummary is what an offer asks for.
+	SDPSummary struct {
+		// Codecs of the media, without the ones for retransmission and FEC
+		Audio []string `json:"audio"`
+		Video []string `json:"video"`
+		// RIDs of simulcast layers, empty without simulcast
+		Simulcast []string `json:"simulcast"`
+	}
+
+	Decision struct {
+		Allow bool `json:"allow"`
+		// Stream the request goes to instead of the requested one, empty
+		// keeps it
+		Stream string `json:"stream,omitempty"`
+		// Why the request was denied, it is written to the audit log
+		Reason string `json:"reason,omitempty"`
+	}
+
+	// HTTPAuthorizer POSTs the AuthorizeRequest as JSON to a URL, which
+	// responds with 200 and the Decision as JSON.
+	HTTPAuthorizer struct {
+		url    string
+		client *http.Client
+	}
+
+	// cachedAuthorizer remembers the decisions of another Authorizer for a
+	// while, errors aren't remembered.
+	cachedAuthorizer struct {
+		next Authorizer
+		ttl  time.Duration
+
+		mu        sync.Mutex
+		decisions map[[sha256.Size]byte]cachedDecision
+		lastPrune time.Time
+	}
+
+	cachedDecision struct {
+		decision Decision
+		expires  time.Time
+	}
+)
+
+func NewHTTPAuthorizer(url string, timeout time.Duration) *HTTPAuthorizer {
+	return &HTTPAuthorizer{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (a *HTTPAuthorizer) Authorize(ctx context.Context, req AuthorizeRequest) (Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := a.client.Do(httpReq)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("authorization callback responded with %s", res.Status)
+	}
+
+	var decision Decision
+	if err = json.NewDecoder(res.Body).Decode(&decision); err != nil {
+		return Decision{}, fmt.Errorf("authorization callback responded with invalid JSON: %w", err)
+	}
+
+	return decision, nil
+}
+
+// NewCachedAuthorizer returns an Authorizer that asks next once for equal
+// requests within ttl, or next itself if ttl isn't positive.
+func NewCachedAuthorizer(next Authorizer, ttl time.Duration) Authorizer {
+	if ttl <= 0 {
+		return next
+	}
+
+	return &cachedAuthorizer{next: next, ttl: ttl, decisions: map[[sha256.Size]byte]cachedDecision{}}
+}
+
+func (a *cachedAuthorizer) Authorize(ctx context.Context, req AuthorizeRequest) (Decision, error) {
+	// Hashed so stream keys aren't kept in memory
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	key := sha256.Sum256(body)
+
+	now := time.Now()
+	a.mu.Lock()
+	cached, ok := a.decisions[key]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.decision, nil
+	}
+
+	decision, err := a.next.Authorize(ctx, req)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.lastPrune) > a.ttl {
+		for k, d := range a.decisions {
+			if now.After(d.expires) {
+				delete(a.decisions, k)
+			}
+		}
+		a.lastPrune = now
+	}
+	a.decisions[key] = cachedDecision{decision: decision, expires: now.Add(a.ttl)}
+
+	return decision, nil
+}
+
+// SummarizeSDP returns the summary of an offer, nil if it can't be parsed.
+func SummarizeSDP(offer string) *SDPSummary {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.UnmarshalString(offer); err != nil {
+		return nil
+	}
+
+	summary := &SDPSummary{Audio: []string{}, Video: []string{}, Simulcast: []string{}}
+	for _, media := range parsed.MediaDescriptions {
+		var codecs *[]string
+		switch media.MediaName.Media {
+		case "audio":
+			codecs = &summary.Audio
+		case "video":
+			codecs = &summary.Video
+		default:
+			continue
+		}
+
+		for _, attribute := range media.Attributes {
+			switch attribute.Key {
+			case "rtpmap":
+				// <payload type> <codec>/<clock rate>[/<channels>]
+				_, encoding, _ := strings.Cut(attribute.Value, " ")
+				codec, _, _ := strings.Cut(encoding, "/")
+				switch strings.ToLower(codec) {
+				case "", "rtx", "red", "ulpfec", "flexfec-03":
+				default:
+					if !slices.Contains(*codecs, codec) {
+						*codecs = append(*codecs, codec)
+					}
+				}
+			case "rid":
+				if rid, _, _ := strings.Cut(attribute.Value, " "); rid != "" && media.MediaName.Media == "video" {
+					summary.Simulcast = append(summary.Simulcast, rid)
+				}
+			}
+		}
+	}
+
+	return summary
+}
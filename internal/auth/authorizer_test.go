@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testOffer = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=audio 9 UDP/TLS/RTP/SAVPF 111
+a=rtpmap:111 opus/48000/2
+m=video 9 UDP/TLS/RTP/SAVPF 96 97 98
+a=rtpmap:96 H264/90000
+a=rtpmap:97 rtx/90000
+a=rtpmap:98 VP8/90000
+a=rid:high send
+a=rid:low send
+a=simulcast:send high;low
+`
+
+func TestSummarizeSDP(t *testing.T) {
+	summary := SummarizeSDP(testOffer)
+	switch {
+	case summary == nil:
+		t.Fatal("offer was not parsed")
+	case !slices.Equal(summary.Audio, []string{"opus"}):
+		t.Errorf("wrong audio %v", summary.Audio)
+	case !slices.Equal(summary.Video, []string{"H264", "VP8"}):
+		t.Errorf("wrong video %v", summary.Video)
+	case !slices.Equal(summary.Simulcast, []string{"high", "low"}):
+		t.Errorf("wrong simulcast %v", summary.Simulcast)
+	}
+
+	if SummarizeSDP("not sdp") != nil {
+		t.Error("invalid offer was summarized")
+	}
+}
+
+func TestHTTPAuthorizer(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		var req AuthorizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		switch req.Stream {
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			_ = json.NewEncoder(w).Encode(Decision{Allow: req.StreamKey == "key", Stream: "rewritten"})
+		}
+	}))
+	defer server.Close()
+
+	authorizer := NewCachedAuthorizer(NewHTTPAuthorizer(server.URL, 100*time.Millisecond), time.Minute)
+	req := AuthorizeRequest{Action: AuthorizeActionPublish, Protocol: "whip", Stream: "user", StreamKey: "key"}
+
+	for range 2 {
+		decision, err := authorizer.Authorize(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		} else if !decision.Allow || decision.Stream != "rewritten" {
+			t.Errorf("wrong decision %+v", decision)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("decision was not cached, %d calls", calls.Load())
+	}
+
+	req.StreamKey = "wrong"
+	if decision, err := authorizer.Authorize(context.Background(), req); err != nil || decision.Allow {
+		t.Errorf("other stream key was allowed %+v %v", decision, err)
+	}
+
+	for _, stream := range []string{"slow", "broken"} {
+		req.Stream = stream
+		if _, err := authorizer.Authorize(context.Background(), req); err == nil {
+			t.Errorf("%s callback didn't fail", stream)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcFlowCookieName = "broadcast-box-oidc"
+	// How long a user has to log in at the provider
+	oidcFlowMaxAge = 10 * time.Minute
+
+	defaultOIDCUsernameClaim = "preferred_username"
+)
+
+// Roles in order of precedence when claims map to more than one
+var rolePrecedence = []string{RoleAdmin, RoleBroadcaster, RoleViewer}
+
+type (
+	// OIDCConfig configures logging in with an OpenID Connect provider.
+	OIDCConfig struct {
+		Issuer       string
+		ClientID     string
+		ClientSecret string
+		// Callback URL registered at the provider, ending in /auth/oidc/callback
+		RedirectURL string
+		// Scopes besides openid
+		Scopes []string
+		// Claim used as the username of new users
+		UsernameClaim string
+		// Claim holding the roles or groups of a user, a string or list of
+		// strings. If empty every user gets DefaultRole and roles are never
+		// changed on login.
+		RoleClaim string
+		// Maps values of RoleClaim to roles
+		RoleMap map[string]string
+		// Role of users none of whose claims are in RoleMap
+		DefaultRole string
+		// If the cookie of the login flow is only sent over HTTPS
+		SecureCookies bool
+	}
+
+	oidcProvider struct {
+		config   OIDCConfig
+		oauth2   oauth2.Config
+		verifier *oidc.IDTokenVerifier
+		codec    securecookie.Codec
+	}
+
+	// State of a login in progress, kept in a cookie until the callback
+	oidcFlow struct {
+		State       string
+		Nonce       string
+		Verifier    string
+		RedirectURL string
+	}
+)
+
+// EnableOIDC discovers the provider at cfg.Issuer and enables the
+// /auth/oidc/login and /auth/oidc/callback handlers.
+func (ctx *AuthContext) EnableOIDC(c context.Context, cfg OIDCConfig) error {
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = defaultOIDCUsernameClaim
+	}
+
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = RoleViewer
+	}
+
+	if !validRole(cfg.DefaultRole) {
+		return fmt.Errorf("unknown default role %q", cfg.DefaultRole)
+	}
+
+	for claim, role := range cfg.RoleMap {
+		if !validRole(role) {
+			return fmt.Errorf("claim %q maps to unknown role %q", claim, role)
+		}
+	}
+
+	provider, err := oidc.NewProvider(c, cfg.Issuer)
+	if err != nil {
+		return err
+	}
+
+	// Logins in progress are lost on restart, so the key doesn't need to be kept
+	codec := securecookie.New([]byte(rand.Text()+rand.Text()), nil)
+	codec.MaxAge(int(oidcFlowMaxAge.Seconds()))
+
+	ctx.oidc = &oidcProvider{
+		config: cfg,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, cfg.Scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		codec:    codec,
+	}
+
+	return nil
+}
+
+// mapRole returns the role for the claims of a user, or "" if roles are not
+// taken from claims.
+func (p *oidcProvider) mapRole(claims map[string]any) string {
+	if p.config.RoleClaim == "" {
+		return ""
+	}
+
+	var values []string
+	switch v := claims[p.config.RoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []any:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	roles := []string{}
+	for _, v := range values {
+		if role, ok := p.config.RoleMap[v]; ok {
+			roles = append(roles, role)
+		}
+	}
+
+	for _, role := range rolePrecedence {
+		if slices.Contains(roles, role) {
+			return role
+		}
+	}
+
+	return p.config.DefaultRole
+}
+
+// provisionUser returns the user linked to the identity of the ID token,
+// creating them on their first login.
+func (ctx *AuthContext) provisionUser(c context.Context, token *oidc.IDToken, claims map[string]any) (*User, error) {
+	role := ctx.oidc.mapRole(claims)
+
+	identity, err := ctx.Db.GetOIDCIdentity(c, database.GetOIDCIdentityParams{Issuer: token.Issuer, Subject: token.Subject})
+	switch {
+	case err == nil:
+		u, err := ctx.Db.GetUserByID(c, identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		user := &User{user: &u}
+		if role != "" && role != user.Role() {
+			err = user.ChangeRole(c, ctx.Db, role)
+		}
+
+		return user, err
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	username, _ := claims[ctx.oidc.config.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("ID token has no %q claim", ctx.oidc.config.UsernameClaim)
+	}
+
+	// Linking to an existing local user would let the provider take it over
+	if _, err = GetUser(c, ctx.Db, username); err == nil {
+		return nil, fmt.Errorf("user %q already exists", username)
+	}
+
+	if role == "" {
+		role = ctx.oidc.config.DefaultRole
+	}
+
+	// The password is never shown, these users can only log in at the provider
+	user, err := NewUser(c, ctx.Db, username, rand.Text(), GenerateStreamKey(), role)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ctx.Db.CreateOIDCIdentity(c, database.CreateOIDCIdentityParams{
+		Issuer:  token.Issuer,
+		Subject: token.Subject,
+		UserID:  user.ID(),
+	}); err != nil {
+		return nil, errors.Join(err, RemoveUser(c, ctx.Db, username))
+	}
+
+	return &user, nil
+}
+
+// OIDCLoginHandler redirects to the provider. After logging in there the user
+// is sent to the local path in the redirectUrl query parameter.
+func (ctx *AuthContext) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if ctx.oidc == nil {
+		http.Error(w, errors.New("OpenID Connect is not configured.").Error(), http.StatusNotFound)
+		return
+	}
+
+	flow := oidcFlow{
+		State:       rand.Text(),
+		Nonce:       rand.Text(),
+		Verifier:    oauth2.GenerateVerifier(),
+		RedirectURL: r.URL.Query().Get("redirectUrl"),
+	}
+
+	// Only redirect within Broadcast Box after logging in
+	if !strings.HasPrefix(flow.RedirectURL, "/") || strings.HasPrefix(flow.RedirectURL, "//") {
+		flow.RedirectURL = "/"
+	}
+
+	encoded, err := ctx.oidc.codec.Encode(oidcFlowCookieName, flow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookieName,
+		Value:    encoded,
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcFlowMaxAge.Seconds()),
+		Secure:   ctx.oidc.config.SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, ctx.oidc.oauth2.AuthCodeURL(
+		flow.State,
+		oidc.Nonce(flow.Nonce),
+		oauth2.S256ChallengeOption(flow.Verifier),
+	), http.StatusFound)
+}
+
+// OIDCCallbackHandler finishes a login started by OIDCLoginHandler.
+func (ctx *AuthContext) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if ctx.oidc == nil {
+		http.Error(w, errors.New("OpenID Connect is not configured.").Error(), http.StatusNotFound)
+		return
+	}
+
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		http.Error(w, "Login failed: "+errParam, http.StatusUnauthorized)
+		return
+	}
+
+	var flow oidcFlow
+	c, err := r.Cookie(oidcFlowCookieName)
+	if err == nil {
+		err = ctx.oidc.codec.Decode(oidcFlowCookieName, c.Value, &flow)
+	}
+
+	if err != nil || flow.State != r.URL.Query().Get("state") {
+		http.Error(w, errors.New("Login expired, please try again.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookieName, Path: "/auth/oidc", MaxAge: -1})
+
+	oauth2Token, err := ctx.oidc.oauth2.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, errors.New("Invalid login data.").Error(), http.StatusUnauthorized)
+		return
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, errors.New("Invalid login data.").Error(), http.StatusUnauthorized)
+		return
+	}
+
+	idToken, err := ctx.oidc.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != flow.Nonce {
+		http.Error(w, errors.New("Invalid login data.").Error(), http.StatusUnauthorized)
+		return
+	}
+
+	claims := map[string]any{}
+	if err = idToken.Claims(&claims); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := ctx.provisionUser(r.Context(), idToken, claims)
+	if err != nil {
+		log.Println(err)
+		ctx.Audit(r, AuditLoginFailed, idToken.Subject, idToken.Subject, "oidc: "+err.Error())
+		http.Error(w, errors.New("Couldn't log in with this account.").Error(), http.StatusForbidden)
+		return
+	}
+
+	if err = ctx.logIn(user, w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Audit(r, AuditLogin, user.Name(), user.Name(), "oidc")
+
+	http.Redirect(w, r, flow.RedirectURL, http.StatusFound)
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+)
+
+// mockIssuer is a minimal OpenID Connect provider that logs in a single user
+// with the configured claims.
+type mockIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	claims    map[string]any
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T, claims map[string]any) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{key: key, claims: claims}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != m.challenge {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     m.idToken(t),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+
+	return m
+}
+
+func (m *mockIssuer) idToken(t *testing.T) string {
+	claims := map[string]any{
+		"iss":   m.URL,
+		"aud":   "broadcast-box",
+		"sub":   "1234",
+		"nonce": m.nonce,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login runs the browser side of the authorization code flow and returns the
+// response of the callback.
+func (m *mockIssuer) login(t *testing.T, authCtx *AuthContext) *http.Response {
+	rec := httptest.NewRecorder()
+	authCtx.OIDCLoginHandler(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login?redirectUrl=/stream", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login returned %d", rec.Code)
+	}
+
+	authorize, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := authorize.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatal("login did not use PKCE")
+	}
+	m.nonce = query.Get("nonce")
+	m.challenge = query.Get("code_challenge")
+
+	callback := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+	for _, c := range rec.Result().Cookies() {
+		callback.AddCookie(c)
+	}
+
+	rec = httptest.NewRecorder()
+	authCtx.OIDCCallbackHandler(rec, callback)
+	return rec.Result()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	issuer := newMockIssuer(t, map[string]any{"preferred_username": "alice", "groups": []string{"staff", "streamers"}})
+	defer issuer.Close()
+
+	queries := database.New(db)
+	authCtx := NewContext(queries, NewSessionStore(queries, time.Hour, time.Hour, false, []byte("session")), []byte("viewer"))
+	if err = authCtx.EnableOIDC(ctx, OIDCConfig{
+		Issuer:      issuer.URL,
+		ClientID:    "broadcast-box",
+		RedirectURL: "http://localhost/auth/oidc/callback",
+		RoleClaim:   "groups",
+		RoleMap:     map[string]string{"streamers": RoleBroadcaster, "admins": RoleAdmin},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := issuer.login(t, &authCtx)
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/stream" {
+		t.Fatalf("callback returned %d to %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	user, err := GetUser(ctx, queries, "alice")
+	if err != nil {
+		t.Fatalf("user was not provisioned: %s", err)
+	}
+
+	if user.Role() != RoleBroadcaster {
+		t.Errorf("user has role %q, want %q", user.Role(), RoleBroadcaster)
+	}
+
+	sessions, err := queries.ListSessions(ctx, user.ID())
+	if err != nil || len(sessions) != 1 {
+		t.Errorf("user has %d sessions after logging in", len(sessions))
+	}
+
+	// Roles follow the claims on every login
+	issuer.claims["groups"] = []string{"admins"}
+	if res = issuer.login(t, &authCtx); res.StatusCode != http.StatusFound {
+		t.Fatalf("second login returned %d", res.StatusCode)
+	}
+
+	if user, _ = GetUser(ctx, queries, "alice"); user.Role() != RoleAdmin {
+		t.Errorf("user has role %q after the claims changed, want %q", user.Role(), RoleAdmin)
+	}
+
+	// A local user with the same name is never taken over
+	if _, err = NewUser(ctx, queries, "bob", "password", "streamkey", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.claims["preferred_username"] = "bob"
+	issuer.claims["sub"] = "5678"
+	if res = issuer.login(t, &authCtx); res.StatusCode != http.StatusForbidden {
+		t.Errorf("login as existing local user returned %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/glimesh/broadcast-box/internal/publisher"
+)
+
+const (
+	// Anyone can watch, the stream is listed in the status
+	VisibilityPublic = "public"
+	// Anyone with the link can watch, the stream is not listed
+	VisibilityUnlisted = "unlisted"
+	// Every logged in user can watch
+	VisibilityLoginRequired = "login-required"
+	// Only the listed users and members of the listed groups can watch
+	VisibilityAllowList = "allow-list"
+
+	defaultVisibility = VisibilityLoginRequired
+
+	allowedViewerKindUser  = "user"
+	allowedViewerKindGroup = "group"
+)
+
+var (
+	errUnknownVisibility      = errors.New("unknown visibility")
+	errUnknownPublisherPolicy = errors.New("unknown publisher policy")
+)
+
+type (
+	// StreamPolicy decides who may watch the stream of a user, if it is
+	// recorded and what happens when a second publisher starts a broadcast.
+	StreamPolicy struct {
+		Visibility    string   `json:"visibility"`
+		AllowedUsers  []string `json:"allowedUsers"`
+		AllowedGroups []string `json:"allowedGroups"`
+		Record        bool     `json:"record"`
+		// One of the publisher.Policy values
+		PublisherPolicy string `json:"publisherPolicy"`
+	}
+
+	userGroupsRequestJSON struct {
+		Groups []string `json:"groups"`
+	}
+)
+
+func validVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityLoginRequired, VisibilityAllowList:
+		return true
+	}
+
+	return false
+}
+
+// GetStreamPolicy returns the policy of the stream owned by the user. Streams
+// that were never configured use the default policy.
+func GetStreamPolicy(ctx context.Context, queries *database.Queries, owner *User) (StreamPolicy, error) {
+	policy := StreamPolicy{
+		Visibility:      defaultVisibility,
+		AllowedUsers:    []string{},
+		AllowedGroups:   []string{},
+		PublisherPolicy: publisher.PolicyTakeover,
+	}
+
+	settings, err := queries.GetStreamSettings(ctx, owner.ID())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return policy, nil
+	case err != nil:
+		return policy, err
+	}
+	policy.Visibility = settings.Visibility
+	policy.Record = settings.Record
+	policy.PublisherPolicy = settings.PublisherPolicy
+
+	allowed, err := queries.ListStreamAllowedViewers(ctx, owner.ID())
+	if err != nil {
+		return policy, err
+	}
+
+	for _, a := range allowed {
+		if a.Kind == allowedViewerKindGroup {
+			policy.AllowedGroups = append(policy.AllowedGroups, a.Name)
+		} else {
+			policy.AllowedUsers = append(policy.AllowedUsers, a.Name)
+		}
+	}
+
+	return policy, nil
+}
+
+// SetStreamPolicy replaces the policy of the stream owned by the user in one
+// transaction. An empty publisher policy is the default one.
+func SetStreamPolicy(ctx context.Context, queries *database.Queries, owner *User, policy StreamPolicy) error {
+	if !validVisibility(policy.Visibility) {
+		return errUnknownVisibility
+	}
+
+	if policy.PublisherPolicy == "" {
+		policy.PublisherPolicy = publisher.PolicyTakeover
+	} else if !publisher.ValidPolicy(policy.PublisherPolicy) {
+		return errUnknownPublisherPolicy
+	}
+
+	return queries.InTx(ctx, func(queries *database.Queries) error {
+		if err := queries.UpsertStreamSettings(ctx, database.UpsertStreamSettingsParams{
+			UserID:          owner.ID(),
+			Visibility:      policy.Visibility,
+			Record:          policy.Record,
+			PublisherPolicy: policy.PublisherPolicy,
+		}); err != nil {
+			return err
+		}
+
+		if err := queries.DeleteStreamAllowedViewers(ctx, owner.ID()); err != nil {
+			return err
+		}
+
+		for kind, names := range map[string][]string{allowedViewerKindUser: policy.AllowedUsers, allowedViewerKindGroup: policy.AllowedGroups} {
+			slices.Sort(names)
+			for _, name := range slices.Compact(names) {
+				if err := queries.AddStreamAllowedViewer(ctx, database.AddStreamAllowedViewerParams{
+					UserID: owner.ID(),
+					Kind:   kind,
+					Name:   name,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Listed reports if the stream shows up in listings for viewers that may watch it.
+func (p StreamPolicy) Listed() bool {
+	return p.Visibility != VisibilityUnlisted
+}
+
+// CanWatch reports if the viewer may watch the stream of owner. viewer is the
+// empty user for anonymous requests.
+func CanWatch(ctx context.Context, queries *database.Queries, viewer, owner *User) (bool, error) {
+	if viewer.ID() != "" && (viewer.ID() == owner.ID() || viewer.Can(PermissionWatchAll)) {
+		return true, nil
+	}
+
+	policy, err := GetStreamPolicy(ctx, queries, owner)
+	if err != nil {
+		return false, err
+	}
+
+	switch policy.Visibility {
+	case VisibilityPublic, VisibilityUnlisted:
+		return true, nil
+	case VisibilityLoginRequired:
+		return viewer.Can(PermissionWatch), nil
+	case VisibilityAllowList:
+		if !viewer.Can(PermissionWatch) {
+			return false, nil
+		}
+
+		if slices.Contains(policy.AllowedUsers, viewer.Name()) {
+			return true, nil
+		}
+
+		groups, err := queries.ListUserGroups(ctx, viewer.ID())
+		if err != nil {
+			return false, err
+		}
+
+		for _, g := range groups {
+			if slices.Contains(policy.AllowedGroups, g) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (ctx *AuthContext) GetStreamPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	policy, err := GetStreamPolicy(r.Context(), ctx.Db, UserFromRequest(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, policy)
+}
+
+// SetStreamPolicyHandler lets a logged in user change who may watch their stream.
+func (ctx *AuthContext) SetStreamPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var policy StreamPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := SetStreamPolicy(r.Context(), ctx.Db, UserFromRequest(r), policy)
+	switch {
+	case errors.Is(err, errUnknownVisibility):
+		http.Error(w, errors.New("Unknown visibility.").Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errUnknownPublisherPolicy):
+		http.Error(w, errors.New("Unknown publisher policy.").Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.GetStreamPolicyHandler(w, r)
+}
+
+func (ctx *AuthContext) AdminSetGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	var req userGroupsRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := ctx.getUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	slices.Sort(req.Groups)
+	groups := slices.Compact(req.Groups)
+	if err := ctx.Db.InTx(r.Context(), func(queries *database.Queries) error {
+		if err := queries.DeleteUserGroups(r.Context(), user.ID()); err != nil {
+			return err
+		}
+
+		for _, g := range groups {
+			if err := queries.AddUserGroup(r.Context(), database.AddUserGroupParams{UserID: user.ID(), Name: g}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Audit(r, AuditAdminGroupsChange, UserFromRequest(r).Name(), user.Name(), strings.Join(groups, ","))
+	writeJSON(w, http.StatusOK, userGroupsRequestJSON{Groups: groups})
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+)
+
+const (
+	RoleAdmin       = "admin"
+	RoleBroadcaster = "broadcaster"
+	RoleViewer      = "viewer"
+)
+
+type Permission int
+
+const (
+	// Watch streams that require a login
+	PermissionWatch Permission = iota + 1
+	// Publish to the user's own stream with its stream key
+	PermissionPublish
+	// See the status of every stream instead of only the own one
+	PermissionViewAllStatus
+	// Watch every stream and control every WHEP session regardless of its policy
+	PermissionWatchAll
+	// Manage users, roles and stream keys
+	PermissionManageUsers
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:       {PermissionWatch, PermissionPublish, PermissionViewAllStatus, PermissionWatchAll, PermissionManageUsers},
+	RoleBroadcaster: {PermissionWatch, PermissionPublish},
+	RoleViewer:      {PermissionWatch},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can reports if the user's role grants the permission.
+func (u *User) Can(p Permission) bool {
+	return slices.Contains(rolePermissions[u.user.Role], p)
+}
+
+// PermissionHandler only calls next for logged in users whose role grants the
+// permission.
+func (ctx *AuthContext) PermissionHandler(p Permission, next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return ctx.AuthHandler(func(w http.ResponseWriter, r *http.Request) {
+		if !UserFromRequest(r).Can(p) {
+			http.Error(w, errors.New("You don't have permission to do this.").Error(), http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// AdminHandler only calls next for logged in users that may manage users.
+func (ctx *AuthContext) AdminHandler(next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return ctx.PermissionHandler(PermissionManageUsers, next)
+}
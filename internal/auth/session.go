@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	DefaultSessionIdleTimeout = 7 * 24 * time.Hour
+	DefaultSessionMaxAge      = 30 * 24 * time.Hour
+
+	// Last seen is only written once per interval to not write on every request
+	sessionTouchInterval = time.Minute
+
+	userIDValue = "userID"
+)
+
+// ActiveSession is a login of a user, as listed to them.
+type ActiveSession struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+// SessionStore is a sessions.Store that keeps sessions in the database, the
+// cookie only holds the signed session ID. Sessions can be revoked and expire
+// after being idle for IdleTimeout or MaxAge after logging in, whichever is
+// first.
+//
+// Only the ID of the logged in user is persisted in Values.
+type SessionStore struct {
+	db          *database.Queries
+	codecs      []securecookie.Codec
+	options     *sessions.Options
+	idleTimeout time.Duration
+	maxAge      time.Duration
+}
+
+// NewSessionStore returns a SessionStore signing cookies with keys. The first
+// key signs new cookies, the others are still accepted so keys can be rotated.
+// Cookies are only sent over HTTPS if secure is set.
+func NewSessionStore(db *database.Queries, idleTimeout, maxAge time.Duration, secure bool, keys ...[]byte) *SessionStore {
+	keyPairs := make([][]byte, 0, len(keys)*2)
+	for _, k := range keys {
+		keyPairs = append(keyPairs, k, nil)
+	}
+
+	s := &SessionStore{
+		db:     db,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(maxAge.Seconds()),
+			SameSite: http.SameSiteLaxMode,
+			Secure:   secure,
+			HttpOnly: true,
+		},
+		idleTimeout: idleTimeout,
+		maxAge:      maxAge,
+	}
+
+	for _, codec := range s.codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.options.MaxAge)
+		}
+	}
+
+	return s
+}
+
+// Get returns the session of the request, cached for the rest of it.
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request cookie. Missing, expired or
+// revoked sessions are returned as new, empty sessions.
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err = securecookie.DecodeMulti(name, c.Value, &id, s.codecs...); err != nil {
+		return session, err
+	}
+
+	row, err := s.db.GetSession(r.Context(), id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return session, nil
+	case err != nil:
+		return session, err
+	}
+
+	now := time.Now().UTC()
+	if s.expired(row, now) {
+		_, err = s.db.DeleteSession(r.Context(), database.DeleteSessionParams{ID: row.ID, UserID: row.UserID})
+		return session, err
+	}
+
+	if now.Sub(row.LastSeenAt) > sessionTouchInterval {
+		if err = s.db.TouchSession(r.Context(), database.TouchSessionParams{LastSeenAt: now, ID: row.ID}); err != nil {
+			log.Println(err)
+		}
+	}
+
+	session.ID = row.ID
+	session.Values[userIDValue] = row.UserID
+	session.IsNew = false
+	return session, nil
+}
+
+// Save creates the session in the database once a user is set, or deletes it
+// when Options.MaxAge is negative.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	userID, _ := session.Values[userIDValue].(string)
+	if session.Options.MaxAge < 0 || userID == "" {
+		if session.ID != "" {
+			if _, err := s.db.DeleteSession(r.Context(), database.DeleteSessionParams{ID: session.ID, UserID: userID}); err != nil {
+				return err
+			}
+		}
+
+		opts := *session.Options
+		opts.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", &opts))
+		return nil
+	}
+
+	if session.ID == "" {
+		now := time.Now().UTC()
+		if err := s.db.DeleteExpiredSessions(r.Context(), database.DeleteExpiredSessionsParams{
+			LastSeenAt: now.Add(-s.idleTimeout),
+			CreatedAt:  now.Add(-s.maxAge),
+		}); err != nil {
+			log.Println(err)
+		}
+
+		row, err := s.db.CreateSession(r.Context(), database.CreateSessionParams{
+			ID:         rand.Text(),
+			UserID:     userID,
+			UserAgent:  r.UserAgent(),
+			CreatedAt:  now,
+			LastSeenAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		session.ID = row.ID
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *SessionStore) expired(row database.Session, now time.Time) bool {
+	return now.Sub(row.LastSeenAt) > s.idleTimeout || now.Sub(row.CreatedAt) > s.maxAge
+}
+
+func (ctx *AuthContext) ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := ctx.Db.ListSessions(r.Context(), UserFromRequest(r).ID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	current, _ := ctx.store.Get(r, sessionName)
+	res := make([]ActiveSession, 0, len(rows))
+	for _, s := range rows {
+		res = append(res, ActiveSession{
+			ID:         s.ID,
+			UserAgent:  s.UserAgent,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			Current:    s.ID == current.ID,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// EndSessionHandler logs the user out of one of their sessions.
+func (ctx *AuthContext) EndSessionHandler(w http.ResponseWriter, r *http.Request) {
+	deleted, err := ctx.Db.DeleteSession(r.Context(), database.DeleteSessionParams{ID: r.PathValue("id"), UserID: UserFromRequest(r).ID()})
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case deleted == 0:
+		http.Error(w, errors.New("Session does not exist.").Error(), http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// EndAllSessionsHandler logs the user out everywhere, including this session.
+func (ctx *AuthContext) EndAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ctx.Db.DeleteUserSessions(r.Context(), database.DeleteUserSessionsParams{UserID: UserFromRequest(r).ID()}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
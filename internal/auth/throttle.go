@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Failures allowed before attempts are delayed
+	throttleFreeAttempts = 5
+	throttleBaseDelay    = time.Second
+	throttleMaxDelay     = 15 * time.Minute
+	// Failures are forgotten after this long without another one
+	throttleForgetAfter = time.Hour
+)
+
+type throttleEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Throttle slows down guessing of passwords and stream keys. Every failed
+// attempt past the first few locks the keys it was made with, like the client
+// IP and the username, for twice as long as the previous one.
+type Throttle struct {
+	mu        sync.Mutex
+	entries   map[string]*throttleEntry
+	lastPrune time.Time
+}
+
+func NewThrottle() *Throttle {
+	return &Throttle{entries: map[string]*throttleEntry{}}
+}
+
+// Allow reports if an attempt may be made with all of keys, and otherwise how
+// long until it may.
+func (t *Throttle) Allow(keys ...string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		if e, ok := t.entries[k]; ok && e.lockedUntil.After(now) {
+			wait = max(wait, e.lockedUntil.Sub(now))
+		}
+	}
+
+	return wait, wait == 0
+}
+
+// Fail records a failed attempt with keys, it reports if that locked any of
+// them. Attempts are only made while keys are not locked, so every lock is the
+// start of a lockout.
+func (t *Throttle) Fail(keys ...string) (locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastPrune) > time.Minute {
+		t.prune(now)
+	}
+
+	for _, k := range keys {
+		e, ok := t.entries[k]
+		if !ok {
+			e = &throttleEntry{}
+			t.entries[k] = e
+		}
+
+		e.failures++
+		e.lastFailure = now
+		if e.failures > throttleFreeAttempts {
+			delay := throttleMaxDelay
+			if n := e.failures - throttleFreeAttempts - 1; n < 20 {
+				delay = min(throttleBaseDelay<<n, throttleMaxDelay)
+			}
+			e.lockedUntil = now.Add(delay)
+			locked = true
+		}
+	}
+
+	return locked
+}
+
+// Reset forgets the failures of keys after a successful attempt.
+func (t *Throttle) Reset(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, k := range keys {
+		delete(t.entries, k)
+	}
+}
+
+func (t *Throttle) prune(now time.Time) {
+	for k, e := range t.entries {
+		if now.Sub(e.lastFailure) > throttleForgetAfter && now.After(e.lockedUntil) {
+			delete(t.entries, k)
+		}
+	}
+	t.lastPrune = now
+}
+
+// FailAttempt records a failed attempt of the client at ip with throttleKeys
+// on target. Only the start of a lockout is audited as action, not every
+// attempt rejected during it.
+func (ctx *AuthContext) FailAttempt(c context.Context, ip, action, target string, throttleKeys ...string) {
+	if ctx.Throttle.Fail(throttleKeys...) {
+		ctx.AuditIP(c, ip, action, target, target, "too many attempts")
+	}
+}
+
+// TooManyAttempts responds that the client has to wait before trying again.
+func TooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, errors.New("Too many attempts, try again later.").Error(), http.StatusTooManyRequests)
+}
+
+// ClientIP returns the IP address the request was made from. Requests from
+// TrustedProxies are from the last address in X-Forwarded-For that isn't one
+// of them.
+func (ctx *AuthContext) ClientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !ctx.FromTrustedProxy(r) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for _, entry := range slices.Backward(forwarded) {
+		addr, err := netip.ParseAddr(strings.TrimSpace(entry))
+		if err != nil {
+			break
+		}
+
+		host = addr.String()
+		if !ctx.trustedProxy(addr) {
+			break
+		}
+	}
+
+	return host
+}
+
+// FromTrustedProxy reports if the request was made by one of TrustedProxies,
+// only then its X-Forwarded headers can be trusted.
+func (ctx *AuthContext) FromTrustedProxy(r *http.Request) bool {
+	addr, err := netip.ParseAddr(remoteHost(r))
+	return err == nil && ctx.trustedProxy(addr)
+}
+
+// remoteHost returns the IP address of the peer of the request.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (ctx *AuthContext) trustedProxy(addr netip.Addr) bool {
+	return slices.ContainsFunc(ctx.TrustedProxies, func(p netip.Prefix) bool {
+		return p.Contains(addr.Unmap())
+	})
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestThrottle(t *testing.T) {
+	throttle := NewThrottle()
+
+	for range throttleFreeAttempts {
+		if throttle.Fail("ip:a", "user:foo") {
+			t.Fatal("free attempt locked the keys")
+		}
+	}
+
+	if _, ok := throttle.Allow("ip:a", "user:foo"); !ok {
+		t.Fatal("attempts were throttled before using up the free ones")
+	}
+
+	if !throttle.Fail("ip:a", "user:foo") {
+		t.Error("lockout was not reported")
+	}
+	if wait, ok := throttle.Allow("ip:b", "user:foo"); ok || wait > throttleBaseDelay {
+		t.Errorf("username was not locked for %s from another IP, got %s", throttleBaseDelay, wait)
+	}
+
+	throttle.Fail("ip:a")
+	if wait, _ := throttle.Allow("ip:a"); wait <= throttleBaseDelay {
+		t.Errorf("delay did not grow, got %s", wait)
+	}
+
+	if _, ok := throttle.Allow("ip:b", "user:bar"); !ok {
+		t.Error("unrelated keys were throttled")
+	}
+
+	throttle.Reset("user:foo")
+	if _, ok := throttle.Allow("ip:b", "user:foo"); !ok {
+		t.Error("username was still locked after a successful attempt")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	ctx := AuthContext{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+
+	for _, c := range []struct {
+		remoteAddr, forwardedFor, ip string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// Only trusted proxies may forward
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		// Addresses the client sent before the proxies are not trusted
+		{"10.0.0.1:1234", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "unknown", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+
+		if ip := ctx.ClientIP(r); ip != c.ip {
+			t.Errorf("%s forwarding %q is %s, expected %s", c.remoteAddr, c.forwardedFor, ip, c.ip)
+		}
+	}
+}
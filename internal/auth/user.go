@@ -3,8 +3,12 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"errors"
 	"log"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/glimesh/broadcast-box/internal/database"
 	"github.com/google/uuid"
@@ -14,11 +18,29 @@ import (
 const runes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 const rounds = 13
 
+var (
+	// ErrLastAdmin is returned when deleting or demoting a user would leave no
+	// admin.
+	ErrLastAdmin = errors.New("user is the last admin")
+
+	// Compared against for names without a user, see VerifyUnknownUser
+	dummyHash = sync.OnceValue(func() []byte {
+		h, _ := hash(rand.Text())
+		return h
+	})
+)
+
 type User struct {
 	user *database.User
 }
 
-func NewUser(ctx context.Context, queries *database.Queries, username, password, streamKey string) (User, error) {
+// ValidUsername reports if name can be a user. Names are path elements of the
+// API and recordings, so they must be a single one.
+func ValidUsername(name string) bool {
+	return strings.TrimSpace(name) != "" && name != "." && filepath.IsLocal(name) && !strings.ContainsAny(name, `/\`)
+}
+
+func NewUser(ctx context.Context, queries *database.Queries, username, password, streamKey, role string) (User, error) {
 
 	id, err := uuid.NewV7()
 	if err != nil {
@@ -40,13 +62,38 @@ func NewUser(ctx context.Context, queries *database.Queries, username, password,
 		Name:      username,
 		Password:  pw,
 		Streamkey: sk,
+		Role:      role,
 	})
+	if err != nil {
+		return User{}, err
+	}
 
 	return User{user: &u}, nil
 }
 
+// RemoveUser deletes the user, unless it is the last admin.
 func RemoveUser(ctx context.Context, queries *database.Queries, username string) error {
-	return queries.DeleteUser(ctx, username)
+	deleted, err := queries.DeleteUser(ctx, username)
+	if err != nil || deleted != 0 {
+		return err
+	}
+
+	// Nothing was deleted, either the user doesn't exist or is the last admin
+	if _, err = queries.GetUser(ctx, username); errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return ErrLastAdmin
+}
+
+// VerifyUnknownUser takes as long as checking a password or stream key of a
+// user, so rejecting names without one doesn't reveal that. It always returns
+// false.
+func VerifyUnknownUser(secret string) bool {
+	_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(secret))
+	return false
 }
 
 func GetUser(ctx context.Context, queries *database.Queries, username string) (*User, error) {
@@ -72,6 +119,10 @@ func ListUsers(ctx context.Context, queries *database.Queries) (map[string]*User
 	return res, nil
 }
 
+func (u *User) ID() string   { return u.user.ID }
+func (u *User) Name() string { return u.user.Name }
+func (u *User) Role() string { return u.user.Role }
+
 func (u *User) VerifyPassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword(u.user.Password, []byte(password))
 	return err == nil
@@ -87,6 +138,11 @@ func (u *User) ChangePassword(ctx context.Context, queries *database.Queries, cu
 		return errors.New("passwords did not match")
 	}
 
+	return u.SetPassword(ctx, queries, new)
+}
+
+// SetPassword replaces the password without verifying the current one.
+func (u *User) SetPassword(ctx context.Context, queries *database.Queries, new string) error {
 	hash, err := hash(new)
 	if err != nil {
 		return err
@@ -126,6 +182,22 @@ func (u *User) ChangeStreamkey(ctx context.Context, queries *database.Queries, n
 	return nil
 }
 
+func (u *User) ChangeRole(ctx context.Context, queries *database.Queries, role string) error {
+	if !validRole(role) {
+		return errors.New("unknown role")
+	}
+
+	updated, err := queries.UpdateUserRole(ctx, database.UpdateUserRoleParams{Role: role, ID: u.user.ID})
+	if err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrLastAdmin
+	}
+
+	u.user.Role = role
+	return nil
+}
+
 func GenerateStreamKey() string {
 	return rand.Text()
 }
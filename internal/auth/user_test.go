@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+)
+
+func TestLastAdmin(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	queries := database.New(db)
+	users := map[string]*User{}
+	for _, name := range []string{"first", "second"} {
+		u, err := queries.CreateUser(ctx, database.CreateUserParams{ID: name, Name: name, Password: []byte{}, Streamkey: []byte(name), Role: RoleAdmin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[name] = &User{user: &u}
+	}
+
+	if err = users["first"].ChangeRole(ctx, queries, RoleViewer); err != nil {
+		t.Fatalf("couldn't demote one of two admins: %s", err)
+	}
+
+	if err = users["second"].ChangeRole(ctx, queries, RoleBroadcaster); !errors.Is(err, ErrLastAdmin) {
+		t.Fatalf("last admin was demoted: %v", err)
+	}
+	if err = users["second"].ChangeRole(ctx, queries, RoleAdmin); err != nil {
+		t.Errorf("couldn't keep the last admin an admin: %s", err)
+	}
+
+	if err = RemoveUser(ctx, queries, "second"); !errors.Is(err, ErrLastAdmin) {
+		t.Fatalf("last admin was deleted: %v", err)
+	}
+
+	if err = RemoveUser(ctx, queries, "first"); err != nil {
+		t.Errorf("couldn't delete a viewer: %s", err)
+	}
+	if err = RemoveUser(ctx, queries, "missing"); err != nil {
+		t.Errorf("deleting a missing user failed: %s", err)
+	}
+}
+
+func TestValidUsername(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"user":       true,
+		"user name":  true,
+		"user..name": true,
+		"":           false,
+		"  ":         false,
+		".":          false,
+		"..":         false,
+		"a/b":        false,
+		`a\b`:        false,
+		"../user":    false,
+	} {
+		if ValidUsername(name) != valid {
+			t.Errorf("%q is valid: %t, expected %t", name, !valid, valid)
+		}
+	}
+}
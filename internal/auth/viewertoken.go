@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultViewerTokenTTL = 24 * time.Hour
+	maxViewerTokenTTL     = 365 * 24 * time.Hour
+)
+
+// Pre-encoded header of every viewer token, they are JWTs signed with HS256
+var viewerTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var ErrInvalidViewerToken = errors.New("invalid viewer token")
+
+type (
+	viewerTokenClaims struct {
+		ID        string `json:"jti"`
+		Stream    string `json:"sub"`
+		ExpiresAt int64  `json:"exp"`
+		IssuedAt  int64  `json:"iat"`
+	}
+
+	// ViewerToken lets anyone holding it watch one stream until it expires or
+	// is revoked, regardless of the stream's policy.
+	ViewerToken struct {
+		ID        string    `json:"id"`
+		Stream    string    `json:"stream"`
+		CreatedBy string    `json:"createdBy"`
+		MaxUses   int64     `json:"maxUses"`
+		Revoked   bool      `json:"revoked"`
+		ExpiresAt time.Time `json:"expiresAt"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	createViewerTokenRequestJSON struct {
+		// Lifetime in seconds
+		ExpiresIn int64 `json:"expiresIn"`
+		// Maximum concurrent WHEP sessions, 0 is unlimited
+		MaxUses int64 `json:"maxUses"`
+	}
+
+	createViewerTokenResponseJSON struct {
+		ViewerToken
+		Token string `json:"token"`
+	}
+)
+
+func newViewerToken(t database.ViewerToken, stream string) ViewerToken {
+	return ViewerToken{
+		ID:        t.ID,
+		Stream:    stream,
+		CreatedBy: t.CreatedBy,
+		MaxUses:   t.MaxUses,
+		Revoked:   t.Revoked,
+		ExpiresAt: t.ExpiresAt,
+		CreatedAt: t.CreatedAt,
+	}
+}
+
+func (ctx *AuthContext) signViewerToken(claims viewerTokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := viewerTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, ctx.viewerTokenKey)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// IssueViewerToken creates a signed token for the stream of owner.
+func (ctx *AuthContext) IssueViewerToken(c context.Context, owner, issuer *User, ttl time.Duration, maxUses int64) (string, ViewerToken, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", ViewerToken{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	t, err := ctx.Db.CreateViewerToken(c, database.CreateViewerTokenParams{
+		ID:        id.String(),
+		UserID:    owner.ID(),
+		CreatedBy: issuer.Name(),
+		MaxUses:   maxUses,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", ViewerToken{}, err
+	}
+
+	token, err := ctx.signViewerToken(viewerTokenClaims{
+		ID:        t.ID,
+		Stream:    owner.Name(),
+		ExpiresAt: t.ExpiresAt.Unix(),
+		IssuedAt:  now.Unix(),
+	})
+
+	return token, newViewerToken(t, owner.Name()), err
+}
+
+// VerifyViewerToken checks the signature and expiry of token, that it was
+// issued for stream and that it has not been revoked.
+func (ctx *AuthContext) VerifyViewerToken(c context.Context, token, stream string) (ViewerToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != viewerTokenHeader {
+		return ViewerToken{}, ErrInvalidViewerToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ViewerToken{}, ErrInvalidViewerToken
+	}
+
+	mac := hmac.New(sha256.New, ctx.viewerTokenKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return ViewerToken{}, ErrInvalidViewerToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ViewerToken{}, ErrInvalidViewerToken
+	}
+
+	var claims viewerTokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return ViewerToken{}, ErrInvalidViewerToken
+	}
+
+	if claims.Stream != stream || time.Now().Unix() >= claims.ExpiresAt {
+		return ViewerToken{}, ErrInvalidViewerToken
+	}
+
+	t, err := ctx.Db.GetViewerToken(c, claims.ID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ViewerToken{}, ErrInvalidViewerToken
+	case err != nil:
+		return ViewerToken{}, err
+	case t.Revoked:
+		return ViewerToken{}, ErrInvalidViewerToken
+	}
+
+	return newViewerToken(t, claims.Stream), nil
+}
+
+// Session identity of viewers that authenticated with a viewer token
+func (t ViewerToken) Viewer() string {
+	return "token:" + t.ID
+}
+
+func (ctx *AuthContext) listViewerTokens(w http.ResponseWriter, r *http.Request, owner *User) {
+	tokens, err := ctx.Db.ListViewerTokens(r.Context(), owner.ID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]ViewerToken, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, newViewerToken(t, owner.Name()))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (ctx *AuthContext) createViewerToken(w http.ResponseWriter, r *http.Request, owner *User) {
+	var req createViewerTokenRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	switch {
+	case req.ExpiresIn == 0:
+		ttl = defaultViewerTokenTTL
+	case req.ExpiresIn < 0 || ttl > maxViewerTokenTTL:
+		http.Error(w, errors.New("expiresIn is out of range.").Error(), http.StatusBadRequest)
+		return
+	case req.MaxUses < 0:
+		http.Error(w, errors.New("maxUses must not be negative.").Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, t, err := ctx.IssueViewerToken(r.Context(), owner, UserFromRequest(r), ttl, req.MaxUses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, createViewerTokenResponseJSON{ViewerToken: t, Token: token})
+}
+
+func (ctx *AuthContext) revokeViewerToken(w http.ResponseWriter, r *http.Request, owner *User) {
+	revoked, err := ctx.Db.RevokeViewerToken(r.Context(), database.RevokeViewerTokenParams{ID: r.PathValue("id"), UserID: owner.ID()})
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case revoked == 0:
+		http.Error(w, errors.New("Viewer token does not exist.").Error(), http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (ctx *AuthContext) ListViewerTokensHandler(w http.ResponseWriter, r *http.Request) {
+	ctx.listViewerTokens(w, r, UserFromRequest(r))
+}
+
+func (ctx *AuthContext) CreateViewerTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx.createViewerToken(w, r, UserFromRequest(r))
+}
+
+func (ctx *AuthContext) RevokeViewerTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx.revokeViewerToken(w, r, UserFromRequest(r))
+}
+
+func (ctx *AuthContext) AdminListViewerTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := ctx.getUserFromPath(w, r); ok {
+		ctx.listViewerTokens(w, r, owner)
+	}
+}
+
+func (ctx *AuthContext) AdminCreateViewerTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := ctx.getUserFromPath(w, r); ok {
+		ctx.createViewerToken(w, r, owner)
+	}
+}
+
+func (ctx *AuthContext) AdminRevokeViewerTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := ctx.getUserFromPath(w, r); ok {
+		ctx.revokeViewerToken(w, r, owner)
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+)
+
+func TestViewerToken(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	queries := database.New(db)
+	owner, err := queries.CreateUser(ctx, database.CreateUserParams{ID: "1", Name: "foo", Password: []byte{}, Streamkey: []byte{}, Role: RoleBroadcaster})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authCtx := NewContext(queries, nil, []byte("viewer"))
+	token, issued, err := authCtx.IssueViewerToken(ctx, &User{user: &owner}, &User{user: &owner}, time.Minute, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = authCtx.VerifyViewerToken(ctx, token, "foo"); err != nil {
+		t.Errorf("couldn't verify token: %s", err)
+	}
+
+	if _, err = authCtx.VerifyViewerToken(ctx, token, "bar"); err == nil {
+		t.Error("token was accepted for another stream")
+	}
+
+	if _, err = authCtx.VerifyViewerToken(ctx, token[:len(token)-2]+"AA", "foo"); err == nil {
+		t.Error("token with a modified signature was accepted")
+	}
+
+	otherKeyCtx := NewContext(queries, nil, []byte("other"))
+	if _, err = otherKeyCtx.VerifyViewerToken(ctx, token, "foo"); err == nil {
+		t.Error("token signed with another key was accepted")
+	}
+
+	if _, err = queries.RevokeViewerToken(ctx, database.RevokeViewerTokenParams{ID: issued.ID, UserID: owner.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = authCtx.VerifyViewerToken(ctx, token, "foo"); err == nil {
+		t.Error("revoked token was accepted")
+	}
+
+	expired, _, err := authCtx.IssueViewerToken(ctx, &User{user: &owner}, &User{user: &owner}, -time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = authCtx.VerifyViewerToken(ctx, expired, "foo"); err == nil {
+		t.Error("expired token was accepted")
+	}
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Open opens (and creates if needed) the SQLite database at path and applies
+// all pending migrations.
+func Open(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Migrate applies every migration newer than the schema version stored in the
+// database. Migrations are forward-only, a database written by a newer build is
+// rejected.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	current, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if err = applyMigration(ctx, db, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the version of the last migration applied to db.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint
+
+	if _, err = tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []migration{}
+	for _, e := range entries {
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", e.Name())
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", e.Name(), err)
+		}
+
+		content, err := fs.ReadFile(migrationFiles, path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{version: version, name: e.Name(), sql: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := range migrations {
+		if migrations[i].version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence, expected version %d", migrations[i].name, i+1)
+		}
+	}
+
+	return migrations, nil
+}
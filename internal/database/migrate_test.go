@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].version
+
+	version, err := SchemaVersion(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != latest {
+		t.Errorf("schema version wrong. expected: %d, actual: %d", latest, version)
+	}
+
+	if _, err = New(db).CreateUser(ctx, CreateUserParams{ID: "1", Name: "foo", Password: []byte("bar"), Streamkey: []byte("baz")}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Reopening must keep existing data and not re-run migrations
+	db, err = Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = New(db).GetUser(ctx, "foo"); err != nil {
+		t.Errorf("user did not survive reopening the database: %s", err)
+	}
+
+	if _, err = db.ExecContext(ctx, "PRAGMA user_version = 1000"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Migrate(ctx, db); err == nil {
+		t.Error("migrating a database with a newer schema version did not fail")
+	}
+}
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'broadcaster';
+
+-- The first user is the one created on first run
+UPDATE users SET role = 'admin'
+WHERE id = (SELECT MIN(id) FROM users);
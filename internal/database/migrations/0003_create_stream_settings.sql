@@ -0,0 +1,17 @@
+CREATE TABLE stream_settings (
+  user_id    TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  visibility TEXT NOT NULL DEFAULT 'login-required'
+);
+
+CREATE TABLE stream_allowed_viewers (
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  kind    TEXT NOT NULL,
+  name    TEXT NOT NULL,
+  PRIMARY KEY (user_id, kind, name)
+);
+
+CREATE TABLE user_groups (
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name    TEXT NOT NULL,
+  PRIMARY KEY (user_id, name)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE viewer_tokens (
+  id         TEXT     PRIMARY KEY,
+  user_id    TEXT     NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_by TEXT     NOT NULL,
+  max_uses   INTEGER  NOT NULL DEFAULT 0,
+  revoked    BOOLEAN  NOT NULL DEFAULT FALSE,
+  expires_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL
+);
+
+CREATE INDEX viewer_tokens_user_id ON viewer_tokens (user_id);
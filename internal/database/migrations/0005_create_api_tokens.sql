@@ -0,0 +1,9 @@
+CREATE TABLE api_tokens (
+  id           TEXT     PRIMARY KEY,
+  user_id      TEXT     NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name         TEXT     NOT NULL,
+  token_hash   BLOB     NOT NULL UNIQUE,
+  created_at   DATETIME NOT NULL,
+  last_used_at DATETIME,
+  UNIQUE (user_id, name)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE sessions (
+  id           TEXT     PRIMARY KEY,
+  user_id      TEXT     NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  user_agent   TEXT     NOT NULL,
+  created_at   DATETIME NOT NULL,
+  last_seen_at DATETIME NOT NULL
+);
+
+CREATE INDEX sessions_user_id ON sessions (user_id);
@@ -0,0 +1,12 @@
+CREATE TABLE audit_log (
+  id         INTEGER  PRIMARY KEY AUTOINCREMENT,
+  created_at DATETIME NOT NULL,
+  action     TEXT     NOT NULL,
+  actor      TEXT     NOT NULL,
+  target     TEXT     NOT NULL,
+  ip         TEXT     NOT NULL,
+  details    TEXT     NOT NULL
+);
+
+CREATE INDEX audit_log_action ON audit_log (action);
+CREATE INDEX audit_log_actor ON audit_log (actor);
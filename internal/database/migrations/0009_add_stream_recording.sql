@@ -0,0 +1 @@
+ALTER TABLE stream_settings ADD COLUMN record BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,11 @@
+CREATE TABLE restream_targets (
+  id         TEXT     PRIMARY KEY,
+  user_id    TEXT     NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name       TEXT     NOT NULL,
+  kind       TEXT     NOT NULL,
+  url        TEXT     NOT NULL,
+  token      TEXT     NOT NULL,
+  enabled    BOOLEAN  NOT NULL,
+  created_at DATETIME NOT NULL,
+  UNIQUE (user_id, name)
+);
@@ -0,0 +1,27 @@
+CREATE TABLE webhooks (
+  id         TEXT     PRIMARY KEY,
+  url        TEXT     NOT NULL,
+  secret     TEXT     NOT NULL,
+  created_at DATETIME NOT NULL
+);
+
+CREATE TABLE webhook_events (
+  webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+  event      TEXT NOT NULL,
+  PRIMARY KEY (webhook_id, event)
+);
+
+CREATE TABLE webhook_deliveries (
+  id          TEXT     PRIMARY KEY,
+  webhook_id  TEXT     NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+  event       TEXT     NOT NULL,
+  payload     TEXT     NOT NULL,
+  attempts    INTEGER  NOT NULL,
+  status_code INTEGER  NOT NULL,
+  error       TEXT     NOT NULL,
+  delivered   BOOLEAN  NOT NULL,
+  created_at  DATETIME NOT NULL,
+  updated_at  DATETIME NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);
@@ -0,0 +1 @@
+ALTER TABLE stream_settings ADD COLUMN publisher_policy TEXT NOT NULL DEFAULT 'takeover';
@@ -4,9 +4,112 @@
 
 package database
 
+import (
+	"database/sql"
+	"time"
+)
+
+type ApiToken struct {
+	ID         string
+	UserID     string
+	Name       string
+	TokenHash  []byte
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+type AuditLog struct {
+	ID        int64
+	CreatedAt time.Time
+	Action    string
+	Actor     string
+	Target    string
+	Ip        string
+	Details   string
+}
+
+type OidcIdentity struct {
+	Issuer  string
+	Subject string
+	UserID  string
+}
+
+type RestreamTarget struct {
+	ID        string
+	UserID    string
+	Name      string
+	Kind      string
+	Url       string
+	Token     string
+	Enabled   bool
+	CreatedAt time.Time
+}
+
+type Session struct {
+	ID         string
+	UserID     string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+type StreamAllowedViewer struct {
+	UserID string
+	Kind   string
+	Name   string
+}
+
+type StreamSetting struct {
+	UserID          string
+	Visibility      string
+	Record          bool
+	PublisherPolicy string
+}
+
 type User struct {
 	ID        string
 	Name      string
 	Password  []byte
 	Streamkey []byte
+	Role      string
+}
+
+type UserGroup struct {
+	UserID string
+	Name   string
+}
+
+type ViewerToken struct {
+	ID        string
+	UserID    string
+	CreatedBy string
+	MaxUses   int64
+	Revoked   bool
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+type Webhook struct {
+	ID        string
+	Url       string
+	Secret    string
+	CreatedAt time.Time
+}
+
+type WebhookDelivery struct {
+	ID         string
+	WebhookID  string
+	Event      string
+	Payload    string
+	Attempts   int64
+	StatusCode int64
+	Error      string
+	Delivered  bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+type WebhookEvent struct {
+	WebhookID string
+	Event     string
 }
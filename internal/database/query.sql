@@ -12,8 +12,8 @@ WHERE streamKey = ?;
 
 -- name: CreateUser :one
 INSERT INTO users (
-  id, name, password, streamKey) VALUES (
-  ?, ?, ?, ?
+  id, name, password, streamKey, role) VALUES (
+  ?, ?, ?, ?, ?
 )
 RETURNING *;
 
@@ -24,6 +24,252 @@ password = ?,
 streamKey = ?
 WHERE id = ?;
 
--- name: DeleteUser :exec
+-- name: UpdateUserRole :execrows
+UPDATE users
+SET role = @role
+WHERE id = @id AND (role != 'admin' OR @role = 'admin'
+  OR (SELECT COUNT(*) FROM users WHERE role = 'admin') > 1);
+
+-- name: DeleteUser :execrows
 DELETE FROM users
-WHERE name = ?;
+WHERE name = ? AND (role != 'admin'
+  OR (SELECT COUNT(*) FROM users WHERE role = 'admin') > 1);
+
+-- name: GetUserByID :one
+SELECT * FROM users
+WHERE id = ? LIMIT 1;
+
+-- name: GetStreamSettings :one
+SELECT * FROM stream_settings
+WHERE user_id = ? LIMIT 1;
+
+-- name: UpsertStreamSettings :exec
+INSERT INTO stream_settings (
+  user_id, visibility, record, publisher_policy) VALUES (
+  ?, ?, ?, ?
+)
+ON CONFLICT (user_id) DO UPDATE
+SET visibility = excluded.visibility, record = excluded.record, publisher_policy = excluded.publisher_policy;
+
+-- name: ListStreamAllowedViewers :many
+SELECT * FROM stream_allowed_viewers
+WHERE user_id = ?
+ORDER BY kind, name;
+
+-- name: AddStreamAllowedViewer :exec
+INSERT INTO stream_allowed_viewers (
+  user_id, kind, name) VALUES (
+  ?, ?, ?
+);
+
+-- name: DeleteStreamAllowedViewers :exec
+DELETE FROM stream_allowed_viewers
+WHERE user_id = ?;
+
+-- name: ListUserGroups :many
+SELECT name FROM user_groups
+WHERE user_id = ?
+ORDER BY name;
+
+-- name: AddUserGroup :exec
+INSERT INTO user_groups (
+  user_id, name) VALUES (
+  ?, ?
+);
+
+-- name: DeleteUserGroups :exec
+DELETE FROM user_groups
+WHERE user_id = ?;
+
+-- name: CreateViewerToken :one
+INSERT INTO viewer_tokens (
+  id, user_id, created_by, max_uses, expires_at, created_at) VALUES (
+  ?, ?, ?, ?, ?, ?
+)
+RETURNING *;
+
+-- name: GetViewerToken :one
+SELECT * FROM viewer_tokens
+WHERE id = ? LIMIT 1;
+
+-- name: ListViewerTokens :many
+SELECT * FROM viewer_tokens
+WHERE user_id = ?
+ORDER BY created_at;
+
+-- name: RevokeViewerToken :execrows
+UPDATE viewer_tokens
+SET revoked = TRUE
+WHERE id = ? AND user_id = ?;
+
+-- name: CreateAPIToken :one
+INSERT INTO api_tokens (
+  id, user_id, name, token_hash, created_at) VALUES (
+  ?, ?, ?, ?, ?
+)
+RETURNING *;
+
+-- name: GetAPITokenByHash :one
+SELECT * FROM api_tokens
+WHERE token_hash = ? LIMIT 1;
+
+-- name: ListAPITokens :many
+SELECT * FROM api_tokens
+WHERE user_id = ?
+ORDER BY created_at;
+
+-- name: TouchAPIToken :exec
+UPDATE api_tokens
+SET last_used_at = ?
+WHERE id = ?;
+
+-- name: DeleteAPIToken :execrows
+DELETE FROM api_tokens
+WHERE id = ? AND user_id = ?;
+
+-- name: CreateSession :one
+INSERT INTO sessions (
+  id, user_id, user_agent, created_at, last_seen_at) VALUES (
+  ?, ?, ?, ?, ?
+)
+RETURNING *;
+
+-- name: GetSession :one
+SELECT * FROM sessions
+WHERE id = ? LIMIT 1;
+
+-- name: ListSessions :many
+SELECT * FROM sessions
+WHERE user_id = ?
+ORDER BY last_seen_at DESC;
+
+-- name: TouchSession :exec
+UPDATE sessions
+SET last_seen_at = ?
+WHERE id = ?;
+
+-- name: DeleteSession :execrows
+DELETE FROM sessions
+WHERE id = ? AND user_id = ?;
+
+-- name: DeleteUserSessions :exec
+DELETE FROM sessions
+WHERE user_id = ? AND id != ?;
+
+-- name: DeleteExpiredSessions :exec
+DELETE FROM sessions
+WHERE last_seen_at < ? OR created_at < ?;
+
+-- name: CreateOIDCIdentity :exec
+INSERT INTO oidc_identities (
+  issuer, subject, user_id) VALUES (
+  ?, ?, ?
+);
+
+-- name: GetOIDCIdentity :one
+SELECT * FROM oidc_identities
+WHERE issuer = ? AND subject = ? LIMIT 1;
+
+-- name: CreateAuditEvent :exec
+INSERT INTO audit_log (
+  created_at, action, actor, target, ip, details) VALUES (
+  ?, ?, ?, ?, ?, ?
+);
+
+-- name: ListAuditEvents :many
+SELECT * FROM audit_log
+WHERE (sqlc.narg(action) IS NULL OR action = sqlc.narg(action))
+  AND (sqlc.narg(actor) IS NULL OR actor = sqlc.narg(actor))
+  AND id < @before
+ORDER BY id DESC
+LIMIT @limit;
+
+-- name: CreateRestreamTarget :one
+INSERT INTO restream_targets (
+  id, user_id, name, kind, url, token, enabled, created_at) VALUES (
+  ?, ?, ?, ?, ?, ?, ?, ?
+)
+RETURNING *;
+
+-- name: GetRestreamTarget :one
+SELECT * FROM restream_targets
+WHERE id = ? AND user_id = ? LIMIT 1;
+
+-- name: ListRestreamTargets :many
+SELECT * FROM restream_targets
+WHERE user_id = ?
+ORDER BY created_at;
+
+-- name: UpdateRestreamTarget :execrows
+UPDATE restream_targets
+SET name = ?,
+kind = ?,
+url = ?,
+token = ?,
+enabled = ?
+WHERE id = ? AND user_id = ?;
+
+-- name: DeleteRestreamTarget :execrows
+DELETE FROM restream_targets
+WHERE id = ? AND user_id = ?;
+
+-- name: CreateWebhook :one
+INSERT INTO webhooks (
+  id, url, secret, created_at) VALUES (
+  ?, ?, ?, ?
+)
+RETURNING *;
+
+-- name: AddWebhookEvent :exec
+INSERT INTO webhook_events (
+  webhook_id, event) VALUES (
+  ?, ?
+);
+
+-- name: ListWebhooks :many
+SELECT * FROM webhooks
+ORDER BY created_at;
+
+-- name: ListWebhookEvents :many
+SELECT event FROM webhook_events
+WHERE webhook_id = ?
+ORDER BY event;
+
+-- name: ListWebhooksForEvent :many
+SELECT webhooks.* FROM webhooks
+JOIN webhook_events ON webhook_events.webhook_id = webhooks.id
+WHERE webhook_events.event = ?;
+
+-- name: DeleteWebhook :execrows
+DELETE FROM webhooks
+WHERE id = ?;
+
+-- name: CreateWebhookDelivery :exec
+INSERT INTO webhook_deliveries (
+  id, webhook_id, event, payload, attempts, status_code, error, delivered, created_at, updated_at) VALUES (
+  ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+);
+
+-- name: UpdateWebhookDelivery :exec
+UPDATE webhook_deliveries
+SET attempts = ?,
+status_code = ?,
+error = ?,
+delivered = ?,
+updated_at = ?
+WHERE id = ?;
+
+-- name: ListWebhookDeliveries :many
+SELECT * FROM webhook_deliveries
+WHERE webhook_id = ?
+ORDER BY id DESC
+LIMIT ?;
+
+-- name: DeleteOldWebhookDeliveries :exec
+DELETE FROM webhook_deliveries
+WHERE webhook_id = @webhook_id AND id NOT IN (
+  SELECT id FROM webhook_deliveries
+  WHERE webhook_id = @webhook_id
+  ORDER BY id DESC
+  LIMIT @keep
+);
@@ -7,14 +7,240 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 )
 
+const addStreamAllowedViewer = `-- name: AddStreamAllowedViewer :exec
+INSERT INTO stream_allowed_viewers (
+  user_id, kind, name) VALUES (
+  ?, ?, ?
+)
+`
+
+type AddStreamAllowedViewerParams struct {
+	UserID string
+	Kind   string
+	Name   string
+}
+
+func (q *Queries) AddStreamAllowedViewer(ctx context.Context, arg AddStreamAllowedViewerParams) error {
+	_, err := q.db.ExecContext(ctx, addStreamAllowedViewer,
+		arg.UserID,
+		arg.Kind,
+		arg.Name,
+	)
+	return err
+}
+
+const addUserGroup = `-- name: AddUserGroup :exec
+INSERT INTO user_groups (
+  user_id, name) VALUES (
+  ?, ?
+)
+`
+
+type AddUserGroupParams struct {
+	UserID string
+	Name   string
+}
+
+func (q *Queries) AddUserGroup(ctx context.Context, arg AddUserGroupParams) error {
+	_, err := q.db.ExecContext(ctx, addUserGroup,
+		arg.UserID,
+		arg.Name,
+	)
+	return err
+}
+
+const addWebhookEvent = `-- name: AddWebhookEvent :exec
+INSERT INTO webhook_events (
+  webhook_id, event) VALUES (
+  ?, ?
+)
+`
+
+type AddWebhookEventParams struct {
+	WebhookID string
+	Event     string
+}
+
+func (q *Queries) AddWebhookEvent(ctx context.Context, arg AddWebhookEventParams) error {
+	_, err := q.db.ExecContext(ctx, addWebhookEvent, arg.WebhookID, arg.Event)
+	return err
+}
+
+const createAPIToken = `-- name: CreateAPIToken :one
+INSERT INTO api_tokens (
+  id, user_id, name, token_hash, created_at) VALUES (
+  ?, ?, ?, ?, ?
+)
+RETURNING id, user_id, name, token_hash, created_at, last_used_at
+`
+
+type CreateAPITokenParams struct {
+	ID        string
+	UserID    string
+	Name      string
+	TokenHash []byte
+	CreatedAt time.Time
+}
+
+func (q *Queries) CreateAPIToken(ctx context.Context, arg CreateAPITokenParams) (ApiToken, error) {
+	row := q.db.QueryRowContext(ctx, createAPIToken,
+		arg.ID,
+		arg.UserID,
+		arg.Name,
+		arg.TokenHash,
+		arg.CreatedAt,
+	)
+	var i ApiToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.TokenHash,
+		&i.CreatedAt,
+		&i.LastUsedAt,
+	)
+	return i, err
+}
+
+const createAuditEvent = `-- name: CreateAuditEvent :exec
+INSERT INTO audit_log (
+  created_at, action, actor, target, ip, details) VALUES (
+  ?, ?, ?, ?, ?, ?
+)
+`
+
+type CreateAuditEventParams struct {
+	CreatedAt time.Time
+	Action    string
+	Actor     string
+	Target    string
+	Ip        string
+	Details   string
+}
+
+func (q *Queries) CreateAuditEvent(ctx context.Context, arg CreateAuditEventParams) error {
+	_, err := q.db.ExecContext(ctx, createAuditEvent,
+		arg.CreatedAt,
+		arg.Action,
+		arg.Actor,
+		arg.Target,
+		arg.Ip,
+		arg.Details,
+	)
+	return err
+}
+
+const createOIDCIdentity = `-- name: CreateOIDCIdentity :exec
+INSERT INTO oidc_identities (
+  issuer, subject, user_id) VALUES (
+  ?, ?, ?
+)
+`
+
+type CreateOIDCIdentityParams struct {
+	Issuer  string
+	Subject string
+	UserID  string
+}
+
+func (q *Queries) CreateOIDCIdentity(ctx context.Context, arg CreateOIDCIdentityParams) error {
+	_, err := q.db.ExecContext(ctx, createOIDCIdentity,
+		arg.Issuer,
+		arg.Subject,
+		arg.UserID,
+	)
+	return err
+}
+
+const createRestreamTarget = `-- name: CreateRestreamTarget :one
+INSERT INTO restream_targets (
+  id, user_id, name, kind, url, token, enabled, created_at) VALUES (
+  ?, ?, ?, ?, ?, ?, ?, ?
+)
+RETURNING id, user_id, name, kind, url, token, enabled, created_at
+`
+
+type CreateRestreamTargetParams struct {
+	ID        string
+	UserID    string
+	Name      string
+	Kind      string
+	Url       string
+	Token     string
+	Enabled   bool
+	CreatedAt time.Time
+}
+
+func (q *Queries) CreateRestreamTarget(ctx context.Context, arg CreateRestreamTargetParams) (RestreamTarget, error) {
+	row := q.db.QueryRowContext(ctx, createRestreamTarget,
+		arg.ID,
+		arg.UserID,
+		arg.Name,
+		arg.Kind,
+		arg.Url,
+		arg.Token,
+		arg.Enabled,
+		arg.CreatedAt,
+	)
+	var i RestreamTarget
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.Kind,
+		&i.Url,
+		&i.Token,
+		&i.Enabled,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createSession = `-- name: CreateSession :one
+INSERT INTO sessions (
+  id, user_id, user_agent, created_at, last_seen_at) VALUES (
+  ?, ?, ?, ?, ?
+)
+RETURNING id, user_id, user_agent, created_at, last_seen_at
+`
+
+type CreateSessionParams struct {
+	ID         string
+	UserID     string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+func (q *Queries) CreateSession(ctx context.Context, arg CreateSessionParams) (Session, error) {
+	row := q.db.QueryRowContext(ctx, createSession,
+		arg.ID,
+		arg.UserID,
+		arg.UserAgent,
+		arg.CreatedAt,
+		arg.LastSeenAt,
+	)
+	var i Session
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.UserAgent,
+		&i.CreatedAt,
+		&i.LastSeenAt,
+	)
+	return i, err
+}
+
 const createUser = `-- name: CreateUser :one
 INSERT INTO users (
-  id, name, password, streamKey) VALUES (
-  ?, ?, ?, ?
+  id, name, password, streamKey, role) VALUES (
+  ?, ?, ?, ?, ?
 )
-RETURNING id, name, password, streamkey
+RETURNING id, name, password, streamkey, role
 `
 
 type CreateUserParams struct {
@@ -22,6 +248,7 @@ type CreateUserParams struct {
 	Name      string
 	Password  []byte
 	Streamkey []byte
+	Role      string
 }
 
 func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, error) {
@@ -30,6 +257,7 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		arg.Name,
 		arg.Password,
 		arg.Streamkey,
+		arg.Role,
 	)
 	var i User
 	err := row.Scan(
@@ -37,51 +265,684 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Name,
 		&i.Password,
 		&i.Streamkey,
+		&i.Role,
+	)
+	return i, err
+}
+
+const createViewerToken = `-- name: CreateViewerToken :one
+INSERT INTO viewer_tokens (
+  id, user_id, created_by, max_uses, expires_at, created_at) VALUES (
+  ?, ?, ?, ?, ?, ?
+)
+RETURNING id, user_id, created_by, max_uses, revoked, expires_at, created_at
+`
+
+type CreateViewerTokenParams struct {
+	ID        string
+	UserID    string
+	CreatedBy string
+	MaxUses   int64
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func (q *Queries) CreateViewerToken(ctx context.Context, arg CreateViewerTokenParams) (ViewerToken, error) {
+	row := q.db.QueryRowContext(ctx, createViewerToken,
+		arg.ID,
+		arg.UserID,
+		arg.CreatedBy,
+		arg.MaxUses,
+		arg.ExpiresAt,
+		arg.CreatedAt,
+	)
+	var i ViewerToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CreatedBy,
+		&i.MaxUses,
+		&i.Revoked,
+		&i.ExpiresAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createWebhook = `-- name: CreateWebhook :one
+INSERT INTO webhooks (
+  id, url, secret, created_at) VALUES (
+  ?, ?, ?, ?
+)
+RETURNING id, url, secret, created_at
+`
+
+type CreateWebhookParams struct {
+	ID        string
+	Url       string
+	Secret    string
+	CreatedAt time.Time
+}
+
+func (q *Queries) CreateWebhook(ctx context.Context, arg CreateWebhookParams) (Webhook, error) {
+	row := q.db.QueryRowContext(ctx, createWebhook,
+		arg.ID,
+		arg.Url,
+		arg.Secret,
+		arg.CreatedAt,
+	)
+	var i Webhook
+	err := row.Scan(
+		&i.ID,
+		&i.Url,
+		&i.Secret,
+		&i.CreatedAt,
 	)
 	return i, err
 }
 
-const deleteUser = `-- name: DeleteUser :exec
+const createWebhookDelivery = `-- name: CreateWebhookDelivery :exec
+INSERT INTO webhook_deliveries (
+  id, webhook_id, event, payload, attempts, status_code, error, delivered, created_at, updated_at) VALUES (
+  ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+)
+`
+
+type CreateWebhookDeliveryParams struct {
+	ID         string
+	WebhookID  string
+	Event      string
+	Payload    string
+	Attempts   int64
+	StatusCode int64
+	Error      string
+	Delivered  bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (q *Queries) CreateWebhookDelivery(ctx context.Context, arg CreateWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, createWebhookDelivery,
+		arg.ID,
+		arg.WebhookID,
+		arg.Event,
+		arg.Payload,
+		arg.Attempts,
+		arg.StatusCode,
+		arg.Error,
+		arg.Delivered,
+		arg.CreatedAt,
+		arg.UpdatedAt,
+	)
+	return err
+}
+
+const deleteAPIToken = `-- name: DeleteAPIToken :execrows
+DELETE FROM api_tokens
+WHERE id = ? AND user_id = ?
+`
+
+type DeleteAPITokenParams struct {
+	ID     string
+	UserID string
+}
+
+func (q *Queries) DeleteAPIToken(ctx context.Context, arg DeleteAPITokenParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteAPIToken,
+		arg.ID,
+		arg.UserID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteExpiredSessions = `-- name: DeleteExpiredSessions :exec
+DELETE FROM sessions
+WHERE last_seen_at < ? OR created_at < ?
+`
+
+type DeleteExpiredSessionsParams struct {
+	LastSeenAt time.Time
+	CreatedAt  time.Time
+}
+
+func (q *Queries) DeleteExpiredSessions(ctx context.Context, arg DeleteExpiredSessionsParams) error {
+	_, err := q.db.ExecContext(ctx, deleteExpiredSessions,
+		arg.LastSeenAt,
+		arg.CreatedAt,
+	)
+	return err
+}
+
+const deleteOldWebhookDeliveries = `-- name: DeleteOldWebhookDeliveries :exec
+DELETE FROM webhook_deliveries
+WHERE webhook_id = ?1 AND id NOT IN (
+  SELECT id FROM webhook_deliveries
+  WHERE webhook_id = ?1
+  ORDER BY id DESC
+  LIMIT ?2
+)
+`
+
+type DeleteOldWebhookDeliveriesParams struct {
+	WebhookID string
+	Keep      int64
+}
+
+func (q *Queries) DeleteOldWebhookDeliveries(ctx context.Context, arg DeleteOldWebhookDeliveriesParams) error {
+	_, err := q.db.ExecContext(ctx, deleteOldWebhookDeliveries, arg.WebhookID, arg.Keep)
+	return err
+}
+
+const deleteRestreamTarget = `-- name: DeleteRestreamTarget :execrows
+DELETE FROM restream_targets
+WHERE id = ? AND user_id = ?
+`
+
+type DeleteRestreamTargetParams struct {
+	ID     string
+	UserID string
+}
+
+func (q *Queries) DeleteRestreamTarget(ctx context.Context, arg DeleteRestreamTargetParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteRestreamTarget,
+		arg.ID,
+		arg.UserID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteSession = `-- name: DeleteSession :execrows
+DELETE FROM sessions
+WHERE id = ? AND user_id = ?
+`
+
+type DeleteSessionParams struct {
+	ID     string
+	UserID string
+}
+
+func (q *Queries) DeleteSession(ctx context.Context, arg DeleteSessionParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteSession,
+		arg.ID,
+		arg.UserID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteStreamAllowedViewers = `-- name: DeleteStreamAllowedViewers :exec
+DELETE FROM stream_allowed_viewers
+WHERE user_id = ?
+`
+
+func (q *Queries) DeleteStreamAllowedViewers(ctx context.Context, userID string) error {
+	_, err := q.db.ExecContext(ctx, deleteStreamAllowedViewers, userID)
+	return err
+}
+
+const deleteUser = `-- name: DeleteUser :execrows
 DELETE FROM users
-WHERE name = ?
+WHERE name = ? AND (role != 'admin'
+  OR (SELECT COUNT(*) FROM users WHERE role = 'admin') > 1)
+`
+
+func (q *Queries) DeleteUser(ctx context.Context, name string) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteUser, name)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteUserGroups = `-- name: DeleteUserGroups :exec
+DELETE FROM user_groups
+WHERE user_id = ?
 `
 
-func (q *Queries) DeleteUser(ctx context.Context, name string) error {
-	_, err := q.db.ExecContext(ctx, deleteUser, name)
+func (q *Queries) DeleteUserGroups(ctx context.Context, userID string) error {
+	_, err := q.db.ExecContext(ctx, deleteUserGroups, userID)
 	return err
 }
 
-const getUser = `-- name: GetUser :one
-SELECT id, name, password, streamkey FROM users
-WHERE name = ? LIMIT 1
+const deleteUserSessions = `-- name: DeleteUserSessions :exec
+DELETE FROM sessions
+WHERE user_id = ? AND id != ?
+`
+
+type DeleteUserSessionsParams struct {
+	UserID string
+	ID     string
+}
+
+func (q *Queries) DeleteUserSessions(ctx context.Context, arg DeleteUserSessionsParams) error {
+	_, err := q.db.ExecContext(ctx, deleteUserSessions,
+		arg.UserID,
+		arg.ID,
+	)
+	return err
+}
+
+const deleteWebhook = `-- name: DeleteWebhook :execrows
+DELETE FROM webhooks
+WHERE id = ?
+`
+
+func (q *Queries) DeleteWebhook(ctx context.Context, id string) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteWebhook, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const getAPITokenByHash = `-- name: GetAPITokenByHash :one
+SELECT id, user_id, name, token_hash, created_at, last_used_at FROM api_tokens
+WHERE token_hash = ? LIMIT 1
+`
+
+func (q *Queries) GetAPITokenByHash(ctx context.Context, tokenHash []byte) (ApiToken, error) {
+	row := q.db.QueryRowContext(ctx, getAPITokenByHash, tokenHash)
+	var i ApiToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.TokenHash,
+		&i.CreatedAt,
+		&i.LastUsedAt,
+	)
+	return i, err
+}
+
+const getOIDCIdentity = `-- name: GetOIDCIdentity :one
+SELECT issuer, subject, user_id FROM oidc_identities
+WHERE issuer = ? AND subject = ? LIMIT 1
+`
+
+type GetOIDCIdentityParams struct {
+	Issuer  string
+	Subject string
+}
+
+func (q *Queries) GetOIDCIdentity(ctx context.Context, arg GetOIDCIdentityParams) (OidcIdentity, error) {
+	row := q.db.QueryRowContext(ctx, getOIDCIdentity,
+		arg.Issuer,
+		arg.Subject,
+	)
+	var i OidcIdentity
+	err := row.Scan(
+		&i.Issuer,
+		&i.Subject,
+		&i.UserID,
+	)
+	return i, err
+}
+
+const getRestreamTarget = `-- name: GetRestreamTarget :one
+SELECT id, user_id, name, kind, url, token, enabled, created_at FROM restream_targets
+WHERE id = ? AND user_id = ? LIMIT 1
+`
+
+type GetRestreamTargetParams struct {
+	ID     string
+	UserID string
+}
+
+func (q *Queries) GetRestreamTarget(ctx context.Context, arg GetRestreamTargetParams) (RestreamTarget, error) {
+	row := q.db.QueryRowContext(ctx, getRestreamTarget,
+		arg.ID,
+		arg.UserID,
+	)
+	var i RestreamTarget
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.Kind,
+		&i.Url,
+		&i.Token,
+		&i.Enabled,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getSession = `-- name: GetSession :one
+SELECT id, user_id, user_agent, created_at, last_seen_at FROM sessions
+WHERE id = ? LIMIT 1
+`
+
+func (q *Queries) GetSession(ctx context.Context, id string) (Session, error) {
+	row := q.db.QueryRowContext(ctx, getSession, id)
+	var i Session
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.UserAgent,
+		&i.CreatedAt,
+		&i.LastSeenAt,
+	)
+	return i, err
+}
+
+const getStreamSettings = `-- name: GetStreamSettings :one
+SELECT user_id, visibility, record, publisher_policy FROM stream_settings
+WHERE user_id = ? LIMIT 1
+`
+
+func (q *Queries) GetStreamSettings(ctx context.Context, userID string) (StreamSetting, error) {
+	row := q.db.QueryRowContext(ctx, getStreamSettings, userID)
+	var i StreamSetting
+	err := row.Scan(
+		&i.UserID,
+		&i.Visibility,
+		&i.Record,
+		&i.PublisherPolicy,
+	)
+	return i, err
+}
+
+const getUser = `-- name: GetUser :one
+SELECT id, name, password, streamkey, role FROM users
+WHERE name = ? LIMIT 1
+`
+
+func (q *Queries) GetUser(ctx context.Context, name string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUser, name)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Password,
+		&i.Streamkey,
+		&i.Role,
+	)
+	return i, err
+}
+
+const getUserByID = `-- name: GetUserByID :one
+SELECT id, name, password, streamkey, role FROM users
+WHERE id = ? LIMIT 1
+`
+
+func (q *Queries) GetUserByID(ctx context.Context, id string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByID, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Password,
+		&i.Streamkey,
+		&i.Role,
+	)
+	return i, err
+}
+
+const getUsernameForStreamKey = `-- name: GetUsernameForStreamKey :one
+SELECT name FROM users
+WHERE streamKey = ?
+`
+
+func (q *Queries) GetUsernameForStreamKey(ctx context.Context, streamkey []byte) (string, error) {
+	row := q.db.QueryRowContext(ctx, getUsernameForStreamKey, streamkey)
+	var name string
+	err := row.Scan(&name)
+	return name, err
+}
+
+const getViewerToken = `-- name: GetViewerToken :one
+SELECT id, user_id, created_by, max_uses, revoked, expires_at, created_at FROM viewer_tokens
+WHERE id = ? LIMIT 1
+`
+
+func (q *Queries) GetViewerToken(ctx context.Context, id string) (ViewerToken, error) {
+	row := q.db.QueryRowContext(ctx, getViewerToken, id)
+	var i ViewerToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CreatedBy,
+		&i.MaxUses,
+		&i.Revoked,
+		&i.ExpiresAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const listAPITokens = `-- name: ListAPITokens :many
+SELECT id, user_id, name, token_hash, created_at, last_used_at FROM api_tokens
+WHERE user_id = ?
+ORDER BY created_at
+`
+
+func (q *Queries) ListAPITokens(ctx context.Context, userID string) ([]ApiToken, error) {
+	rows, err := q.db.QueryContext(ctx, listAPITokens, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ApiToken
+	for rows.Next() {
+		var i ApiToken
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Name,
+			&i.TokenHash,
+			&i.CreatedAt,
+			&i.LastUsedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listAuditEvents = `-- name: ListAuditEvents :many
+SELECT id, created_at, action, actor, target, ip, details FROM audit_log
+WHERE (?1 IS NULL OR action = ?1)
+  AND (?2 IS NULL OR actor = ?2)
+  AND id < ?3
+ORDER BY id DESC
+LIMIT ?4
+`
+
+type ListAuditEventsParams struct {
+	Action sql.NullString
+	Actor  sql.NullString
+	Before int64
+	Limit  int64
+}
+
+func (q *Queries) ListAuditEvents(ctx context.Context, arg ListAuditEventsParams) ([]AuditLog, error) {
+	rows, err := q.db.QueryContext(ctx, listAuditEvents,
+		arg.Action,
+		arg.Actor,
+		arg.Before,
+		arg.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AuditLog
+	for rows.Next() {
+		var i AuditLog
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.Action,
+			&i.Actor,
+			&i.Target,
+			&i.Ip,
+			&i.Details,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRestreamTargets = `-- name: ListRestreamTargets :many
+SELECT id, user_id, name, kind, url, token, enabled, created_at FROM restream_targets
+WHERE user_id = ?
+ORDER BY created_at
+`
+
+func (q *Queries) ListRestreamTargets(ctx context.Context, userID string) ([]RestreamTarget, error) {
+	rows, err := q.db.QueryContext(ctx, listRestreamTargets, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RestreamTarget
+	for rows.Next() {
+		var i RestreamTarget
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Name,
+			&i.Kind,
+			&i.Url,
+			&i.Token,
+			&i.Enabled,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listSessions = `-- name: ListSessions :many
+SELECT id, user_id, user_agent, created_at, last_seen_at FROM sessions
+WHERE user_id = ?
+ORDER BY last_seen_at DESC
+`
+
+func (q *Queries) ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := q.db.QueryContext(ctx, listSessions, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Session
+	for rows.Next() {
+		var i Session
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.UserAgent,
+			&i.CreatedAt,
+			&i.LastSeenAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStreamAllowedViewers = `-- name: ListStreamAllowedViewers :many
+SELECT user_id, kind, name FROM stream_allowed_viewers
+WHERE user_id = ?
+ORDER BY kind, name
 `
 
-func (q *Queries) GetUser(ctx context.Context, name string) (User, error) {
-	row := q.db.QueryRowContext(ctx, getUser, name)
-	var i User
-	err := row.Scan(
-		&i.ID,
-		&i.Name,
-		&i.Password,
-		&i.Streamkey,
-	)
-	return i, err
+func (q *Queries) ListStreamAllowedViewers(ctx context.Context, userID string) ([]StreamAllowedViewer, error) {
+	rows, err := q.db.QueryContext(ctx, listStreamAllowedViewers, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StreamAllowedViewer
+	for rows.Next() {
+		var i StreamAllowedViewer
+		if err := rows.Scan(
+			&i.UserID,
+			&i.Kind,
+			&i.Name,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
-const getUsernameForStreamKey = `-- name: GetUsernameForStreamKey :one
-SELECT name FROM users
-WHERE streamKey = ?
+const listUserGroups = `-- name: ListUserGroups :many
+SELECT name FROM user_groups
+WHERE user_id = ?
+ORDER BY name
 `
 
-func (q *Queries) GetUsernameForStreamKey(ctx context.Context, streamkey []byte) (string, error) {
-	row := q.db.QueryRowContext(ctx, getUsernameForStreamKey, streamkey)
-	var name string
-	err := row.Scan(&name)
-	return name, err
+func (q *Queries) ListUserGroups(ctx context.Context, userID string) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, listUserGroups, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		items = append(items, name)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
 const listUsers = `-- name: ListUsers :many
-SELECT id, name, password, streamkey FROM users
+SELECT id, name, password, streamkey, role FROM users
 ORDER BY id
 `
 
@@ -99,6 +960,186 @@ func (q *Queries) ListUsers(ctx context.Context) ([]User, error) {
 			&i.Name,
 			&i.Password,
 			&i.Streamkey,
+			&i.Role,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listViewerTokens = `-- name: ListViewerTokens :many
+SELECT id, user_id, created_by, max_uses, revoked, expires_at, created_at FROM viewer_tokens
+WHERE user_id = ?
+ORDER BY created_at
+`
+
+func (q *Queries) ListViewerTokens(ctx context.Context, userID string) ([]ViewerToken, error) {
+	rows, err := q.db.QueryContext(ctx, listViewerTokens, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ViewerToken
+	for rows.Next() {
+		var i ViewerToken
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.CreatedBy,
+			&i.MaxUses,
+			&i.Revoked,
+			&i.ExpiresAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listWebhookDeliveries = `-- name: ListWebhookDeliveries :many
+SELECT id, webhook_id, event, payload, attempts, status_code, error, delivered, created_at, updated_at FROM webhook_deliveries
+WHERE webhook_id = ?
+ORDER BY id DESC
+LIMIT ?
+`
+
+type ListWebhookDeliveriesParams struct {
+	WebhookID string
+	Limit     int64
+}
+
+func (q *Queries) ListWebhookDeliveries(ctx context.Context, arg ListWebhookDeliveriesParams) ([]WebhookDelivery, error) {
+	rows, err := q.db.QueryContext(ctx, listWebhookDeliveries, arg.WebhookID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WebhookDelivery
+	for rows.Next() {
+		var i WebhookDelivery
+		if err := rows.Scan(
+			&i.ID,
+			&i.WebhookID,
+			&i.Event,
+			&i.Payload,
+			&i.Attempts,
+			&i.StatusCode,
+			&i.Error,
+			&i.Delivered,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listWebhookEvents = `-- name: ListWebhookEvents :many
+SELECT event FROM webhook_events
+WHERE webhook_id = ?
+ORDER BY event
+`
+
+func (q *Queries) ListWebhookEvents(ctx context.Context, webhookID string) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, listWebhookEvents, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var event string
+		if err := rows.Scan(&event); err != nil {
+			return nil, err
+		}
+		items = append(items, event)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listWebhooks = `-- name: ListWebhooks :many
+SELECT id, url, secret, created_at FROM webhooks
+ORDER BY created_at
+`
+
+func (q *Queries) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := q.db.QueryContext(ctx, listWebhooks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Webhook
+	for rows.Next() {
+		var i Webhook
+		if err := rows.Scan(
+			&i.ID,
+			&i.Url,
+			&i.Secret,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listWebhooksForEvent = `-- name: ListWebhooksForEvent :many
+SELECT webhooks.id, webhooks.url, webhooks.secret, webhooks.created_at FROM webhooks
+JOIN webhook_events ON webhook_events.webhook_id = webhooks.id
+WHERE webhook_events.event = ?
+`
+
+func (q *Queries) ListWebhooksForEvent(ctx context.Context, event string) ([]Webhook, error) {
+	rows, err := q.db.QueryContext(ctx, listWebhooksForEvent, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Webhook
+	for rows.Next() {
+		var i Webhook
+		if err := rows.Scan(
+			&i.ID,
+			&i.Url,
+			&i.Secret,
+			&i.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -113,6 +1154,102 @@ func (q *Queries) ListUsers(ctx context.Context) ([]User, error) {
 	return items, nil
 }
 
+const revokeViewerToken = `-- name: RevokeViewerToken :execrows
+UPDATE viewer_tokens
+SET revoked = TRUE
+WHERE id = ? AND user_id = ?
+`
+
+type RevokeViewerTokenParams struct {
+	ID     string
+	UserID string
+}
+
+func (q *Queries) RevokeViewerToken(ctx context.Context, arg RevokeViewerTokenParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeViewerToken,
+		arg.ID,
+		arg.UserID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const touchAPIToken = `-- name: TouchAPIToken :exec
+UPDATE api_tokens
+SET last_used_at = ?
+WHERE id = ?
+`
+
+type TouchAPITokenParams struct {
+	LastUsedAt sql.NullTime
+	ID         string
+}
+
+func (q *Queries) TouchAPIToken(ctx context.Context, arg TouchAPITokenParams) error {
+	_, err := q.db.ExecContext(ctx, touchAPIToken,
+		arg.LastUsedAt,
+		arg.ID,
+	)
+	return err
+}
+
+const touchSession = `-- name: TouchSession :exec
+UPDATE sessions
+SET last_seen_at = ?
+WHERE id = ?
+`
+
+type TouchSessionParams struct {
+	LastSeenAt time.Time
+	ID         string
+}
+
+func (q *Queries) TouchSession(ctx context.Context, arg TouchSessionParams) error {
+	_, err := q.db.ExecContext(ctx, touchSession,
+		arg.LastSeenAt,
+		arg.ID,
+	)
+	return err
+}
+
+const updateRestreamTarget = `-- name: UpdateRestreamTarget :execrows
+UPDATE restream_targets
+SET name = ?,
+kind = ?,
+url = ?,
+token = ?,
+enabled = ?
+WHERE id = ? AND user_id = ?
+`
+
+type UpdateRestreamTargetParams struct {
+	Name    string
+	Kind    string
+	Url     string
+	Token   string
+	Enabled bool
+	ID      string
+	UserID  string
+}
+
+func (q *Queries) UpdateRestreamTarget(ctx context.Context, arg UpdateRestreamTargetParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updateRestreamTarget,
+		arg.Name,
+		arg.Kind,
+		arg.Url,
+		arg.Token,
+		arg.Enabled,
+		arg.ID,
+		arg.UserID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const updateUser = `-- name: UpdateUser :exec
 UPDATE users
 SET name = ?,
@@ -137,3 +1274,80 @@ func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) error {
 	)
 	return err
 }
+
+const updateUserRole = `-- name: UpdateUserRole :execrows
+UPDATE users
+SET role = ?1
+WHERE id = ?2 AND (role != 'admin' OR ?1 = 'admin'
+  OR (SELECT COUNT(*) FROM users WHERE role = 'admin') > 1)
+`
+
+type UpdateUserRoleParams struct {
+	Role string
+	ID   string
+}
+
+func (q *Queries) UpdateUserRole(ctx context.Context, arg UpdateUserRoleParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updateUserRole, arg.Role, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const updateWebhookDelivery = `-- name: UpdateWebhookDelivery :exec
+UPDATE webhook_deliveries
+SET attempts = ?,
+status_code = ?,
+error = ?,
+delivered = ?,
+updated_at = ?
+WHERE id = ?
+`
+
+type UpdateWebhookDeliveryParams struct {
+	Attempts   int64
+	StatusCode int64
+	Error      string
+	Delivered  bool
+	UpdatedAt  time.Time
+	ID         string
+}
+
+func (q *Queries) UpdateWebhookDelivery(ctx context.Context, arg UpdateWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, updateWebhookDelivery,
+		arg.Attempts,
+		arg.StatusCode,
+		arg.Error,
+		arg.Delivered,
+		arg.UpdatedAt,
+		arg.ID,
+	)
+	return err
+}
+
+const upsertStreamSettings = `-- name: UpsertStreamSettings :exec
+INSERT INTO stream_settings (
+  user_id, visibility, record, publisher_policy) VALUES (
+  ?, ?, ?, ?
+)
+ON CONFLICT (user_id) DO UPDATE
+SET visibility = excluded.visibility, record = excluded.record, publisher_policy = excluded.publisher_policy
+`
+
+type UpsertStreamSettingsParams struct {
+	UserID          string
+	Visibility      string
+	Record          bool
+	PublisherPolicy string
+}
+
+func (q *Queries) UpsertStreamSettings(ctx context.Context, arg UpsertStreamSettingsParams) error {
+	_, err := q.db.ExecContext(ctx, upsertStreamSettings,
+		arg.UserID,
+		arg.Visibility,
+		arg.Record,
+		arg.PublisherPolicy,
+	)
+	return err
+}
@@ -0,0 +1,28 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+// InTx runs fn with queries in a transaction, which is committed if fn returns
+// nil and rolled back otherwise. Queries that already are in a transaction run
+// fn in it.
+func (q *Queries) InTx(ctx context.Context, fn func(*Queries) error) error {
+	db, ok := q.db.(*sql.DB)
+	if !ok {
+		return fn(q)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint
+
+	if err = fn(q.WithTx(tx)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
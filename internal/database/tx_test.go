@@ -0,0 +1,42 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestInTx(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	errFailed := errors.New("failed")
+	if err = New(db).InTx(ctx, func(q *Queries) error {
+		if _, err := q.CreateUser(ctx, CreateUserParams{ID: "1", Name: "foo", Password: []byte("bar"), Streamkey: []byte("baz")}); err != nil {
+			return err
+		}
+		return errFailed
+	}); !errors.Is(err, errFailed) {
+		t.Fatalf("error of the transaction was not returned: %v", err)
+	}
+
+	if _, err = New(db).GetUser(ctx, "foo"); err == nil {
+		t.Error("failed transaction was not rolled back")
+	}
+
+	if err = New(db).InTx(ctx, func(q *Queries) error {
+		_, err := q.CreateUser(ctx, CreateUserParams{ID: "1", Name: "foo", Password: []byte("bar"), Streamkey: []byte("baz")})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = New(db).GetUser(ctx, "foo"); err != nil {
+		t.Errorf("transaction was not committed: %s", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Package db implements the legacy JSON user database. It is kept so existing
+// deployments can import their users into the SQLite database.
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const rounds = 14
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user does not exist")
+)
+
+// User is a single entry of the JSON database. Hashes are bcrypt and stored
+// base64 encoded.
+type User struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	PasswordHash  []byte `json:"password_hash"`
+	StreamKeyHash []byte `json:"streamkey_hash"`
+}
+
+type DB struct {
+	path  string
+	lock  sync.Mutex
+	users map[string]User
+}
+
+// Open reads the JSON database at path. A missing file is treated as an empty
+// database and only created once a user is written.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path, users: map[string]User{}}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	} else if err != nil {
+		return db, err
+	}
+
+	users := []User{}
+	if err = json.Unmarshal(content, &users); err != nil {
+		return db, err
+	}
+
+	for _, u := range users {
+		db.users[u.Username] = u
+	}
+
+	return db, nil
+}
+
+// Users returns a copy of all users keyed by username.
+func (db *DB) Users() map[string]User {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	users := make(map[string]User, len(db.users))
+	for name, u := range db.users {
+		users[name] = u
+	}
+
+	return users
+}
+
+func (db *DB) AddUser(username, password, streamKey string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, ok := db.users[username]; ok {
+		return ErrUserExists
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+
+	pw, err := bcrypt.GenerateFromPassword([]byte(password), rounds)
+	if err != nil {
+		return err
+	}
+
+	sk, err := bcrypt.GenerateFromPassword([]byte(streamKey), rounds)
+	if err != nil {
+		return err
+	}
+
+	db.users[username] = User{ID: id.String(), Username: username, PasswordHash: pw, StreamKeyHash: sk}
+	return db.save()
+}
+
+func (db *DB) RemoveUser(username string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, ok := db.users[username]; !ok {
+		return ErrUserNotFound
+	}
+
+	delete(db.users, username)
+	return db.save()
+}
+
+func (db *DB) ChangePassword(username, current, new string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	u, ok := db.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	if !u.VerifyPassword(current) {
+		return errors.New("passwords did not match")
+	}
+
+	pw, err := bcrypt.GenerateFromPassword([]byte(new), rounds)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = pw
+	db.users[username] = u
+	return db.save()
+}
+
+func (db *DB) save() error {
+	users := make([]User, 0, len(db.users))
+	for _, u := range db.users {
+		users = append(users, u)
+	}
+
+	content, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(db.path, content, 0o600)
+}
+
+func (u User) VerifyPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) == nil
+}
+
+func (u User) VerifyStreamKey(streamKey string) bool {
+	return bcrypt.CompareHashAndPassword(u.StreamKeyHash, []byte(streamKey)) == nil
+}
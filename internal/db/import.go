@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/glimesh/broadcast-box/internal/auth"
+	"github.com/glimesh/broadcast-box/internal/database"
+)
+
+// Conflict is a legacy user that could not be imported.
+type Conflict struct {
+	ID       string
+	Username string
+	Reason   string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s (%s): %s", c.Username, c.ID, c.Reason)
+}
+
+type ImportReport struct {
+	Imported  []string
+	Conflicts []Conflict
+}
+
+// Import copies all users of the legacy database into the SQLite users table,
+// keeping their IDs and hashes. Users whose ID or name is already taken are
+// skipped and reported as conflicts. Nothing is written if an error occurs.
+func Import(ctx context.Context, sqlDB *sql.DB, legacy *DB) (ImportReport, error) {
+	report := ImportReport{}
+
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback() //nolint
+
+	queries := database.New(sqlDB).WithTx(tx)
+
+	users := legacy.Users()
+	usernames := make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		u := users[username]
+
+		switch conflict, err := findConflict(ctx, queries, u); {
+		case err != nil:
+			return ImportReport{}, err
+		case conflict != "":
+			report.Conflicts = append(report.Conflicts, Conflict{ID: u.ID, Username: u.Username, Reason: conflict})
+			continue
+		}
+
+		if _, err = queries.CreateUser(ctx, database.CreateUserParams{
+			ID:        u.ID,
+			Name:      u.Username,
+			Password:  u.PasswordHash,
+			Streamkey: u.StreamKeyHash,
+			Role:      auth.RoleBroadcaster,
+		}); err != nil {
+			return ImportReport{}, fmt.Errorf("importing %s: %w", u.Username, err)
+		}
+
+		report.Imported = append(report.Imported, u.Username)
+	}
+
+	return report, tx.Commit()
+}
+
+func findConflict(ctx context.Context, queries *database.Queries, u User) (string, error) {
+	if u.ID == "" || u.Username == "" || len(u.PasswordHash) == 0 || len(u.StreamKeyHash) == 0 {
+		return "incomplete entry", nil
+	}
+
+	existing, err := queries.GetUserByID(ctx, u.ID)
+	switch {
+	case err == nil:
+		return "id already used by " + existing.Name, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return "", err
+	}
+
+	_, err = queries.GetUser(ctx, u.Username)
+	switch {
+	case err == nil:
+		return "username already exists", nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return "", err
+	}
+
+	return "", nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := database.Open(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+
+	queries := database.New(sqlDB)
+	if _, err = queries.CreateUser(ctx, database.CreateUserParams{
+		ID:        "existing",
+		Name:      "Angela",
+		Password:  []byte("foo"),
+		Streamkey: []byte("bar"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := Open("existing_db_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Import(ctx, sqlDB, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Imported) != 3 {
+		t.Errorf("expected 3 imported users, actual: %v", report.Imported)
+	}
+
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Username != "Angela" {
+		t.Errorf("expected a conflict for Angela, actual: %v", report.Conflicts)
+	}
+
+	john, err := queries.GetUser(ctx, "John")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if john.ID != legacy.Users()["John"].ID {
+		t.Errorf("id was not preserved. expected: %s, actual: %s", legacy.Users()["John"].ID, john.ID)
+	}
+
+	if bcrypt.CompareHashAndPassword(john.Password, []byte("foo")) != nil {
+		t.Error("couldn't verify imported password")
+	}
+
+	if bcrypt.CompareHashAndPassword(john.Streamkey, []byte("bar")) != nil {
+		t.Error("couldn't verify imported streamkey")
+	}
+
+	// Importing again must not change anything
+	report, err = Import(ctx, sqlDB, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Imported) != 0 || len(report.Conflicts) != 4 {
+		t.Errorf("expected 4 conflicts on reimport, actual: %v", report.Conflicts)
+	}
+}
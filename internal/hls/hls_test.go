@@ -0,0 +1,214 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/glimesh/broadcast-box/internal/media"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const frameRate = 30
+
+type broadcaster struct {
+	sink                                     internalwebrtc.Sink
+	frame                                    int
+	videoSequenceNumber, audioSequenceNumber uint16
+	audioTimestamp                           uint32
+}
+
+// send sends frames of H.264 with a key frame every second and Opus audio.
+func (b *broadcaster) send(frames int) {
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps, _ := hex.DecodeString("68ebecb22c")
+
+	for end := b.frame + frames; b.frame < end; b.frame++ {
+		payloads := [][]byte{{0x41, 0x9A, 0x24, 0x6C}}
+		if b.frame%frameRate == 0 {
+			stapA := append([]byte{0x78, 0x00, byte(len(sps))}, sps...)
+			stapA = append(append(stapA, 0x00, byte(len(pps))), pps...)
+			payloads = [][]byte{stapA, {0x65, 0x88, 0x84, 0x00}}
+		}
+
+		for j, payload := range payloads {
+			b.sink.WriteVideo("high", webrtc.MimeTypeH264, &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         j == len(payloads)-1,
+					SequenceNumber: b.videoSequenceNumber,
+					Timestamp:      uint32(b.frame * media.VideoClockRate / frameRate),
+				},
+				Payload: payload,
+			})
+			b.videoSequenceNumber++
+		}
+
+		for ; b.audioTimestamp <= uint32((b.frame+1)*media.AudioClockRate/frameRate); b.audioTimestamp += media.AudioClockRate / 50 {
+			b.sink.WriteAudio(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: b.audioSequenceNumber, Timestamp: b.audioTimestamp},
+				Payload: []byte{0xFC, 0xFF, 0xFE},
+			})
+			b.audioSequenceNumber++
+		}
+	}
+}
+
+func newTestServer(t *testing.T) (*Packager, *httptest.Server) {
+	t.Helper()
+
+	p := New(time.Second, 200*time.Millisecond, 3)
+	mux := http.NewServeMux()
+	mux.Handle("/api/hls/{username}/{path...}", p)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return p, server
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, body
+}
+
+func TestPlaylists(t *testing.T) {
+	p, server := newTestServer(t)
+	keyframeRequests := 0
+	b := &broadcaster{sink: p.Sink("user", func() { keyframeRequests++ })}
+	b.send(3*frameRate + frameRate/2)
+
+	status, body := get(t, server.URL+"/api/hls/user/index.m3u8?token=abc")
+	if status != http.StatusOK || !strings.Contains(string(body), `CODECS="avc1.64001E,opus",RESOLUTION=640x360`) || !strings.Contains(string(body), "\nhigh/index.m3u8?token=abc\n") {
+		t.Fatalf("wrong multivariant playlist %d %s", status, body)
+	}
+
+	status, body = get(t, server.URL+"/api/hls/user/high/index.m3u8")
+	playlist := string(body)
+	if status != http.StatusOK {
+		t.Fatalf("wrong status %d %s", status, body)
+	}
+
+	for _, want := range []string{
+		"#EXT-X-TARGETDURATION:1\n",
+		"#EXT-X-MEDIA-SEQUENCE:0\n",
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n",
+		"#EXT-X-PART:DURATION=0.20000,URI=\"part2.0.m4s\",INDEPENDENT=YES\n",
+		"#EXTINF:1.00000,\nseg2.m4s\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part3.2.m4s\"\n",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist is missing %q:\n%s", want, playlist)
+		}
+	}
+	if strings.Contains(playlist, "seg3.m4s") || strings.Contains(playlist, "#EXT-X-ENDLIST") {
+		t.Errorf("playlist has more than was broadcast:\n%s", playlist)
+	}
+	if keyframeRequests != 0 {
+		t.Errorf("requested %d key frames while they came on time", keyframeRequests)
+	}
+
+	_, init := get(t, server.URL+"/api/hls/user/high/init1.mp4")
+	status, segment := get(t, server.URL+"/api/hls/user/high/seg1.m4s")
+	if status != http.StatusOK {
+		t.Fatalf("wrong status %d %s", status, segment)
+	}
+
+	f, err := mp4.DecodeFile(bytes.NewReader(append(init, segment...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	videoSamples := 0
+	for _, fragment := range f.Segments[0].Fragments {
+		for _, traf := range fragment.Moof.Trafs {
+			if traf.Tfhd.TrackID == media.FMP4VideoTrackID {
+				videoSamples += int(traf.Trun.SampleCount())
+			}
+		}
+	}
+	if videoSamples != frameRate {
+		t.Errorf("expected %d video samples in a segment, got %d", frameRate, videoSamples)
+	}
+}
+
+func TestBlockingPlaylistReload(t *testing.T) {
+	p, server := newTestServer(t)
+	sink := p.Sink("user", func() {})
+	b := &broadcaster{sink: sink}
+	b.send(frameRate / 2)
+
+	done := make(chan string)
+	go func() {
+		_, body := get(t, server.URL+"/api/hls/user/high/index.m3u8?_HLS_msn=1&_HLS_part=0")
+		done <- string(body)
+	}()
+
+	select {
+	case playlist := <-done:
+		t.Fatalf("blocking request returned before the part existed:\n%s", playlist)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	b.send(frameRate + frameRate/2)
+	if playlist := <-done; !strings.Contains(playlist, `URI="part1.0.m4s"`) {
+		t.Errorf("playlist is missing the part it was blocked on:\n%s", playlist)
+	}
+
+	if status, body := get(t, server.URL+"/api/hls/user/high/index.m3u8?_HLS_msn=9"); status != http.StatusBadRequest {
+		t.Errorf("request for a segment too far ahead got %d %s", status, body)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get(t, server.URL+"/api/hls/user/index.m3u8"); status != http.StatusNotFound {
+		t.Errorf("ended stream got %d", status)
+	}
+}
+
+func TestKeyframeRequests(t *testing.T) {
+	p, _ := newTestServer(t)
+	keyframeRequests := 0
+	b := &broadcaster{sink: p.Sink("user", func() { keyframeRequests++ })}
+
+	// Key frames only come every second, the segments are due after half
+	p.segmentDuration = time.Second / 2
+	b.send(2 * frameRate)
+
+	if keyframeRequests != 2 {
+		t.Errorf("expected a key frame request per segment, got %d", keyframeRequests)
+	}
+
+	s := p.stream("user")
+	l := s.layer("high")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	playlist := &strings.Builder{}
+	l.writePlaylist(playlist, "")
+	if l.targetDuration() != 1 || !strings.Contains(playlist.String(), fmt.Sprintf("#EXTINF:%.5f,\nseg0.m4s\n", 1.0)) {
+		t.Errorf("segments don't end at key frames:\n%s", playlist)
+	}
+}
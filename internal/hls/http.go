@@ -0,0 +1,256 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often a multivariant playlist request checks for a layer to list
+const layerPollInterval = 50 * time.Millisecond
+
+var (
+	errNotFound           = errors.New("Not found.")
+	errInvalidDeliveryDir = errors.New("Invalid playlist delivery directive.")
+	errTimeout            = errors.New("Playlist was not updated in time.")
+)
+
+// ServeHTTP serves the HLS stream of the {username} path value by the
+// {path...} path value.
+//
+//   - index.m3u8 is the multivariant playlist
+//   - {layer}/index.m3u8 is the media playlist of a simulcast layer
+//   - {layer}/init{id}.mp4, {layer}/seg{msn}.m4s and {layer}/part{msn}.{part}.m4s
+//     are its init segments, segments and parts
+//
+// The token query parameter is kept on every URI of the playlists, so viewer
+// tokens work with players that can't send headers.
+func (p *Packager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, errors.New("Method not allowed.").Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := p.stream(req.PathValue("username"))
+	if s == nil {
+		http.Error(w, errNotStreaming.Error(), http.StatusNotFound)
+		return
+	}
+
+	query := ""
+	if token := req.URL.Query().Get("token"); token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+
+	path := req.PathValue("path")
+	if path == "index.m3u8" {
+		s.serveMultivariantPlaylist(w, query)
+		return
+	}
+
+	i := strings.LastIndex(path, "/")
+	if i == -1 {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	s.layersLock.RLock()
+	l := s.layer(path[:i])
+	s.layersLock.RUnlock()
+	if l == nil {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	name := path[i+1:]
+	switch {
+	case name == "index.m3u8":
+		l.serveMediaPlaylist(w, req, query)
+	case strings.HasPrefix(name, "init") && strings.HasSuffix(name, ".mp4"):
+		l.serveInit(w, strings.TrimSuffix(strings.TrimPrefix(name, "init"), ".mp4"))
+	case strings.HasPrefix(name, "seg") && strings.HasSuffix(name, ".m4s"):
+		l.serveSegment(w, strings.TrimSuffix(strings.TrimPrefix(name, "seg"), ".m4s"))
+	case strings.HasPrefix(name, "part") && strings.HasSuffix(name, ".m4s"):
+		l.servePart(w, strings.TrimSuffix(strings.TrimPrefix(name, "part"), ".m4s"))
+	default:
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+	}
+}
+
+// serveMultivariantPlaylist lists every layer that can be played, it waits for
+// the first one if there is none yet.
+func (s *stream) serveMultivariantPlaylist(w http.ResponseWriter, query string) {
+	timeout := time.Now().Add(blockingRequestTargetDurations * s.packager.segmentDuration)
+
+	b := &strings.Builder{}
+	for {
+		b.Reset()
+		b.WriteString("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+		listed := 0
+		s.layersLock.RLock()
+		for _, l := range s.layers {
+			l.mu.Lock()
+			if l.ready() {
+				l.writeVariant(b, query)
+				listed++
+			}
+			l.mu.Unlock()
+		}
+		closed := s.closed
+		s.layersLock.RUnlock()
+
+		if listed != 0 || closed || time.Now().After(timeout) {
+			if listed == 0 {
+				http.Error(w, errNotStreaming.Error(), http.StatusNotFound)
+				return
+			}
+			break
+		}
+		time.Sleep(layerPollInterval)
+	}
+
+	writePlaylist(w, b.String())
+}
+
+// serveMediaPlaylist serves the playlist of the layer, blocking requests wait
+// for the segment or part they ask for, see section 6.2.5.2 of RFC 8216bis.
+func (l *layer) serveMediaPlaylist(w http.ResponseWriter, req *http.Request, query string) {
+	msn, partIndex := -1, -1
+	if v := req.URL.Query().Get("_HLS_msn"); v != "" {
+		var err error
+		if msn, err = strconv.Atoi(v); err != nil || msn < 0 {
+			http.Error(w, errInvalidDeliveryDir.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := req.URL.Query().Get("_HLS_part"); v != "" {
+		var err error
+		if partIndex, err = strconv.Atoi(v); err != nil || partIndex < 0 || msn == -1 {
+			http.Error(w, errInvalidDeliveryDir.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	l.mu.Lock()
+	tooFar := msn != -1 && len(l.segments) != 0 && msn > l.segments[len(l.segments)-1].msn+2
+	timeout := time.After(time.Duration(blockingRequestTargetDurations*l.targetDuration()) * time.Second)
+	l.mu.Unlock()
+	if tooFar {
+		http.Error(w, errInvalidDeliveryDir.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ok := l.wait(timeout, func() bool {
+		return l.ready() && (msn == -1 || l.hasPart(msn, partIndex))
+	})
+	defer l.mu.Unlock()
+
+	switch {
+	case !l.ready():
+		http.Error(w, errNotStreaming.Error(), http.StatusNotFound)
+	case !ok && !l.ended:
+		http.Error(w, errTimeout.Error(), http.StatusServiceUnavailable)
+	default:
+		b := &strings.Builder{}
+		l.writePlaylist(b, query)
+		writePlaylist(w, b.String())
+	}
+}
+
+func (l *layer) serveInit(w http.ResponseWriter, id string) {
+	initID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	l.mu.Lock()
+	init, ok := l.inits[initID]
+	l.mu.Unlock()
+	if !ok {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeMedia(w, init)
+}
+
+func (l *layer) serveSegment(w http.ResponseWriter, name string) {
+	msn, err := strconv.Atoi(name)
+	if err != nil {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	l.mu.Lock()
+	data := []byte{}
+	s := l.segment(msn)
+	if s != nil && s.complete {
+		for _, p := range s.parts {
+			data = append(data, p.data...)
+		}
+	}
+	l.mu.Unlock()
+
+	if s == nil || !s.complete {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeMedia(w, data)
+}
+
+// servePart serves a part, the one of the preload hint is waited for.
+func (l *layer) servePart(w http.ResponseWriter, name string) {
+	var msn, partIndex int
+	if _, err := fmt.Sscanf(name, "%d.%d", &msn, &partIndex); err != nil || fmt.Sprintf("%d.%d", msn, partIndex) != name {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	l.mu.Lock()
+	timeout := time.After(time.Duration(blockingRequestTargetDurations*l.targetDuration()) * time.Second)
+	hinted := false
+	if len(l.segments) != 0 {
+		last := l.segments[len(l.segments)-1]
+		// The hinted part may also turn out to start the next segment
+		hinted = (msn == last.msn && partIndex == len(last.parts)) || (msn == last.msn+1 && partIndex == 0)
+	}
+	l.mu.Unlock()
+
+	var p *part
+	if hinted {
+		l.wait(timeout, func() bool { return l.part(msn, partIndex) != nil })
+		p = l.part(msn, partIndex)
+		l.mu.Unlock()
+	} else {
+		l.mu.Lock()
+		p = l.part(msn, partIndex)
+		l.mu.Unlock()
+	}
+
+	if p == nil {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeMedia(w, p.data)
+}
+
+func writePlaylist(w http.ResponseWriter, playlist string) {
+	w.Header().Set("Content-Type", playlistContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, playlist)
+}
+
+func writeMedia(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
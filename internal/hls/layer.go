@@ -0,0 +1,427 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+)
+
+type (
+	// layer packages one video layer of a broadcast, with the audio of the
+	// broadcast, into segments that start with a key frame. Segments are made
+	// of parts, which are what Low-Latency HLS clients load.
+	layer struct {
+		name     string
+		mimeType string
+		packager *Packager
+		// Asks the publisher for a key frame
+		requestKeyframe func()
+		video           *media.Track
+
+		mu sync.Mutex
+		// Closed and replaced when a part is added or the broadcast ends
+		changed chan struct{}
+		ended   bool
+
+		config *media.VideoConfig
+		muxer  *media.FMP4Muxer
+		// When the first frame of the muxer is played, audio before it is
+		// dropped
+		muxerStart time.Duration
+		// Init segments of the segments in the playlist by ID
+		inits  map[int][]byte
+		initID int
+		// Complete segments of the playlist and the one being built
+		segments              []*segment
+		discontinuitySequence int
+		partStart             time.Duration
+		partIndependent       bool
+		// PTS of the last video frame
+		lastPTS           time.Duration
+		keyframeRequested bool
+		// Longest segment so far, the target duration may only grow
+		maxSegmentDuration time.Duration
+	}
+
+	segment struct {
+		msn    int
+		initID int
+		// The init segment or timeline changed since the segment before
+		discontinuity bool
+		parts         []*part
+		duration      time.Duration
+		complete      bool
+	}
+
+	part struct {
+		data     []byte
+		duration time.Duration
+		// Starts with a key frame
+		independent bool
+	}
+)
+
+func newLayer(p *Packager, name, mimeType string, requestKeyframe func(), video *media.Track) *layer {
+	return &layer{
+		name:            name,
+		mimeType:        mimeType,
+		packager:        p,
+		requestKeyframe: requestKeyframe,
+		video:           video,
+		changed:         make(chan struct{}),
+		inits:           map[int][]byte{},
+	}
+}
+
+// writeVideo adds the frames pkt completes. Only the goroutine of the layer
+// calls it.
+func (l *layer) writeVideo(pkt *rtp.Packet) {
+	l.video.Push(pkt)
+	for frame := l.video.Pop(); frame != nil; frame = l.video.Pop() {
+		l.addVideo(frame)
+	}
+}
+
+func (l *layer) addVideo(frame *media.Frame) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ended {
+		return
+	}
+
+	keyframe := media.IsKeyframe(l.mimeType, frame.Data)
+	if keyframe {
+		l.keyframeRequested = false
+	}
+
+	if l.muxer == nil {
+		if keyframe {
+			l.start(frame)
+		} else {
+			l.askForKeyframe()
+		}
+		return
+	}
+
+	var config *media.VideoConfig
+	if keyframe {
+		var err error
+		if config, err = media.ParseVideoConfig(l.mimeType, frame.Data, l.config); err != nil {
+			log.Println(err)
+			config = l.config
+		}
+	}
+
+	interval := frame.PTS - l.lastPTS
+	l.lastPTS = frame.PTS
+	segmentDue := frame.PTS-l.segments[len(l.segments)-1].start(l) >= l.packager.segmentDuration
+
+	switch {
+	case keyframe && !config.Equal(l.config):
+		// Frames of the new configuration need a new init segment
+		l.muxer.Flush()
+		l.endPart(frame.PTS, true)
+		l.muxer = nil
+		l.start(frame)
+		return
+	case keyframe && segmentDue:
+		l.muxer.AddVideo(frame.Data, true, frame.PTS)
+		l.endPart(frame.PTS, true)
+	case frame.PTS+interval > l.partStart+l.packager.partDuration:
+		// Another frame would make the part longer than the target
+		l.muxer.AddVideo(frame.Data, keyframe, frame.PTS)
+		l.endPart(frame.PTS, false)
+	default:
+		l.muxer.AddVideo(frame.Data, keyframe, frame.PTS)
+		return
+	}
+
+	// The frame is still pending, so it starts the next part
+	l.partIndependent = keyframe
+	if segmentDue && !keyframe {
+		l.askForKeyframe()
+	}
+}
+
+// start begins a segment with a new init segment at a key frame.
+func (l *layer) start(frame *media.Frame) {
+	config, err := media.ParseVideoConfig(l.mimeType, frame.Data, l.config)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	muxer, err := media.NewFMP4Muxer(config)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	init := &bytes.Buffer{}
+	if err = muxer.Init.Encode(init); err != nil {
+		log.Println(err)
+		return
+	}
+
+	l.initID++
+	l.inits[l.initID] = init.Bytes()
+	l.config, l.muxer, l.muxerStart = config, muxer, frame.PTS
+	l.partStart, l.partIndependent, l.lastPTS = frame.PTS, true, frame.PTS
+
+	discontinuity := len(l.segments) != 0
+	if discontinuity && len(l.segments[len(l.segments)-1].parts) == 0 {
+		// The segment that was started for the frame is replaced
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	l.startSegment(discontinuity)
+
+	muxer.AddVideo(frame.Data, true, frame.PTS)
+}
+
+func (l *layer) startSegment(discontinuity bool) {
+	msn := 0
+	if len(l.segments) != 0 {
+		msn = l.segments[len(l.segments)-1].msn + 1
+	}
+
+	l.segments = append(l.segments, &segment{msn: msn, initID: l.initID, discontinuity: discontinuity})
+}
+
+// start returns when the first frame of the segment is played.
+func (s *segment) start(l *layer) time.Duration {
+	return l.partStart - s.duration
+}
+
+func (l *layer) askForKeyframe() {
+	if !l.keyframeRequested {
+		l.requestKeyframe()
+		l.keyframeRequested = true
+	}
+}
+
+// endPart writes the completed samples to a part that ends at end, and starts
+// the next segment if endSegment.
+func (l *layer) endPart(end time.Duration, endSegment bool) {
+	data := &bytes.Buffer{}
+	if err := l.muxer.WriteFragment(data); err != nil {
+		log.Println(err)
+		return
+	}
+
+	current := l.segments[len(l.segments)-1]
+	if data.Len() != 0 {
+		p := &part{data: data.Bytes(), duration: end - l.partStart, independent: l.partIndependent}
+		current.parts = append(current.parts, p)
+		current.duration += p.duration
+	}
+	l.partStart = end
+
+	if endSegment && len(current.parts) != 0 {
+		current.complete = true
+		l.maxSegmentDuration = max(l.maxSegmentDuration, current.duration)
+		l.startSegment(false)
+		l.removeOldSegments()
+	}
+
+	l.notify()
+}
+
+// removeOldSegments keeps the configured number of complete segments.
+func (l *layer) removeOldSegments() {
+	for len(l.segments)-1 > l.packager.segmentCount {
+		if l.segments[1].discontinuity {
+			l.discontinuitySequence++
+		}
+		l.segments = l.segments[1:]
+	}
+
+	for id := range l.inits {
+		if id < l.segments[0].initID {
+			delete(l.inits, id)
+		}
+	}
+}
+
+func (l *layer) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *layer) addAudio(frame *media.Frame) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ended || l.muxer == nil || frame.PTS < l.muxerStart {
+		return
+	}
+
+	l.muxer.AddAudio(frame.Data, frame.PTS)
+}
+
+// end writes what is left and marks the playlist as ended.
+func (l *layer) end() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ended {
+		return
+	}
+
+	if l.muxer != nil {
+		l.muxer.Flush()
+		l.endPart(l.lastPTS+defaultFrameDuration, true)
+	}
+	l.ended = true
+	l.notify()
+}
+
+// ready reports if there is something to play.
+func (l *layer) ready() bool {
+	return len(l.segments) != 0 && (l.segments[0].complete || len(l.segments[0].parts) != 0)
+}
+
+// wait blocks until ready returns true or the request times out. It returns
+// with l.mu held.
+func (l *layer) wait(timeout <-chan time.Time, ready func() bool) bool {
+	l.mu.Lock()
+	for !ready() && !l.ended {
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			l.mu.Lock()
+			return ready()
+		}
+
+		l.mu.Lock()
+	}
+
+	return ready()
+}
+
+// segment returns the segment with msn, if it is in the playlist.
+func (l *layer) segment(msn int) *segment {
+	if len(l.segments) == 0 || msn < l.segments[0].msn || msn > l.segments[len(l.segments)-1].msn {
+		return nil
+	}
+
+	return l.segments[msn-l.segments[0].msn]
+}
+
+// hasPart reports if the playlist has part partIndex of segment msn, or the
+// whole segment if partIndex is -1.
+func (l *layer) hasPart(msn, partIndex int) bool {
+	if len(l.segments) != 0 && msn < l.segments[len(l.segments)-1].msn {
+		return true
+	}
+
+	s := l.segment(msn)
+	if s == nil {
+		return false
+	}
+
+	return s.complete || (partIndex != -1 && partIndex < len(s.parts))
+}
+
+// part returns part partIndex of segment msn, if it is in the playlist.
+func (l *layer) part(msn, partIndex int) *part {
+	s := l.segment(msn)
+	if s == nil || partIndex < 0 || partIndex >= len(s.parts) {
+		return nil
+	}
+
+	return s.parts[partIndex]
+}
+
+// targetDuration returns the EXT-X-TARGETDURATION of the playlist.
+func (l *layer) targetDuration() int {
+	return int(math.Ceil(max(l.packager.segmentDuration, l.maxSegmentDuration).Seconds()))
+}
+
+// bandwidth returns the peak bit rate of the segments in the playlist.
+func (l *layer) bandwidth() int {
+	peak := 0
+	for _, s := range l.segments {
+		if s.duration <= 0 {
+			continue
+		}
+
+		size := 0
+		for _, p := range s.parts {
+			size += len(p.data)
+		}
+		peak = max(peak, int(float64(size*8)/s.duration.Seconds()))
+	}
+
+	return max(peak, defaultBandwidth)
+}
+
+// writePlaylist writes the media playlist, query is appended to every URI.
+func (l *layer) writePlaylist(w io.Writer, query string) {
+	partTarget := l.packager.partDuration.Seconds()
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:%d\n", l.targetDuration())
+	fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", partHoldBack*partTarget)
+	fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", l.segments[0].msn)
+	fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", l.discontinuitySequence)
+
+	// Parts are only listed for the last segments, see section 6.2.2 of RFC
+	// 8216bis
+	partsFrom := len(l.segments)
+	for remaining := time.Duration(partsListedTargetDurations*l.targetDuration()) * time.Second; partsFrom > 0 && remaining > 0; {
+		partsFrom--
+		remaining -= l.segments[partsFrom].duration
+	}
+
+	for i, s := range l.segments {
+		if i == 0 || s.discontinuity {
+			if i != 0 {
+				b.WriteString("#EXT-X-DISCONTINUITY\n")
+			}
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"init%d.mp4%s\"\n", s.initID, query)
+		}
+
+		if i >= partsFrom {
+			for j, p := range s.parts {
+				fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.m4s%s\"", p.duration.Seconds(), s.msn, j, query)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+
+		if s.complete {
+			fmt.Fprintf(b, "#EXTINF:%.5f,\nseg%d.m4s%s\n", s.duration.Seconds(), s.msn, query)
+		}
+	}
+
+	if last := l.segments[len(l.segments)-1]; l.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else {
+		fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s%s\"\n", last.msn, len(last.parts), query)
+	}
+
+	io.WriteString(w, b.String())
+}
+
+// writeVariant writes the EXT-X-STREAM-INF of the layer to the multivariant
+// playlist.
+func (l *layer) writeVariant(w io.Writer, query string) {
+	fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s,opus\",RESOLUTION=%dx%d\n%s/index.m3u8%s\n",
+		l.bandwidth(), l.config.CodecString(), l.config.Width, l.config.Height, url.PathEscape(l.name), query)
+}
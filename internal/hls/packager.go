@@ -0,0 +1,186 @@
+// Package hls repackages broadcasts as HLS and Low-Latency HLS, one variant
+// per simulcast layer. Nothing is transcoded, so only layers of codecs that can
+// be written to fragmented MP4 are served.
+package hls
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/media"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/rtp"
+)
+
+const (
+	// Clients play this many part targets behind the live edge
+	partHoldBack = 3
+	// Parts are listed for the segments of this many target durations
+	partsListedTargetDurations = 3
+	// Blocking requests wait this many target durations, see section 6.2.5.2
+	// of RFC 8216bis
+	blockingRequestTargetDurations = 3
+
+	// Duration of the last frame of an ended broadcast
+	defaultFrameDuration = time.Second / 30
+	// BANDWIDTH of layers without a segment yet
+	defaultBandwidth = 100_000
+
+	playlistContentType = "application/vnd.apple.mpegurl"
+)
+
+var errNotStreaming = errors.New("Stream is not live.")
+
+type (
+	// Packager packages the broadcasts of every stream as HLS while they are
+	// live. Playlists and segments are kept in memory.
+	Packager struct {
+		segmentDuration time.Duration
+		partDuration    time.Duration
+		// Complete segments kept in the playlist
+		segmentCount int
+
+		streamsLock sync.Mutex
+		streams     map[string]*stream
+	}
+
+	// stream is the sink of a broadcast, it gives every video layer a layer
+	// and the audio to all of them.
+	stream struct {
+		packager        *Packager
+		streamKey       string
+		requestKeyframe func()
+		// Tracks are timed by when their first packet came
+		start time.Time
+
+		audioLock sync.Mutex
+		audio     *media.Track
+
+		layersLock sync.RWMutex
+		closed     bool
+		layers     []*layer
+		// RIDs of layers that aren't packaged
+		unsupported map[string]bool
+	}
+)
+
+func New(segmentDuration, partDuration time.Duration, segmentCount int) *Packager {
+	return &Packager{
+		segmentDuration: segmentDuration,
+		partDuration:    partDuration,
+		segmentCount:    segmentCount,
+		streams:         map[string]*stream{},
+	}
+}
+
+// Sink returns the sink that packages the broadcast to streamKey, it replaces
+// the broadcast before.
+func (p *Packager) Sink(streamKey string, requestKeyframe func()) internalwebrtc.Sink {
+	s := &stream{packager: p, streamKey: streamKey, requestKeyframe: requestKeyframe, start: time.Now(), unsupported: map[string]bool{}}
+
+	p.streamsLock.Lock()
+	defer p.streamsLock.Unlock()
+
+	p.streams[streamKey] = s
+	return s
+}
+
+func (p *Packager) stream(streamKey string) *stream {
+	p.streamsLock.Lock()
+	defer p.streamsLock.Unlock()
+
+	return p.streams[streamKey]
+}
+
+func (s *stream) WriteAudio(pkt *rtp.Packet) {
+	s.audioLock.Lock()
+	if s.audio == nil {
+		s.audio = media.NewAudioTrack(time.Since(s.start), pkt.Timestamp)
+	}
+
+	s.audio.Push(pkt)
+	frames := []*media.Frame{}
+	for frame := s.audio.Pop(); frame != nil; frame = s.audio.Pop() {
+		frames = append(frames, frame)
+	}
+	s.audioLock.Unlock()
+
+	s.layersLock.RLock()
+	defer s.layersLock.RUnlock()
+
+	for _, l := range s.layers {
+		for _, frame := range frames {
+			l.addAudio(frame)
+		}
+	}
+}
+
+func (s *stream) WriteVideo(rid, mimeType string, pkt *rtp.Packet) {
+	s.layersLock.RLock()
+	l, unsupported := s.layer(rid), s.unsupported[rid]
+	s.layersLock.RUnlock()
+
+	if unsupported {
+		return
+	} else if l == nil {
+		if l = s.addLayer(rid, mimeType, pkt); l == nil {
+			return
+		}
+	}
+
+	l.writeVideo(pkt)
+}
+
+// layer returns the layer of rid, if it is packaged.
+func (s *stream) layer(rid string) *layer {
+	for _, l := range s.layers {
+		if l.name == rid {
+			return l
+		}
+	}
+
+	return nil
+}
+
+func (s *stream) addLayer(rid, mimeType string, pkt *rtp.Packet) *layer {
+	if !media.FMP4Supported(mimeType) {
+		log.Printf("Not packaging %s of %s as HLS, %s can't be written to fragmented MP4", rid, s.streamKey, mimeType)
+
+		s.layersLock.Lock()
+		defer s.layersLock.Unlock()
+		s.unsupported[rid] = true
+		return nil
+	}
+
+	l := newLayer(s.packager, rid, mimeType, s.requestKeyframe, media.NewVideoTrack(media.NewVideoDepacketizer(mimeType), time.Since(s.start), pkt.Timestamp))
+
+	s.layersLock.Lock()
+	defer s.layersLock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.layers = append(s.layers, l)
+	return l
+}
+
+func (s *stream) Close() error {
+	s.packager.streamsLock.Lock()
+	if s.packager.streams[s.streamKey] == s {
+		delete(s.packager.streams, s.streamKey)
+	}
+	s.packager.streamsLock.Unlock()
+
+	s.layersLock.Lock()
+	defer s.layersLock.Unlock()
+
+	s.closed = true
+	for _, l := range s.layers {
+		l.end()
+	}
+
+	return nil
+}
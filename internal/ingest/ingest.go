@@ -0,0 +1,178 @@
+// Package ingest turns the frames of broadcasts that don't come over WebRTC,
+// like RTMP and SRT ones, into RTP packets like the ones of WHIP sessions.
+package ingest
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h265"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// Largest payload of the RTP packets, like the ones browsers send
+const rtpPayloadSize = 1200
+
+type (
+	// Publisher gets the media of a broadcast as RTP packets. Packets are only
+	// valid until the call returns.
+	Publisher interface {
+		// WriteAudio writes an Opus packet
+		WriteAudio(pkt *rtp.Packet)
+		// WriteVideo writes a packet of the video layer rid, which is empty
+		// unless the broadcast has more than one video track
+		WriteVideo(rid, mimeType string, pkt *rtp.Packet)
+		// Close is called once when the broadcast ends
+		Close()
+		// Done is closed when the broadcast ended, also when another
+		// publisher took over its stream
+		Done() <-chan struct{}
+	}
+
+	// VideoPacketizer turns the frames of a video track into RTP packets.
+	VideoPacketizer struct {
+		publisher      Publisher
+		rid, mimeType  string
+		payloader      rtp.Payloader
+		sequenceNumber uint16
+
+		// Latest parameter sets of H.264 and H.265, by NAL unit type
+		parameterSets     map[uint8][]byte
+		parameterSetTypes []uint8
+	}
+
+	// AudioPacketizer puts Opus packets into RTP packets.
+	AudioPacketizer struct {
+		publisher      Publisher
+		sequenceNumber uint16
+	}
+)
+
+// NewVideoPacketizer returns a packetizer of a video track of mimeType. Key
+// frames of H.264 and H.265 get parameterSets until the track sends newer ones.
+func NewVideoPacketizer(publisher Publisher, rid, mimeType string, parameterSets ...[]byte) (*VideoPacketizer, error) {
+	p := &VideoPacketizer{publisher: publisher, rid: rid, mimeType: mimeType, parameterSets: map[uint8][]byte{}}
+
+	switch {
+	case media.IsMimeType(mimeType, webrtc.MimeTypeH264):
+		p.payloader = &codecs.H264Payloader{}
+		p.parameterSetTypes = []uint8{uint8(h264.NALUTypeSPS), uint8(h264.NALUTypePPS)}
+	case media.IsMimeType(mimeType, webrtc.MimeTypeH265):
+		p.payloader = &codecs.H265Payloader{}
+		p.parameterSetTypes = []uint8{uint8(h265.NALUType_VPS_NUT), uint8(h265.NALUType_SPS_NUT), uint8(h265.NALUType_PPS_NUT)}
+	case media.IsMimeType(mimeType, webrtc.MimeTypeAV1):
+		p.payloader = &codecs.AV1Payloader{}
+	case media.IsMimeType(mimeType, webrtc.MimeTypeVP9):
+		p.payloader = &codecs.VP9Payloader{}
+	default:
+		return nil, media.ErrUnsupportedCodec
+	}
+
+	for _, t := range p.parameterSetTypes {
+		p.parameterSets[t] = nil
+	}
+	p.updateParameterSets(parameterSets)
+
+	return p, nil
+}
+
+// WriteAccessUnit writes the NAL units of an H.264 or H.265 access unit played
+// at timestamp, in the clock rate of video. Access units of only parameter sets
+// are kept for the next key frame.
+func (p *VideoPacketizer) WriteAccessUnit(timestamp uint32, au [][]byte) {
+	keyframe := false
+	if media.IsMimeType(p.mimeType, webrtc.MimeTypeH264) {
+		keyframe = h264.IsRandomAccess(au)
+	} else {
+		keyframe = h265.IsRandomAccess(au)
+	}
+
+	au = p.updateParameterSets(au)
+	if len(au) == 0 {
+		return
+	}
+
+	// Parameter sets go first, like browsers send them
+	if keyframe {
+		sets := [][]byte{}
+		for _, t := range p.parameterSetTypes {
+			if len(p.parameterSets[t]) != 0 {
+				sets = append(sets, p.parameterSets[t])
+			}
+		}
+		au = append(sets, au...)
+	}
+
+	frame, err := h264.AnnexB(au).Marshal()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	p.WriteFrame(timestamp, frame)
+}
+
+// WriteFrame writes a frame played at timestamp, in the clock rate of video.
+// H.264 and H.265 frames are Annex B, AV1 ones OBUs with size fields.
+func (p *VideoPacketizer) WriteFrame(timestamp uint32, frame []byte) {
+	payloads := p.payloader.Payload(rtpPayloadSize, frame)
+	for i, payload := range payloads {
+		p.publisher.WriteVideo(p.rid, p.mimeType, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: p.sequenceNumber,
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		})
+		p.sequenceNumber++
+	}
+}
+
+// updateParameterSets keeps the parameter sets of au and returns the rest.
+func (p *VideoPacketizer) updateParameterSets(au [][]byte) [][]byte {
+	rest := [][]byte{}
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		t := nalu[0] & 0x1F
+		if media.IsMimeType(p.mimeType, webrtc.MimeTypeH265) {
+			t = (nalu[0] >> 1) & 0x3F
+		}
+
+		if _, ok := p.parameterSets[t]; ok {
+			p.parameterSets[t] = bytes.Clone(nalu)
+			continue
+		}
+		rest = append(rest, nalu)
+	}
+
+	return rest
+}
+
+// NewAudioPacketizer returns a packetizer of an Opus track.
+func NewAudioPacketizer(publisher Publisher) *AudioPacketizer {
+	return &AudioPacketizer{publisher: publisher}
+}
+
+// WriteOpus writes an Opus packet played at timestamp, in the clock rate of
+// audio.
+func (p *AudioPacketizer) WriteOpus(timestamp uint32, packet []byte) {
+	p.publisher.WriteAudio(&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			SequenceNumber: p.sequenceNumber,
+			Timestamp:      timestamp,
+		},
+		Payload: packet,
+	})
+	p.sequenceNumber++
+}
@@ -0,0 +1,262 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/av1"
+	"github.com/Eyevinn/mp4ff/bits"
+	"github.com/pion/rtp/codecs/av1/obu"
+)
+
+var errNoSequenceHeader = errors.New("no AV1 sequence header")
+
+// AV1SequenceHeader is the part of an AV1 sequence header OBU containers need,
+// see section 5.5 of the AV1 specification.
+type AV1SequenceHeader struct {
+	Width, Height int
+	Config        av1.CodecConfRec
+}
+
+// av1OBUs calls f with the type and the whole of every OBU in data, which has
+// OBUs with size fields like the AV1 depacketizer returns.
+func av1OBUs(data []byte, f func(t obu.Type, o []byte)) {
+	for len(data) > 0 {
+		header, err := obu.ParseOBUHeader(data)
+		if err != nil || !header.HasSizeField {
+			return
+		}
+
+		size, n, err := obu.ReadLeb128(data[header.Size():])
+		if err != nil || header.Size()+int(n)+int(size) > len(data) {
+			return
+		}
+
+		end := header.Size() + int(n) + int(size)
+		f(header.Type, data[:end])
+		data = data[end:]
+	}
+}
+
+// ParseAV1SequenceHeader parses the first sequence header OBU of a temporal
+// unit.
+func ParseAV1SequenceHeader(data []byte) (*AV1SequenceHeader, error) {
+	var sequenceHeader []byte
+	av1OBUs(data, func(t obu.Type, o []byte) {
+		if t == obu.OBUSequenceHeader && sequenceHeader == nil {
+			sequenceHeader = o
+		}
+	})
+	if sequenceHeader == nil {
+		return nil, errNoSequenceHeader
+	}
+
+	header, err := obu.ParseOBUHeader(sequenceHeader)
+	if err != nil {
+		return nil, err
+	}
+	_, n, err := obu.ReadLeb128(sequenceHeader[header.Size():])
+	if err != nil {
+		return nil, err
+	}
+
+	r := bits.NewReader(bytes.NewReader(sequenceHeader[header.Size()+int(n):]))
+	s := &AV1SequenceHeader{Config: av1.CodecConfRec{Version: 1, ConfigOBUs: sequenceHeader}}
+
+	s.Config.SeqProfile = byte(r.Read(3))
+	r.Read(1) // still_picture
+	reducedStillPictureHeader := r.ReadFlag()
+	if reducedStillPictureHeader {
+		s.Config.SeqLevelIdx0 = byte(r.Read(5))
+	} else {
+		decoderModelInfoPresent := false
+		bufferDelayLength := 0
+		if r.ReadFlag() { // timing_info_present_flag
+			r.Read(32)        // num_units_in_display_tick
+			r.Read(32)        // time_scale
+			if r.ReadFlag() { // equal_picture_interval
+				readUVLC(r)
+			}
+
+			if decoderModelInfoPresent = r.ReadFlag(); decoderModelInfoPresent {
+				bufferDelayLength = int(r.Read(5)) + 1
+				r.Read(32) // num_units_in_decoding_tick
+				r.Read(5)  // buffer_removal_time_length_minus_1
+				r.Read(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+
+		initialDisplayDelayPresent := r.ReadFlag()
+		operatingPoints := int(r.Read(5)) + 1
+		for i := range operatingPoints {
+			r.Read(12) // operating_point_idc
+			seqLevelIdx := byte(r.Read(5))
+			seqTier := byte(0)
+			if seqLevelIdx > 7 {
+				seqTier = byte(r.Read(1))
+			}
+			if i == 0 {
+				s.Config.SeqLevelIdx0, s.Config.SeqTier0 = seqLevelIdx, seqTier
+			}
+
+			if decoderModelInfoPresent && r.ReadFlag() {
+				r.Read(bufferDelayLength) // decoder_buffer_delay
+				r.Read(bufferDelayLength) // encoder_buffer_delay
+				r.Read(1)                 // low_delay_mode_flag
+			}
+
+			if initialDisplayDelayPresent && r.ReadFlag() {
+				r.Read(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+
+	frameWidthBits := int(r.Read(4)) + 1
+	frameHeightBits := int(r.Read(4)) + 1
+	s.Width = int(r.Read(frameWidthBits)) + 1
+	s.Height = int(r.Read(frameHeightBits)) + 1
+
+	if !reducedStillPictureHeader && r.ReadFlag() { // frame_id_numbers_present_flag
+		r.Read(4) // delta_frame_id_length_minus_2
+		r.Read(3) // additional_frame_id_length_minus_1
+	}
+
+	r.Read(1) // use_128x128_superblock
+	r.Read(1) // enable_filter_intra
+	r.Read(1) // enable_intra_edge_filter
+	if !reducedStillPictureHeader {
+		r.Read(1) // enable_interintra_compound
+		r.Read(1) // enable_masked_compound
+		r.Read(1) // enable_warped_motion
+		r.Read(1) // enable_dual_filter
+		enableOrderHint := r.ReadFlag()
+		if enableOrderHint {
+			r.Read(1) // enable_jnt_comp
+			r.Read(1) // enable_ref_frame_mvs
+		}
+
+		forceScreenContentTools := 2
+		if !r.ReadFlag() { // seq_choose_screen_content_tools
+			forceScreenContentTools = int(r.Read(1))
+		}
+		if forceScreenContentTools > 0 && !r.ReadFlag() { // seq_choose_integer_mv
+			r.Read(1) // seq_force_integer_mv
+		}
+
+		if enableOrderHint {
+			r.Read(3) // order_hint_bits_minus_1
+		}
+	}
+
+	r.Read(1) // enable_superres
+	r.Read(1) // enable_cdef
+	r.Read(1) // enable_restoration
+	parseAV1ColorConfig(r, &s.Config)
+
+	if err = r.AccError(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func parseAV1ColorConfig(r *bits.Reader, config *av1.CodecConfRec) {
+	const (
+		colorPrimariesBT709         = 1
+		transferCharacteristicsSRGB = 13
+		matrixCoefficientsIdentity  = 0
+		colorDescriptionUnspecified = 2
+		seqProfileProfessional      = 2
+		seqProfileHigh              = 1
+		chromaSamplePositionUnknown = 0
+	)
+
+	config.HighBitdepth = byte(r.Read(1))
+	if config.SeqProfile == seqProfileProfessional && config.HighBitdepth == 1 {
+		config.TwelveBit = byte(r.Read(1))
+	}
+	if config.SeqProfile != seqProfileHigh {
+		config.MonoChrome = byte(r.Read(1))
+	}
+
+	colorPrimaries, transferCharacteristics, matrixCoefficients := uint(colorDescriptionUnspecified), uint(colorDescriptionUnspecified), uint(colorDescriptionUnspecified)
+	if r.ReadFlag() { // color_description_present_flag
+		colorPrimaries, transferCharacteristics, matrixCoefficients = r.Read(8), r.Read(8), r.Read(8)
+	}
+
+	switch {
+	case config.MonoChrome == 1:
+		r.Read(1) // color_range
+		config.ChromaSubsamplingX, config.ChromaSubsamplingY = 1, 1
+		config.ChromaSamplePosition = chromaSamplePositionUnknown
+		return
+	case colorPrimaries == colorPrimariesBT709 && transferCharacteristics == transferCharacteristicsSRGB && matrixCoefficients == matrixCoefficientsIdentity:
+		return
+	}
+
+	r.Read(1) // color_range
+	switch {
+	case config.SeqProfile == 0:
+		config.ChromaSubsamplingX, config.ChromaSubsamplingY = 1, 1
+	case config.SeqProfile == seqProfileHigh:
+	case config.TwelveBit == 1:
+		config.ChromaSubsamplingX = byte(r.Read(1))
+		if config.ChromaSubsamplingX == 1 {
+			config.ChromaSubsamplingY = byte(r.Read(1))
+		}
+	default:
+		config.ChromaSubsamplingX = 1
+	}
+
+	if config.ChromaSubsamplingX == 1 && config.ChromaSubsamplingY == 1 {
+		config.ChromaSamplePosition = byte(r.Read(2))
+	}
+}
+
+// readUVLC reads a variable length unsigned number, see section 4.10.3 of the
+// AV1 specification.
+func readUVLC(r *bits.Reader) uint {
+	leadingZeros := 0
+	for !r.ReadFlag() {
+		if r.AccError() != nil {
+			return 0
+		}
+		leadingZeros++
+	}
+
+	if leadingZeros >= 32 {
+		return 1<<32 - 1
+	}
+
+	return r.Read(leadingZeros) + 1<<leadingZeros - 1
+}
+
+// CodecPrivate returns the av1C record that describes AV1 tracks.
+func (s *AV1SequenceHeader) CodecPrivate() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := s.Config.Encode(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// codecString returns the codecs parameter of AV1, see section 5 of the AV1
+// codec ISO media file format binding.
+func (s *AV1SequenceHeader) codecString() string {
+	tier := "M"
+	if s.Config.SeqTier0 == 1 {
+		tier = "H"
+	}
+
+	bitDepth := 8
+	switch {
+	case s.Config.TwelveBit == 1:
+		bitDepth = 12
+	case s.Config.HighBitdepth == 1:
+		bitDepth = 10
+	}
+
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", s.Config.SeqProfile, s.Config.SeqLevelIdx0, tier, bitDepth)
+}
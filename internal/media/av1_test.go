@@ -0,0 +1,24 @@
+package media
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseAV1SequenceHeader(t *testing.T) {
+	// Temporal unit with a sequence header for 1920x1080 main profile 4:2:0
+	data, _ := hex.DecodeString("0a0b00000042abbfc373ffe601")
+	s, err := ParseAV1SequenceHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Width != 1920 || s.Height != 1080 {
+		t.Errorf("wrong size %dx%d", s.Width, s.Height)
+	}
+
+	if s.Config.SeqProfile != 0 || s.Config.ChromaSubsamplingX != 1 || s.Config.ChromaSubsamplingY != 1 || !bytes.Equal(s.Config.ConfigOBUs, data) {
+		t.Errorf("wrong configuration %+v", s.Config)
+	}
+}
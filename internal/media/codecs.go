@@ -0,0 +1,310 @@
+// Package media depacketizes the codecs broadcasts are sent with and writes
+// them to containers.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/bits"
+	"github.com/Eyevinn/mp4ff/hevc"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/av1/obu"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	h265NALUTypeAggregationPacket    = 48
+	h265NALUTypeFragmentationUnit    = 49
+	h265FragmentationUnitStartBit    = 0x80
+	h265FragmentationUnitTypeBitmask = 0x3F
+)
+
+const (
+	AudioClockRate = 48000
+	VideoClockRate = 90000
+
+	// Opus is always described as stereo, see RFC 7587
+	OpusChannels = 2
+)
+
+var (
+	ErrUnsupportedCodec   = errors.New("codec is not supported")
+	ErrNoParameterSets    = errors.New("no parameter sets before the key frame")
+	ErrInvalidVideoHeader = errors.New("invalid video frame header")
+
+	annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+)
+
+type (
+	// VideoConfig describes a video track of a container, it comes from the
+	// key frame the track starts with.
+	VideoConfig struct {
+		MimeType      string
+		Width, Height int
+		// Parameter sets of H.264 and H.265
+		VPS, SPS, PPS [][]byte
+		AV1           *AV1SequenceHeader
+	}
+
+	// h265Depacketizer turns H.265 RTP payloads into Annex B, see RFC 7798.
+	// Fragmentation units are passed on as they come, the sample builder puts
+	// them back together.
+	h265Depacketizer struct{}
+)
+
+// IsMimeType reports if mimeType is want, which RTP doesn't treat case
+// sensitively.
+func IsMimeType(mimeType, want string) bool {
+	return strings.EqualFold(mimeType, want)
+}
+
+// NewVideoDepacketizer returns the depacketizer that turns RTP payloads of
+// mimeType into what containers store, or nil if mimeType isn't supported.
+func NewVideoDepacketizer(mimeType string) rtp.Depacketizer {
+	switch {
+	case IsMimeType(mimeType, webrtc.MimeTypeH264):
+		return &codecs.H264Packet{}
+	case IsMimeType(mimeType, webrtc.MimeTypeH265):
+		return &h265Depacketizer{}
+	case IsMimeType(mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}
+	case IsMimeType(mimeType, webrtc.MimeTypeVP9):
+		return &codecs.VP9Packet{}
+	case IsMimeType(mimeType, webrtc.MimeTypeAV1):
+		return &codecs.AV1Depacketizer{}
+	}
+
+	return nil
+}
+
+func (h *h265Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if len(payload) < 3 {
+		return nil, ErrInvalidVideoHeader
+	}
+
+	switch (payload[0] >> 1) & 0x3F {
+	case h265NALUTypeAggregationPacket:
+		out := []byte{}
+		for offset := 2; offset+2 <= len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset+size > len(payload) {
+				return nil, ErrInvalidVideoHeader
+			}
+
+			out = append(append(out, annexBStartCode...), payload[offset:offset+size]...)
+			offset += size
+		}
+		return out, nil
+	case h265NALUTypeFragmentationUnit:
+		if payload[2]&h265FragmentationUnitStartBit == 0 {
+			return payload[3:], nil
+		}
+
+		header := []byte{payload[0]&0x81 | (payload[2]&h265FragmentationUnitTypeBitmask)<<1, payload[1]}
+		return append(append(append([]byte{}, annexBStartCode...), header...), payload[3:]...), nil
+	}
+
+	return append(append([]byte{}, annexBStartCode...), payload...), nil
+}
+
+func (h *h265Depacketizer) IsPartitionHead(payload []byte) bool {
+	if len(payload) < 3 || (payload[0]>>1)&0x3F != h265NALUTypeFragmentationUnit {
+		return true
+	}
+
+	return payload[2]&h265FragmentationUnitStartBit != 0
+}
+
+func (h *h265Depacketizer) IsPartitionTail(marker bool, _ []byte) bool {
+	return marker
+}
+
+// IsKeyframe reports if a depacketized frame can be decoded on its own.
+func IsKeyframe(mimeType string, data []byte) bool {
+	switch {
+	case IsMimeType(mimeType, webrtc.MimeTypeH264):
+		return avc.IsIDRSample(avc.ConvertByteStreamToNaluSample(bytes.Clone(data)))
+	case IsMimeType(mimeType, webrtc.MimeTypeH265):
+		return hevc.IsRAPSample(avc.ConvertByteStreamToNaluSample(bytes.Clone(data)))
+	case IsMimeType(mimeType, webrtc.MimeTypeVP8):
+		return len(data) > 0 && data[0]&0x01 == 0
+	case IsMimeType(mimeType, webrtc.MimeTypeVP9):
+		keyframe, _, _, err := parseVP9Header(data)
+		return err == nil && keyframe
+	case IsMimeType(mimeType, webrtc.MimeTypeAV1):
+		sequenceHeader := false
+		av1OBUs(data, func(t obu.Type, _ []byte) {
+			sequenceHeader = sequenceHeader || t == obu.OBUSequenceHeader
+		})
+		return sequenceHeader
+	}
+
+	return false
+}
+
+// ParseVideoConfig reads the configuration of a video track from a key frame.
+// H.264 and H.265 parameter sets may have come in frames before, last is the
+// configuration of the track before if there was one.
+func ParseVideoConfig(mimeType string, keyframe []byte, last *VideoConfig) (*VideoConfig, error) {
+	config := &VideoConfig{MimeType: mimeType}
+
+	switch {
+	case IsMimeType(mimeType, webrtc.MimeTypeH264):
+		config.SPS, config.PPS = avc.GetParameterSets(avc.ConvertByteStreamToNaluSample(bytes.Clone(keyframe)))
+		if len(config.SPS) == 0 || len(config.PPS) == 0 {
+			if last == nil {
+				return nil, ErrNoParameterSets
+			}
+			config.SPS, config.PPS = last.SPS, last.PPS
+		}
+
+		sps, err := avc.ParseSPSNALUnit(config.SPS[0], false)
+		if err != nil {
+			return nil, err
+		}
+		config.Width, config.Height = int(sps.Width), int(sps.Height)
+	case IsMimeType(mimeType, webrtc.MimeTypeH265):
+		config.VPS, config.SPS, config.PPS = hevc.GetParameterSets(avc.ConvertByteStreamToNaluSample(bytes.Clone(keyframe)))
+		if len(config.VPS) == 0 || len(config.SPS) == 0 || len(config.PPS) == 0 {
+			if last == nil {
+				return nil, ErrNoParameterSets
+			}
+			config.VPS, config.SPS, config.PPS = last.VPS, last.SPS, last.PPS
+		}
+
+		sps, err := hevc.ParseSPSNALUnit(config.SPS[0])
+		if err != nil {
+			return nil, err
+		}
+		width, height := sps.ImageSize()
+		config.Width, config.Height = int(width), int(height)
+	case IsMimeType(mimeType, webrtc.MimeTypeVP8):
+		// Frame tag, start code, then the 14 bit width and height
+		if len(keyframe) < 10 || keyframe[3] != 0x9D || keyframe[4] != 0x01 || keyframe[5] != 0x2A {
+			return nil, ErrInvalidVideoHeader
+		}
+		config.Width = int(keyframe[6]) | int(keyframe[7]&0x3F)<<8
+		config.Height = int(keyframe[8]) | int(keyframe[9]&0x3F)<<8
+	case IsMimeType(mimeType, webrtc.MimeTypeVP9):
+		_, width, height, err := parseVP9Header(keyframe)
+		if err != nil {
+			return nil, err
+		}
+		config.Width, config.Height = width, height
+	case IsMimeType(mimeType, webrtc.MimeTypeAV1):
+		sequenceHeader, err := ParseAV1SequenceHeader(keyframe)
+		if err != nil {
+			return nil, err
+		}
+		config.AV1 = sequenceHeader
+		config.Width, config.Height = sequenceHeader.Width, sequenceHeader.Height
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+
+	// Parameter sets point into the frame, which the container may change
+	for _, sets := range []*[][]byte{&config.VPS, &config.SPS, &config.PPS} {
+		for i := range *sets {
+			(*sets)[i] = bytes.Clone((*sets)[i])
+		}
+	}
+
+	return config, nil
+}
+
+// Equal reports if frames of both configurations can be written to the same
+// track.
+func (c *VideoConfig) Equal(o *VideoConfig) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+
+	if !IsMimeType(c.MimeType, o.MimeType) || c.Width != o.Width || c.Height != o.Height || (c.AV1 == nil) != (o.AV1 == nil) {
+		return false
+	} else if c.AV1 != nil && !bytes.Equal(c.AV1.Config.ConfigOBUs, o.AV1.Config.ConfigOBUs) {
+		return false
+	}
+
+	return slices.EqualFunc(c.VPS, o.VPS, bytes.Equal) && slices.EqualFunc(c.SPS, o.SPS, bytes.Equal) && slices.EqualFunc(c.PPS, o.PPS, bytes.Equal)
+}
+
+// CodecString returns the codec as the CODECS attribute of HLS and the codecs
+// parameter of MIME types describe it, see RFC 6381. It is empty for codecs
+// that can't be written to MP4.
+func (c *VideoConfig) CodecString() string {
+	switch {
+	case IsMimeType(c.MimeType, webrtc.MimeTypeH264):
+		if sps, err := avc.ParseSPSNALUnit(c.SPS[0], false); err == nil {
+			return avc.CodecString("avc1", sps)
+		}
+		return "avc1"
+	case IsMimeType(c.MimeType, webrtc.MimeTypeH265):
+		if sps, err := hevc.ParseSPSNALUnit(c.SPS[0]); err == nil {
+			return hevc.CodecString("hvc1", sps)
+		}
+		return "hvc1"
+	case IsMimeType(c.MimeType, webrtc.MimeTypeAV1):
+		return c.AV1.codecString()
+	}
+
+	return ""
+}
+
+// parseVP9Header parses the uncompressed header of a VP9 frame, the size is
+// only known for key frames. See section 6.2 of the VP9 bitstream
+// specification.
+func parseVP9Header(data []byte) (keyframe bool, width, height int, err error) {
+	const (
+		frameMarker   = 2
+		syncCode      = 0x498342
+		colorSpaceRGB = 7
+	)
+
+	r := bits.NewReader(bytes.NewReader(data))
+	if r.Read(2) != frameMarker {
+		return false, 0, 0, ErrInvalidVideoHeader
+	}
+
+	profile := r.Read(1)
+	profile |= r.Read(1) << 1
+	if profile == 3 {
+		r.Read(1) // reserved_zero
+	}
+
+	if r.ReadFlag() { // show_existing_frame
+		return false, 0, 0, r.AccError()
+	}
+
+	if r.ReadFlag() { // frame_type is non key frame
+		return false, 0, 0, r.AccError()
+	}
+
+	r.Read(1) // show_frame
+	r.Read(1) // error_resilient_mode
+	if r.Read(24) != syncCode {
+		return false, 0, 0, ErrInvalidVideoHeader
+	}
+
+	if profile >= 2 {
+		r.Read(1) // ten_or_twelve_bit
+	}
+	if r.Read(3) != colorSpaceRGB {
+		r.Read(1) // color_range
+		if profile == 1 || profile == 3 {
+			r.Read(3) // subsampling_x, subsampling_y and reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.Read(1) // reserved_zero
+	}
+
+	width = int(r.Read(16)) + 1
+	height = int(r.Read(16)) + 1
+
+	return true, width, height, r.AccError()
+}
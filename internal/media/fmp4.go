@@ -0,0 +1,182 @@
+package media
+
+import (
+	"io"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	FMP4VideoTrackID = 1
+	FMP4AudioTrackID = 2
+
+	// Durations of the last samples of a track, nothing comes after them that
+	// tells how long they are
+	defaultVideoSampleDuration = VideoClockRate / 30
+	defaultAudioSampleDuration = AudioClockRate / 50
+)
+
+type (
+	// FMP4Muxer puts Opus audio with H.264, H.265 or AV1 video into fragments
+	// of a fragmented MP4. Samples are written once the sample after them tells
+	// how long they are.
+	FMP4Muxer struct {
+		Init           *mp4.InitSegment
+		annexB         bool
+		sequenceNumber uint32
+		video, audio   fmp4Track
+	}
+
+	fmp4Track struct {
+		trackID   uint32
+		clockRate uint32
+		// Written once the next sample tells its duration
+		pending *mp4.FullSample
+		// Samples of the next fragment
+		samples         []mp4.FullSample
+		defaultDuration uint32
+	}
+)
+
+// FMP4Supported reports if video of mimeType can be written to fragmented MP4.
+func FMP4Supported(mimeType string) bool {
+	return IsMimeType(mimeType, webrtc.MimeTypeH264) || IsMimeType(mimeType, webrtc.MimeTypeH265) || IsMimeType(mimeType, webrtc.MimeTypeAV1)
+}
+
+// NewFMP4Muxer returns a muxer with the video track of config and an Opus
+// track, its Init segment describes them.
+func NewFMP4Muxer(config *VideoConfig) (*FMP4Muxer, error) {
+	init := mp4.CreateEmptyInit()
+	init.AddEmptyTrack(VideoClockRate, "video", "und")
+	init.AddEmptyTrack(AudioClockRate, "audio", "und")
+	videoTrak, audioTrak := init.Moov.Traks[0], init.Moov.Traks[1]
+
+	m := &FMP4Muxer{
+		Init:  init,
+		video: fmp4Track{trackID: FMP4VideoTrackID, clockRate: VideoClockRate, defaultDuration: defaultVideoSampleDuration},
+		audio: fmp4Track{trackID: FMP4AudioTrackID, clockRate: AudioClockRate, defaultDuration: defaultAudioSampleDuration},
+	}
+
+	switch {
+	case IsMimeType(config.MimeType, webrtc.MimeTypeH264):
+		if err := videoTrak.SetAVCDescriptor("avc1", config.SPS, config.PPS, true); err != nil {
+			return nil, err
+		}
+		m.annexB = true
+	case IsMimeType(config.MimeType, webrtc.MimeTypeH265):
+		if err := videoTrak.SetHEVCDescriptor("hvc1", config.VPS, config.SPS, config.PPS, nil, true); err != nil {
+			return nil, err
+		}
+		m.annexB = true
+	case IsMimeType(config.MimeType, webrtc.MimeTypeAV1):
+		videoTrak.Tkhd.Width = mp4.Fixed32(config.Width << 16)
+		videoTrak.Tkhd.Height = mp4.Fixed32(config.Height << 16)
+		videoTrak.Mdia.Minf.Stbl.Stsd.AddChild(mp4.CreateVisualSampleEntryBox("av01", uint16(config.Width), uint16(config.Height), &mp4.Av1CBox{CodecConfRec: config.AV1.Config}))
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+
+	audioTrak.Mdia.Minf.Stbl.Stsd.AddChild(mp4.CreateAudioSampleEntryBox("Opus", OpusChannels, 16, AudioClockRate, &mp4.DopsBox{
+		OutputChannelCount: OpusChannels,
+		InputSampleRate:    AudioClockRate,
+	}))
+
+	return m, nil
+}
+
+// AddVideo queues a frame played at pts. The muxer keeps data.
+func (m *FMP4Muxer) AddVideo(data []byte, keyframe bool, pts time.Duration) {
+	if m.annexB {
+		data = avc.ConvertByteStreamToNaluSample(data)
+	}
+
+	flags := mp4.NonSyncSampleFlags
+	if keyframe {
+		flags = mp4.SyncSampleFlags
+	}
+
+	m.video.add(data, flags, pts)
+}
+
+// AddAudio queues an Opus packet played at pts. The muxer keeps data.
+func (m *FMP4Muxer) AddAudio(data []byte, pts time.Duration) {
+	m.audio.add(data, mp4.SyncSampleFlags, pts)
+}
+
+// Flush completes the last samples of both tracks, so the next fragment ends
+// the file.
+func (m *FMP4Muxer) Flush() {
+	m.video.flushPending()
+	m.audio.flushPending()
+}
+
+// WriteFragment writes the completed samples of both tracks to w as one
+// fragment, if there are any.
+func (m *FMP4Muxer) WriteFragment(w io.Writer) error {
+	trackIDs := []uint32{}
+	for _, t := range []*fmp4Track{&m.video, &m.audio} {
+		if len(t.samples) > 0 {
+			trackIDs = append(trackIDs, t.trackID)
+		}
+	}
+	if len(trackIDs) == 0 {
+		return nil
+	}
+
+	m.sequenceNumber++
+	fragment, err := mp4.CreateMultiTrackFragment(m.sequenceNumber, trackIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range []*fmp4Track{&m.video, &m.audio} {
+		for _, sample := range t.samples {
+			if err = fragment.AddFullSampleToTrack(sample, t.trackID); err != nil {
+				return err
+			}
+		}
+		t.samples = nil
+	}
+
+	return fragment.Encode(w)
+}
+
+// add queues a sample, which makes the one before it complete.
+func (t *fmp4Track) add(data []byte, flags uint32, pts time.Duration) {
+	decodeTime := uint64(pts * time.Duration(t.clockRate) / time.Second)
+
+	if t.pending != nil {
+		duration := uint32(1)
+		if decodeTime > t.pending.DecodeTime {
+			duration = uint32(decodeTime - t.pending.DecodeTime)
+		}
+		t.pending.Dur = duration
+		t.samples = append(t.samples, *t.pending)
+		// Keep decode times increasing even if the sample came too early
+		decodeTime = max(decodeTime, t.pending.DecodeTime+uint64(duration))
+	}
+
+	t.pending = &mp4.FullSample{
+		Sample:     mp4.Sample{Flags: flags, Size: uint32(len(data))},
+		DecodeTime: decodeTime,
+		Data:       data,
+	}
+}
+
+// flushPending completes the last sample of the track with the duration of
+// the one before it.
+func (t *fmp4Track) flushPending() {
+	if t.pending == nil {
+		return
+	}
+
+	t.pending.Dur = t.defaultDuration
+	if len(t.samples) > 0 {
+		t.pending.Dur = t.samples[len(t.samples)-1].Dur
+	}
+	t.samples = append(t.samples, *t.pending)
+	t.pending = nil
+}
@@ -0,0 +1,80 @@
+package media
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+const (
+	// How many packets tracks keep while waiting for missing ones
+	maxLateAudioPackets = 50
+	maxLateVideoPackets = 500
+	// How long frames wait for missing packets before they are dropped
+	maxFrameDelay = 500 * time.Millisecond
+)
+
+type (
+	// Track puts the RTP packets of a track back together into frames and
+	// times them. Tracks of a broadcast are timed by when their first packet
+	// came, then by their RTP timestamps.
+	Track struct {
+		builder   *samplebuilder.SampleBuilder
+		clockRate uint32
+		// When the first packet came since the start of the broadcast
+		offset time.Duration
+		// RTP time since the first packet
+		elapsed       int64
+		lastTimestamp uint32
+	}
+
+	Frame struct {
+		Data []byte
+		// When the frame is played since the start of the broadcast
+		PTS time.Duration
+	}
+)
+
+// NewAudioTrack returns an Opus track whose first packet came offset after the
+// start of the broadcast with timestamp.
+func NewAudioTrack(offset time.Duration, timestamp uint32) *Track {
+	return newTrack(&codecs.OpusPacket{}, AudioClockRate, maxLateAudioPackets, offset, timestamp)
+}
+
+// NewVideoTrack returns a video track like NewAudioTrack, with a depacketizer
+// from NewVideoDepacketizer.
+func NewVideoTrack(depacketizer rtp.Depacketizer, offset time.Duration, timestamp uint32) *Track {
+	return newTrack(depacketizer, VideoClockRate, maxLateVideoPackets, offset, timestamp)
+}
+
+func newTrack(depacketizer rtp.Depacketizer, clockRate uint32, maxLate uint16, offset time.Duration, timestamp uint32) *Track {
+	return &Track{
+		builder:       samplebuilder.New(maxLate, depacketizer, clockRate, samplebuilder.WithMaxTimeDelay(maxFrameDelay)),
+		clockRate:     clockRate,
+		offset:        offset,
+		lastTimestamp: timestamp,
+	}
+}
+
+// Push adds a packet, frames it completes are returned by Pop.
+func (t *Track) Push(pkt *rtp.Packet) {
+	t.builder.Push(pkt.Clone())
+}
+
+// Pop returns the next complete frame, or nil if there is none yet.
+func (t *Track) Pop() *Frame {
+	sample := t.builder.Pop()
+	if sample == nil {
+		return nil
+	}
+
+	t.elapsed += int64(int32(sample.PacketTimestamp - t.lastTimestamp))
+	t.lastTimestamp = sample.PacketTimestamp
+
+	return &Frame{
+		Data: sample.Data,
+		PTS:  t.offset + time.Duration(t.elapsed)*time.Second/time.Duration(t.clockRate),
+	}
+}
@@ -0,0 +1,333 @@
+// Package metrics exports the metrics of the server and its streams for
+// Prometheus.
+package metrics
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "broadcastbox"
+
+	// LabelStream is the stream key of per-stream metrics
+	LabelStream = "stream"
+	// LabelLayer is the RID of the video layer of per-layer metrics
+	LabelLayer = "layer"
+)
+
+type (
+	// Collector collects the metrics of webrtc streams when it is scraped.
+	// Metrics of streams or layers are summed up when their label is left out,
+	// key frame intervals take the longest one. Counters then also keep what
+	// streams and layers that ended counted.
+	Collector struct {
+		streamLabel, layerLabel bool
+
+		publishers    *prometheus.Desc
+		viewers       *prometheus.Desc
+		audio         sampleDescs
+		video         sampleDescs
+		packetsLost   *prometheus.Desc
+		keyframe      *prometheus.Desc
+		plisSent      *prometheus.Desc
+		plisReceived  *prometheus.Desc
+		nacksSent     *prometheus.Desc
+		nacksReceived *prometheus.Desc
+		iceFailures   *prometheus.Desc
+		dtlsFailures  *prometheus.Desc
+
+		requestDuration *prometheus.HistogramVec
+	}
+
+	// sampleDescs describe the traffic of the audio or video of streams.
+	sampleDescs struct {
+		packetsReceived, bytesReceived, packetsSent, bytesSent, bitrate *prometheus.Desc
+	}
+
+	// samples collects a metric, samples with the same labels are summed up or
+	// take the highest value.
+	samples struct {
+		desc      *prometheus.Desc
+		valueType prometheus.ValueType
+		max       bool
+		values    map[string]*sample
+	}
+
+	sample struct {
+		labels []string
+		value  float64
+	}
+
+	// statusRecorder keeps the status code a handler responded with.
+	statusRecorder struct {
+		http.ResponseWriter
+		status      int
+		wroteHeader bool
+	}
+)
+
+// New returns a collector whose metrics leave out the labels in
+// disabledLabels, LabelStream or LabelLayer, to keep their cardinality low.
+func New(disabledLabels []string) *Collector {
+	c := &Collector{
+		streamLabel: !slices.Contains(disabledLabels, LabelStream),
+		layerLabel:  !slices.Contains(disabledLabels, LabelLayer),
+	}
+
+	streamLabels, layerLabels := c.labelNames()
+	c.publishers = prometheus.NewDesc(namespace+"_publishers", "Streams with a publisher.", nil, nil)
+	c.viewers = prometheus.NewDesc(namespace+"_viewers", "WHEP sessions watching streams.", streamLabels, nil)
+	c.audio = newSampleDescs("audio", "audio", streamLabels)
+	c.video = newSampleDescs("video", "video layers", layerLabels)
+	c.packetsLost = prometheus.NewDesc(namespace+"_video_packets_lost_total", "Video packets of publishers that never came.", layerLabels, nil)
+	c.keyframe = prometheus.NewDesc(namespace+"_video_keyframe_interval_seconds", "Time between the last two key frames of video layers.", layerLabels, nil)
+	c.plisSent = prometheus.NewDesc(namespace+"_plis_sent_total", "PLIs sent to publishers.", streamLabels, nil)
+	c.plisReceived = prometheus.NewDesc(namespace+"_plis_received_total", "PLIs received from WHEP sessions.", streamLabels, nil)
+	c.nacksSent = prometheus.NewDesc(namespace+"_nacks_sent_total", "NACKs sent to publishers.", nil, nil)
+	c.nacksReceived = prometheus.NewDesc(namespace+"_nacks_received_total", "NACKs received from WHEP sessions.", streamLabels, nil)
+	c.iceFailures = prometheus.NewDesc(namespace+"_ice_failures_total", "WHIP and WHEP sessions whose ICE connection failed.", []string{"session"}, nil)
+	c.dtlsFailures = prometheus.NewDesc(namespace+"_dtls_failures_total", "WHIP and WHEP sessions whose DTLS connection failed.", []string{"session"}, nil)
+	c.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of WHIP and WHEP requests by status code.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"endpoint", "method", "code"})
+
+	return c
+}
+
+func newSampleDescs(kind, help string, labels []string) sampleDescs {
+	return sampleDescs{
+		packetsReceived: prometheus.NewDesc(namespace+"_"+kind+"_packets_received_total", "RTP packets of "+help+" received from publishers.", labels, nil),
+		bytesReceived:   prometheus.NewDesc(namespace+"_"+kind+"_bytes_received_total", "Bytes of RTP packets of "+help+" received from publishers.", labels, nil),
+		packetsSent:     prometheus.NewDesc(namespace+"_"+kind+"_packets_sent_total", "RTP packets of "+help+" sent to WHEP sessions.", labels, nil),
+		bytesSent:       prometheus.NewDesc(namespace+"_"+kind+"_bytes_sent_total", "Bytes of RTP packets of "+help+" sent to WHEP sessions.", labels, nil),
+		bitrate:         prometheus.NewDesc(namespace+"_"+kind+"_received_bits_per_second", "Bitrate of "+help+" received from publishers.", labels, nil),
+	}
+}
+
+// labelNames returns the labels of per-stream and per-layer metrics.
+func (c *Collector) labelNames() (streamLabels, layerLabels []string) {
+	if c.streamLabel {
+		streamLabels = append(streamLabels, LabelStream)
+	}
+
+	layerLabels = slices.Clone(streamLabels)
+	if c.layerLabel {
+		layerLabels = append(layerLabels, LabelLayer)
+	}
+
+	return streamLabels, layerLabels
+}
+
+// labels returns the label values of a stream, and of one of its layers if
+// rid isn't empty.
+func (c *Collector) labels(streamKey, rid string) []string {
+	labels := []string{}
+	if c.streamLabel {
+		labels = append(labels, streamKey)
+	}
+
+	if rid != "" && c.layerLabel {
+		labels = append(labels, rid)
+	}
+
+	return labels
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.publishers, c.viewers, c.packetsLost, c.keyframe, c.plisSent, c.plisReceived, c.nacksSent, c.nacksReceived, c.iceFailures, c.dtlsFailures,
+		c.audio.packetsReceived, c.audio.bytesReceived, c.audio.packetsSent, c.audio.bytesSent, c.audio.bitrate,
+		c.video.packetsReceived, c.video.bytesReceived, c.video.packetsSent, c.video.bytesSent, c.video.bitrate,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	metrics := webrtc.GetMetrics()
+
+	publishers := 0
+	counter := func(desc *prometheus.Desc) *samples { return newSamples(desc, prometheus.CounterValue, false) }
+	gauge := func(desc *prometheus.Desc) *samples { return newSamples(desc, prometheus.GaugeValue, false) }
+
+	viewers, plisSent, plisReceived, nacksReceived := gauge(c.viewers), counter(c.plisSent), counter(c.plisReceived), counter(c.nacksReceived)
+	audioPacketsReceived, audioBytesReceived := counter(c.audio.packetsReceived), counter(c.audio.bytesReceived)
+	audioPacketsSent, audioBytesSent, audioBitrate := counter(c.audio.packetsSent), counter(c.audio.bytesSent), gauge(c.audio.bitrate)
+	videoPacketsReceived, videoBytesReceived := counter(c.video.packetsReceived), counter(c.video.bytesReceived)
+	videoPacketsSent, videoBytesSent, videoBitrate := counter(c.video.packetsSent), counter(c.video.bytesSent), gauge(c.video.bitrate)
+	packetsLost, keyframeInterval := counter(c.packetsLost), newSamples(c.keyframe, prometheus.GaugeValue, true)
+
+	streamSamples := []*samples{
+		viewers, plisSent, plisReceived, nacksReceived,
+		audioPacketsReceived, audioBytesReceived, audioPacketsSent, audioBytesSent, audioBitrate,
+	}
+	layerSamples := []*samples{
+		videoPacketsReceived, videoBytesReceived, videoPacketsSent, videoBytesSent, videoBitrate,
+		packetsLost, keyframeInterval,
+	}
+
+	// Gauges are 0 rather than missing while nothing is live
+	if !c.streamLabel {
+		for _, s := range streamSamples {
+			s.add(0, []string{})
+		}
+	}
+	if !c.streamLabel && !c.layerLabel {
+		for _, s := range layerSamples {
+			s.add(0, []string{})
+		}
+	}
+
+	addStreamTraffic := func(traffic webrtc.TrafficMetrics, labels []string) {
+		plisSent.add(float64(traffic.PLIsSent), labels)
+		plisReceived.add(float64(traffic.PLIsReceived), labels)
+		nacksReceived.add(float64(traffic.NACKsReceived), labels)
+		audioPacketsReceived.add(float64(traffic.AudioPacketsReceived), labels)
+		audioBytesReceived.add(float64(traffic.AudioBytesReceived), labels)
+		audioPacketsSent.add(float64(traffic.AudioPacketsSent), labels)
+		audioBytesSent.add(float64(traffic.AudioBytesSent), labels)
+	}
+	addVideoTraffic := func(traffic webrtc.TrafficMetrics, labels []string) {
+		videoPacketsReceived.add(float64(traffic.VideoPacketsReceived), labels)
+		videoBytesReceived.add(float64(traffic.VideoBytesReceived), labels)
+		videoPacketsSent.add(float64(traffic.VideoPacketsSent), labels)
+		videoBytesSent.add(float64(traffic.VideoBytesSent), labels)
+		packetsLost.add(float64(traffic.VideoPacketsLost), labels)
+	}
+
+	// Counters without the stream or layer label come from the totals of the
+	// server and of streams, which keep the traffic of streams and layers that
+	// ended. Sums of the live ones would go down, which Prometheus takes for a
+	// reset.
+	if !c.streamLabel {
+		addStreamTraffic(metrics.Totals, []string{})
+		if !c.layerLabel {
+			addVideoTraffic(metrics.Totals, []string{})
+		}
+	}
+	if !c.streamLabel && c.layerLabel {
+		for rid, traffic := range metrics.LayerTotals {
+			addVideoTraffic(traffic, c.labels("", rid))
+		}
+	}
+
+	for _, stream := range metrics.Streams {
+		if stream.Publishing {
+			publishers++
+		}
+
+		labels := c.labels(stream.StreamKey, "")
+		viewers.add(float64(stream.Viewers), labels)
+		audioBitrate.add(stream.AudioBitrate, labels)
+		if c.streamLabel {
+			addStreamTraffic(stream.TrafficMetrics, labels)
+			if !c.layerLabel {
+				addVideoTraffic(stream.TrafficMetrics, labels)
+			}
+		}
+
+		for _, layer := range stream.Layers {
+			labels := c.labels(stream.StreamKey, layer.RID)
+			videoBitrate.add(layer.Bitrate, labels)
+			keyframeInterval.add(layer.KeyframeInterval.Seconds(), labels)
+			if c.streamLabel && c.layerLabel {
+				addVideoTraffic(webrtc.TrafficMetrics{
+					VideoPacketsReceived: layer.PacketsReceived,
+					VideoBytesReceived:   layer.BytesReceived,
+					VideoPacketsSent:     layer.PacketsSent,
+					VideoBytesSent:       layer.BytesSent,
+					VideoPacketsLost:     layer.PacketsLost,
+				}, labels)
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.publishers, prometheus.GaugeValue, float64(publishers))
+	ch <- prometheus.MustNewConstMetric(c.nacksSent, prometheus.CounterValue, float64(metrics.NACKsSent))
+	ch <- prometheus.MustNewConstMetric(c.iceFailures, prometheus.CounterValue, float64(metrics.WHIPFailures.ICE), "whip")
+	ch <- prometheus.MustNewConstMetric(c.iceFailures, prometheus.CounterValue, float64(metrics.WHEPFailures.ICE), "whep")
+	ch <- prometheus.MustNewConstMetric(c.dtlsFailures, prometheus.CounterValue, float64(metrics.WHIPFailures.DTLS), "whip")
+	ch <- prometheus.MustNewConstMetric(c.dtlsFailures, prometheus.CounterValue, float64(metrics.WHEPFailures.DTLS), "whep")
+
+	for _, s := range append(streamSamples, layerSamples...) {
+		s.collect(ch)
+	}
+}
+
+func newSamples(desc *prometheus.Desc, valueType prometheus.ValueType, highest bool) *samples {
+	return &samples{desc: desc, valueType: valueType, max: highest, values: map[string]*sample{}}
+}
+
+func (s *samples) add(value float64, labels []string) {
+	key := strings.Join(labels, "\x00")
+	existing, ok := s.values[key]
+	switch {
+	case !ok:
+		s.values[key] = &sample{labels: labels, value: value}
+	case s.max:
+		existing.value = max(existing.value, value)
+	default:
+		existing.value += value
+	}
+}
+
+func (s *samples) collect(ch chan<- prometheus.Metric) {
+	for _, sample := range s.values {
+		ch <- prometheus.MustNewConstMetric(s.desc, s.valueType, sample.value, sample.labels...)
+	}
+}
+
+// Handler returns the handler that serves the metrics of c, of the requests
+// it instruments and of the Go runtime and the process.
+func (c *Collector) Handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		c,
+		c.requestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Instrument measures the latency and status codes of the requests next
+// handles as endpoint. Answers wait for ICE candidates, so latencies of
+// seconds are expected.
+func (c *Collector) Instrument(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, req)
+
+		c.requestDuration.WithLabelValues(endpoint, req.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status, s.wroteHeader = status, true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
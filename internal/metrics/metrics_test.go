@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/publisher"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func publish(t *testing.T, streamKey string, rids ...string) *webrtc.Publisher {
+	t.Helper()
+
+	p, err := webrtc.Publish(streamKey, publisher.PolicyTakeover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	for _, rid := range rids {
+		for sequenceNumber := range uint16(2) {
+			p.WriteVideo(rid, "video/VP8", &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: sequenceNumber}, Payload: []byte{0x10}})
+		}
+	}
+
+	return p
+}
+
+func TestCollector(t *testing.T) {
+	webrtc.Configure()
+	publish(t, "a", "high", "low")
+	b := publish(t, "b", "")
+
+	if err := testutil.CollectAndCompare(New(nil), strings.NewReader(`
+# HELP broadcastbox_publishers Streams with a publisher.
+# TYPE broadcastbox_publishers gauge
+broadcastbox_publishers 2
+# HELP broadcastbox_video_packets_received_total RTP packets of video layers received from publishers.
+# TYPE broadcastbox_video_packets_received_total counter
+broadcastbox_video_packets_received_total{layer="default",stream="b"} 2
+broadcastbox_video_packets_received_total{layer="high",stream="a"} 2
+broadcastbox_video_packets_received_total{layer="low",stream="a"} 2
+`), "broadcastbox_publishers", "broadcastbox_video_packets_received_total"); err != nil {
+		t.Error(err)
+	}
+
+	if err := testutil.CollectAndCompare(New([]string{LabelLayer}), strings.NewReader(`
+# HELP broadcastbox_video_packets_received_total RTP packets of video layers received from publishers.
+# TYPE broadcastbox_video_packets_received_total counter
+broadcastbox_video_packets_received_total{stream="a"} 4
+broadcastbox_video_packets_received_total{stream="b"} 2
+`), "broadcastbox_video_packets_received_total"); err != nil {
+		t.Error(err)
+	}
+
+	if err := testutil.CollectAndCompare(New([]string{LabelStream, LabelLayer}), strings.NewReader(`
+# HELP broadcastbox_viewers WHEP sessions watching streams.
+# TYPE broadcastbox_viewers gauge
+broadcastbox_viewers 0
+# HELP broadcastbox_video_packets_received_total RTP packets of video layers received from publishers.
+# TYPE broadcastbox_video_packets_received_total counter
+broadcastbox_video_packets_received_total 6
+`), "broadcastbox_viewers", "broadcastbox_video_packets_received_total"); err != nil {
+		t.Error(err)
+	}
+
+	// Totals keep counting what streams that ended received
+	b.Close()
+	if err := testutil.CollectAndCompare(New([]string{LabelStream}), strings.NewReader(`
+# HELP broadcastbox_publishers Streams with a publisher.
+# TYPE broadcastbox_publishers gauge
+broadcastbox_publishers 1
+# HELP broadcastbox_video_packets_received_total RTP packets of video layers received from publishers.
+# TYPE broadcastbox_video_packets_received_total counter
+broadcastbox_video_packets_received_total{layer="default"} 2
+broadcastbox_video_packets_received_total{layer="high"} 2
+broadcastbox_video_packets_received_total{layer="low"} 2
+`), "broadcastbox_publishers", "broadcastbox_video_packets_received_total"); err != nil {
+		t.Error(err)
+	}
+
+	if err := testutil.CollectAndCompare(New([]string{LabelStream, LabelLayer}), strings.NewReader(`
+# HELP broadcastbox_video_packets_received_total RTP packets of video layers received from publishers.
+# TYPE broadcastbox_video_packets_received_total counter
+broadcastbox_video_packets_received_total 6
+`), "broadcastbox_video_packets_received_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	c := New(nil)
+	handler := c.Instrument("whip", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/whip/user/", nil))
+
+	res := httptest.NewRecorder()
+	c.Handler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := res.Body.String(); !strings.Contains(body, `broadcastbox_http_request_duration_seconds_count{code="201",endpoint="whip",method="POST"} 1`) {
+		t.Errorf("request was not measured %s", body)
+	}
+}
@@ -0,0 +1,24 @@
+// Package publisher has the policies that decide what happens when a stream
+// that already has a publisher gets another one.
+package publisher
+
+const (
+	// A publisher is rejected while the stream has one
+	PolicyReject = "reject"
+	// A publisher replaces the one the stream had, which is disconnected
+	PolicyTakeover = "takeover"
+	// A publisher waits as the backup of the one the stream has and takes over
+	// when it disconnects or its connection fails. A newer backup replaces an
+	// older one.
+	PolicyStandby = "standby"
+)
+
+// ValidPolicy reports if policy is one of the Policy values.
+func ValidPolicy(policy string) bool {
+	switch policy {
+	case PolicyReject, PolicyTakeover, PolicyStandby:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package recording
+
+import (
+	"io"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/media"
+)
+
+// fmp4Container writes a fragmented MP4 file, Opus audio with H.264, H.265 or
+// AV1 video. Every fragment starts with a video key frame.
+type fmp4Container struct {
+	w     io.WriteCloser
+	muxer *media.FMP4Muxer
+}
+
+func newFMP4Container(w io.WriteCloser, config *media.VideoConfig) (*fmp4Container, error) {
+	muxer, err := media.NewFMP4Muxer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = muxer.Init.Encode(w); err != nil {
+		return nil, err
+	}
+
+	return &fmp4Container{w: w, muxer: muxer}, nil
+}
+
+func (c *fmp4Container) writeVideo(data []byte, keyframe bool, pts time.Duration) error {
+	c.muxer.AddVideo(data, keyframe, pts)
+	if !keyframe {
+		return nil
+	}
+
+	// The key frame is still pending, so it starts the next fragment
+	return c.muxer.WriteFragment(c.w)
+}
+
+func (c *fmp4Container) writeAudio(data []byte, pts time.Duration) error {
+	c.muxer.AddAudio(data, pts)
+	return nil
+}
+
+func (c *fmp4Container) Close() error {
+	c.muxer.Flush()
+
+	err := c.muxer.WriteFragment(c.w)
+	if closeErr := c.w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,327 @@
+// Package recording writes broadcasts to WebM and fragmented MP4 files.
+package recording
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/auth"
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/glimesh/broadcast-box/internal/media"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	FormatWebM = "webm"
+	FormatMP4  = "mp4"
+
+	// Files are named after when they were started
+	fileNameLayout = "2006-01-02T15-04-05.000Z"
+)
+
+var (
+	ErrRecordingNotFound = errors.New("recording does not exist")
+	ErrRecordingActive   = errors.New("recording is still being written")
+	ErrUnknownFormat     = errors.New("unknown recording format")
+)
+
+type (
+	// Recorder records the broadcasts of users who turned recording on in
+	// their stream settings, into a directory per user. VP8 and VP9 are
+	// written to WebM, H.264 and H.265 to fragmented MP4 and AV1 to either.
+	Recorder struct {
+		db   *database.Queries
+		path string
+		// A new file is started at the first key frame after a file got this
+		// big or long, 0 for no limit
+		maxSize     int64
+		maxDuration time.Duration
+		av1Format   string
+
+		// OnFinish is called with each file once nothing more is written to
+		// it, from the goroutine of the broadcast
+		OnFinish func(username string, recording Recording)
+		// Layer is the RID of the simulcast layer to record. Broadcasts
+		// without it get the layer of the highest resolution recorded.
+		Layer string
+
+		activeLock sync.Mutex
+		// Paths of files being written
+		active map[string]bool
+	}
+
+	// Recording is a file of a recorded broadcast.
+	Recording struct {
+		Name      string    `json:"name"`
+		Size      int64     `json:"size"`
+		StartedAt time.Time `json:"startedAt"`
+		// The broadcast is still being written to it
+		Active bool `json:"active"`
+	}
+)
+
+func New(db *database.Queries, path string, maxSize int64, maxDuration time.Duration, av1Format string) (*Recorder, error) {
+	if av1Format != FormatWebM && av1Format != FormatMP4 {
+		return nil, ErrUnknownFormat
+	}
+
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		db:          db,
+		path:        path,
+		maxSize:     maxSize,
+		maxDuration: maxDuration,
+		av1Format:   av1Format,
+		active:      map[string]bool{},
+	}, nil
+}
+
+// Sink returns a sink that records the broadcast to streamKey, or nil if its
+// owner didn't turn recording on.
+func (r *Recorder) Sink(streamKey string, requestKeyframe func()) internalwebrtc.Sink {
+	dir, ok := r.userDir(streamKey)
+	if !ok {
+		return nil
+	}
+
+	ctx := context.Background()
+	owner, err := auth.GetUser(ctx, r.db, streamKey)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		log.Println(err)
+		return nil
+	}
+
+	policy, err := auth.GetStreamPolicy(ctx, r.db, owner)
+	if err != nil {
+		log.Println(err)
+		return nil
+	} else if !policy.Record {
+		return nil
+	}
+
+	return &recordingSink{recorder: r, username: streamKey, dir: dir, start: time.Now(), requestKeyframe: requestKeyframe}
+}
+
+// userDir returns the directory of the recordings of username. Names that
+// aren't a single path element don't get one.
+func (r *Recorder) userDir(username string) (string, bool) {
+	if !auth.ValidUsername(username) {
+		return "", false
+	}
+
+	return filepath.Join(r.path, username), true
+}
+
+// recordingPath returns the path of a recording, if name is one.
+func (r *Recorder) recordingPath(username, name string) (string, bool) {
+	dir, ok := r.userDir(username)
+	if !ok || !validRecordingName(name) {
+		return "", false
+	}
+
+	return filepath.Join(dir, name), true
+}
+
+func validRecordingName(name string) bool {
+	ext := filepath.Ext(name)
+	return filepath.IsLocal(name) && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".") &&
+		(ext == "."+FormatWebM || ext == "."+FormatMP4)
+}
+
+func (r *Recorder) format(mimeType string) string {
+	switch {
+	case media.IsMimeType(mimeType, webrtc.MimeTypeVP8), media.IsMimeType(mimeType, webrtc.MimeTypeVP9):
+		return FormatWebM
+	case media.IsMimeType(mimeType, webrtc.MimeTypeAV1):
+		return r.av1Format
+	}
+
+	return FormatMP4
+}
+
+// full reports if a file should end before a key frame played at pts.
+func (r *Recorder) full(f *recordingFile, pts time.Duration) bool {
+	return (r.maxSize > 0 && f.size.n.Load() >= r.maxSize) || (r.maxDuration > 0 && pts-f.start >= r.maxDuration)
+}
+
+func (r *Recorder) setActive(path string, active bool) {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+
+	if active {
+		r.active[path] = true
+	} else {
+		delete(r.active, path)
+	}
+}
+
+func (r *Recorder) isActive(path string) bool {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+
+	return r.active[path]
+}
+
+// List returns the recordings of username, oldest first.
+func (r *Recorder) List(username string) ([]Recording, error) {
+	recordings := []Recording{}
+
+	dir, ok := r.userDir(username)
+	if !ok {
+		return recordings, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return recordings, nil
+	case err != nil:
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !validRecordingName(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		startedAt, err := time.Parse(fileNameLayout, strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		if err != nil {
+			startedAt = info.ModTime()
+		}
+
+		recordings = append(recordings, Recording{
+			Name:      entry.Name(),
+			Size:      info.Size(),
+			StartedAt: startedAt.UTC(),
+			Active:    r.isActive(filepath.Join(dir, entry.Name())),
+		})
+	}
+
+	slices.SortFunc(recordings, func(a, b Recording) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+
+	return recordings, nil
+}
+
+// Delete removes a recording of username that isn't being written anymore.
+func (r *Recorder) Delete(username, name string) error {
+	path, ok := r.recordingPath(username, name)
+	if !ok {
+		return ErrRecordingNotFound
+	}
+
+	if r.isActive(path) {
+		return ErrRecordingActive
+	}
+
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return ErrRecordingNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// owner returns whose recordings a request is about, the user of the
+// {username} path value for admins or else the logged in user.
+func owner(req *http.Request) string {
+	if username := req.PathValue("username"); username != "" {
+		return username
+	}
+
+	return auth.UserFromRequest(req).Name()
+}
+
+func (r *Recorder) ListHandler(w http.ResponseWriter, req *http.Request) {
+	recordings, err := r.List(owner(req))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recordings)
+}
+
+// DownloadHandler serves a recording, files still being written included.
+func (r *Recorder) DownloadHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	path, ok := r.recordingPath(owner(req), name)
+	if !ok {
+		http.Error(w, errors.New("Recording does not exist.").Error(), http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, errors.New("Recording does not exist.").Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "video/mp4"
+	if filepath.Ext(name) == "."+FormatWebM {
+		contentType = "video/webm"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeContent(w, req, name, info.ModTime(), f)
+}
+
+func (r *Recorder) DeleteHandler(w http.ResponseWriter, req *http.Request) {
+	err := r.Delete(owner(req), req.PathValue("name"))
+	switch {
+	case errors.Is(err, ErrRecordingNotFound):
+		http.Error(w, errors.New("Recording does not exist.").Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrRecordingActive):
+		http.Error(w, errors.New("Recording is still being written.").Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,299 @@
+package recording
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const frameRate = 30
+
+// broadcast sends seconds of video with a key frame every second and Opus
+// audio to s. frame returns the RTP payloads of a frame.
+func broadcast(s *recordingSink, mimeType string, seconds int, frame func(keyframe bool) [][]byte) {
+	videoSequenceNumber, audioSequenceNumber := uint16(0), uint16(0)
+	audioTimestamp := uint32(0)
+
+	for i := range seconds * frameRate {
+		payloads := frame(i%frameRate == 0)
+		for j, payload := range payloads {
+			s.WriteVideo("default", mimeType, &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         j == len(payloads)-1,
+					SequenceNumber: videoSequenceNumber,
+					Timestamp:      uint32(i * media.VideoClockRate / frameRate),
+				},
+				Payload: payload,
+			})
+			videoSequenceNumber++
+		}
+
+		for ; audioTimestamp <= uint32((i+1)*media.AudioClockRate/frameRate); audioTimestamp += media.AudioClockRate / 50 {
+			s.WriteAudio(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: audioSequenceNumber, Timestamp: audioTimestamp},
+				Payload: []byte{0xFC, 0xFF, 0xFE},
+			})
+			audioSequenceNumber++
+		}
+	}
+}
+
+func newTestRecorder(t *testing.T, maxDuration time.Duration) (*Recorder, *recordingSink) {
+	t.Helper()
+
+	r, err := New(nil, t.TempDir(), 0, maxDuration, FormatMP4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, &recordingSink{recorder: r, dir: filepath.Join(r.path, "user"), start: time.Now(), requestKeyframe: func() {}}
+}
+
+func TestRecordVP8ToWebM(t *testing.T) {
+	r, s := newTestRecorder(t, time.Second)
+
+	broadcast(s, webrtc.MimeTypeVP8, 3, func(keyframe bool) [][]byte {
+		if keyframe {
+			// Payload descriptor, frame tag, start code and a 640x480 size
+			return [][]byte{{0x10, 0x50, 0x36, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0xE0, 0x01, 0x00}}
+		}
+		return [][]byte{{0x10, 0x31, 0x0B, 0x00, 0x11}}
+	})
+
+	recordings, err := r.List("user")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recordings) != 3 {
+		t.Fatalf("expected a file per second, got %v", recordings)
+	} else if !recordings[2].Active {
+		t.Error("the last file is not active")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, blocks := readWebM(t, filepath.Join(r.path, "user", recordings[0].Name))
+	if len(tracks) != 2 || tracks[0].CodecID != "V_VP8" || tracks[0].Video.PixelWidth != 640 || tracks[0].Video.PixelHeight != 480 || tracks[1].CodecID != "A_OPUS" {
+		t.Fatalf("wrong tracks %+v", tracks)
+	}
+	if blocks[webmVideoTrackNumber] != frameRate || blocks[webmAudioTrackNumber] == 0 {
+		t.Errorf("wrong number of blocks %v", blocks)
+	}
+
+	recordings, err = r.List("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recording := range recordings {
+		if recording.Active {
+			t.Errorf("%s is still active after the broadcast ended", recording.Name)
+		}
+	}
+}
+
+// readWebM returns the tracks of a WebM recording and its number of blocks by
+// track number.
+func readWebM(t *testing.T, path string) ([]webm.TrackEntry, map[uint64]int) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var file struct {
+		Header  webm.EBMLHeader `ebml:"EBML"`
+		Segment webm.Segment    `ebml:"Segment"`
+	}
+	if err = ebml.Unmarshal(f, &file); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := map[uint64]int{}
+	for _, cluster := range file.Segment.Cluster {
+		for _, block := range cluster.SimpleBlock {
+			blocks[block.TrackNumber]++
+		}
+	}
+
+	return file.Segment.Tracks.TrackEntry, blocks
+}
+
+func TestRecordSimulcastLayer(t *testing.T) {
+	for _, test := range []struct {
+		layer string
+		width uint64
+	}{
+		{"", 640},
+		{"q", 320},
+	} {
+		r, s := newTestRecorder(t, 0)
+		r.Layer = test.layer
+
+		// The quarter layer comes first, a key frame of each every second
+		sequenceNumbers := map[string]uint16{}
+		for i := range 3 * frameRate {
+			for _, layer := range []struct {
+				rid      string
+				keyframe []byte
+			}{
+				{"q", []byte{0x10, 0x50, 0x36, 0x00, 0x9D, 0x01, 0x2A, 0x40, 0x01, 0xF0, 0x00}}, // 320x240
+				{"f", []byte{0x10, 0x50, 0x36, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0xE0, 0x01}}, // 640x480
+			} {
+				payload := []byte{0x10, 0x31, 0x0B, 0x00, 0x11}
+				if i%frameRate == 0 {
+					payload = layer.keyframe
+				}
+
+				s.WriteVideo(layer.rid, webrtc.MimeTypeVP8, &rtp.Packet{
+					Header: rtp.Header{
+						Version:        2,
+						Marker:         true,
+						SequenceNumber: sequenceNumbers[layer.rid],
+						Timestamp:      uint32(i * media.VideoClockRate / frameRate),
+					},
+					Payload: payload,
+				})
+				sequenceNumbers[layer.rid]++
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		recordings, err := r.List("user")
+		if err != nil {
+			t.Fatal(err)
+		} else if len(recordings) != 1 {
+			t.Fatalf("expected one file, got %v", recordings)
+		}
+
+		tracks, _ := readWebM(t, filepath.Join(r.path, "user", recordings[0].Name))
+		if tracks[0].Video == nil || tracks[0].Video.PixelWidth != test.width {
+			t.Errorf("layer %q: wrong video track %+v", test.layer, tracks[0])
+		}
+	}
+}
+
+func TestRecordAudioOnly(t *testing.T) {
+	r, s := newTestRecorder(t, 0)
+
+	for i := range uint16(3 * 50) {
+		s.WriteAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: i, Timestamp: uint32(i) * media.AudioClockRate / 50},
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		})
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recordings, err := r.List("user")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recordings) != 1 || filepath.Ext(recordings[0].Name) != "."+FormatWebM {
+		t.Fatalf("expected one WebM file, got %v", recordings)
+	}
+
+	tracks, blocks := readWebM(t, filepath.Join(r.path, "user", recordings[0].Name))
+	if len(tracks) != 1 || tracks[0].CodecID != "A_OPUS" {
+		t.Fatalf("wrong tracks %+v", tracks)
+	}
+	// The last packets wait for the ones after them
+	if blocks[webmAudioTrackNumber] < 3*50-5 {
+		t.Errorf("expected the audio from its first packet, got %d blocks", blocks[webmAudioTrackNumber])
+	}
+}
+
+func TestRecordH264ToMP4(t *testing.T) {
+	r, s := newTestRecorder(t, 0)
+
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps, _ := hex.DecodeString("68ebecb22c")
+	broadcast(s, webrtc.MimeTypeH264, 2, func(keyframe bool) [][]byte {
+		if keyframe {
+			stapA := append([]byte{0x78, 0x00, byte(len(sps))}, sps...)
+			stapA = append(append(stapA, 0x00, byte(len(pps))), pps...)
+			return [][]byte{stapA, {0x65, 0x88, 0x84, 0x00}}
+		}
+		return [][]byte{{0x41, 0x9A, 0x24, 0x6C}}
+	})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recordings, err := r.List("user")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recordings) != 1 {
+		t.Fatalf("expected one file, got %v", recordings)
+	}
+
+	f, err := mp4.ReadMP4File(filepath.Join(r.path, "user", recordings[0].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.IsFragmented() || len(f.Init.Moov.Traks) != 2 {
+		t.Fatal("not a fragmented file with audio and video")
+	}
+
+	avc1, ok := f.Init.Moov.Traks[0].Mdia.Minf.Stbl.Stsd.Children[0].(*mp4.VisualSampleEntryBox)
+	if !ok || avc1.Type() != "avc1" || avc1.Width != 640 || avc1.Height != 360 {
+		t.Fatalf("wrong video sample entry %+v", avc1)
+	}
+
+	videoSamples := 0
+	for _, segment := range f.Segments {
+		for _, fragment := range segment.Fragments {
+			for _, traf := range fragment.Moof.Trafs {
+				if traf.Tfhd.TrackID != media.FMP4VideoTrackID {
+					continue
+				}
+
+				if !mp4.IsSyncSampleFlags(traf.Trun.Samples[0].Flags) {
+					t.Error("fragment does not start with a key frame")
+				}
+				videoSamples += int(traf.Trun.SampleCount())
+			}
+		}
+	}
+	if videoSamples != 2*frameRate-1 {
+		t.Errorf("expected %d video samples, got %d", 2*frameRate-1, videoSamples)
+	}
+}
+
+func TestRecordingPath(t *testing.T) {
+	r := &Recorder{path: "/recordings"}
+
+	for _, test := range []struct {
+		username, name string
+		ok             bool
+	}{
+		{"user", "2025-01-01T00-00-00.000Z.webm", true},
+		{"user", "2025-01-01T00-00-00.000Z.mp4", true},
+		{"user", "../other/2025-01-01T00-00-00.000Z.mp4", false},
+		{"user", "..", false},
+		{"user", ".hidden.mp4", false},
+		{"user", "notes.txt", false},
+		{"..", "2025-01-01T00-00-00.000Z.mp4", false},
+		{"a/b", "2025-01-01T00-00-00.000Z.mp4", false},
+		{"", "2025-01-01T00-00-00.000Z.mp4", false},
+	} {
+		if _, ok := r.recordingPath(test.username, test.name); ok != test.ok {
+			t.Errorf("recordingPath(%q, %q) ok = %t, want %t", test.username, test.name, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package recording
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/media"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/rtp"
+)
+
+// How long after the first frame of a broadcast the sink waits for its other
+// tracks, before it chooses the video layer to record or records audio only
+const trackWaitTime = time.Second
+
+type (
+	// container writes the frames of a recording file. Timestamps are since
+	// the first video frame of the file.
+	container interface {
+		writeVideo(data []byte, keyframe bool, pts time.Duration) error
+		writeAudio(data []byte, pts time.Duration) error
+		Close() error
+	}
+
+	// recordingSink records a broadcast. One video layer is recorded, see
+	// chooseLayer, files start with a key frame of it. Broadcasts without
+	// video are recorded from their first audio frame.
+	recordingSink struct {
+		recorder        *Recorder
+		username        string
+		dir             string
+		requestKeyframe func()
+		// Tracks are timed by when their first packet came
+		start time.Time
+
+		mu     sync.Mutex
+		closed bool
+		audio  *media.Track
+		// Audio frames kept while it isn't known yet if there is video
+		pendingAudio []*media.Frame
+		// Video layers by RID, and the one that is recorded once it was chosen
+		layers           map[string]*recordingLayer
+		video            *recordingLayer
+		firstVideoPTS    time.Duration
+		firstVideoPTSSet bool
+		mimeType         string
+		// Configuration of the last file, H.264 and H.265 key frames don't
+		// always repeat the parameter sets
+		videoConfig *media.VideoConfig
+		file        *recordingFile
+		// A key frame was requested to start the next file with
+		keyframeRequested bool
+	}
+
+	// recordingLayer is a video layer of a broadcast.
+	recordingLayer struct {
+		mimeType string
+		// nil if the codec can't be recorded
+		track *media.Track
+		// Configuration of the last key frame, nil before the first one
+		config *media.VideoConfig
+	}
+
+	recordingFile struct {
+		path      string
+		startedAt time.Time
+		container container
+		size      *countingWriter
+		// When the first frame is played since the start of the recording
+		start time.Duration
+		// The broadcast had no video when the file was started
+		audioOnly bool
+	}
+
+	countingWriter struct {
+		io.WriteCloser
+		n atomic.Int64
+	}
+)
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (s *recordingSink) WriteAudio(pkt *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.audio == nil {
+		s.audio = media.NewAudioTrack(time.Since(s.start), pkt.Timestamp)
+	}
+
+	s.audio.Push(pkt)
+	for frame := s.audio.Pop(); frame != nil; frame = s.audio.Pop() {
+		s.writeAudioFrame(frame)
+	}
+}
+
+func (s *recordingSink) writeAudioFrame(frame *media.Frame) {
+	if s.file == nil && len(s.layers) == 0 {
+		// Without video for trackWaitTime the file starts with the first
+		// audio frame
+		s.pendingAudio = append(s.pendingAudio, frame)
+		if frame.PTS-s.pendingAudio[0].PTS < trackWaitTime {
+			return
+		}
+
+		pending := s.pendingAudio
+		s.pendingAudio = nil
+		if err := s.openFile(nil, pending[0].PTS); err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, frame := range pending {
+			s.writeAudioFrame(frame)
+		}
+		return
+	}
+
+	if s.file == nil || frame.PTS < s.file.start {
+		return
+	}
+
+	if s.file.audioOnly && s.recorder.full(s.file, frame.PTS) {
+		s.closeFile()
+		if err := s.openFile(nil, frame.PTS); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if err := s.file.container.writeAudio(frame.Data, frame.PTS-s.file.start); err != nil {
+		log.Println(err)
+		s.closeFile()
+	}
+}
+
+func (s *recordingSink) WriteVideo(rid, mimeType string, pkt *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	l, ok := s.layers[rid]
+	switch {
+	case s.video != nil && s.video != l:
+		return
+	case !ok:
+		l = &recordingLayer{mimeType: mimeType}
+		if depacketizer := media.NewVideoDepacketizer(mimeType); depacketizer != nil {
+			l.track = media.NewVideoTrack(depacketizer, time.Since(s.start), pkt.Timestamp)
+		} else {
+			log.Printf("Not recording layer %s of %s, %s can't be recorded", rid, s.dir, mimeType)
+		}
+
+		if s.layers == nil {
+			s.layers = map[string]*recordingLayer{}
+		}
+		s.layers[rid] = l
+		s.pendingAudio = nil
+	}
+
+	if l.track == nil {
+		return
+	}
+
+	l.track.Push(pkt)
+	for frame := l.track.Pop(); frame != nil; frame = l.track.Pop() {
+		if s.video == nil {
+			l.parseConfig(frame)
+			s.chooseLayer(rid, frame.PTS)
+		}
+
+		if s.video == l {
+			s.writeVideoFrame(frame)
+		}
+	}
+}
+
+// parseConfig keeps the configuration of a key frame of the layer.
+func (l *recordingLayer) parseConfig(frame *media.Frame) {
+	if !media.IsKeyframe(l.mimeType, frame.Data) {
+		return
+	}
+
+	if config, err := media.ParseVideoConfig(l.mimeType, frame.Data, l.config); err == nil {
+		l.config = config
+	}
+}
+
+// chooseLayer picks the video layer that is recorded, after a frame of the
+// layer rid played at pts. Broadcasts without simulcast have one layer, which
+// is chosen right away. Otherwise it is the layer of Recorder.Layer as soon as
+// it has a frame, or else trackWaitTime after the first frame the one of the
+// highest resolution.
+func (s *recordingSink) chooseLayer(rid string, pts time.Duration) {
+	if !s.firstVideoPTSSet {
+		s.firstVideoPTS, s.firstVideoPTSSet = pts, true
+	}
+
+	chosen := s.layers[rid]
+	if rid != internalwebrtc.DefaultRID && rid != s.recorder.Layer {
+		if pts-s.firstVideoPTS < trackWaitTime {
+			return
+		}
+
+		chosen = nil
+		for _, l := range s.layers {
+			if l.track == nil || l.config == nil {
+				continue
+			} else if chosen == nil || l.config.Width*l.config.Height > chosen.config.Width*chosen.config.Height {
+				chosen = l
+			}
+		}
+		if chosen == nil {
+			return
+		}
+	}
+
+	s.video, s.mimeType, s.videoConfig = chosen, chosen.mimeType, chosen.config
+	s.requestKeyframe()
+	s.keyframeRequested = true
+}
+
+func (s *recordingSink) writeVideoFrame(frame *media.Frame) {
+	keyframe := media.IsKeyframe(s.mimeType, frame.Data)
+	pts := frame.PTS
+
+	if keyframe {
+		s.keyframeRequested = false
+	}
+
+	// Video that came after the broadcast was recorded as audio only gets a
+	// file of its own
+	if s.file != nil && s.file.audioOnly && keyframe {
+		s.closeFile()
+	}
+
+	if s.file != nil && s.recorder.full(s.file, pts) {
+		switch {
+		case keyframe:
+			s.closeFile()
+		case !s.keyframeRequested:
+			s.requestKeyframe()
+			s.keyframeRequested = true
+		}
+	}
+
+	if s.file == nil {
+		if !keyframe {
+			return
+		}
+
+		if err := s.openFile(frame.Data, pts); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if err := s.file.container.writeVideo(frame.Data, keyframe, pts-s.file.start); err != nil {
+		log.Println(err)
+		s.closeFile()
+	}
+}
+
+// openFile starts a new file with a key frame played at pts, or an audio only
+// one if keyframe is nil.
+func (s *recordingSink) openFile(keyframe []byte, pts time.Duration) error {
+	var (
+		config *media.VideoConfig
+		format = FormatWebM
+		err    error
+	)
+	if keyframe != nil {
+		if config, err = media.ParseVideoConfig(s.mimeType, keyframe, s.videoConfig); err != nil {
+			return err
+		}
+		format = s.recorder.format(s.mimeType)
+	}
+
+	if err = os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	var (
+		path string
+		f    *os.File
+	)
+	// Files started in the same millisecond are named a millisecond apart
+	var startedAt time.Time
+	for startedAt = time.Now().UTC(); ; startedAt = startedAt.Add(time.Millisecond) {
+		path = filepath.Join(s.dir, startedAt.Format(fileNameLayout)+"."+format)
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); !errors.Is(err, os.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	out := &countingWriter{WriteCloser: f}
+	var c container
+	if format == FormatWebM {
+		c, err = newWebMContainer(out, config)
+	} else {
+		c, err = newFMP4Container(out, config)
+	}
+	if err != nil {
+		return errors.Join(err, f.Close(), os.Remove(path))
+	}
+
+	s.recorder.setActive(path, true)
+	if config != nil {
+		s.videoConfig = config
+	}
+	s.file = &recordingFile{path: path, startedAt: startedAt, container: c, size: out, start: pts, audioOnly: config == nil}
+	log.Printf("Recording to `%s`", path)
+
+	return nil
+}
+
+func (s *recordingSink) closeFile() {
+	if err := s.file.container.Close(); err != nil {
+		log.Println(err)
+	}
+
+	s.recorder.setActive(s.file.path, false)
+	if s.recorder.OnFinish != nil {
+		s.recorder.OnFinish(s.username, Recording{
+			Name:      filepath.Base(s.file.path),
+			Size:      s.file.size.n.Load(),
+			StartedAt: s.file.startedAt.Truncate(time.Millisecond),
+		})
+	}
+	s.file = nil
+}
+
+func (s *recordingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.file != nil {
+		s.closeFile()
+	}
+
+	return nil
+}
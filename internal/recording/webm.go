@@ -0,0 +1,134 @@
+package recording
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"time"
+
+	"github.com/at-wat/ebml-go/mkvcore"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	webmTrackTypeVideo = 1
+	webmTrackTypeAudio = 2
+
+	webmVideoTrackNumber = 1
+	webmAudioTrackNumber = 2
+
+	// Decoders should decode this much before a seek target, see RFC 7845
+	opusSeekPreRoll = 80 * time.Millisecond
+)
+
+type (
+	// webmContainer writes a WebM file, Opus audio with VP8, VP9 or AV1 video
+	// or without video.
+	webmContainer struct {
+		// nil without video
+		video, audio webm.BlockWriteCloser
+		// Closed when the block writer closed the file
+		done chan struct{}
+	}
+
+	// notifyingCloser closes done after closing the WriteCloser
+	notifyingCloser struct {
+		io.WriteCloser
+		done chan struct{}
+	}
+)
+
+func (n *notifyingCloser) Close() error {
+	defer close(n.done)
+	return n.WriteCloser.Close()
+}
+
+// newWebMContainer returns a container with the video track of config and an
+// Opus track, or only the Opus track if config is nil.
+func newWebMContainer(w io.WriteCloser, config *media.VideoConfig) (*webmContainer, error) {
+	tracks := []webm.TrackEntry{}
+	if config != nil {
+		videoTrack := webm.TrackEntry{
+			Name:        "Video",
+			TrackNumber: webmVideoTrackNumber,
+			TrackUID:    webmVideoTrackNumber,
+			TrackType:   webmTrackTypeVideo,
+			Video:       &webm.Video{PixelWidth: uint64(config.Width), PixelHeight: uint64(config.Height)},
+		}
+
+		switch {
+		case media.IsMimeType(config.MimeType, webrtc.MimeTypeVP8):
+			videoTrack.CodecID = "V_VP8"
+		case media.IsMimeType(config.MimeType, webrtc.MimeTypeVP9):
+			videoTrack.CodecID = "V_VP9"
+		case media.IsMimeType(config.MimeType, webrtc.MimeTypeAV1):
+			codecPrivate, err := config.AV1.CodecPrivate()
+			if err != nil {
+				return nil, err
+			}
+			videoTrack.CodecID, videoTrack.CodecPrivate = "V_AV1", codecPrivate
+		default:
+			return nil, media.ErrUnsupportedCodec
+		}
+		tracks = append(tracks, videoTrack)
+	}
+
+	c := &webmContainer{done: make(chan struct{})}
+	writers, err := webm.NewSimpleBlockWriter(&notifyingCloser{WriteCloser: w, done: c.done}, append(tracks, webm.TrackEntry{
+		Name:         "Audio",
+		TrackNumber:  webmAudioTrackNumber,
+		TrackUID:     webmAudioTrackNumber,
+		TrackType:    webmTrackTypeAudio,
+		CodecID:      "A_OPUS",
+		CodecPrivate: opusHead(),
+		SeekPreRoll:  uint64(opusSeekPreRoll),
+		Audio:        &webm.Audio{SamplingFrequency: media.AudioClockRate, Channels: media.OpusChannels},
+	}), mkvcore.WithOnErrorHandler(func(err error) { log.Println(err) }))
+	if err != nil {
+		return nil, err
+	}
+
+	if config != nil {
+		c.video, writers = writers[0], writers[1:]
+	}
+	c.audio = writers[0]
+	return c, nil
+}
+
+func (c *webmContainer) writeVideo(data []byte, keyframe bool, pts time.Duration) error {
+	_, err := c.video.Write(keyframe, pts.Milliseconds(), data)
+	return err
+}
+
+func (c *webmContainer) writeAudio(data []byte, pts time.Duration) error {
+	_, err := c.audio.Write(true, pts.Milliseconds(), data)
+	return err
+}
+
+// Close writes the remaining frames and closes the file once both tracks
+// are closed.
+func (c *webmContainer) Close() error {
+	var videoErr error
+	if c.video != nil {
+		videoErr = c.video.Close()
+	}
+	audioErr := c.audio.Close()
+	<-c.done
+
+	if videoErr != nil {
+		return videoErr
+	}
+	return audioErr
+}
+
+// opusHead returns the identification header of stereo Opus at 48kHz, see
+// section 5.1 of RFC 7845.
+func opusHead() []byte {
+	head := append([]byte("OpusHead"), 1, media.OpusChannels)
+	head = binary.LittleEndian.AppendUint16(head, 0) // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, media.AudioClockRate)
+	head = binary.LittleEndian.AppendUint16(head, 0) // output gain
+	return append(head, 0)                           // channel mapping family
+}
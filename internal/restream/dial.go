@@ -0,0 +1,75 @@
+package restream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+)
+
+// ErrPrivateDestination is returned for destinations that aren't public
+// addresses and aren't in Restreamer.AllowedNetworks.
+var ErrPrivateDestination = errors.New("destination is not a public address")
+
+// dialer connects outputs to their destinations. It only connects to public
+// addresses and ones in allowed, so targets can't reach the server itself or
+// hosts of its network.
+type dialer struct {
+	allowed []netip.Prefix
+	client  *http.Client
+}
+
+func newDialer(allowed []netip.Prefix) *dialer {
+	d := &dialer{allowed: allowed}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect to the destination in place of the checked dialer
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Control: d.control}).DialContext
+	d.client = &http.Client{Transport: transport}
+	return d
+}
+
+// check returns ErrPrivateDestination if addr may not be connected to.
+func (d *dialer) check(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range d.allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+
+	// Loopback, link-local, multicast and unspecified addresses aren't global
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return fmt.Errorf("%w: %s", ErrPrivateDestination, addr)
+	}
+	return nil
+}
+
+// checkHost resolves host and checks every address of it.
+func (d *dialer) checkHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if err = d.check(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// control checks the address a net.Dialer connects to after it was resolved.
+func (d *dialer) control(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	return d.check(addrPort.Addr())
+}
@@ -0,0 +1,196 @@
+package restream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/auth"
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/google/uuid"
+)
+
+// targetRequestJSON creates or changes a target. Changes apply when the target
+// is started next, an empty token keeps the one before.
+type targetRequestJSON struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	URL     string `json:"url"`
+	Token   string `json:"token"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (req *targetRequestJSON) validate(ctx context.Context, dialer *dialer) error {
+	if req.Name == "" {
+		return errors.New("Name is empty.")
+	}
+
+	u, err := url.Parse(req.URL)
+	switch {
+	case req.Kind != KindWHIP && req.Kind != KindRTMP:
+		return errors.New("Kind is not whip or rtmp.")
+	case err != nil || u.Host == "":
+		return errors.New("URL is invalid.")
+	case req.Kind == KindWHIP && u.Scheme != "http" && u.Scheme != "https":
+		return errors.New("URL of a WHIP target is not http or https.")
+	case req.Kind == KindRTMP && u.Scheme != "rtmp" && u.Scheme != "rtmps":
+		return errors.New("URL of an RTMP target is not rtmp or rtmps.")
+	}
+
+	// Connecting checks the address again, the host may resolve differently then
+	if err = dialer.checkHost(ctx, u.Hostname()); errors.Is(err, ErrPrivateDestination) {
+		return errors.New("URL is not a public address.")
+	} else if err != nil {
+		return errors.New("Host of the URL can't be resolved.")
+	}
+
+	return nil
+}
+
+func (r *Restreamer) ListHandler(w http.ResponseWriter, req *http.Request) {
+	targets, err := r.Targets(req.Context(), auth.UserFromRequest(req).ID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, targets)
+}
+
+func (r *Restreamer) CreateHandler(w http.ResponseWriter, req *http.Request) {
+	var body targetRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := body.validate(req.Context(), newDialer(r.AllowedNetworks)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t, err := r.db.CreateRestreamTarget(req.Context(), database.CreateRestreamTargetParams{
+		ID:        id.String(),
+		UserID:    auth.UserFromRequest(req).ID(),
+		Name:      body.Name,
+		Kind:      body.Kind,
+		Url:       body.URL,
+		Token:     body.Token,
+		Enabled:   body.Enabled,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		http.Error(w, errors.New("Restream target with this name already exists.").Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newTarget(t))
+}
+
+func (r *Restreamer) UpdateHandler(w http.ResponseWriter, req *http.Request) {
+	var body targetRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := body.validate(req.Context(), newDialer(r.AllowedNetworks)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID := auth.UserFromRequest(req).ID()
+	t, err := r.db.GetRestreamTarget(req.Context(), database.GetRestreamTargetParams{ID: req.PathValue("id"), UserID: userID})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, errors.New("Restream target does not exist.").Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t.Name, t.Kind, t.Url, t.Enabled = body.Name, body.Kind, body.URL, body.Enabled
+	if body.Token != "" {
+		t.Token = body.Token
+	}
+
+	if _, err = r.db.UpdateRestreamTarget(req.Context(), database.UpdateRestreamTargetParams{
+		Name:    t.Name,
+		Kind:    t.Kind,
+		Url:     t.Url,
+		Token:   t.Token,
+		Enabled: t.Enabled,
+		ID:      t.ID,
+		UserID:  userID,
+	}); err != nil {
+		http.Error(w, errors.New("Restream target with this name already exists.").Error(), http.StatusConflict)
+		return
+	}
+
+	target := newTarget(t)
+	if b := r.broadcast(userID); b != nil {
+		target.Status = b.status(t.ID)
+	}
+
+	writeJSON(w, http.StatusOK, target)
+}
+
+// DeleteHandler deletes a target, its restream ends.
+func (r *Restreamer) DeleteHandler(w http.ResponseWriter, req *http.Request) {
+	userID := auth.UserFromRequest(req).ID()
+	deleted, err := r.db.DeleteRestreamTarget(req.Context(), database.DeleteRestreamTargetParams{ID: req.PathValue("id"), UserID: userID})
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case deleted == 0:
+		http.Error(w, errors.New("Restream target does not exist.").Error(), http.StatusNotFound)
+	default:
+		r.forget(userID, req.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (r *Restreamer) StartHandler(w http.ResponseWriter, req *http.Request) {
+	err := r.Start(req.Context(), auth.UserFromRequest(req).ID(), req.PathValue("id"))
+	switch {
+	case errors.Is(err, ErrTargetNotFound):
+		http.Error(w, errors.New("Restream target does not exist.").Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotLive):
+		http.Error(w, errors.New("Stream is not live.").Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (r *Restreamer) StopHandler(w http.ResponseWriter, req *http.Request) {
+	err := r.Stop(auth.UserFromRequest(req).ID(), req.PathValue("id"))
+	switch {
+	case errors.Is(err, ErrTargetNotFound):
+		http.Error(w, errors.New("Restream target was not started.").Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotLive):
+		http.Error(w, errors.New("Stream is not live.").Error(), http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
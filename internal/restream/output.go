@@ -0,0 +1,239 @@
+package restream
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+)
+
+const (
+	StateConnecting = "connecting"
+	StateLive       = "live"
+	StateRetrying   = "retrying"
+	// The broadcast can't be restreamed to the target, it isn't retried
+	StateFailed  = "failed"
+	StateStopped = "stopped"
+
+	// Packets an output keeps while it connects or falls behind
+	queueSize = 1024
+	// Connecting is retried after this long, the delay doubles after every
+	// failure up to the maximum
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+	// How long connecting to a destination may take
+	connectTimeout = 10 * time.Second
+)
+
+type (
+	// Status is the status of the restream of a broadcast to a target.
+	Status struct {
+		State string `json:"state"`
+		// Why the last connection failed
+		Error string `json:"error,omitempty"`
+		// Connections that failed in a row
+		Failures int `json:"failures"`
+		// When the state changed
+		Since time.Time `json:"since"`
+	}
+
+	// connection sends a broadcast to a destination. Packets belong to the
+	// connection.
+	connection interface {
+		writeAudio(pkt *rtp.Packet) error
+		writeVideo(pkt *rtp.Packet) error
+		// failed gets why the destination ended the connection, if it can tell
+		// without a write failing
+		failed() <-chan error
+		close()
+	}
+
+	queuedPacket struct {
+		video    bool
+		mimeType string
+		pkt      *rtp.Packet
+	}
+
+	// output restreams a broadcast to a target until it is stopped, failed
+	// connections are retried.
+	output struct {
+		target          database.RestreamTarget
+		requestKeyframe func()
+		dialer          *dialer
+		queue           chan queuedPacket
+		ctx             context.Context
+		cancel          context.CancelFunc
+
+		statusLock    sync.Mutex
+		currentStatus Status
+	}
+)
+
+func newOutput(target database.RestreamTarget, requestKeyframe func(), dialer *dialer) *output {
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &output{
+		target:          target,
+		requestKeyframe: requestKeyframe,
+		dialer:          dialer,
+		queue:           make(chan queuedPacket, queueSize),
+		ctx:             ctx,
+		cancel:          cancel,
+		currentStatus:   Status{State: StateConnecting, Since: time.Now().UTC()},
+	}
+
+	go o.run()
+	return o
+}
+
+// write queues a packet, it is dropped if the output fell too far behind.
+func (o *output) write(video bool, mimeType string, pkt *rtp.Packet) {
+	if o.ctx.Err() != nil {
+		return
+	}
+
+	select {
+	case o.queue <- queuedPacket{video: video, mimeType: mimeType, pkt: pkt.Clone()}:
+	default:
+	}
+}
+
+func (o *output) stop() {
+	o.cancel()
+	o.setStatus(StateStopped, nil)
+}
+
+func (o *output) status() Status {
+	o.statusLock.Lock()
+	defer o.statusLock.Unlock()
+
+	return o.currentStatus
+}
+
+func (o *output) setStatus(state string, err error) {
+	o.statusLock.Lock()
+	defer o.statusLock.Unlock()
+
+	// Stopped outputs stay stopped
+	if o.ctx.Err() != nil {
+		state, err = StateStopped, nil
+	}
+
+	switch state {
+	case StateLive:
+		o.currentStatus.Failures = 0
+	case StateRetrying, StateFailed:
+		o.currentStatus.Failures++
+	}
+
+	if state != o.currentStatus.State {
+		o.currentStatus.Since = time.Now().UTC()
+	}
+	o.currentStatus.State = state
+	if err != nil {
+		o.currentStatus.Error = err.Error()
+	}
+}
+
+func (o *output) run() {
+	delay := minRetryDelay
+	for {
+		connected, err := o.connect()
+		switch {
+		case o.ctx.Err() != nil:
+			o.setStatus(StateStopped, nil)
+			return
+		case errors.Is(err, media.ErrUnsupportedCodec):
+			log.Printf("Not restreaming to `%s`, %s", o.target.Name, err)
+			o.setStatus(StateFailed, err)
+			return
+		}
+
+		log.Printf("Restream to `%s` failed: %s", o.target.Name, err)
+		o.setStatus(StateRetrying, err)
+
+		// Connections that worked for a while are retried right away
+		if connected >= maxRetryDelay {
+			delay = minRetryDelay
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-o.ctx.Done():
+			o.setStatus(StateStopped, nil)
+			return
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// connect connects to the target and forwards the broadcast until the
+// connection fails, it returns how long it was connected.
+func (o *output) connect() (time.Duration, error) {
+	// The codec is only known once video comes
+	mimeType, err := o.videoMimeType()
+	if err != nil {
+		return 0, err
+	}
+
+	o.setStatus(StateConnecting, nil)
+	ctx, cancel := context.WithTimeout(o.ctx, connectTimeout)
+	defer cancel()
+
+	var conn connection
+	if o.target.Kind == KindWHIP {
+		conn, err = dialWHIP(ctx, o.dialer, o.target, mimeType, o.requestKeyframe)
+	} else {
+		conn, err = dialRTMP(ctx, o.dialer, o.target, mimeType)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer conn.close()
+
+	// Packets that queued up while connecting are late, the destination
+	// starts with the next key frame
+	for len(o.queue) != 0 {
+		<-o.queue
+	}
+
+	connectedAt := time.Now()
+	o.setStatus(StateLive, nil)
+	o.requestKeyframe()
+
+	for {
+		select {
+		case p := <-o.queue:
+			if p.video {
+				err = conn.writeVideo(p.pkt)
+			} else {
+				err = conn.writeAudio(p.pkt)
+			}
+		case err = <-conn.failed():
+		case <-o.ctx.Done():
+			err = o.ctx.Err()
+		}
+
+		if err != nil {
+			return time.Since(connectedAt), err
+		}
+	}
+}
+
+// videoMimeType waits for the first video packet and returns its codec.
+func (o *output) videoMimeType() (string, error) {
+	for {
+		select {
+		case p := <-o.queue:
+			if p.video {
+				return p.mimeType, nil
+			}
+		case <-o.ctx.Done():
+			return "", o.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package restream forwards live broadcasts to other platforms over WHIP and
+// RTMP. Nothing is transcoded, destinations get the codecs the broadcast is
+// sent with.
+package restream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/auth"
+	"github.com/glimesh/broadcast-box/internal/database"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/rtp"
+)
+
+const (
+	KindWHIP = "whip"
+	KindRTMP = "rtmp"
+)
+
+var (
+	ErrTargetNotFound = errors.New("restream target does not exist")
+	ErrNotLive        = errors.New("stream is not live")
+)
+
+type (
+	// Restreamer restreams the broadcasts of every user to their targets.
+	// Enabled targets are started when a broadcast starts, others can be
+	// started while it is live.
+	Restreamer struct {
+		db *database.Queries
+		// Targets may connect to these networks besides public addresses
+		AllowedNetworks []netip.Prefix
+
+		broadcastsLock sync.Mutex
+		broadcasts     map[string]*broadcast
+	}
+
+	// Target is a destination of the broadcasts of a user. The token is never
+	// returned, it is the bearer token of WHIP targets and the stream key of
+	// RTMP ones.
+	Target struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		Kind      string    `json:"kind"`
+		URL       string    `json:"url"`
+		Enabled   bool      `json:"enabled"`
+		CreatedAt time.Time `json:"createdAt"`
+		// Status of the restream of the live broadcast, nil if the target
+		// wasn't started
+		Status *Status `json:"status"`
+	}
+
+	// broadcast is the sink of a broadcast, it forwards the first video layer
+	// it gets and the audio to the outputs of started targets.
+	broadcast struct {
+		restreamer      *Restreamer
+		userID          string
+		requestKeyframe func()
+
+		mu       sync.Mutex
+		closed   bool
+		hasVideo bool
+		videoRID string
+		// Outputs by target ID, stopped ones included for their status
+		outputs map[string]*output
+	}
+)
+
+func New(db *database.Queries) *Restreamer {
+	return &Restreamer{db: db, broadcasts: map[string]*broadcast{}}
+}
+
+// Sink returns the sink that restreams the broadcast to streamKey, it replaces
+// the broadcast before. It starts the enabled targets of the owner.
+func (r *Restreamer) Sink(streamKey string, requestKeyframe func()) internalwebrtc.Sink {
+	ctx := context.Background()
+	owner, err := auth.GetUser(ctx, r.db, streamKey)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		log.Println(err)
+		return nil
+	}
+
+	targets, err := r.db.ListRestreamTargets(ctx, owner.ID())
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	b := &broadcast{restreamer: r, userID: owner.ID(), requestKeyframe: requestKeyframe, outputs: map[string]*output{}}
+	for _, target := range targets {
+		if target.Enabled {
+			b.start(target)
+		}
+	}
+
+	r.broadcastsLock.Lock()
+	defer r.broadcastsLock.Unlock()
+
+	r.broadcasts[owner.ID()] = b
+	return b
+}
+
+func (r *Restreamer) broadcast(userID string) *broadcast {
+	r.broadcastsLock.Lock()
+	defer r.broadcastsLock.Unlock()
+
+	return r.broadcasts[userID]
+}
+
+// Targets returns the targets of a user with the status of their restreams.
+func (r *Restreamer) Targets(ctx context.Context, userID string) ([]Target, error) {
+	targets, err := r.db.ListRestreamTargets(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	b := r.broadcast(userID)
+	res := make([]Target, 0, len(targets))
+	for _, t := range targets {
+		target := newTarget(t)
+		if b != nil {
+			target.Status = b.status(t.ID)
+		}
+		res = append(res, target)
+	}
+
+	return res, nil
+}
+
+// Start restreams the live broadcast of a user to one of their targets, it is
+// restarted if it was already.
+func (r *Restreamer) Start(ctx context.Context, userID, targetID string) error {
+	target, err := r.db.GetRestreamTarget(ctx, database.GetRestreamTargetParams{ID: targetID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTargetNotFound
+	} else if err != nil {
+		return err
+	}
+
+	b := r.broadcast(userID)
+	if b == nil || !b.start(target) {
+		return ErrNotLive
+	}
+
+	return nil
+}
+
+// Stop ends the restream of the live broadcast of a user to one of their
+// targets.
+func (r *Restreamer) Stop(userID, targetID string) error {
+	b := r.broadcast(userID)
+	if b == nil {
+		return ErrNotLive
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.outputs[targetID]
+	if !ok {
+		return ErrTargetNotFound
+	}
+
+	o.stop()
+	return nil
+}
+
+// forget stops and drops the output of a target that was deleted.
+func (r *Restreamer) forget(userID, targetID string) {
+	b := r.broadcast(userID)
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if o, ok := b.outputs[targetID]; ok {
+		o.stop()
+		delete(b.outputs, targetID)
+	}
+}
+
+func newTarget(t database.RestreamTarget) Target {
+	return Target{ID: t.ID, Name: t.Name, Kind: t.Kind, URL: t.Url, Enabled: t.Enabled, CreatedAt: t.CreatedAt}
+}
+
+// start starts an output to target, replacing the one before. It reports if
+// the broadcast is still live.
+func (b *broadcast) start(target database.RestreamTarget) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return false
+	}
+
+	if o, ok := b.outputs[target.ID]; ok {
+		o.stop()
+	}
+
+	b.outputs[target.ID] = newOutput(target, b.requestKeyframe, newDialer(b.restreamer.AllowedNetworks))
+	return true
+}
+
+func (b *broadcast) status(targetID string) *Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.outputs[targetID]
+	if !ok {
+		return nil
+	}
+
+	status := o.status()
+	return &status
+}
+
+func (b *broadcast) WriteAudio(pkt *rtp.Packet) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, o := range b.outputs {
+		o.write(false, "", pkt)
+	}
+}
+
+func (b *broadcast) WriteVideo(rid, mimeType string, pkt *rtp.Packet) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.hasVideo {
+		b.hasVideo, b.videoRID = true, rid
+	} else if rid != b.videoRID {
+		return
+	}
+
+	for _, o := range b.outputs {
+		o.write(true, mimeType, pkt)
+	}
+}
+
+func (b *broadcast) Close() error {
+	b.restreamer.broadcastsLock.Lock()
+	if b.restreamer.broadcasts[b.userID] == b {
+		delete(b.restreamer.broadcasts, b.userID)
+	}
+	b.restreamer.broadcastsLock.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for _, o := range b.outputs {
+		o.stop()
+	}
+
+	return nil
+}
@@ -0,0 +1,378 @@
+package restream
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/glimesh/broadcast-box/internal/rtmp"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const frameRate = 30
+
+// sinkPublisher writes what ingest packetizes to a sink.
+type sinkPublisher struct{ internalwebrtc.Sink }
+
+func (sinkPublisher) Close() {}
+
+func (sinkPublisher) Done() <-chan struct{} { return nil }
+
+// testPublisher is an RTMP broadcast the restream is sent to.
+type testPublisher struct {
+	mu       sync.Mutex
+	mimeType string
+	video    int
+	closed   chan struct{}
+}
+
+func (p *testPublisher) WriteAudio(*rtp.Packet) {}
+
+func (p *testPublisher) WriteVideo(_, mimeType string, _ *rtp.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mimeType = mimeType
+	p.video++
+}
+
+func (p *testPublisher) Close() {
+	close(p.closed)
+}
+
+func (p *testPublisher) Done() <-chan struct{} {
+	return p.closed
+}
+
+func newTestRestreamer(t *testing.T) (*Restreamer, string) {
+	t.Helper()
+
+	ctx := context.Background()
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	queries := database.New(db)
+	user, err := queries.CreateUser(ctx, database.CreateUserParams{ID: "1", Name: "user", Password: []byte{}, Streamkey: []byte{}, Role: "broadcaster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(queries)
+	r.AllowedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	return r, user.ID
+}
+
+func createTarget(t *testing.T, r *Restreamer, userID, kind, url, token string, enabled bool) string {
+	t.Helper()
+
+	target, err := r.db.CreateRestreamTarget(context.Background(), database.CreateRestreamTargetParams{
+		ID: kind, UserID: userID, Name: kind, Kind: kind, Url: url, Token: token, Enabled: enabled, CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return target.ID
+}
+
+// sendBroadcast sends H.264 with a key frame every second and Opus audio to sink
+// in real time, until done is closed.
+func sendBroadcast(sink internalwebrtc.Sink, done <-chan struct{}) {
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps, _ := hex.DecodeString("68ebecb22c")
+	video, _ := ingest.NewVideoPacketizer(sinkPublisher{sink}, "", webrtc.MimeTypeH264, sps, pps)
+	audio := ingest.NewAudioPacketizer(sinkPublisher{sink})
+
+	ticker := time.NewTicker(time.Second / frameRate)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		au := [][]byte{{0x41, 0x9A, 0x24, 0x6C}}
+		if i%frameRate == 0 {
+			au = [][]byte{{0x65, 0x88, 0x84, 0x00}}
+		}
+		video.WriteAccessUnit(uint32(i*media.VideoClockRate/frameRate), au)
+		audio.WriteOpus(uint32(i*media.AudioClockRate/frameRate), []byte{0xFC, 0xFF, 0xFE})
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// waitForStatus waits until the restream to a target is in state.
+func waitForStatus(t *testing.T, r *Restreamer, userID, targetID, state string) Status {
+	t.Helper()
+
+	for range 200 {
+		targets, err := r.Targets(context.Background(), userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, target := range targets {
+			if target.ID == targetID && target.Status != nil && target.Status.State == state {
+				return *target.Status
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("restream did not become %s", state)
+	return Status{}
+}
+
+func TestRestreamToRTMP(t *testing.T) {
+	r, userID := newTestRestreamer(t)
+
+	publishers := make(chan *testPublisher, 1)
+	server := &rtmp.Server{
+		Authorize: func(_ context.Context, _, username, streamKey string) bool {
+			return username == "user" && streamKey == "key"
+		},
+		Publish: func(string) (ingest.Publisher, error) {
+			p := &testPublisher{closed: make(chan struct{})}
+			publishers <- p
+			return p, nil
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l) //nolint:errcheck
+
+	targetID := createTarget(t, r, userID, KindRTMP, "rtmp://"+l.Addr().String()+"/user", "key", true)
+
+	// Enabled targets start with the broadcast
+	sink := r.Sink("user", func() {})
+	done := make(chan struct{})
+	go sendBroadcast(sink, done)
+	defer close(done)
+
+	waitForStatus(t, r, userID, targetID, StateLive)
+
+	var p *testPublisher
+	select {
+	case p = <-publishers:
+	case <-time.After(10 * time.Second):
+		t.Fatal("restream was not published")
+	}
+
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-p.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("restream did not end with the broadcast")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mimeType != webrtc.MimeTypeH264 || p.video == 0 {
+		t.Errorf("wrong restream %s %d", p.mimeType, p.video)
+	}
+}
+
+func TestRestreamToWHIP(t *testing.T) {
+	r, userID := newTestRestreamer(t)
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := internalwebrtc.PopulateMediaEngine(mediaEngine); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+
+	videoPackets, deleted := make(chan string, 100), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /whip", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		offer, _ := io.ReadAll(req.Body)
+		peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { peerConnection.Close() })
+
+		peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			for {
+				if _, _, err := track.ReadRTP(); err != nil {
+					return
+				}
+				if track.Kind() == webrtc.RTPCodecTypeVideo {
+					select {
+					case videoPackets <- track.Codec().MimeType:
+					default:
+					}
+				}
+			}
+		})
+
+		if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+			t.Error(err)
+			return
+		}
+
+		answer, err := peerConnection.CreateAnswer(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		gatheringComplete := webrtc.GatheringCompletePromise(peerConnection)
+		if err = peerConnection.SetLocalDescription(answer); err != nil {
+			t.Error(err)
+			return
+		}
+		<-gatheringComplete
+
+		w.Header().Set("Location", "/whip/session")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, peerConnection.LocalDescription().SDP)
+	})
+	mux.HandleFunc("DELETE /whip/session", func(w http.ResponseWriter, _ *http.Request) {
+		close(deleted)
+	})
+	endpoint := httptest.NewServer(mux)
+	defer endpoint.Close()
+
+	targetID := createTarget(t, r, userID, KindWHIP, endpoint.URL+"/whip", "token", false)
+
+	if err := r.Start(context.Background(), userID, targetID); err != ErrNotLive {
+		t.Fatalf("started without a broadcast: %v", err)
+	}
+
+	sink := r.Sink("user", func() {})
+	defer sink.Close()
+	done := make(chan struct{})
+	go sendBroadcast(sink, done)
+	defer close(done)
+
+	// Targets that aren't enabled are started by hand
+	if err := r.Start(context.Background(), userID, targetID); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, r, userID, targetID, StateLive)
+
+	select {
+	case mimeType := <-videoPackets:
+		if mimeType != webrtc.MimeTypeH264 {
+			t.Errorf("wrong codec %s", mimeType)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no video was restreamed")
+	}
+
+	if err := r.Stop(userID, targetID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-deleted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WHIP session was not deleted")
+	}
+	waitForStatus(t, r, userID, targetID, StateStopped)
+}
+
+func TestRestreamRetries(t *testing.T) {
+	r, userID := newTestRestreamer(t)
+
+	// Nothing listens on the port anymore
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	targetID := createTarget(t, r, userID, KindRTMP, "rtmp://"+l.Addr().String()+"/user", "key", true)
+
+	sink := r.Sink("user", func() {})
+	defer sink.Close()
+	done := make(chan struct{})
+	go sendBroadcast(sink, done)
+	defer close(done)
+
+	status := waitForStatus(t, r, userID, targetID, StateRetrying)
+	if status.Failures == 0 || status.Error == "" {
+		t.Errorf("failure is not reported %+v", status)
+	}
+
+	if err = r.Stop(userID, targetID); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, r, userID, targetID, StateStopped)
+}
+
+func TestRestreamToPrivateDestination(t *testing.T) {
+	r, userID := newTestRestreamer(t)
+	r.AllowedNetworks = nil
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			requests.Add(1)
+			conn.Close()
+		}
+	}()
+
+	whipID := createTarget(t, r, userID, KindWHIP, server.URL, "", true)
+	rtmpID := createTarget(t, r, userID, KindRTMP, "rtmp://"+l.Addr().String()+"/user", "key", true)
+
+	sink := r.Sink("user", func() {})
+	defer sink.Close()
+	done := make(chan struct{})
+	go sendBroadcast(sink, done)
+	defer close(done)
+
+	for _, targetID := range []string{whipID, rtmpID} {
+		if status := waitForStatus(t, r, userID, targetID, StateRetrying); !strings.Contains(status.Error, ErrPrivateDestination.Error()) {
+			t.Errorf("private destination is not reported %+v", status)
+		}
+	}
+	if requests.Load() != 0 {
+		t.Errorf("%d connections were made to private destinations", requests.Load())
+	}
+}
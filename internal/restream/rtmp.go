@@ -0,0 +1,208 @@
+package restream
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	rtmpcodecs "github.com/bluenviron/gortmplib/pkg/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/av1"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// How long a write to an RTMP server may block
+const writeTimeout = 10 * time.Second
+
+// rtmpConnection sends a broadcast to an RTMP server, video of Enhanced RTMP
+// codecs and Opus audio.
+type rtmpConnection struct {
+	client   *gortmplib.Client
+	mimeType string
+	// Tracks are timed by when their first packet came
+	start        time.Time
+	audio, video *media.Track
+
+	// The stream is set up at the first key frame, with an audio track if
+	// audio came before it
+	writer                 *gortmplib.Writer
+	videoTrack, audioTrack *gortmplib.Track
+	// When the first key frame is played, RTMP timestamps start at it
+	firstPTS time.Duration
+}
+
+// dialRTMP publishes video of mimeType to the RTMP server of target, with the
+// token as the stream key.
+func dialRTMP(ctx context.Context, dialer *dialer, target database.RestreamTarget, mimeType string) (*rtmpConnection, error) {
+	switch {
+	case media.IsMimeType(mimeType, webrtc.MimeTypeH264), media.IsMimeType(mimeType, webrtc.MimeTypeH265),
+		media.IsMimeType(mimeType, webrtc.MimeTypeAV1), media.IsMimeType(mimeType, webrtc.MimeTypeVP9):
+	default:
+		return nil, media.ErrUnsupportedCodec
+	}
+
+	rawURL := target.Url
+	if target.Token != "" {
+		rawURL = strings.TrimSuffix(rawURL, "/") + "/" + target.Token
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client can't take a dialer, the address is checked before and
+	// after it connects
+	if err = dialer.checkHost(ctx, u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	client := &gortmplib.Client{URL: u, Publish: true}
+	if err = client.Initialize(ctx); err != nil {
+		return nil, err
+	}
+
+	addrPort, err := netip.ParseAddrPort(client.NetConn().RemoteAddr().String())
+	if err == nil {
+		err = dialer.check(addrPort.Addr())
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &rtmpConnection{client: client, mimeType: mimeType, start: time.Now()}, nil
+}
+
+func (c *rtmpConnection) writeAudio(pkt *rtp.Packet) error {
+	if c.audio == nil {
+		c.audio = media.NewAudioTrack(time.Since(c.start), pkt.Timestamp)
+	}
+
+	c.audio.Push(pkt)
+	for frame := c.audio.Pop(); frame != nil; frame = c.audio.Pop() {
+		if c.audioTrack == nil || frame.PTS < c.firstPTS {
+			continue
+		}
+
+		if err := c.client.NetConn().SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+			return err
+		}
+
+		if err := c.writer.WriteOpus(c.audioTrack, frame.PTS-c.firstPTS, frame.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *rtmpConnection) writeVideo(pkt *rtp.Packet) error {
+	if c.video == nil {
+		c.video = media.NewVideoTrack(media.NewVideoDepacketizer(c.mimeType), time.Since(c.start), pkt.Timestamp)
+	}
+
+	c.video.Push(pkt)
+	for frame := c.video.Pop(); frame != nil; frame = c.video.Pop() {
+		if err := c.writeVideoFrame(frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *rtmpConnection) writeVideoFrame(frame *media.Frame) error {
+	if c.writer == nil {
+		if !media.IsKeyframe(c.mimeType, frame.Data) {
+			return nil
+		}
+
+		// Key frames without parameter sets can't start the stream
+		config, err := media.ParseVideoConfig(c.mimeType, frame.Data, nil)
+		if err != nil {
+			return nil
+		}
+
+		if err = c.setup(config, frame.PTS); err != nil {
+			return err
+		}
+	}
+
+	if err := c.client.NetConn().SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	pts := frame.PTS - c.firstPTS
+	switch {
+	case media.IsMimeType(c.mimeType, webrtc.MimeTypeH264), media.IsMimeType(c.mimeType, webrtc.MimeTypeH265):
+		var au h264.AnnexB
+		if err := au.Unmarshal(frame.Data); err != nil {
+			return nil
+		}
+
+		// WebRTC has no B-frames, frames are decoded when they are played
+		if media.IsMimeType(c.mimeType, webrtc.MimeTypeH264) {
+			return c.writer.WriteH264(c.videoTrack, pts, pts, au)
+		}
+		return c.writer.WriteH265(c.videoTrack, pts, pts, au)
+	case media.IsMimeType(c.mimeType, webrtc.MimeTypeAV1):
+		var tu av1.Bitstream
+		if err := tu.Unmarshal(frame.Data); err != nil {
+			return nil
+		}
+		return c.writer.WriteAV1(c.videoTrack, pts, tu)
+	}
+
+	return c.writer.WriteVP9(c.videoTrack, pts, frame.Data)
+}
+
+// setup announces the tracks of the stream, which starts with a key frame of
+// config played at pts.
+func (c *rtmpConnection) setup(config *media.VideoConfig, pts time.Duration) error {
+	var codec rtmpcodecs.Codec
+	switch {
+	case media.IsMimeType(c.mimeType, webrtc.MimeTypeH264):
+		codec = &rtmpcodecs.H264{SPS: config.SPS[0], PPS: config.PPS[0]}
+	case media.IsMimeType(c.mimeType, webrtc.MimeTypeH265):
+		codec = &rtmpcodecs.H265{VPS: config.VPS[0], SPS: config.SPS[0], PPS: config.PPS[0]}
+	case media.IsMimeType(c.mimeType, webrtc.MimeTypeAV1):
+		codec = &rtmpcodecs.AV1{}
+	default:
+		codec = &rtmpcodecs.VP9{}
+	}
+
+	c.videoTrack = &gortmplib.Track{Codec: codec}
+	tracks := []*gortmplib.Track{c.videoTrack}
+	if c.audio != nil {
+		c.audioTrack = &gortmplib.Track{Codec: &rtmpcodecs.Opus{ChannelCount: media.OpusChannels}}
+		tracks = append(tracks, c.audioTrack)
+	}
+
+	if err := c.client.NetConn().SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	c.writer = &gortmplib.Writer{Conn: c.client, Tracks: tracks}
+	if err := c.writer.Initialize(); err != nil {
+		return err
+	}
+
+	c.firstPTS = pts
+	return nil
+}
+
+// failed returns nil, RTMP servers that end the connection make writes fail.
+func (c *rtmpConnection) failed() <-chan error {
+	return nil
+}
+
+func (c *rtmpConnection) close() {
+	c.client.Close()
+}
@@ -0,0 +1,232 @@
+package restream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/glimesh/broadcast-box/internal/media"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Largest answer a WHIP endpoint may respond with
+const maxAnswerSize = 1 << 20
+
+var errDisconnected = errors.New("WHIP connection was lost")
+
+// whipConnection sends a broadcast to a WHIP endpoint.
+type whipConnection struct {
+	peerConnection *webrtc.PeerConnection
+	video, audio   *webrtc.TrackLocalStaticRTP
+	token          string
+	client         *http.Client
+	// URL of the WHIP session, it is deleted when the connection ends
+	location string
+	failures chan error
+}
+
+var whipAPI = sync.OnceValues(func() (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := internalwebrtc.PopulateMediaEngine(mediaEngine); err != nil {
+		return nil, err
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry)), nil
+})
+
+// dialWHIP publishes video of mimeType and Opus audio to the WHIP endpoint of
+// target. Key frames the endpoint asks for are requested with requestKeyframe.
+func dialWHIP(ctx context.Context, dialer *dialer, target database.RestreamTarget, mimeType string, requestKeyframe func()) (*whipConnection, error) {
+	api, err := whipAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &whipConnection{peerConnection: peerConnection, token: target.Token, client: dialer.client, failures: make(chan error, 1)}
+	if err = c.connect(ctx, target.Url, mimeType, requestKeyframe); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *whipConnection) connect(ctx context.Context, endpoint, mimeType string, requestKeyframe func()) (err error) {
+	if c.video, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: media.VideoClockRate}, "video", "broadcast-box"); err != nil {
+		return err
+	}
+
+	if c.audio, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: media.AudioClockRate, Channels: media.OpusChannels}, "audio", "broadcast-box"); err != nil {
+		return err
+	}
+
+	for _, track := range []*webrtc.TrackLocalStaticRTP{c.video, c.audio} {
+		transceiver, err := c.peerConnection.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		if err != nil {
+			return err
+		}
+
+		go readRTCP(transceiver.Sender(), requestKeyframe)
+	}
+
+	connected := make(chan struct{})
+	closeConnected := sync.OnceFunc(func() { close(connected) })
+	c.peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			closeConnected()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			select {
+			case c.failures <- errDisconnected:
+			default:
+			}
+		}
+	})
+
+	offer, err := c.peerConnection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	// Candidates are sent with the offer, WHIP endpoints don't have to support
+	// trickle ICE
+	gatheringComplete := webrtc.GatheringCompletePromise(c.peerConnection)
+	if err = c.peerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	select {
+	case <-gatheringComplete:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	answer, err := c.post(ctx, endpoint, c.peerConnection.LocalDescription().SDP)
+	if err != nil {
+		return err
+	}
+
+	if err = c.peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		return err
+	}
+
+	select {
+	case <-connected:
+		return nil
+	case err = <-c.failures:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// post sends the offer to the WHIP endpoint and returns its answer.
+func (c *whipConnection) post(ctx context.Context, endpoint, offer string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(offer))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	c.authorize(req)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("WHIP endpoint responded with %s", res.Status)
+	}
+
+	if location, err := res.Location(); err == nil {
+		c.location = location.String()
+	}
+
+	answer, err := io.ReadAll(io.LimitReader(res.Body, maxAnswerSize))
+	return string(answer), err
+}
+
+func (c *whipConnection) authorize(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
+// readRTCP reads the RTCP packets of a sender, which the interceptors need,
+// and requests the key frames they ask for.
+func readRTCP(sender *webrtc.RTPSender, requestKeyframe func()) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, pkt := range packets {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				requestKeyframe()
+			}
+		}
+	}
+}
+
+func (c *whipConnection) writeAudio(pkt *rtp.Packet) error {
+	return c.write(c.audio, pkt)
+}
+
+func (c *whipConnection) writeVideo(pkt *rtp.Packet) error {
+	return c.write(c.video, pkt)
+}
+
+// write sends a packet without the header extensions of the publisher, their
+// IDs were negotiated with it.
+func (c *whipConnection) write(track *webrtc.TrackLocalStaticRTP, pkt *rtp.Packet) error {
+	pkt.Extension, pkt.Extensions = false, nil
+	return track.WriteRTP(pkt)
+}
+
+func (c *whipConnection) failed() <-chan error {
+	return c.failures
+}
+
+// close ends the connection and deletes the WHIP session.
+func (c *whipConnection) close() {
+	_ = c.peerConnection.Close()
+
+	if c.location == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.location, nil)
+	if err != nil {
+		return
+	}
+	c.authorize(req)
+
+	if res, err := c.client.Do(req); err == nil {
+		res.Body.Close()
+	}
+}
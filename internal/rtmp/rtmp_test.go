@@ -0,0 +1,192 @@
+package rtmp
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	rtmpcodecs "github.com/bluenviron/gortmplib/pkg/codecs"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+const frameRate = 30
+
+type testPublisher struct {
+	mu           sync.Mutex
+	audio, video []*rtp.Packet
+	mimeType     string
+	closed       chan struct{}
+}
+
+func (p *testPublisher) WriteAudio(pkt *rtp.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.audio = append(p.audio, pkt.Clone())
+}
+
+func (p *testPublisher) WriteVideo(rid, mimeType string, pkt *rtp.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mimeType = mimeType
+	p.video = append(p.video, pkt.Clone())
+}
+
+func (p *testPublisher) Close() {
+	close(p.closed)
+}
+
+func (p *testPublisher) Done() <-chan struct{} {
+	return p.closed
+}
+
+// newTestServer serves RTMP for the user with the stream key "key".
+func newTestServer(t *testing.T) (string, chan *testPublisher) {
+	t.Helper()
+
+	publishers := make(chan *testPublisher, 1)
+	s := &Server{
+		Authorize: func(_ context.Context, _, username, streamKey string) bool {
+			return username == "user" && streamKey == "key"
+		},
+		Publish: func(string) (ingest.Publisher, error) {
+			p := &testPublisher{closed: make(chan struct{})}
+			publishers <- p
+			return p, nil
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l) //nolint:errcheck
+
+	return "rtmp://" + l.Addr().String(), publishers
+}
+
+func dial(t *testing.T, rawURL string) *gortmplib.Client {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &gortmplib.Client{URL: u, Publish: true}
+	if err = c.Initialize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestPublishH264AndOpus(t *testing.T) {
+	address, publishers := newTestServer(t)
+
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps, _ := hex.DecodeString("68ebecb22c")
+
+	c := dial(t, address+"/user/key")
+	video := &gortmplib.Track{Codec: &rtmpcodecs.H264{SPS: sps, PPS: pps}}
+	audio := &gortmplib.Track{Codec: &rtmpcodecs.Opus{ChannelCount: 2}}
+	w := &gortmplib.Writer{Conn: c, Tracks: []*gortmplib.Track{video, audio}}
+	if err := w.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tracks are only known after two seconds of media
+	const frames = 3 * frameRate
+	for i := range frames {
+		au := [][]byte{{0x41, 0x9A, 0x24, 0x6C}}
+		if i%frameRate == 0 {
+			au = [][]byte{{0x65, 0x88, 0x84, 0x00}}
+		}
+
+		pts := time.Duration(i) * time.Second / frameRate
+		if err := w.WriteH264(video, pts, pts, au); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteOpus(audio, pts, []byte{0xFC, 0xFF, 0xFE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	p := <-publishers
+	select {
+	case <-p.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast did not end")
+	}
+
+	frameEnds := 0
+	for _, pkt := range p.video {
+		if pkt.Marker {
+			frameEnds++
+		}
+	}
+	if p.mimeType != webrtc.MimeTypeH264 || frameEnds != frames || len(p.audio) != frames {
+		t.Fatalf("wrong packets %s %d %d", p.mimeType, frameEnds, len(p.audio))
+	}
+
+	// Key frames get the parameter sets of the track
+	for i, pkt := range p.video {
+		if i != 0 && p.video[i-1].Marker && pkt.Timestamp%media.VideoClockRate == 0 {
+			if nalus, err := (&codecs.H264Packet{}).Unmarshal(pkt.Payload); err != nil || nalus[4]&0x1F != 7 {
+				t.Errorf("key frame does not start with the SPS %x", nalus)
+			}
+		}
+		if i != 0 && pkt.SequenceNumber != p.video[i-1].SequenceNumber+1 {
+			t.Errorf("sequence number %d does not follow %d", pkt.SequenceNumber, p.video[i-1].SequenceNumber)
+		}
+	}
+
+	// RTMP timestamps are in milliseconds
+	lastMilliseconds := uint32((frames - 1) * 1000 / frameRate)
+	if last := p.video[len(p.video)-1]; last.Timestamp != lastMilliseconds*media.VideoClockRate/1000 {
+		t.Errorf("wrong video timestamp %d", last.Timestamp)
+	}
+	if last := p.audio[len(p.audio)-1]; last.Timestamp != lastMilliseconds*media.AudioClockRate/1000 {
+		t.Errorf("wrong audio timestamp %d", last.Timestamp)
+	}
+}
+
+func TestInvalidStreamKey(t *testing.T) {
+	address, publishers := newTestServer(t)
+
+	for _, path := range []string{"/user/wrong", "/user", "/other/key"} {
+		c := dial(t, address+path)
+		w := &gortmplib.Writer{Conn: c, Tracks: []*gortmplib.Track{{Codec: &rtmpcodecs.Opus{ChannelCount: 2}}}}
+
+		// The server closes the connection, so writes fail eventually
+		failed := false
+		for range 100 {
+			if w.Initialize() != nil || w.WriteOpus(w.Tracks[0], 0, []byte{0xFC}) != nil {
+				failed = true
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Close()
+
+		if !failed {
+			t.Errorf("%s was able to publish", path)
+		}
+	}
+
+	select {
+	case <-publishers:
+		t.Error("broadcast was published with an invalid stream key")
+	default:
+	}
+}
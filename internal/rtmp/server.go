@@ -0,0 +1,128 @@
+// Package rtmp ingests broadcasts sent with RTMP and Enhanced RTMP.
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+)
+
+const (
+	// How long a client has to connect and send the tracks it publishes
+	handshakeTimeout = 10 * time.Second
+	// How long a broadcast may send nothing before it is ended
+	readTimeout = 10 * time.Second
+)
+
+var (
+	errNotPublishing = errors.New("connection does not publish")
+	errInvalidURL    = errors.New("URL is not rtmp://host/{username}/{stream key}")
+	errUnauthorized  = errors.New("invalid stream key")
+	errNoTracks      = errors.New("broadcast has no supported tracks")
+)
+
+// Server accepts RTMP broadcasts to rtmp://host/{username}/{stream key}.
+// Encoders that ask for a server and a stream key get rtmp://host/{username}
+// as the server.
+type Server struct {
+	// Authorize reports if streamKey may publish to the stream of username,
+	// ip is the address the client connected from.
+	Authorize func(ctx context.Context, ip, username, streamKey string) bool
+	// Publish starts a broadcast to the stream of username.
+	Publish func(username string) (ingest.Publisher, error)
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	if err := s.serveConn(conn); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("RTMP connection from %s ended: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+
+	serverConn := &gortmplib.ServerConn{RW: conn}
+	if err := serverConn.Initialize(); err != nil {
+		return err
+	}
+
+	if err := serverConn.Accept(); err != nil {
+		return err
+	}
+
+	if !serverConn.Publish {
+		return errNotPublishing
+	}
+
+	username, streamKey, ok := strings.Cut(strings.TrimPrefix(serverConn.URL.Path, "/"), "/")
+	if !ok || username == "" || streamKey == "" {
+		return errInvalidURL
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+
+	if !s.Authorize(context.Background(), ip, username, streamKey) {
+		return errUnauthorized
+	}
+
+	reader := &gortmplib.Reader{Conn: serverConn}
+	if err = reader.Initialize(); err != nil {
+		return err
+	}
+
+	if !hasSupportedTrack(reader.Tracks()) {
+		return errNoTracks
+	}
+
+	publisher, err := s.Publish(username)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	// Another publisher may take over the stream
+	go func() {
+		<-publisher.Done()
+		conn.Close()
+	}()
+
+	if err = forwardTracks(reader, username, publisher); err != nil {
+		return err
+	}
+
+	for {
+		if err = conn.SetDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+
+		if err = reader.Read(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package rtmp
+
+import (
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	rtmpcodecs "github.com/bluenviron/gortmplib/pkg/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/av1"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/webrtc/v4"
+)
+
+// hasSupportedTrack reports if any of tracks can be published.
+func hasSupportedTrack(tracks []*gortmplib.Track) bool {
+	for _, track := range tracks {
+		if track == nil {
+			continue
+		}
+
+		if track.Codec.IsVideo() {
+			return true
+		}
+
+		if _, ok := track.Codec.(*rtmpcodecs.Opus); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardTracks makes reader write the tracks it reads to publisher. Audio that
+// isn't Opus is dropped, it would have to be transcoded.
+func forwardTracks(reader *gortmplib.Reader, username string, publisher ingest.Publisher) error {
+	// Tracks that were announced but never set up are nil
+	tracks := slices.DeleteFunc(reader.Tracks(), func(track *gortmplib.Track) bool { return track == nil })
+
+	videoTracks := 0
+	for _, track := range tracks {
+		if track.Codec.IsVideo() {
+			videoTracks++
+		}
+	}
+
+	video := 0
+	for _, track := range tracks {
+		if !track.Codec.IsVideo() {
+			forwardAudio(reader, track, username, publisher)
+			continue
+		}
+
+		// Multiple video tracks of Enhanced RTMP are simulcast layers
+		rid := ""
+		if videoTracks > 1 {
+			rid = strconv.Itoa(video)
+		}
+		video++
+
+		switch codec := track.Codec.(type) {
+		case *rtmpcodecs.H264:
+			p, err := ingest.NewVideoPacketizer(publisher, rid, webrtc.MimeTypeH264, codec.SPS, codec.PPS)
+			if err != nil {
+				return err
+			}
+			reader.OnDataH264(track, func(pts, _ time.Duration, au [][]byte) {
+				p.WriteAccessUnit(rtpTimestamp(pts, media.VideoClockRate), au)
+			})
+		case *rtmpcodecs.H265:
+			p, err := ingest.NewVideoPacketizer(publisher, rid, webrtc.MimeTypeH265, codec.VPS, codec.SPS, codec.PPS)
+			if err != nil {
+				return err
+			}
+			reader.OnDataH265(track, func(pts, _ time.Duration, au [][]byte) {
+				p.WriteAccessUnit(rtpTimestamp(pts, media.VideoClockRate), au)
+			})
+		case *rtmpcodecs.AV1:
+			p, err := ingest.NewVideoPacketizer(publisher, rid, webrtc.MimeTypeAV1)
+			if err != nil {
+				return err
+			}
+			reader.OnDataAV1(track, func(pts time.Duration, tu [][]byte) {
+				frame, err := av1.Bitstream(tu).Marshal()
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				p.WriteFrame(rtpTimestamp(pts, media.VideoClockRate), frame)
+			})
+		case *rtmpcodecs.VP9:
+			p, err := ingest.NewVideoPacketizer(publisher, rid, webrtc.MimeTypeVP9)
+			if err != nil {
+				return err
+			}
+			reader.OnDataVP9(track, func(pts time.Duration, frame []byte) {
+				p.WriteFrame(rtpTimestamp(pts, media.VideoClockRate), frame)
+			})
+		}
+	}
+
+	return nil
+}
+
+// forwardAudio makes reader write an Opus track to publisher and drop others.
+func forwardAudio(reader *gortmplib.Reader, track *gortmplib.Track, username string, publisher ingest.Publisher) {
+	if _, ok := track.Codec.(*rtmpcodecs.Opus); ok {
+		p := ingest.NewAudioPacketizer(publisher)
+		reader.OnDataOpus(track, func(pts time.Duration, packet []byte) {
+			p.WriteOpus(rtpTimestamp(pts, media.AudioClockRate), packet)
+		})
+		return
+	}
+
+	log.Printf("RTMP broadcast of `%s` has %T audio, it is published without audio as only Opus is supported", username, track.Codec)
+
+	// Every track needs a callback
+	switch track.Codec.(type) {
+	case *rtmpcodecs.MPEG4Audio:
+		reader.OnDataMPEG4Audio(track, func(time.Duration, []byte) {})
+	case *rtmpcodecs.MPEG1Audio:
+		reader.OnDataMPEG1Audio(track, func(time.Duration, []byte) {})
+	case *rtmpcodecs.AC3:
+		reader.OnDataAC3(track, func(time.Duration, []byte) {})
+	case *rtmpcodecs.G711:
+		reader.OnDataG711(track, func(time.Duration, []byte) {})
+	case *rtmpcodecs.LPCM:
+		reader.OnDataLPCM(track, func(time.Duration, []byte) {})
+	}
+}
+
+// rtpTimestamp converts pts to a timestamp of clockRate. RTMP timestamps are
+// in milliseconds.
+func rtpTimestamp(pts time.Duration, clockRate int64) uint32 {
+	return uint32(pts.Milliseconds() * clockRate / 1000)
+}
@@ -0,0 +1,163 @@
+// Package srt ingests broadcasts sent with SRT, carrying MPEG-TS.
+package srt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+	gosrt "github.com/datarhei/gosrt"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+)
+
+const (
+	// How long a client has to send the tracks it publishes once connected
+	handshakeTimeout = 10 * time.Second
+	// How long a broadcast may send nothing before it is ended
+	readTimeout = 10 * time.Second
+
+	// Prefix of a streamid in the syntax of the SRT access control guidelines
+	accessControlPrefix = "#!::"
+)
+
+var (
+	errNotPublishing    = errors.New("connection does not publish")
+	errInvalidStreamID  = errors.New("streamid is not {username}/{stream key} or #!::r={username},s={stream key}")
+	errUnauthorized     = errors.New("invalid stream key")
+	errNoTracks         = errors.New("broadcast has no supported tracks")
+	errHandshakeTimeout = errors.New("no tracks were sent in time")
+)
+
+// Server accepts SRT broadcasts in caller mode with the streamid
+// {username}/{stream key}, or #!::r={username},s={stream key},m=publish.
+type Server struct {
+	// Authorize reports if streamKey may publish to the stream of username,
+	// ip is the address the client connected from.
+	Authorize func(ctx context.Context, ip, username, streamKey string) bool
+	// Publish starts a broadcast to the stream of username.
+	Publish func(username string) (ingest.Publisher, error)
+}
+
+// Listen listens for SRT connections on the UDP address.
+func Listen(address string) (gosrt.Listener, error) {
+	config := gosrt.DefaultConfig()
+	config.PeerIdleTimeout = readTimeout
+
+	return gosrt.Listen("srt", address, config)
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *Server) Serve(l gosrt.Listener) error {
+	for {
+		req, err := l.Accept2()
+		if err != nil {
+			return err
+		}
+
+		go s.handleRequest(req)
+	}
+}
+
+func (s *Server) handleRequest(req gosrt.ConnRequest) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr().String())
+	if err != nil {
+		ip = req.RemoteAddr().String()
+	}
+
+	username, streamKey, err := parseStreamID(req.StreamId())
+	switch {
+	case errors.Is(err, errNotPublishing):
+		req.Reject(gosrt.REJX_BAD_MODE)
+	case err != nil:
+		req.Reject(gosrt.REJX_BAD_REQUEST)
+	case !s.Authorize(context.Background(), ip, username, streamKey):
+		err = errUnauthorized
+		req.Reject(gosrt.REJX_UNAUTHORIZED)
+	}
+	if err != nil {
+		log.Printf("SRT connection from %s rejected: %s", req.RemoteAddr(), err)
+		return
+	}
+
+	conn, err := req.Accept()
+	if err != nil {
+		log.Printf("SRT connection from %s failed: %s", req.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+
+	if err = s.serveConn(conn, username); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("SRT connection from %s ended: %s", req.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) serveConn(conn gosrt.Conn, username string) error {
+	// Reads of SRT connections have no deadlines
+	handshakeTimer := time.AfterFunc(handshakeTimeout, func() { conn.Close() })
+	reader := &mpegts.Reader{R: conn}
+	err := reader.Initialize()
+	if !handshakeTimer.Stop() {
+		return errHandshakeTimeout
+	}
+	if err != nil {
+		return err
+	}
+
+	if !hasSupportedTrack(reader.Tracks()) {
+		return errNoTracks
+	}
+
+	publisher, err := s.Publish(username)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	// Another publisher may take over the stream
+	go func() {
+		<-publisher.Done()
+		conn.Close()
+	}()
+
+	if err = forwardTracks(reader, username, publisher); err != nil {
+		return err
+	}
+
+	for {
+		if err = reader.Read(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseStreamID returns the username and stream key of a streamid.
+func parseStreamID(streamID string) (username, streamKey string, err error) {
+	if !strings.HasPrefix(streamID, accessControlPrefix) {
+		username, streamKey, _ = strings.Cut(streamID, "/")
+	} else {
+		for _, pair := range strings.Split(strings.TrimPrefix(streamID, accessControlPrefix), ",") {
+			key, value, _ := strings.Cut(pair, "=")
+			switch key {
+			case "r":
+				username = value
+			case "s":
+				streamKey = value
+			case "m":
+				if value != "publish" {
+					return "", "", errNotPublishing
+				}
+			}
+		}
+	}
+
+	if username == "" || streamKey == "" {
+		return "", "", errInvalidStreamID
+	}
+
+	return username, streamKey, nil
+}
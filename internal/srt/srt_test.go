@@ -0,0 +1,222 @@
+package srt
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+	tscodecs "github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts/codecs"
+	gosrt "github.com/datarhei/gosrt"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	frameRate = 30
+	// Size of the payloads of SRT packets, seven MPEG-TS packets
+	payloadSize = 7 * 188
+)
+
+type testPublisher struct {
+	mu           sync.Mutex
+	audio, video []*rtp.Packet
+	mimeType     string
+	closed       chan struct{}
+}
+
+func (p *testPublisher) WriteAudio(pkt *rtp.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.audio = append(p.audio, pkt.Clone())
+}
+
+func (p *testPublisher) WriteVideo(rid, mimeType string, pkt *rtp.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mimeType = mimeType
+	p.video = append(p.video, pkt.Clone())
+}
+
+func (p *testPublisher) Close() {
+	close(p.closed)
+}
+
+func (p *testPublisher) Done() <-chan struct{} {
+	return p.closed
+}
+
+func (p *testPublisher) audioPackets() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.audio)
+}
+
+// newTestServer serves SRT for the user with the stream key "key".
+func newTestServer(t *testing.T) (string, chan *testPublisher) {
+	t.Helper()
+
+	publishers := make(chan *testPublisher, 1)
+	s := &Server{
+		Authorize: func(_ context.Context, _, username, streamKey string) bool {
+			return username == "user" && streamKey == "key"
+		},
+		Publish: func(string) (ingest.Publisher, error) {
+			p := &testPublisher{closed: make(chan struct{})}
+			publishers <- p
+			return p, nil
+		},
+	}
+
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Close)
+	go s.Serve(l) //nolint:errcheck
+
+	return l.Addr().String(), publishers
+}
+
+func dial(address, streamID string) (gosrt.Conn, error) {
+	config := gosrt.DefaultConfig()
+	config.StreamId = streamID
+
+	return gosrt.Dial("srt", address, config)
+}
+
+func TestPublishH264AndOpus(t *testing.T) {
+	address, publishers := newTestServer(t)
+
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps, _ := hex.DecodeString("68ebecb22c")
+
+	conn, err := dial(address, "#!::r=user,s=key,m=publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bw := bufio.NewWriterSize(conn, payloadSize)
+	video := &mpegts.Track{Codec: &tscodecs.H264{}}
+	audio := &mpegts.Track{Codec: &tscodecs.Opus{ChannelCount: 2}}
+	w := &mpegts.Writer{W: bw, Tracks: []*mpegts.Track{video, audio}}
+	if err = w.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each frame comes with two 10 ms Opus packets
+	opusPacket := []byte{0xF0, 0xFF, 0xFE}
+	const frames = 3 * frameRate
+	for i := range frames {
+		au := [][]byte{{0x41, 0x9A, 0x24, 0x6C}}
+		if i%frameRate == 0 {
+			au = [][]byte{sps, pps, {0x65, 0x88, 0x84, 0x00}}
+		}
+
+		pts := int64(i) * 90000 / frameRate
+		if err = w.WriteH264(video, pts, pts, au); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.WriteOpus(audio, pts, [][]byte{opusPacket, opusPacket}); err != nil {
+			t.Fatal(err)
+		}
+		if err = bw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var p *testPublisher
+	select {
+	case p = <-publishers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast was not published")
+	}
+
+	// Packets are delivered after the latency of the connection, closing it
+	// drops the ones that weren't. The last access unit may only be emitted
+	// once the connection ends.
+	for i := 0; i < 100 && p.audioPackets() < 2*(frames-1); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn.Close()
+
+	select {
+	case <-p.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast did not end")
+	}
+
+	frameEnds := 0
+	for _, pkt := range p.video {
+		if pkt.Marker {
+			frameEnds++
+		}
+	}
+	if p.mimeType != webrtc.MimeTypeH264 || frameEnds < frames-1 || frameEnds > frames || len(p.audio) < 2*(frames-1) {
+		t.Fatalf("wrong packets %s %d %d", p.mimeType, frameEnds, len(p.audio))
+	}
+
+	// Key frames start with the parameter sets
+	for i, pkt := range p.video {
+		if i == 0 || p.video[i-1].Marker {
+			nalus, err := (&codecs.H264Packet{}).Unmarshal(pkt.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyframe := pkt.Timestamp%media.VideoClockRate == 0; keyframe != (nalus[4]&0x1F == 7) {
+				t.Errorf("frame at %d starts with %x", pkt.Timestamp, nalus)
+			}
+		}
+		if i != 0 && pkt.SequenceNumber != p.video[i-1].SequenceNumber+1 {
+			t.Errorf("sequence number %d does not follow %d", pkt.SequenceNumber, p.video[i-1].SequenceNumber)
+		}
+	}
+
+	// Timestamps start at zero, packets of an access unit follow each other
+	if p.video[0].Timestamp != 0 {
+		t.Errorf("wrong video timestamp %d", p.video[0].Timestamp)
+	}
+	if p.audio[1].Timestamp != media.AudioClockRate/100 || p.audio[2].Timestamp != media.AudioClockRate/frameRate {
+		t.Errorf("wrong audio timestamps %d %d", p.audio[1].Timestamp, p.audio[2].Timestamp)
+	}
+}
+
+func TestInvalidStreamID(t *testing.T) {
+	address, publishers := newTestServer(t)
+
+	for _, streamID := range []string{"user/wrong", "user", "other/key", "#!::r=user,s=key,m=request", ""} {
+		if conn, err := dial(address, streamID); err == nil {
+			conn.Close()
+			t.Errorf("%q was able to publish", streamID)
+		}
+	}
+
+	select {
+	case <-publishers:
+		t.Error("broadcast was published with an invalid streamid")
+	default:
+	}
+}
+
+func TestParseStreamID(t *testing.T) {
+	for streamID, expected := range map[string][2]string{
+		"user/key":                   {"user", "key"},
+		"user/key/with/slashes":      {"user", "key/with/slashes"},
+		"#!::r=user,s=key":           {"user", "key"},
+		"#!::s=key,m=publish,r=user": {"user", "key"},
+		"#!::r=user,s=key,m=request": {},
+		"#!::r=user":                 {},
+		"user":                       {},
+	} {
+		username, streamKey, err := parseStreamID(streamID)
+		if (err == nil) != (expected[0] != "") || username != expected[0] || streamKey != expected[1] {
+			t.Errorf("%q was parsed as %q %q %v", streamID, username, streamKey, err)
+		}
+	}
+}
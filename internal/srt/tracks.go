@@ -0,0 +1,113 @@
+package srt
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/opus"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+	tscodecs "github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts/codecs"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/webrtc/v4"
+)
+
+// isVideo reports if a track can be published as video.
+func isVideo(track *mpegts.Track) bool {
+	switch track.Codec.(type) {
+	case *tscodecs.H264, *tscodecs.H265:
+		return true
+	}
+
+	return false
+}
+
+// hasSupportedTrack reports if any of tracks can be published.
+func hasSupportedTrack(tracks []*mpegts.Track) bool {
+	for _, track := range tracks {
+		if _, ok := track.Codec.(*tscodecs.Opus); ok || isVideo(track) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardTracks makes reader write the tracks it reads to publisher. Other
+// tracks are dropped, audio that isn't Opus would have to be transcoded.
+func forwardTracks(reader *mpegts.Reader, username string, publisher ingest.Publisher) error {
+	videoTracks := 0
+	for _, track := range reader.Tracks() {
+		if isVideo(track) {
+			videoTracks++
+		}
+	}
+
+	// Timestamps of all tracks have the same origin, so they stay in sync
+	timeDecoder := &mpegts.TimeDecoder{}
+	timeDecoder.Initialize()
+
+	video := 0
+	for _, track := range reader.Tracks() {
+		if !isVideo(track) {
+			forwardAudio(reader, track, timeDecoder, username, publisher)
+			continue
+		}
+
+		// Multiple video tracks are simulcast layers
+		rid := ""
+		if videoTracks > 1 {
+			rid = strconv.Itoa(video)
+		}
+		video++
+
+		mimeType := webrtc.MimeTypeH264
+		if _, ok := track.Codec.(*tscodecs.H265); ok {
+			mimeType = webrtc.MimeTypeH265
+		}
+
+		// Parameter sets of MPEG-TS come with the key frames
+		p, err := ingest.NewVideoPacketizer(publisher, rid, mimeType)
+		if err != nil {
+			return err
+		}
+
+		write := func(pts, _ int64, au [][]byte) error {
+			p.WriteAccessUnit(rtpTimestamp(timeDecoder.Decode(pts), media.VideoClockRate), au)
+			return nil
+		}
+		if mimeType == webrtc.MimeTypeH264 {
+			reader.OnDataH264(track, write)
+		} else {
+			reader.OnDataH265(track, write)
+		}
+	}
+
+	return nil
+}
+
+// forwardAudio makes reader write an Opus track to publisher, others are
+// dropped.
+func forwardAudio(reader *mpegts.Reader, track *mpegts.Track, timeDecoder *mpegts.TimeDecoder, username string, publisher ingest.Publisher) {
+	if _, ok := track.Codec.(*tscodecs.Opus); !ok {
+		log.Printf("SRT broadcast of `%s` has %T track, it is dropped as only H.264, H.265 and Opus are supported", username, track.Codec)
+		return
+	}
+
+	p := ingest.NewAudioPacketizer(publisher)
+	reader.OnDataOpus(track, func(pts int64, packets [][]byte) error {
+		// Packets of an access unit follow each other
+		timestamp := rtpTimestamp(timeDecoder.Decode(pts), media.AudioClockRate)
+		for _, packet := range packets {
+			p.WriteOpus(timestamp, packet)
+			timestamp += uint32(opus.PacketDuration2(packet))
+		}
+		return nil
+	})
+}
+
+// rtpTimestamp converts pts to a timestamp of clockRate. MPEG-TS timestamps
+// are in 90 kHz.
+func rtpTimestamp(pts, clockRate int64) uint32 {
+	return uint32(pts * clockRate / 90000)
+}
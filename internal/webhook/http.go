@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/google/uuid"
+)
+
+type (
+	// webhookRequestJSON creates a webhook, a secret is generated if it is
+	// empty.
+	webhookRequestJSON struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+
+	// webhookJSON is a webhook, the secret is only returned when it is
+	// created.
+	webhookJSON struct {
+		ID        string    `json:"id"`
+		URL       string    `json:"url"`
+		Events    []string  `json:"events"`
+		Secret    string    `json:"secret,omitempty"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	deliveryJSON struct {
+		ID      string          `json:"id"`
+		Event   string          `json:"event"`
+		Payload json.RawMessage `json:"payload"`
+		// Attempts made so far, StatusCode is of the last one and 0 if the
+		// receiver didn't respond
+		Attempts   int64     `json:"attempts"`
+		StatusCode int64     `json:"statusCode"`
+		Error      string    `json:"error"`
+		Delivered  bool      `json:"delivered"`
+		CreatedAt  time.Time `json:"createdAt"`
+		UpdatedAt  time.Time `json:"updatedAt"`
+	}
+)
+
+func (req *webhookRequestJSON) validate() error {
+	u, err := url.Parse(req.URL)
+	switch {
+	case err != nil || u.Host == "":
+		return errors.New("URL is invalid.")
+	case u.Scheme != "http" && u.Scheme != "https":
+		return errors.New("URL is not http or https.")
+	case len(req.Events) == 0:
+		return errors.New("Events are empty.")
+	}
+
+	for _, event := range req.Events {
+		if !validEvent(event) {
+			return errors.New("Unknown event " + event + ".")
+		}
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) ListHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := d.db.ListWebhooks(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := []webhookJSON{}
+	for _, webhook := range webhooks {
+		events, err := d.db.ListWebhookEvents(r.Context(), webhook.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out = append(out, webhookJSON{ID: webhook.ID, URL: webhook.Url, Events: events, CreatedAt: webhook.CreatedAt})
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (d *Dispatcher) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Secret == "" {
+		req.Secret = rand.Text()
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	webhook, err := d.db.CreateWebhook(r.Context(), database.CreateWebhookParams{
+		ID:        id.String(),
+		Url:       req.URL,
+		Secret:    req.Secret,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slices.Sort(req.Events)
+	events := slices.Compact(req.Events)
+	for _, event := range events {
+		if err = d.db.AddWebhookEvent(r.Context(), database.AddWebhookEventParams{WebhookID: webhook.ID, Event: event}); err != nil {
+			_, _ = d.db.DeleteWebhook(r.Context(), webhook.ID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, webhookJSON{
+		ID:        webhook.ID,
+		URL:       webhook.Url,
+		Events:    events,
+		Secret:    webhook.Secret,
+		CreatedAt: webhook.CreatedAt,
+	})
+}
+
+// DeleteHandler deletes a webhook and its delivery log, deliveries being
+// retried still finish.
+func (d *Dispatcher) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	deleted, err := d.db.DeleteWebhook(r.Context(), r.PathValue("id"))
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case deleted == 0:
+		http.Error(w, errors.New("Webhook does not exist.").Error(), http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeliveriesHandler returns the delivery log of a webhook, newest first.
+func (d *Dispatcher) DeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := d.db.ListWebhookDeliveries(r.Context(), database.ListWebhookDeliveriesParams{
+		WebhookID: r.PathValue("id"),
+		Limit:     keepDeliveries,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := []deliveryJSON{}
+	for _, delivery := range deliveries {
+		out = append(out, deliveryJSON{
+			ID:         delivery.ID,
+			Event:      delivery.Event,
+			Payload:    json.RawMessage(delivery.Payload),
+			Attempts:   delivery.Attempts,
+			StatusCode: delivery.StatusCode,
+			Error:      delivery.Error,
+			Delivered:  delivery.Delivered,
+			CreatedAt:  delivery.CreatedAt,
+			UpdatedAt:  delivery.UpdatedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,237 @@
+// Package webhook tells other services about streams with signed HTTP
+// requests, like a broadcast starting or a recording being finished.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+	"github.com/glimesh/broadcast-box/internal/recording"
+	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/google/uuid"
+)
+
+const (
+	EventStreamStart     = internalwebrtc.StreamEventStart
+	EventStreamStop      = internalwebrtc.StreamEventStop
+	EventFirstViewer     = internalwebrtc.StreamEventFirstViewer
+	EventLastViewer      = internalwebrtc.StreamEventLastViewer
+	EventRecordingFinish = "recording.finish"
+	EventStreamKeyRotate = "streamkey.rotate"
+
+	EventHeader    = "X-Broadcast-Box-Event"
+	DeliveryHeader = "X-Broadcast-Box-Delivery"
+	// sha256= and the hex HMAC-SHA256 of the body, keyed with the secret of
+	// the webhook
+	SignatureHeader = "X-Broadcast-Box-Signature"
+
+	// A delivery is given up after this many attempts, the delay between them
+	// doubles from minRetryDelay
+	maxAttempts   = 5
+	minRetryDelay = time.Second
+	// How long the receiver has to respond to an attempt
+	attemptTimeout = 10 * time.Second
+	// Deliveries kept in the log of each webhook
+	keepDeliveries = 100
+)
+
+// Events are the events webhooks can be sent for.
+var Events = []string{
+	EventStreamStart,
+	EventStreamStop,
+	EventFirstViewer,
+	EventLastViewer,
+	EventRecordingFinish,
+	EventStreamKeyRotate,
+}
+
+type (
+	// Dispatcher sends events to the webhooks that subscribed to them. Sending
+	// never blocks, deliveries are retried in the background and logged.
+	Dispatcher struct {
+		db         *database.Queries
+		client     *http.Client
+		retryDelay time.Duration
+	}
+
+	// payload is the body of every webhook request.
+	payload struct {
+		ID        string    `json:"id"`
+		Event     string    `json:"event"`
+		Stream    string    `json:"stream"`
+		CreatedAt time.Time `json:"createdAt"`
+		Data      any       `json:"data,omitempty"`
+	}
+)
+
+func New(db *database.Queries) *Dispatcher {
+	return &Dispatcher{
+		db:         db,
+		client:     &http.Client{Timeout: attemptTimeout},
+		retryDelay: minRetryDelay,
+	}
+}
+
+// StreamEvent sends an event of webrtc, it is a webrtc.StreamListener.
+func (d *Dispatcher) StreamEvent(streamKey, event string) {
+	d.Send(event, streamKey, nil)
+}
+
+// RecordingFinished sends EventRecordingFinish, it is a recording.Recorder
+// OnFinish.
+func (d *Dispatcher) RecordingFinished(username string, r recording.Recording) {
+	d.Send(EventRecordingFinish, username, r)
+}
+
+// StreamKeyRotated sends EventStreamKeyRotate, the key itself isn't sent.
+func (d *Dispatcher) StreamKeyRotated(username string) {
+	d.Send(EventStreamKeyRotate, username, nil)
+}
+
+// Send delivers an event of the stream of a user to the webhooks that
+// subscribed to it, data is the event specific part of the payload.
+func (d *Dispatcher) Send(event, stream string, data any) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	body, err := json.Marshal(payload{
+		ID:        id.String(),
+		Event:     event,
+		Stream:    stream,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	go func() {
+		webhooks, err := d.db.ListWebhooksForEvent(context.Background(), event)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, webhook := range webhooks {
+			go d.deliver(webhook, event, body)
+		}
+	}()
+}
+
+// deliver posts body to a webhook until it is accepted, the receiver rejects
+// it or maxAttempts were made. Every attempt is written to the delivery log.
+func (d *Dispatcher) deliver(webhook database.Webhook, event string, body []byte) {
+	ctx := context.Background()
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if err = d.db.CreateWebhookDelivery(ctx, database.CreateWebhookDeliveryParams{
+		ID:        id.String(),
+		WebhookID: webhook.ID,
+		Event:     event,
+		Payload:   string(body),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}); err != nil {
+		log.Println(err)
+		return
+	}
+
+	delay := d.retryDelay
+	for attempt := 1; ; attempt++ {
+		statusCode, err := d.post(webhook, event, id.String(), body)
+
+		errorText := ""
+		if err != nil {
+			errorText = err.Error()
+		}
+		if updateErr := d.db.UpdateWebhookDelivery(ctx, database.UpdateWebhookDeliveryParams{
+			Attempts:   int64(attempt),
+			StatusCode: int64(statusCode),
+			Error:      errorText,
+			Delivered:  err == nil,
+			UpdatedAt:  time.Now().UTC().Truncate(time.Second),
+			ID:         id.String(),
+		}); updateErr != nil {
+			log.Println(updateErr)
+		}
+
+		if err == nil || !retryable(statusCode) || attempt == maxAttempts {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	if err = d.db.DeleteOldWebhookDeliveries(ctx, database.DeleteOldWebhookDeliveriesParams{
+		WebhookID: webhook.ID,
+		Keep:      keepDeliveries,
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// post makes one attempt to deliver body, it returns the status code of the
+// response or 0 if there was none.
+func (d *Dispatcher) post(webhook database.Webhook, event, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(SignatureHeader, sign(webhook.Secret, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// Drained so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+// retryable reports if a failed attempt that got statusCode may succeed later.
+func retryable(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validEvent(event string) bool {
+	return slices.Contains(Events, event)
+}
@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/database"
+)
+
+func newTestDispatcher(t *testing.T) *Dispatcher {
+	t.Helper()
+
+	db, err := database.Open(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	d := New(database.New(db))
+	d.retryDelay = time.Millisecond
+	return d
+}
+
+// createWebhook creates a webhook with the admin API and returns it.
+func createWebhook(t *testing.T, d *Dispatcher, body string) webhookJSON {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	d.CreateHandler(rec, httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("webhook was not created %d %s", rec.Code, rec.Body)
+	}
+
+	var webhook webhookJSON
+	if err := json.NewDecoder(rec.Body).Decode(&webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	return webhook
+}
+
+// waitForDelivery waits until the last delivery of a webhook is done.
+func waitForDelivery(t *testing.T, d *Dispatcher, webhookID string, attempts int64) deliveryJSON {
+	t.Helper()
+
+	for range 200 {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/webhooks/"+webhookID+"/deliveries", nil)
+		req.SetPathValue("id", webhookID)
+		d.DeliveriesHandler(rec, req)
+
+		var deliveries []deliveryJSON
+		if err := json.NewDecoder(rec.Body).Decode(&deliveries); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(deliveries) != 0 && deliveries[0].Attempts == attempts {
+			return deliveries[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("delivery did not make %d attempts", attempts)
+	return deliveryJSON{}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	d := newTestDispatcher(t)
+
+	var requests atomic.Int32
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != sign("secret", body) || r.Header.Get(EventHeader) != EventStreamStart {
+			t.Errorf("wrong headers %v", r.Header)
+		}
+
+		// The first attempt fails
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	webhook := createWebhook(t, d, `{"url": "`+receiver.URL+`", "events": ["stream.start"], "secret": "secret"}`)
+	if webhook.Secret != "secret" {
+		t.Errorf("wrong secret %q", webhook.Secret)
+	}
+
+	// Not subscribed to
+	d.StreamEvent("user", EventStreamStop)
+	d.StreamEvent("user", EventStreamStart)
+
+	var p payload
+	select {
+	case body := <-bodies:
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	if p.Event != EventStreamStart || p.Stream != "user" || p.ID == "" {
+		t.Errorf("wrong payload %+v", p)
+	}
+
+	delivery := waitForDelivery(t, d, webhook.ID, 2)
+	if !delivery.Delivered || delivery.StatusCode != http.StatusOK || delivery.Event != EventStreamStart {
+		t.Errorf("wrong delivery %+v", delivery)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("%d requests were made", requests.Load())
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	d := newTestDispatcher(t)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	webhook := createWebhook(t, d, `{"url": "`+receiver.URL+`", "events": ["streamkey.rotate"]}`)
+	if webhook.Secret == "" {
+		t.Error("no secret was generated")
+	}
+
+	d.StreamKeyRotated("user")
+
+	delivery := waitForDelivery(t, d, webhook.ID, maxAttempts)
+	if delivery.Delivered || delivery.StatusCode != http.StatusInternalServerError || delivery.Error == "" {
+		t.Errorf("wrong delivery %+v", delivery)
+	}
+}
+
+func TestCreateValidates(t *testing.T) {
+	d := newTestDispatcher(t)
+
+	for _, body := range []string{
+		`{"url": "ftp://example.com", "events": ["stream.start"]}`,
+		`{"url": "https://example.com", "events": []}`,
+		`{"url": "https://example.com", "events": ["stream.pause"]}`,
+	} {
+		rec := httptest.NewRecorder()
+		d.CreateHandler(rec, httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s was accepted", body)
+		}
+	}
+}
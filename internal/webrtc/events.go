@@ -0,0 +1,195 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+)
+
+const (
+	WHEPEventLayers        = "layers"
+	WHEPEventActiveLayer   = "active-layer"
+	WHEPEventViewerCount   = "viewer-count"
+	WHEPEventStreamOnline  = "stream-online"
+	WHEPEventStreamOffline = "stream-offline"
+)
+
+type (
+	// WHEPEvent is a server-sent event of a WHEP session.
+	WHEPEvent struct {
+		Name string
+		Data []byte
+	}
+
+	// Subscribers of a WHEP session, they are woken up whenever something they
+	// send events about might have changed
+	whepSubscribers struct {
+		mu   sync.Mutex
+		subs map[chan struct{}]struct{}
+		// Closed when the session ends
+		done chan struct{}
+	}
+
+	// What subscribers of a WHEP session last told their client
+	whepState struct {
+		layers      []string
+		activeLayer string
+		viewerCount int
+		online      bool
+	}
+
+	activeLayerResponse struct {
+		MediaId    string `json:"mediaId"`
+		EncodingId string `json:"encodingId"`
+	}
+
+	viewerCountResponse struct {
+		ViewerCount int `json:"viewerCount"`
+	}
+
+	streamStateResponse struct {
+		StreamKey string `json:"streamKey"`
+	}
+)
+
+func newWHEPSubscribers() *whepSubscribers {
+	return &whepSubscribers{subs: map[chan struct{}]struct{}{}, done: make(chan struct{})}
+}
+
+func (w *whepSubscribers) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for sub := range w.subs {
+		select {
+		case sub <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyWHEPSessions wakes up the subscribers of every WHEP session of the
+// stream. whepSessionsLock must be held.
+func (s *stream) notifyWHEPSessions() {
+	for _, session := range s.whepSessions {
+		session.subscribers.notify()
+	}
+}
+
+// WHEPSubscribe returns the events of a WHEP session. The current layers,
+// active layer, viewer count and stream state are sent right away, afterwards
+// only their changes. The channel is closed when the session ends or c is
+// done.
+func WHEPSubscribe(c context.Context, whepSessionId string) (<-chan WHEPEvent, error) {
+	streamMapLock.Lock()
+	var (
+		streamKey string
+		stream    *stream
+		session   *whepSession
+	)
+	for key, s := range streamMap {
+		s.whepSessionsLock.RLock()
+		if found, ok := s.whepSessions[whepSessionId]; ok {
+			streamKey, stream, session = key, s, found
+		}
+		s.whepSessionsLock.RUnlock()
+	}
+	streamMapLock.Unlock()
+
+	if session == nil {
+		return nil, ErrSessionNotFound
+	}
+
+	wake := make(chan struct{}, 1)
+	session.subscribers.mu.Lock()
+	session.subscribers.subs[wake] = struct{}{}
+	session.subscribers.mu.Unlock()
+
+	events := make(chan WHEPEvent)
+	go func() {
+		defer func() {
+			session.subscribers.mu.Lock()
+			delete(session.subscribers.subs, wake)
+			session.subscribers.mu.Unlock()
+			close(events)
+		}()
+
+		var last *whepState
+		for {
+			state := session.state(stream)
+			for _, event := range state.events(last, streamKey) {
+				select {
+				case events <- event:
+				case <-session.subscribers.done:
+					return
+				case <-c.Done():
+					return
+				}
+			}
+			last = &state
+
+			select {
+			case <-wake:
+			case <-session.subscribers.done:
+				return
+			case <-c.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func (w *whepSession) state(s *stream) whepState {
+	state := whepState{online: s.hasWHIPClient.Load()}
+	state.activeLayer, _ = w.currentLayer.Load().(string)
+
+	streamMapLock.Lock()
+	for _, t := range s.videoTracks {
+		state.layers = append(state.layers, t.rid)
+	}
+	streamMapLock.Unlock()
+
+	s.whepSessionsLock.RLock()
+	state.viewerCount = len(s.whepSessions)
+	s.whepSessionsLock.RUnlock()
+
+	return state
+}
+
+// events returns the events that tell a client who last got told about last
+// of s, all of them if last is nil.
+func (s whepState) events(last *whepState, streamKey string) []WHEPEvent {
+	events := []WHEPEvent{}
+	add := func(name string, v any) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		events = append(events, WHEPEvent{Name: name, Data: data})
+	}
+
+	if last == nil || s.online != last.online {
+		if s.online {
+			add(WHEPEventStreamOnline, streamStateResponse{StreamKey: streamKey})
+		} else {
+			add(WHEPEventStreamOffline, streamStateResponse{StreamKey: streamKey})
+		}
+	}
+
+	if last == nil || !slices.Equal(s.layers, last.layers) {
+		add(WHEPEventLayers, layersResponse(s.layers))
+	}
+
+	if s.activeLayer != "" && (last == nil || s.activeLayer != last.activeLayer) {
+		add(WHEPEventActiveLayer, activeLayerResponse{MediaId: "1", EncodingId: s.activeLayer})
+	}
+
+	if last == nil || s.viewerCount != last.viewerCount {
+		add(WHEPEventViewerCount, viewerCountResponse{ViewerCount: s.viewerCount})
+	}
+
+	return events
+}
@@ -0,0 +1,37 @@
+package webrtc
+
+import (
+	"slices"
+	"testing"
+)
+
+func eventNames(events []WHEPEvent) []string {
+	names := []string{}
+	for _, e := range events {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+func TestWHEPStateEvents(t *testing.T) {
+	state := whepState{layers: []string{"high", "low"}, viewerCount: 1, online: true}
+
+	initial := state.events(nil, "test")
+	if names := eventNames(initial); !slices.Equal(names, []string{WHEPEventStreamOnline, WHEPEventLayers, WHEPEventViewerCount}) {
+		t.Errorf("wrong initial events %v", names)
+	}
+
+	if string(initial[1].Data) != `{"1":{"layers":[{"encodingId":"high"},{"encodingId":"low"}]}}` {
+		t.Errorf("wrong layers %s", initial[1].Data)
+	}
+
+	if events := state.events(&state, "test"); len(events) != 0 {
+		t.Errorf("unchanged state sent events %v", eventNames(events))
+	}
+
+	changed := whepState{layers: []string{"high"}, activeLayer: "high", viewerCount: 2}
+	if names := eventNames(changed.events(&state, "test")); !slices.Equal(names, []string{WHEPEventStreamOffline, WHEPEventLayers, WHEPEventActiveLayer, WHEPEventViewerCount}) {
+		t.Errorf("wrong events for changes %v", names)
+	}
+}
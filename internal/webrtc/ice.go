@@ -0,0 +1,297 @@
+package webrtc
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	sdpAttributeICEUfrag        = "a=ice-ufrag:"
+	sdpAttributeICEPwd          = "a=ice-pwd:"
+	sdpAttributeICEOptions      = "a=ice-options:"
+	sdpAttributeMid             = "a=mid:"
+	sdpAttributeCandidate       = "a=candidate:"
+	sdpAttributeEndOfCandidates = "a=end-of-candidates"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("session does not exist")
+	ErrICESessionMismatch = errors.New("ICE session does not match If-Match")
+	ErrInvalidSDPFragment = errors.New("invalid SDP fragment")
+
+	// How long clients that support trickle ICE wait for the candidates of the
+	// server before they are answered, 0 to always wait for all of them
+	trickleAnswerTimeout time.Duration
+)
+
+type (
+	// iceSession handles trickle ICE and ICE restarts requested with PATCH on a
+	// WHIP or WHEP session.
+	iceSession struct {
+		peerConnection *webrtc.PeerConnection
+
+		mu sync.Mutex
+		// Local candidates already sent in the answer or a PATCH response
+		sentCandidates      map[string]bool
+		sentEndOfCandidates bool
+	}
+
+	// sdpFragment is an application/trickle-ice-sdpfrag body, see RFC 8840.
+	sdpFragment struct {
+		ufrag           string
+		pwd             string
+		candidates      []string
+		endOfCandidates bool
+	}
+)
+
+func newICESession(peerConnection *webrtc.PeerConnection) *iceSession {
+	return &iceSession{peerConnection: peerConnection, sentCandidates: map[string]bool{}}
+}
+
+// ICEETag returns the entity tag of the ICE session an answer or SDP fragment
+// of the server belongs to. It changes with every ICE restart.
+func ICEETag(sdp string) string {
+	return `"` + sdpAttribute(sdp, sdpAttributeICEUfrag) + `"`
+}
+
+// answer waits for the candidates of the server and returns the local
+// description.
+func (s *iceSession) answer(offer string, gatherComplete <-chan struct{}) string {
+	waitForCandidates(offer, gatherComplete)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sdp := s.peerConnection.LocalDescription().SDP
+	s.markSent(sdp)
+	return sdp
+}
+
+// patch applies an SDP fragment sent by the client. Fragments with new ICE
+// credentials restart ICE and must be sent with If-Match: *, others add remote
+// candidates. It returns a fragment with the local candidates the client
+// doesn't know yet, or "" if there are none.
+func (s *iceSession) patch(ifMatch, body string) (string, error) {
+	fragment, err := parseSDPFragment(body)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remote := s.peerConnection.RemoteDescription()
+	local := s.peerConnection.LocalDescription()
+	if remote == nil || local == nil {
+		return "", ErrSessionNotFound
+	}
+
+	if fragment.ufrag != "" && fragment.ufrag != sdpAttribute(remote.SDP, sdpAttributeICEUfrag) {
+		if ifMatch != "*" {
+			return "", ErrICESessionMismatch
+		}
+
+		return s.restart(remote.SDP, fragment)
+	}
+
+	if ifMatch != "" && ifMatch != "*" && ifMatch != ICEETag(local.SDP) {
+		return "", ErrICESessionMismatch
+	}
+
+	for _, candidate := range fragment.candidates {
+		if err = s.peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+			return "", err
+		}
+	}
+
+	return s.unsentCandidates(s.peerConnection.LocalDescription().SDP), nil
+}
+
+// restart renegotiates the remote offer with the credentials of fragment and
+// returns a fragment with the new local credentials and candidates.
+func (s *iceSession) restart(remoteSDP string, fragment sdpFragment) (string, error) {
+	if fragment.pwd == "" {
+		return "", ErrInvalidSDPFragment
+	}
+
+	offer := []string{}
+	for _, line := range sdpLines(remoteSDP) {
+		switch {
+		case strings.HasPrefix(line, sdpAttributeICEUfrag):
+			line = sdpAttributeICEUfrag + fragment.ufrag
+		case strings.HasPrefix(line, sdpAttributeICEPwd):
+			line = sdpAttributeICEPwd + fragment.pwd
+		case strings.HasPrefix(line, sdpAttributeCandidate), line == sdpAttributeEndOfCandidates:
+			continue
+		}
+		offer = append(offer, line)
+	}
+
+	if err := s.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  strings.Join(offer, "\r\n") + "\r\n",
+		Type: webrtc.SDPTypeOffer,
+	}); err != nil {
+		return "", err
+	}
+
+	for _, candidate := range fragment.candidates {
+		if err := s.peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+			return "", err
+		}
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(s.peerConnection)
+	answer, err := s.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	} else if err = s.peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	waitForCandidates(remoteSDP, gatherComplete)
+
+	sdp := s.peerConnection.LocalDescription().SDP
+	s.sentCandidates = map[string]bool{}
+	s.sentEndOfCandidates = false
+	s.markSent(sdp)
+
+	return localSDPFragment(sdp, sdpCandidates(sdp), strings.Contains(sdp, sdpAttributeEndOfCandidates)), nil
+}
+
+// unsentCandidates returns a fragment with the candidates of sdp that weren't
+// sent to the client yet.
+func (s *iceSession) unsentCandidates(sdp string) string {
+	candidates := []string{}
+	for _, candidate := range sdpCandidates(sdp) {
+		if !s.sentCandidates[candidate] {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	endOfCandidates := !s.sentEndOfCandidates && strings.Contains(sdp, sdpAttributeEndOfCandidates)
+	if len(candidates) == 0 && !endOfCandidates {
+		return ""
+	}
+
+	s.markSent(sdp)
+	return localSDPFragment(sdp, candidates, endOfCandidates)
+}
+
+func (s *iceSession) markSent(sdp string) {
+	for _, candidate := range sdpCandidates(sdp) {
+		s.sentCandidates[candidate] = true
+	}
+	s.sentEndOfCandidates = strings.Contains(sdp, sdpAttributeEndOfCandidates)
+}
+
+// localSDPFragment builds a fragment with the ICE credentials and first media
+// section of sdp. Media is bundled so the candidates are valid for all of it.
+func localSDPFragment(sdp string, candidates []string, endOfCandidates bool) string {
+	fragment := []string{
+		sdpAttributeICEUfrag + sdpAttribute(sdp, sdpAttributeICEUfrag),
+		sdpAttributeICEPwd + sdpAttribute(sdp, sdpAttributeICEPwd),
+	}
+
+	for _, line := range sdpLines(sdp) {
+		if strings.HasPrefix(line, "m=") {
+			fragment = append(fragment, line, sdpAttributeMid+sdpAttribute(sdp, sdpAttributeMid))
+			break
+		}
+	}
+
+	for _, candidate := range candidates {
+		fragment = append(fragment, "a="+candidate)
+	}
+
+	if endOfCandidates {
+		fragment = append(fragment, sdpAttributeEndOfCandidates)
+	}
+
+	return strings.Join(fragment, "\r\n") + "\r\n"
+}
+
+func parseSDPFragment(body string) (sdpFragment, error) {
+	fragment := sdpFragment{}
+	for _, line := range sdpLines(body) {
+		switch {
+		case strings.HasPrefix(line, sdpAttributeICEUfrag):
+			fragment.ufrag = strings.TrimPrefix(line, sdpAttributeICEUfrag)
+		case strings.HasPrefix(line, sdpAttributeICEPwd):
+			fragment.pwd = strings.TrimPrefix(line, sdpAttributeICEPwd)
+		case strings.HasPrefix(line, sdpAttributeCandidate):
+			fragment.candidates = append(fragment.candidates, strings.TrimPrefix(line, "a="))
+		case line == sdpAttributeEndOfCandidates:
+			fragment.endOfCandidates = true
+		case line == "", strings.HasPrefix(line, "a="), strings.HasPrefix(line, "m="):
+		default:
+			return sdpFragment{}, ErrInvalidSDPFragment
+		}
+	}
+
+	return fragment, nil
+}
+
+// waitForCandidates waits until all local candidates are gathered. Clients
+// that support trickle ICE may be answered sooner, they receive the remaining
+// candidates in responses to PATCH.
+func waitForCandidates(offer string, gatherComplete <-chan struct{}) {
+	if trickleAnswerTimeout == 0 || !supportsTrickle(offer) {
+		<-gatherComplete
+		return
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(trickleAnswerTimeout):
+	}
+}
+
+// supportsTrickle reports if an offer has the trickle ICE option.
+func supportsTrickle(offer string) bool {
+	for _, line := range sdpLines(offer) {
+		if strings.HasPrefix(line, sdpAttributeICEOptions) && strings.Contains(line, "trickle") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sdpAttribute returns the value of the first attribute with prefix in sdp.
+func sdpAttribute(sdp, prefix string) string {
+	for _, line := range sdpLines(sdp) {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+
+	return ""
+}
+
+// sdpCandidates returns the distinct candidates of sdp without their "a=".
+func sdpCandidates(sdp string) []string {
+	candidates := []string{}
+	for _, line := range sdpLines(sdp) {
+		candidate := strings.TrimPrefix(line, "a=")
+		if strings.HasPrefix(line, sdpAttributeCandidate) && !slices.Contains(candidates, candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates
+}
+
+func sdpLines(sdp string) []string {
+	lines := strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	return lines
+}
@@ -0,0 +1,108 @@
+package webrtc
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSDPFragment(t *testing.T) {
+	fragment, err := parseSDPFragment(strings.Join([]string{
+		"a=ice-ufrag:EsAw",
+		"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=mid:0",
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0",
+		"a=end-of-candidates",
+		"",
+	}, "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fragment.ufrag != "EsAw" || fragment.pwd != "P2uYro0UCOQ4zxjKXaWCBui1" {
+		t.Errorf("wrong credentials %q %q", fragment.ufrag, fragment.pwd)
+	}
+
+	if !slices.Equal(fragment.candidates, []string{"candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0"}) {
+		t.Errorf("wrong candidates %q", fragment.candidates)
+	}
+
+	if !fragment.endOfCandidates {
+		t.Error("end-of-candidates was not parsed")
+	}
+
+	if _, err = parseSDPFragment("v=0\r\n"); !errors.Is(err, ErrInvalidSDPFragment) {
+		t.Errorf("parsed a session description as a fragment, got %v", err)
+	}
+}
+
+func TestLocalSDPFragment(t *testing.T) {
+	sdp := strings.Join([]string{
+		"v=0",
+		"a=group:BUNDLE 0 1",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=ice-ufrag:abcd",
+		"a=ice-pwd:efgh",
+		"a=mid:0",
+		"a=candidate:1 1 udp 2130706431 192.0.2.2 5000 typ host",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"a=ice-ufrag:abcd",
+		"a=ice-pwd:efgh",
+		"a=mid:1",
+		"a=candidate:1 1 udp 2130706431 192.0.2.2 5000 typ host",
+		"a=end-of-candidates",
+		"",
+	}, "\r\n")
+
+	if ICEETag(sdp) != `"abcd"` {
+		t.Errorf("wrong ETag %s", ICEETag(sdp))
+	}
+
+	s := &iceSession{sentCandidates: map[string]bool{}}
+	if fragment := s.unsentCandidates(sdp); fragment != strings.Join([]string{
+		"a=ice-ufrag:abcd",
+		"a=ice-pwd:efgh",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=mid:0",
+		"a=candidate:1 1 udp 2130706431 192.0.2.2 5000 typ host",
+		"a=end-of-candidates",
+		"",
+	}, "\r\n") {
+		t.Errorf("wrong fragment %q", fragment)
+	}
+
+	if fragment := s.unsentCandidates(sdp); fragment != "" {
+		t.Errorf("candidates were sent twice %q", fragment)
+	}
+}
+
+func TestWaitForCandidates(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	trickleAnswerTimeout = timeout
+	defer func() { trickleAnswerTimeout = 0 }()
+
+	gatherComplete := make(chan struct{})
+	start := time.Now()
+	waitForCandidates("v=0\r\na=ice-options:trickle\r\n", gatherComplete)
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > time.Second {
+		t.Errorf("trickle client was answered after %s", elapsed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		waitForCandidates("v=0\r\n", gatherComplete)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("client without trickle ICE was answered before gathering completed")
+	case <-time.After(2 * timeout):
+	}
+
+	close(gatherComplete)
+	<-done
+}
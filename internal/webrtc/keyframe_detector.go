@@ -2,6 +2,7 @@ package webrtc
 
 import (
 	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 )
 
 const (
@@ -10,10 +11,40 @@ const (
 	idrNALUType = 5
 	spsNALUType = 7
 	ppsNALUType = 8
+
+	// Intra random access point NAL unit types, BLA, IDR and CRA pictures
+	h265IRAPFirstNALUType = 16
+	h265IRAPLastNALUType  = 21
+	h265VPSNALUType       = 32
+	h265PPSNALUType       = 34
+
+	av1OBUTypeSequenceHeader = 1
+	av1OBUTypeShift          = 3
+	av1OBUTypeBitmask        = 0x0F
 )
 
+// newDepacketizer returns the depacketizer isKeyframe needs for codec. AV1
+// packets are parsed on their own, they don't depend on the ones before.
+func newDepacketizer(codec videoTrackCodec) rtp.Depacketizer {
+	switch codec {
+	case videoTrackCodecH264:
+		return &codecs.H264Packet{}
+	case videoTrackCodecVP8:
+		return &codecs.VP8Packet{}
+	case videoTrackCodecVP9:
+		return &codecs.VP9Packet{}
+	case videoTrackCodecH265:
+		return &codecs.H265Packet{}
+	}
+
+	return nil
+}
+
+// isKeyframe reports if pkt starts a frame that can be decoded without any
+// before it, so viewers can switch to its layer.
 func isKeyframe(pkt *rtp.Packet, codec videoTrackCodec, depacketizer rtp.Depacketizer) bool {
-	if codec == videoTrackCodecH264 {
+	switch codec {
+	case videoTrackCodecH264:
 		nalu, err := depacketizer.Unmarshal(pkt.Payload)
 		if err != nil || len(nalu) < 6 {
 			return false
@@ -21,6 +52,100 @@ func isKeyframe(pkt *rtp.Packet, codec videoTrackCodec, depacketizer rtp.Depacke
 
 		firstNaluType := nalu[4] & naluTypeBitmask
 		return firstNaluType == idrNALUType || firstNaluType == spsNALUType || firstNaluType == ppsNALUType
+	case videoTrackCodecVP8:
+		return isVP8Keyframe(pkt.Payload, depacketizer)
+	case videoTrackCodecVP9:
+		return isVP9Keyframe(pkt.Payload, depacketizer)
+	case videoTrackCodecAV1:
+		return isAV1Keyframe(pkt.Payload)
+	case videoTrackCodecH265:
+		return isH265Keyframe(pkt.Payload, depacketizer)
 	}
-	return true
+
+	return false
+}
+
+// The first partition of a VP8 frame starts with the frame tag, whose lowest
+// bit is 0 for key frames.
+func isVP8Keyframe(payload []byte, depacketizer rtp.Depacketizer) bool {
+	vp8Packet, ok := depacketizer.(*codecs.VP8Packet)
+	if !ok {
+		return false
+	}
+
+	if _, err := vp8Packet.Unmarshal(payload); err != nil {
+		return false
+	}
+
+	return vp8Packet.S == 1 && vp8Packet.PID == 0 && len(vp8Packet.Payload) > 0 && vp8Packet.Payload[0]&0x01 == 0
+}
+
+// VP9 frames that aren't inter-picture predicted are key frames, for spatial
+// scalability only those of the base layer.
+func isVP9Keyframe(payload []byte, depacketizer rtp.Depacketizer) bool {
+	vp9Packet, ok := depacketizer.(*codecs.VP9Packet)
+	if !ok {
+		return false
+	}
+
+	if _, err := vp9Packet.Unmarshal(payload); err != nil {
+		return false
+	}
+
+	return vp9Packet.B && !vp9Packet.P && (!vp9Packet.L || vp9Packet.SID == 0)
+}
+
+// AV1 key frames start a new coded video sequence, which the N bit of the
+// aggregation header marks and a sequence header OBU precedes.
+func isAV1Keyframe(payload []byte) bool {
+	av1Packet := &codecs.AV1Packet{}
+	if _, err := av1Packet.Unmarshal(payload); err != nil {
+		return false
+	}
+
+	if av1Packet.N {
+		return true
+	}
+
+	for i, obu := range av1Packet.OBUElements {
+		// The first element continues an OBU of the previous packet
+		if i == 0 && av1Packet.Z {
+			continue
+		}
+
+		if len(obu) > 0 && (obu[0]>>av1OBUTypeShift)&av1OBUTypeBitmask == av1OBUTypeSequenceHeader {
+			return true
+		}
+	}
+
+	return false
+}
+
+// H.265 key frames are IRAP pictures, preceded by their parameter sets.
+func isH265Keyframe(payload []byte, depacketizer rtp.Depacketizer) bool {
+	h265Packet, ok := depacketizer.(*codecs.H265Packet)
+	if !ok {
+		return false
+	}
+
+	if _, err := h265Packet.Unmarshal(payload); err != nil {
+		return false
+	}
+
+	isKeyframeNALUType := func(t uint8) bool {
+		return (t >= h265IRAPFirstNALUType && t <= h265IRAPLastNALUType) || (t >= h265VPSNALUType && t <= h265PPSNALUType)
+	}
+
+	switch p := h265Packet.Packet().(type) {
+	case *codecs.H265SingleNALUnitPacket:
+		return isKeyframeNALUType(p.PayloadHeader().Type())
+	case *codecs.H265FragmentationUnitPacket:
+		return p.FuHeader().S() && isKeyframeNALUType(p.FuHeader().FuType())
+	case *codecs.H265AggregationPacket:
+		if first := p.FirstUnit(); first != nil && len(first.NalUnit()) >= 2 {
+			return isKeyframeNALUType(codecs.H265NALUHeader(uint16(first.NalUnit()[0])<<8 | uint16(first.NalUnit()[1])).Type())
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,137 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// Payloads are the first bytes of RTP packets as browsers and encoders send them
+func TestIsKeyframe(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		codec      videoTrackCodec
+		payload    []byte
+		isKeyframe bool
+	}{
+		{
+			name:  "H264 STAP-A with SPS and PPS",
+			codec: videoTrackCodecH264,
+			payload: []byte{
+				0x78, 0x00, 0x0d, 0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35,
+				0x00, 0x04, 0x68, 0xce, 0x06, 0xe2,
+			},
+			isKeyframe: true,
+		},
+		{
+			name:       "H264 non-IDR slice",
+			codec:      videoTrackCodecH264,
+			payload:    []byte{0x41, 0x9a, 0x24, 0x6c, 0x43, 0x7f, 0xfe},
+			isKeyframe: false,
+		},
+		{
+			name:  "VP8 key frame",
+			codec: videoTrackCodecVP8,
+			// Descriptor with a 15 bit picture ID, then the frame tag and start code
+			payload:    []byte{0x90, 0x80, 0x9c, 0x4f, 0x50, 0x36, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01},
+			isKeyframe: true,
+		},
+		{
+			name:       "VP8 inter frame",
+			codec:      videoTrackCodecVP8,
+			payload:    []byte{0x90, 0x80, 0x9c, 0x50, 0x31, 0x0b, 0x00, 0x11, 0x10, 0x00},
+			isKeyframe: false,
+		},
+		{
+			name:       "VP8 key frame, not the first partition",
+			codec:      videoTrackCodecVP8,
+			payload:    []byte{0x80, 0x80, 0x9c, 0x4f, 0x50, 0x36, 0x00, 0x9d, 0x01, 0x2a},
+			isKeyframe: false,
+		},
+		{
+			name:  "VP9 key frame",
+			codec: videoTrackCodecVP9,
+			// I, F, B and V set, then the picture ID and scalability structure
+			payload:    []byte{0x9a, 0x8a, 0x2f, 0x18, 0x02, 0x80, 0x01, 0x68, 0x01, 0x01, 0x04, 0x82, 0x49, 0x83, 0x42},
+			isKeyframe: true,
+		},
+		{
+			name:       "VP9 inter frame",
+			codec:      videoTrackCodecVP9,
+			payload:    []byte{0xd8, 0x8a, 0x30, 0x02, 0x86, 0x00, 0x40, 0x92},
+			isKeyframe: false,
+		},
+		{
+			name:       "VP9 key frame of an upper spatial layer",
+			codec:      videoTrackCodecVP9,
+			payload:    []byte{0xb8, 0x8a, 0x2f, 0x02, 0x82, 0x49, 0x83, 0x42},
+			isKeyframe: false,
+		},
+		{
+			name:  "AV1 new coded video sequence",
+			codec: videoTrackCodecAV1,
+			// W=2 and N set, a sequence header OBU and the start of a frame OBU
+			payload:    []byte{0x28, 0x0b, 0x08, 0x00, 0x00, 0x00, 0x24, 0xc4, 0xff, 0xdf, 0x00, 0x68, 0x02, 0x32, 0x10},
+			isKeyframe: true,
+		},
+		{
+			name:       "AV1 sequence header without the N bit",
+			codec:      videoTrackCodecAV1,
+			payload:    []byte{0x20, 0x0b, 0x08, 0x00, 0x00, 0x00, 0x24, 0xc4, 0xff, 0xdf, 0x00, 0x68, 0x02, 0x32, 0x10},
+			isKeyframe: true,
+		},
+		{
+			name:       "AV1 frame",
+			codec:      videoTrackCodecAV1,
+			payload:    []byte{0x10, 0x32, 0x1a, 0x30, 0xc0, 0x00, 0x1d, 0x66},
+			isKeyframe: false,
+		},
+		{
+			name:  "AV1 continued fragment that happens to look like a sequence header",
+			codec: videoTrackCodecAV1,
+			// Z and W=1, a single element continuing the previous packet
+			payload:    []byte{0x90, 0x08, 0x00, 0x00, 0x00, 0x24},
+			isKeyframe: false,
+		},
+		{
+			name:  "H265 aggregation packet with VPS, SPS and PPS",
+			codec: videoTrackCodecH265,
+			payload: []byte{
+				0x60, 0x01, 0x00, 0x05, 0x40, 0x01, 0x0c, 0x01, 0xff, 0x00, 0x05, 0x42, 0x01, 0x01, 0x01,
+				0x60, 0x00, 0x04, 0x44, 0x01, 0xc1, 0x72,
+			},
+			isKeyframe: true,
+		},
+		{
+			name:       "H265 start of a fragmented IDR_W_RADL",
+			codec:      videoTrackCodecH265,
+			payload:    []byte{0x62, 0x01, 0x93, 0xaf, 0x0b, 0x73, 0x9f},
+			isKeyframe: true,
+		},
+		{
+			name:       "H265 end of a fragmented IDR_W_RADL",
+			codec:      videoTrackCodecH265,
+			payload:    []byte{0x62, 0x01, 0x53, 0x02, 0x1e, 0x80},
+			isKeyframe: false,
+		},
+		{
+			name:       "H265 CRA",
+			codec:      videoTrackCodecH265,
+			payload:    []byte{0x2a, 0x01, 0xaf, 0x06, 0xb8},
+			isKeyframe: true,
+		},
+		{
+			name:       "H265 TRAIL_R",
+			codec:      videoTrackCodecH265,
+			payload:    []byte{0x02, 0x01, 0xd0, 0x09, 0x7e},
+			isKeyframe: false,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pkt := &rtp.Packet{Payload: test.payload}
+			if got := isKeyframe(pkt, test.codec, newDepacketizer(test.codec)); got != test.isKeyframe {
+				t.Errorf("isKeyframe = %t, want %t", got, test.isKeyframe)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package webrtc
+
+const (
+	// A publisher started broadcasting to a stream
+	StreamEventStart = "stream.start"
+	// The publisher of a stream stopped broadcasting
+	StreamEventStop = "stream.stop"
+	// A stream without viewers got a WHEP session
+	StreamEventFirstViewer = "viewer.first"
+	// The last WHEP session of a stream ended
+	StreamEventLastViewer = "viewer.last"
+)
+
+// StreamListener is told about the StreamEvents of every stream. It's called
+// while streams are locked, so it must not block or call into this package.
+type StreamListener func(streamKey, event string)
+
+var streamListeners []StreamListener
+
+// AddStreamListener makes f get the events of every stream. It must be called
+// before sessions are served.
+func AddStreamListener(f StreamListener) {
+	streamListeners = append(streamListeners, f)
+}
+
+func streamEvent(streamKey, event string) {
+	for _, f := range streamListeners {
+		f(streamKey, event)
+	}
+}
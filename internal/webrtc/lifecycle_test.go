@@ -0,0 +1,35 @@
+package webrtc
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/publisher"
+)
+
+func TestStreamEvents(t *testing.T) {
+	streamMap = map[string]*stream{}
+	defer func(listeners []StreamListener) { streamListeners = listeners }(streamListeners)
+
+	events := []string{}
+	AddStreamListener(func(streamKey, event string) {
+		events = append(events, event)
+	})
+
+	p, err := Publish("lifecycle", publisher.PolicyTakeover)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the publisher doesn't restart the stream
+	replacement, err := Publish("lifecycle", publisher.PolicyTakeover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	replacement.Close()
+
+	if !slices.Equal(events, []string{StreamEventStart, StreamEventStop}) {
+		t.Errorf("wrong events %v", events)
+	}
+}
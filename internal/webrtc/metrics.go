@@ -0,0 +1,339 @@
+package webrtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// How long bitrates are averaged over
+	bitrateWindow = time.Second
+
+	// Packets that didn't come this many packets after the highest one are lost
+	lossWindow = 512
+
+	videoClockRate = 90000
+)
+
+type (
+	// Metrics are the counters of the server and its streams. Counters of a
+	// stream start when the stream does.
+	Metrics struct {
+		Streams []StreamMetrics
+		// Traffic of every stream since the server started, also of the ones
+		// that ended
+		Totals TrafficMetrics
+		// Video traffic of the layers of every stream by RID, since the server
+		// started
+		LayerTotals  map[string]TrafficMetrics
+		WHIPFailures ConnectionFailures
+		WHEPFailures ConnectionFailures
+		// NACKs sent to publishers of every stream
+		NACKsSent uint64
+	}
+
+	// ConnectionFailures counts sessions whose connection failed since the
+	// server started.
+	ConnectionFailures struct {
+		ICE  uint64
+		DTLS uint64
+	}
+
+	StreamMetrics struct {
+		StreamKey  string
+		Publishing bool
+		Viewers    int
+
+		// Traffic of every publisher and layer of the stream
+		TrafficMetrics
+		AudioBitrate float64
+
+		Layers []LayerMetrics
+	}
+
+	// TrafficMetrics count the media and RTCP of streams. Packets written to
+	// WHEP sessions count once per session.
+	TrafficMetrics struct {
+		AudioPacketsReceived uint64
+		AudioBytesReceived   uint64
+		AudioPacketsSent     uint64
+		AudioBytesSent       uint64
+
+		VideoPacketsReceived uint64
+		VideoBytesReceived   uint64
+		VideoPacketsLost     uint64
+		VideoPacketsSent     uint64
+		VideoBytesSent       uint64
+
+		// PLIs sent to publishers and received from WHEP sessions
+		PLIsSent     uint64
+		PLIsReceived uint64
+		// NACKs received from WHEP sessions
+		NACKsReceived uint64
+	}
+
+	LayerMetrics struct {
+		RID             string
+		PacketsReceived uint64
+		BytesReceived   uint64
+		// Packets of the publisher that never came, not even retransmitted
+		PacketsLost uint64
+		// Packets written to WHEP sessions, a packet counts once per session
+		PacketsSent uint64
+		BytesSent   uint64
+		Bitrate     float64
+		// Time between the last two key frames, 0 before the second one
+		KeyframeInterval time.Duration
+	}
+
+	// trafficCounters are the TrafficMetrics of a stream or of the server.
+	trafficCounters struct {
+		audioPacketsReceived, audioBytesReceived, audioPacketsSent, audioBytesSent                   atomic.Uint64
+		videoPacketsReceived, videoBytesReceived, videoPacketsLost, videoPacketsSent, videoBytesSent atomic.Uint64
+		plisSent, plisReceived, nacksReceived                                                        atomic.Uint64
+	}
+
+	// connectionFailures are the ConnectionFailures of WHIP or WHEP sessions.
+	connectionFailures struct {
+		ice  atomic.Uint64
+		dtls atomic.Uint64
+	}
+
+	// bitrate is the bitrate of packets over the last bitrateWindow.
+	bitrate struct {
+		mu            sync.Mutex
+		start         time.Time
+		bytes         uint64
+		bitsPerSecond float64
+	}
+
+	// lossCounter counts the packets of a sequence that never came, also not
+	// late or retransmitted. It must only be used from one goroutine.
+	lossCounter struct {
+		started bool
+		// Extended sequence number of the highest packet
+		highest int64
+		// If the packets up to lossWindow before the highest one came
+		received [lossWindow]bool
+	}
+
+	// nackCounter is an interceptor that counts the NACKs the server sends.
+	nackCounter struct {
+		interceptor.NoOp
+	}
+
+	nackCounterFactory struct{}
+)
+
+var (
+	whipFailures, whepFailures connectionFailures
+	nacksSent                  atomic.Uint64
+	// Traffic of every stream, it doesn't go down when streams end
+	serverTraffic trafficCounters
+	// Traffic of the layers of every stream by RID, *trafficCounters
+	serverLayerTraffic sync.Map
+)
+
+// countDTLSFailures counts the sessions of peerConnection whose DTLS handshake
+// or connection fails.
+func countDTLSFailures(peerConnection *webrtc.PeerConnection, failures *connectionFailures) {
+	peerConnection.SCTP().Transport().OnStateChange(func(state webrtc.DTLSTransportState) {
+		if state == webrtc.DTLSTransportStateFailed {
+			failures.dtls.Add(1)
+		}
+	})
+}
+
+func (f *connectionFailures) metrics() ConnectionFailures {
+	return ConnectionFailures{ICE: f.ice.Load(), DTLS: f.dtls.Load()}
+}
+
+func (b *bitrate) add(bytes int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.start.IsZero() {
+		b.start = now
+	}
+
+	b.bytes += uint64(bytes)
+	if elapsed := now.Sub(b.start); elapsed >= bitrateWindow {
+		b.bitsPerSecond = float64(b.bytes*8) / elapsed.Seconds()
+		b.start, b.bytes = now, 0
+	}
+}
+
+// get returns the bitrate, 0 once packets stopped coming.
+func (b *bitrate) get() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.start) > 2*bitrateWindow {
+		return 0
+	}
+
+	return b.bitsPerSecond
+}
+
+// add counts a packet and returns how many packets were found to be lost.
+func (l *lossCounter) add(sequenceNumber uint16) (lost uint64) {
+	if !l.started {
+		// Packets before the first one aren't missing. A cycle is added so
+		// extended sequence numbers of late packets aren't negative.
+		l.started = true
+		l.highest = int64(sequenceNumber) + 1<<16
+		for i := range l.received {
+			l.received[i] = true
+		}
+		return 0
+	}
+
+	// Extend the sequence number to the cycle closest to the highest one
+	extended := l.highest + int64(int16(sequenceNumber-uint16(l.highest)))
+	switch {
+	case extended <= l.highest-lossWindow:
+		return 0
+	case extended <= l.highest:
+		l.received[extended%lossWindow] = true
+		return 0
+	}
+
+	// Packets leaving the window without having come are lost
+	for s := l.highest + 1; s <= extended; s++ {
+		if !l.received[s%lossWindow] {
+			lost++
+		}
+		l.received[s%lossWindow] = false
+	}
+
+	l.received[extended%lossWindow] = true
+	l.highest = extended
+	return lost
+}
+
+func (nackCounterFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &nackCounter{}, nil
+}
+
+// BindRTCPWriter counts the NACKs written by the interceptors after it.
+func (n *nackCounter) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		for _, pkt := range pkts {
+			if _, ok := pkt.(*rtcp.TransportLayerNack); ok {
+				nacksSent.Add(1)
+			}
+		}
+
+		return writer.Write(pkts, attributes)
+	})
+}
+
+// receivedAudio counts an audio packet of size bytes, which is written to
+// every WHEP session of the stream.
+func (s *stream) receivedAudio(size int) {
+	s.audioBitrate.add(size)
+
+	s.whepSessionsLock.RLock()
+	sessions := uint64(len(s.whepSessions))
+	s.whepSessionsLock.RUnlock()
+
+	s.countTraffic(func(c *trafficCounters) {
+		c.audioPacketsReceived.Add(1)
+		c.audioBytesReceived.Add(uint64(size))
+		c.audioPacketsSent.Add(sessions)
+		c.audioBytesSent.Add(sessions * uint64(size))
+	})
+}
+
+// countTraffic counts traffic of the stream, in its counters and in the ones
+// of the server.
+func (s *stream) countTraffic(count func(*trafficCounters)) {
+	count(&s.traffic)
+	count(&serverTraffic)
+}
+
+// layerTraffic returns the counters of the server for layers with rid.
+func layerTraffic(rid string) *trafficCounters {
+	c, _ := serverLayerTraffic.LoadOrStore(rid, &trafficCounters{})
+	return c.(*trafficCounters)
+}
+
+// countTraffic counts video traffic of the layer, in the counters of its
+// stream, of the server and of its RID.
+func (l *layerWriter) countTraffic(count func(*trafficCounters)) {
+	l.stream.countTraffic(count)
+	count(l.layerTraffic)
+}
+
+func (c *trafficCounters) metrics() TrafficMetrics {
+	return TrafficMetrics{
+		AudioPacketsReceived: c.audioPacketsReceived.Load(),
+		AudioBytesReceived:   c.audioBytesReceived.Load(),
+		AudioPacketsSent:     c.audioPacketsSent.Load(),
+		AudioBytesSent:       c.audioBytesSent.Load(),
+		VideoPacketsReceived: c.videoPacketsReceived.Load(),
+		VideoBytesReceived:   c.videoBytesReceived.Load(),
+		VideoPacketsLost:     c.videoPacketsLost.Load(),
+		VideoPacketsSent:     c.videoPacketsSent.Load(),
+		VideoBytesSent:       c.videoBytesSent.Load(),
+		PLIsSent:             c.plisSent.Load(),
+		PLIsReceived:         c.plisReceived.Load(),
+		NACKsReceived:        c.nacksReceived.Load(),
+	}
+}
+
+func GetMetrics() Metrics {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	out := Metrics{
+		Streams:      []StreamMetrics{},
+		Totals:       serverTraffic.metrics(),
+		LayerTotals:  map[string]TrafficMetrics{},
+		WHIPFailures: whipFailures.metrics(),
+		WHEPFailures: whepFailures.metrics(),
+		NACKsSent:    nacksSent.Load(),
+	}
+
+	serverLayerTraffic.Range(func(rid, c any) bool {
+		out.LayerTotals[rid.(string)] = c.(*trafficCounters).metrics()
+		return true
+	})
+
+	for streamKey, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		viewers := len(stream.whepSessions)
+		stream.whepSessionsLock.RUnlock()
+
+		layers := []LayerMetrics{}
+		for _, videoTrack := range stream.videoTracks {
+			layers = append(layers, LayerMetrics{
+				RID:              videoTrack.rid,
+				PacketsReceived:  videoTrack.packetsReceived.Load(),
+				BytesReceived:    videoTrack.bytesReceived.Load(),
+				PacketsLost:      videoTrack.packetsLost.Load(),
+				PacketsSent:      videoTrack.packetsSent.Load(),
+				BytesSent:        videoTrack.bytesSent.Load(),
+				Bitrate:          videoTrack.bitrate.get(),
+				KeyframeInterval: time.Duration(videoTrack.keyframeInterval.Load()),
+			})
+		}
+
+		out.Streams = append(out.Streams, StreamMetrics{
+			StreamKey:      streamKey,
+			Publishing:     stream.hasWHIPClient.Load(),
+			Viewers:        viewers,
+			TrafficMetrics: stream.traffic.metrics(),
+			AudioBitrate:   stream.audioBitrate.get(),
+			Layers:         layers,
+		})
+	}
+
+	return out
+}
@@ -0,0 +1,71 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/publisher"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestLossCounter(t *testing.T) {
+	var l lossCounter
+
+	lost := uint64(0)
+	// 65535 comes late and 1 never does, across a wraparound
+	for _, sequenceNumber := range []uint16{65533, 65534, 0, 65535, 2} {
+		lost += l.add(sequenceNumber)
+	}
+
+	for i := range lossWindow {
+		lost += l.add(uint16(3 + i))
+	}
+
+	if lost != 1 {
+		t.Fatalf("lost %d packets instead of 1", lost)
+	}
+
+	// Of a gap larger than the window, packets still in it can come late
+	if lost = l.add(uint16(3 + lossWindow + 1000)); lost != 1000-(lossWindow-1) {
+		t.Fatalf("lost %d packets instead of %d", lost, 1000-(lossWindow-1))
+	}
+}
+
+func TestGetMetrics(t *testing.T) {
+	streamMap = map[string]*stream{}
+
+	p, err := Publish("metrics", publisher.PolicyTakeover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// H.264 IDR key frames a second apart, packet 2 is lost
+	for i, sequenceNumber := range []uint16{0, 1, 3} {
+		p.WriteVideo("", webrtc.MimeTypeH264, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: sequenceNumber, Timestamp: uint32(i * videoClockRate)},
+			Payload: []byte{0x65, 0x88, 0x84, 0x00},
+		})
+	}
+	p.WriteAudio(&rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{0xFC}})
+
+	metrics := GetMetrics()
+	if len(metrics.Streams) != 1 {
+		t.Fatalf("wrong streams %+v", metrics.Streams)
+	}
+
+	s := metrics.Streams[0]
+	if s.StreamKey != "metrics" || !s.Publishing || s.Viewers != 0 || s.AudioPacketsReceived != 1 || s.AudioBytesReceived != 13 {
+		t.Errorf("wrong stream %+v", s)
+	}
+
+	if len(s.Layers) != 1 {
+		t.Fatalf("wrong layers %+v", s.Layers)
+	}
+
+	layer := s.Layers[0]
+	if layer.RID != videoTrackLabelDefault || layer.PacketsReceived != 3 || layer.BytesReceived != 3*16 || layer.KeyframeInterval != time.Second {
+		t.Errorf("wrong layer %+v", layer)
+	}
+}
@@ -0,0 +1,123 @@
+package webrtc
+
+import (
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+)
+
+// Publisher publishes a broadcast that doesn't come over WebRTC, like one sent
+// with RTMP, to a stream. Its sinks and WHEP sessions get it like a broadcast
+// from a WHIP session. A Publisher must only be used from one goroutine.
+type Publisher struct {
+	session *whipSession
+	stream  *stream
+	layers  map[string]*layerWriter
+}
+
+// Publish starts publishing to the stream of streamKey, policy decides what
+// happens if the stream already has a publisher. See publisher.PolicyReject.
+func Publish(streamKey, policy string) (*Publisher, error) {
+	session := newWHIPSession(uuid.New().String())
+	session.disconnect = sync.OnceFunc(func() {
+		peerConnectionDisconnected(streamKey, session.id)
+		session.end()
+	})
+
+	streamMapLock.Lock()
+	stream, replaced, publishes, err := addPublisher(streamKey, session, policy)
+	streamMapLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if publishes {
+		session.activate(streamKey, stream)
+	}
+	if replaced != nil {
+		replaced.disconnect()
+	}
+
+	p := &Publisher{
+		session: session,
+		stream:  stream,
+		layers:  map[string]*layerWriter{},
+	}
+
+	go p.dropKeyframeRequests()
+
+	return p, nil
+}
+
+// dropKeyframeRequests empties the PLI channel of the stream while the
+// publisher publishes to it, the publisher can't be asked for key frames.
+func (p *Publisher) dropKeyframeRequests() {
+	if !p.session.waitForKeyframeRequests(p.stream) {
+		return
+	}
+
+	for {
+		select {
+		case <-p.session.done:
+			return
+		case <-p.stream.whipActiveContext.Done():
+			return
+		case <-p.stream.pliChan:
+			if !p.session.keyframeRequested() {
+				return
+			}
+		}
+	}
+}
+
+// Done is closed when the broadcast ended, also when another publisher took
+// over the stream.
+func (p *Publisher) Done() <-chan struct{} {
+	return p.session.done
+}
+
+// WriteAudio publishes an Opus packet, the packet is changed.
+func (p *Publisher) WriteAudio(pkt *rtp.Packet) {
+	if !p.session.active.Load() {
+		return
+	}
+
+	if err := p.stream.writeAudio(p.session, pkt); err != nil {
+		log.Println(err)
+	}
+}
+
+// WriteVideo publishes a packet of the video layer rid, the default layer if
+// it is empty. Layers are added when their first packet is written.
+func (p *Publisher) WriteVideo(rid, mimeType string, pkt *rtp.Packet) {
+	if rid == "" {
+		rid = videoTrackLabelDefault
+	}
+
+	layer, ok := p.layers[rid]
+	if !ok {
+		track, err := addTrack(p.stream, p.session, rid)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		layer = newLayerWriter(p.stream, p.session, track, mimeType)
+		p.layers[rid] = layer
+	}
+
+	if p.session.active.Load() {
+		layer.write(pkt)
+	}
+}
+
+// Close ends the broadcast.
+func (p *Publisher) Close() {
+	for _, layer := range p.layers {
+		removeTrack(p.stream, p.session, layer.track)
+	}
+
+	p.session.disconnect()
+}
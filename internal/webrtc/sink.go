@@ -0,0 +1,54 @@
+package webrtc
+
+import (
+	"log"
+
+	"github.com/pion/rtp"
+)
+
+// DefaultRID is the RID sinks get the video of broadcasts without simulcast
+// with.
+const DefaultRID = videoTrackLabelDefault
+
+type (
+	// Sink gets the media of a broadcast as the publisher sends it, before it
+	// is rewritten for WHEP sessions. Audio and every video layer are written
+	// from their own goroutines. Packets are only valid until the call returns.
+	Sink interface {
+		WriteAudio(pkt *rtp.Packet)
+		WriteVideo(rid, mimeType string, pkt *rtp.Packet)
+		// Close is called once when the broadcast ends
+		Close() error
+	}
+
+	// SinkFactory returns a sink for a new broadcast to streamKey, or nil if
+	// it shouldn't get one. requestKeyframe asks the publisher for a key frame.
+	SinkFactory func(streamKey string, requestKeyframe func()) Sink
+)
+
+var sinkFactories []SinkFactory
+
+// AddSinkFactory makes every following broadcast get a sink from f. It must be
+// called before WHIP sessions are served.
+func AddSinkFactory(f SinkFactory) {
+	sinkFactories = append(sinkFactories, f)
+}
+
+func newSinks(streamKey string, requestKeyframe func()) []Sink {
+	sinks := []Sink{}
+	for _, f := range sinkFactories {
+		if sink := f(streamKey, requestKeyframe); sink != nil {
+			sinks = append(sinks, sink)
+		}
+	}
+
+	return sinks
+}
+
+func closeSinks(sinks []Sink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
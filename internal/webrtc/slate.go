@@ -0,0 +1,392 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/media"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// Largest payload of the RTP packets of the slate, like the ones browsers send
+const slatePayloadSize = 1200
+
+var (
+	// Video clips of the slate, viewers get the first one whose codec they
+	// support
+	slateVideos []*slateVideo
+	// Opus packets of the slate
+	slateAudio []slateAudioPacket
+
+	// Source of the audio of the slate for the audioRewriter of streams
+	slateSource = &whipSession{id: "slate"}
+)
+
+type (
+	// slateVideo is a video clip of the slate, packetized when it is loaded.
+	slateVideo struct {
+		codec  videoTrackCodec
+		frames []slateFrame
+	}
+
+	slateFrame struct {
+		payloads [][]byte
+		// Until the next frame, in the clock rate of video
+		duration uint32
+		keyframe bool
+	}
+
+	slateAudioPacket struct {
+		payload []byte
+		// Until the next packet, in the clock rate of audio
+		duration uint32
+	}
+
+	// slatePosition is where a stream is in a clip of the slate.
+	slatePosition struct {
+		index int
+		// Since the slate started playing
+		next time.Duration
+	}
+)
+
+// LoadSlate loads the media that is played to the viewers of streams without a
+// publisher from dir. Video clips are IVF files of VP8, VP9, AV1 or H.264, the
+// audio an Ogg file of Opus with one packet per page. Clips loop, viewers get
+// the first video clip by file name whose codec they support.
+func LoadSlate(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	videos, audio := []*slateVideo{}, []slateAudioPacket{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".ivf":
+			video, err := loadSlateVideo(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			videos = append(videos, video)
+		case ".ogg", ".opus":
+			if len(audio) != 0 {
+				return fmt.Errorf("%s: slate already has audio", path)
+			}
+
+			if audio, err = loadSlateAudio(path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	if len(videos) == 0 && len(audio) == 0 {
+		return fmt.Errorf("%s has no IVF or Ogg files", dir)
+	}
+
+	slateVideos, slateAudio = videos, audio
+	return nil
+}
+
+func loadSlateVideo(path string) (*slateVideo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// 32 bytes of signature, version, header size, FourCC, width, height, time
+	// base denominator and numerator, frame count and 4 unused ones
+	header := make([]byte, 32)
+	if _, err = io.ReadFull(file, header); err != nil {
+		return nil, err
+	} else if string(header[:4]) != "DKIF" {
+		return nil, errors.New("is not an IVF file")
+	}
+	denominator := uint64(binary.LittleEndian.Uint32(header[16:20]))
+	numerator := uint64(binary.LittleEndian.Uint32(header[20:24]))
+	if numerator == 0 || denominator == 0 {
+		return nil, errors.New("has no time base")
+	}
+
+	var (
+		mimeType  string
+		payloader rtp.Payloader
+	)
+	switch fourCC := string(header[8:12]); fourCC {
+	case "VP80":
+		mimeType, payloader = webrtc.MimeTypeVP8, &codecs.VP8Payloader{}
+	case "VP90":
+		mimeType, payloader = webrtc.MimeTypeVP9, &codecs.VP9Payloader{}
+	case "AV01":
+		mimeType, payloader = webrtc.MimeTypeAV1, &codecs.AV1Payloader{}
+	case "H264":
+		mimeType, payloader = webrtc.MimeTypeH264, &codecs.H264Payloader{}
+	default:
+		return nil, fmt.Errorf("%w %q", media.ErrUnsupportedCodec, fourCC)
+	}
+
+	video := &slateVideo{codec: getVideoTrackCodec(mimeType)}
+	timestamps := []uint64{}
+	// Frames start with 4 bytes of size and 8 of timestamp
+	frameHeader := make([]byte, 12)
+	for {
+		if _, err = io.ReadFull(file, frameHeader); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		frame := make([]byte, binary.LittleEndian.Uint32(frameHeader[:4]))
+		if _, err = io.ReadFull(file, frame); err != nil {
+			return nil, err
+		}
+
+		video.frames = append(video.frames, slateFrame{
+			payloads: payloader.Payload(slatePayloadSize, frame),
+			keyframe: media.IsKeyframe(mimeType, frame),
+		})
+		timestamps = append(timestamps, binary.LittleEndian.Uint64(frameHeader[4:]))
+	}
+
+	if !slices.ContainsFunc(video.frames, func(f slateFrame) bool { return f.keyframe }) {
+		return nil, errors.New("has no key frame")
+	}
+
+	// The timestamps of IVF frames are in units of numerator/denominator
+	// seconds, the last frame lasts as long as the one before
+	for i := range video.frames {
+		duration := uint64(videoClockRate / 30)
+		if i+1 < len(timestamps) && timestamps[i+1] > timestamps[i] {
+			duration = (timestamps[i+1] - timestamps[i]) * videoClockRate * numerator / denominator
+		} else if i > 0 {
+			duration = uint64(video.frames[i-1].duration)
+		}
+		video.frames[i].duration = uint32(max(duration, 1))
+	}
+
+	return video, nil
+}
+
+func loadSlateAudio(path string) ([]slateAudioPacket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, _, err := oggreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+
+	audio := []slateAudioPacket{}
+	lastGranulePosition := uint64(0)
+	for {
+		payload, header, err := reader.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(string(payload), "OpusTags") {
+			continue
+		}
+
+		// Granule positions count samples at 48 kHz, 20 ms if a page has none
+		duration := uint64(audioClockRate / 50)
+		if header.GranulePosition > lastGranulePosition && lastGranulePosition != 0 {
+			duration = header.GranulePosition - lastGranulePosition
+		}
+		lastGranulePosition = header.GranulePosition
+
+		audio = append(audio, slateAudioPacket{payload: payload, duration: uint32(duration)})
+	}
+
+	if len(audio) == 0 {
+		return nil, errors.New("has no Opus packets")
+	}
+
+	return audio, nil
+}
+
+// slateVideo returns the video clip of the slate for the codecs the viewer
+// negotiated, nil if there is none.
+func (t *trackMultiCodec) slateVideo() *slateVideo {
+	for _, video := range slateVideos {
+		if t.supports(video.codec) {
+			return video
+		}
+	}
+
+	return nil
+}
+
+// startSlate starts playing the slate to the WHEP sessions of the stream, if
+// there is one and it doesn't play already.
+func (s *stream) startSlate() {
+	if len(slateVideos) == 0 && len(slateAudio) == 0 {
+		return
+	}
+
+	if !s.slatePlaying.Swap(true) {
+		go s.playSlate()
+	}
+}
+
+// playSlate plays the slate while the stream has no publisher, and after one
+// started until every WHEP session switched to its video. Audio of the slate
+// stops as soon as there is a publisher.
+func (s *stream) playSlate() {
+	defer func() {
+		s.slatePlaying.Store(false)
+
+		// The publisher may have left again while the slate stopped
+		if !s.hasWHIPClient.Load() && s.whipActiveContext.Err() == nil {
+			s.startSlate()
+		}
+	}()
+
+	var (
+		start          = time.Now()
+		videos         = make([]slatePosition, len(slateVideos))
+		audio          slatePosition
+		sequenceNumber uint16
+		timestamp      uint32
+	)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.whipActiveContext.Done():
+			return
+		case <-timer.C:
+		}
+
+		elapsed := time.Since(start)
+		publishing := s.hasWHIPClient.Load()
+		next := elapsed + time.Second
+		onSlate := 0
+
+		for i, video := range slateVideos {
+			position := &videos[i]
+			for position.next <= elapsed {
+				frame := &video.frames[position.index]
+				onSlate += s.writeSlateFrame(video, frame, publishing)
+
+				position.next += time.Duration(frame.duration) * time.Second / videoClockRate
+				position.index = (position.index + 1) % len(video.frames)
+			}
+			next = min(next, position.next)
+		}
+
+		if publishing && onSlate == 0 {
+			return
+		}
+
+		for len(slateAudio) != 0 && audio.next <= elapsed {
+			packet := slateAudio[audio.index]
+			if !publishing {
+				s.writeSlateAudio(&rtp.Packet{
+					Header: rtp.Header{
+						Version:        2,
+						Marker:         true,
+						SequenceNumber: sequenceNumber,
+						Timestamp:      timestamp,
+					},
+					Payload: packet.payload,
+				})
+			}
+
+			sequenceNumber++
+			timestamp += packet.duration
+			audio.next += time.Duration(packet.duration) * time.Second / audioClockRate
+			audio.index = (audio.index + 1) % len(slateAudio)
+		}
+		if len(slateAudio) != 0 {
+			next = min(next, audio.next)
+		}
+
+		timer.Reset(next - time.Since(start))
+	}
+}
+
+// writeSlateFrame writes a frame of a video clip to the WHEP sessions that get
+// it and returns how many there are.
+func (s *stream) writeSlateFrame(video *slateVideo, frame *slateFrame, publishing bool) (onSlate int) {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for _, session := range s.whepSessions {
+		if session.videoTrack.slateVideo() == video && session.sendSlateFrame(video.codec, frame, s.elapsedVideoTimestamp(), publishing) {
+			onSlate++
+		}
+	}
+
+	return onSlate
+}
+
+// writeSlateAudio writes an Opus packet of the slate to the WHEP sessions.
+func (s *stream) writeSlateAudio(pkt *rtp.Packet) {
+	s.audioRewriter.rewrite(slateSource, pkt)
+	if err := s.audioTrack.WriteRTP(pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Println(err)
+	}
+}
+
+// sendSlateFrame writes a frame of the slate, it returns false if the session
+// doesn't get the slate. Sessions switch to the slate at its key frames while
+// the stream has no publisher, and back at the first key frame of the next
+// publisher. elapsed is the time since the publisher sent video, in the clock
+// rate of video.
+func (w *whepSession) sendSlateFrame(codec videoTrackCodec, frame *slateFrame, elapsed int64, publishing bool) bool {
+	w.videoLock.Lock()
+	defer w.videoLock.Unlock()
+
+	timeDiff := int64(w.slateFrameDuration)
+	if !w.onSlate {
+		if publishing || !frame.keyframe {
+			return false
+		}
+
+		w.onSlate = true
+		timeDiff = elapsed
+	}
+	w.timestamp = uint32(int64(w.timestamp) + timeDiff)
+	w.slateFrameDuration = frame.duration
+
+	for i, payload := range frame.payloads {
+		w.sequenceNumber++
+		w.packetsWritten++
+
+		if err := w.videoTrack.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(frame.payloads)-1,
+				SequenceNumber: w.sequenceNumber,
+				Timestamp:      w.timestamp,
+			},
+			Payload: payload,
+		}, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Println(err)
+			break
+		}
+	}
+
+	return true
+}
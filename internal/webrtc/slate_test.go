@@ -0,0 +1,172 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/publisher"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// testTrackWriter keeps the headers of the packets written to a WHEP session.
+type testTrackWriter struct {
+	mu      sync.Mutex
+	headers []rtp.Header
+}
+
+func (w *testTrackWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.headers = append(w.headers, *header)
+	return len(payload), nil
+}
+
+func (w *testTrackWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *testTrackWriter) written() []rtp.Header {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]rtp.Header{}, w.headers...)
+}
+
+// writeTestSlate writes a VP8 clip of a key frame and two other frames at 30
+// frames per second, and a second of Opus.
+func writeTestSlate(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+
+	ivf := []byte("DKIF")
+	ivf = binary.LittleEndian.AppendUint16(ivf, 0)
+	ivf = binary.LittleEndian.AppendUint16(ivf, 32)
+	ivf = append(ivf, "VP80"...)
+	ivf = binary.LittleEndian.AppendUint16(ivf, 640)
+	ivf = binary.LittleEndian.AppendUint16(ivf, 360)
+	ivf = binary.LittleEndian.AppendUint32(ivf, 30)
+	ivf = binary.LittleEndian.AppendUint32(ivf, 1)
+	ivf = binary.LittleEndian.AppendUint32(ivf, 3)
+	ivf = binary.LittleEndian.AppendUint32(ivf, 0)
+	for i, frame := range [][]byte{{0x00, 0x01}, {0x01, 0x01}, {0x01, 0x02}} {
+		ivf = binary.LittleEndian.AppendUint32(ivf, uint32(len(frame)))
+		ivf = binary.LittleEndian.AppendUint64(ivf, uint64(i))
+		ivf = append(ivf, frame...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "slate.ivf"), ivf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ogg, err := oggwriter.New(filepath.Join(dir, "slate.ogg"), audioClockRate, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range uint16(50) {
+		if err = ogg.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: i, Timestamp: uint32(i) * 960}, Payload: []byte{0xFC}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ogg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestLoadSlate(t *testing.T) {
+	defer func() { slateVideos, slateAudio = nil, nil }()
+
+	if err := LoadSlate(writeTestSlate(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(slateVideos) != 1 || slateVideos[0].codec != videoTrackCodecVP8 || len(slateVideos[0].frames) != 3 {
+		t.Fatalf("wrong videos %+v", slateVideos)
+	}
+	for i, frame := range slateVideos[0].frames {
+		if frame.keyframe != (i == 0) || frame.duration != videoClockRate/30 {
+			t.Errorf("wrong frame %d %+v", i, frame)
+		}
+	}
+
+	if len(slateAudio) != 50 || slateAudio[1].duration != 960 {
+		t.Errorf("wrong audio %d packets, %+v", len(slateAudio), slateAudio[1])
+	}
+
+	if err := LoadSlate(t.TempDir()); err == nil {
+		t.Error("empty directory was loaded")
+	}
+}
+
+func TestSlate(t *testing.T) {
+	defer func() { slateVideos, slateAudio = nil, nil }()
+	streamMap = map[string]*stream{}
+
+	if err := LoadSlate(writeTestSlate(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &testTrackWriter{}
+	session := &whepSession{
+		disconnect:  func() {},
+		subscribers: newWHEPSubscribers(),
+		videoTrack:  &trackMultiCodec{writeStream: writer, payloadTypeVP8: 96},
+	}
+	session.videoTrack.bound.Store(true)
+	session.currentLayer.Store("")
+
+	streamMapLock.Lock()
+	s, err := getStream("slate", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.whepSessions["viewer"] = session
+	s.startSlate()
+	streamMapLock.Unlock()
+
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitFor("the slate", func() bool { return len(writer.written()) >= 3 })
+
+	// The viewer switches to the publisher at its key frame, without a gap in
+	// sequence numbers
+	p, err := Publish("slate", publisher.PolicyTakeover)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, payload := range [][]byte{{0x10, 0x11}, {0x10, 0x10}} {
+		p.WriteVideo("", webrtc.MimeTypeVP8, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(1000 + i), Timestamp: uint32(i * 3000)},
+			Payload: payload,
+		})
+	}
+	waitFor("the slate to stop", func() bool { return !s.slatePlaying.Load() })
+
+	headers := writer.written()
+	for i := 1; i < len(headers); i++ {
+		if headers[i].SequenceNumber != headers[i-1].SequenceNumber+1 {
+			t.Fatalf("packet %d of %d doesn't continue %+v", i, len(headers), headers[i])
+		}
+	}
+	if session.onSlate {
+		t.Error("viewer is still on the slate")
+	}
+
+	// The slate plays again until the stream is gone
+	p.Close()
+	waitFor("the slate to play again", func() bool { return len(writer.written()) > len(headers) })
+	s.whipActiveContextCancel()
+	waitFor("the slate to end", func() bool { return !s.slatePlaying.Load() })
+}
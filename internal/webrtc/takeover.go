@@ -0,0 +1,207 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/publisher"
+	"github.com/pion/rtp"
+)
+
+const audioClockRate = 48000
+
+var ErrStreamHasPublisher = errors.New("stream already has a publisher")
+
+type (
+	// rtpRewriter continues the sequence numbers and timestamps of packets
+	// when their source changes, so viewers see one stream across publishers.
+	rtpRewriter struct {
+		mu        sync.Mutex
+		clockRate int64
+		// Source of the last packet, nil before the first one
+		source          *whipSession
+		sequenceOffset  uint16
+		timestampOffset uint32
+		lastSequence    uint16
+		lastTimestamp   uint32
+		lastWritten     time.Time
+	}
+)
+
+// addPublisher makes session the publisher or the backup of the stream of
+// streamKey, depending on policy and if it already has a publisher. It returns
+// the session that was replaced, which the caller disconnects, and if session
+// publishes and must be activated. streamMapLock must be held.
+func addPublisher(streamKey string, session *whipSession, policy string) (stream *stream, replaced *whipSession, publishes bool, err error) {
+	if existing, ok := streamMap[streamKey]; ok && existing.whipSession != nil {
+		switch policy {
+		case publisher.PolicyReject:
+			return nil, nil, false, ErrStreamHasPublisher
+		case publisher.PolicyStandby:
+			replaced = existing.standbySession
+			existing.standbySession = session
+			session.pliChan = existing.pliChan
+			return existing, replaced, false, nil
+		}
+
+		replaced = existing.whipSession
+		replaced.active.Store(false)
+	}
+
+	stream, err = getStream(streamKey, true)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	stream.whipSession = session
+	session.pliChan = stream.pliChan
+	stream.videoTracks = nil
+	stream.whepSessionsLock.RLock()
+	stream.notifyWHEPSessions()
+	stream.whepSessionsLock.RUnlock()
+
+	return stream, replaced, true, nil
+}
+
+// promoteStandby makes the backup of a stream its publisher, when the publisher
+// is gone. It returns false if there is no backup. streamMapLock and
+// whepSessionsLock must be held.
+func (s *stream) promoteStandby(streamKey string) bool {
+	standby := s.standbySession
+	if standby == nil {
+		return false
+	}
+
+	s.standbySession = nil
+	s.whipSession = standby
+	s.videoTracks = append([]*videoTrack{}, standby.videoTracks...)
+	s.notifyWHEPSessions()
+
+	// Sinks can't be created while streams are locked
+	go standby.activate(streamKey, s)
+
+	return true
+}
+
+// publisherSession returns the publisher or backup of the stream with the ID.
+// streamMapLock must be held.
+func (s *stream) publisherSession(whipSessionId string) *whipSession {
+	for _, session := range []*whipSession{s.whipSession, s.standbySession} {
+		if session != nil && session.id == whipSessionId {
+			return session
+		}
+	}
+
+	return nil
+}
+
+// activate starts forwarding the media of a session that became the publisher
+// of a stream. Viewers switch to it at its next key frame.
+func (s *whipSession) activate(streamKey string, stream *stream) {
+	sinks := newSinks(streamKey, s.requestKeyframe)
+
+	// Before the session is active, so no viewer gets a frame it can't decode
+	stream.whepSessionsLock.RLock()
+	for _, session := range stream.whepSessions {
+		session.resync()
+	}
+	stream.whepSessionsLock.RUnlock()
+
+	s.endLock.Lock()
+	if s.ended {
+		s.endLock.Unlock()
+		closeSinks(sinks)
+		return
+	}
+	// Written before the session is active, writers only read it after
+	s.sinks = sinks
+	s.active.Store(true)
+	close(s.activated)
+	s.endLock.Unlock()
+
+	s.requestKeyframe()
+}
+
+// end stops forwarding the media of the session and closes its sinks, it is
+// safe to call more than once.
+func (s *whipSession) end() {
+	s.endLock.Lock()
+	defer s.endLock.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	s.ended = true
+	s.active.Store(false)
+	close(s.done)
+	closeSinks(s.sinks)
+}
+
+// waitForKeyframeRequests returns once the session publishes, false if it
+// ended before.
+func (s *whipSession) waitForKeyframeRequests(stream *stream) bool {
+	select {
+	case <-s.activated:
+		return true
+	case <-s.done:
+	case <-stream.whipActiveContext.Done():
+	}
+
+	return false
+}
+
+// keyframeRequested reports if a key frame request taken from the PLI channel
+// is for the session. Requests that came after it stopped publishing are put
+// back for the publisher that replaced it.
+func (s *whipSession) keyframeRequested() bool {
+	if s.active.Load() {
+		return true
+	}
+
+	select {
+	case s.pliChan <- true:
+	default:
+	}
+
+	return false
+}
+
+// resync makes the session start over at the next key frame of whichever
+// layer comes first, the layers of a new publisher can differ.
+func (w *whepSession) resync() {
+	w.currentLayer.Store("")
+	w.waitingForKeyframe.Store(true)
+	w.subscribers.notify()
+}
+
+// rewrite changes the sequence number and timestamp of a packet of source so
+// they continue after the last packet, even when it came from another source.
+func (r *rtpRewriter) rewrite(source *whipSession, pkt *rtp.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.source != nil && r.source != source {
+		elapsed := max(int64(now.Sub(r.lastWritten))*r.clockRate/int64(time.Second), 1)
+		r.sequenceOffset = r.lastSequence + 1 - pkt.SequenceNumber
+		r.timestampOffset = r.lastTimestamp + uint32(elapsed) - pkt.Timestamp
+	}
+	r.source = source
+
+	pkt.SequenceNumber += r.sequenceOffset
+	pkt.Timestamp += r.timestampOffset
+	r.lastSequence, r.lastTimestamp, r.lastWritten = pkt.SequenceNumber, pkt.Timestamp, now
+}
+
+// elapsedVideoTimestamp returns the time since the stream last forwarded video
+// in video clock units, 0 if it never did.
+func (s *stream) elapsedVideoTimestamp() int64 {
+	last := s.lastVideoForwarded.Load()
+	if last == 0 {
+		return 0
+	}
+
+	return (time.Now().UnixNano() - last) * videoClockRate / int64(time.Second)
+}
@@ -0,0 +1,92 @@
+package webrtc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/publisher"
+	"github.com/pion/rtp"
+)
+
+func TestPublisherPolicies(t *testing.T) {
+	streamMap = map[string]*stream{}
+
+	p, err := Publish("policies", publisher.PolicyTakeover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err = Publish("policies", publisher.PolicyReject); !errors.Is(err, ErrStreamHasPublisher) {
+		t.Fatalf("second publisher was not rejected: %v", err)
+	}
+
+	standby, err := Publish("policies", publisher.PolicyStandby)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	if standby.session.active.Load() {
+		t.Fatal("backup publishes")
+	}
+
+	// A newer backup replaces the older one
+	newerStandby, err := Publish("policies", publisher.PolicyStandby)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newerStandby.Close()
+	select {
+	case <-standby.Done():
+	default:
+		t.Fatal("older backup was not disconnected")
+	}
+
+	// The backup takes over when the publisher is gone
+	p.Close()
+	select {
+	case <-newerStandby.session.activated:
+	case <-time.After(time.Second):
+		t.Fatal("backup didn't take over")
+	}
+
+	takeover, err := Publish("policies", publisher.PolicyTakeover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer takeover.Close()
+	select {
+	case <-newerStandby.Done():
+	default:
+		t.Fatal("publisher was not disconnected by the takeover")
+	}
+	if !takeover.session.active.Load() {
+		t.Fatal("publisher that took over doesn't publish")
+	}
+}
+
+func TestRTPRewriter(t *testing.T) {
+	r := rtpRewriter{clockRate: audioClockRate}
+	first, second := newWHIPSession("first"), newWHIPSession("second")
+
+	pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: 100, Timestamp: 1000}}
+	r.rewrite(first, pkt)
+	if pkt.SequenceNumber != 100 || pkt.Timestamp != 1000 {
+		t.Fatalf("packet of the first source was changed %+v", pkt.Header)
+	}
+
+	// Packets of the next source continue after the last one
+	pkt = &rtp.Packet{Header: rtp.Header{SequenceNumber: 65535, Timestamp: 5}}
+	r.rewrite(second, pkt)
+	if pkt.SequenceNumber != 101 || pkt.Timestamp <= 1000 {
+		t.Fatalf("packet of the second source doesn't continue %+v", pkt.Header)
+	}
+	timestamp := pkt.Timestamp
+
+	pkt = &rtp.Packet{Header: rtp.Header{SequenceNumber: 0, Timestamp: 965}}
+	r.rewrite(second, pkt)
+	if pkt.SequenceNumber != 102 || pkt.Timestamp != timestamp+960 {
+		t.Fatalf("packet of the second source was not offset %+v", pkt.Header)
+	}
+}
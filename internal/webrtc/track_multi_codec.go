@@ -1,6 +1,8 @@
 package webrtc
 
 import (
+	"sync/atomic"
+
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
@@ -12,6 +14,9 @@ type trackMultiCodec struct {
 	payloadTypeH264, payloadTypeH265, payloadTypeVP8, payloadTypeVP9, payloadTypeAV1 uint8
 
 	id, rid, streamID string
+
+	// Set once the fields above are, see supports
+	bound atomic.Bool
 }
 
 func (t *trackMultiCodec) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
@@ -33,6 +38,7 @@ func (t *trackMultiCodec) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecPar
 			t.payloadTypeH265 = uint8(codecs[i].PayloadType)
 		}
 	}
+	t.bound.Store(true)
 
 	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, RTCPFeedback: videoRTCPFeedback}}, nil
 }
@@ -61,6 +67,29 @@ func (t *trackMultiCodec) WriteRTP(p *rtp.Packet, codec videoTrackCodec) error {
 	return err
 }
 
+// supports reports if the viewer negotiated codec, which is only known once the
+// track is bound.
+func (t *trackMultiCodec) supports(codec videoTrackCodec) bool {
+	if !t.bound.Load() {
+		return false
+	}
+
+	switch codec {
+	case videoTrackCodecH264:
+		return t.payloadTypeH264 != 0
+	case videoTrackCodecVP8:
+		return t.payloadTypeVP8 != 0
+	case videoTrackCodecVP9:
+		return t.payloadTypeVP9 != 0
+	case videoTrackCodecAV1:
+		return t.payloadTypeAV1 != 0
+	case videoTrackCodecH265:
+		return t.payloadTypeH265 != 0
+	}
+
+	return false
+}
+
 func (t *trackMultiCodec) ID() string       { return t.id }
 func (t *trackMultiCodec) RID() string      { return t.rid }
 func (t *trackMultiCodec) StreamID() string { return t.streamID }
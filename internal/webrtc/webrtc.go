@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -36,13 +37,27 @@ type (
 		// Does this stream have a publisher?
 		// If stream was created by a WHEP request hasWHIPClient == false
 		hasWHIPClient atomic.Bool
+		// Session of the current publisher and its backup, guarded by
+		// streamMapLock
+		whipSession    *whipSession
+		standbySession *whipSession
 
 		firstSeenEpoch uint64
 
+		// Layers of the current publisher
 		videoTracks []*videoTrack
+		// When video was last forwarded to WHEP sessions, in Unix nanoseconds
+		lastVideoForwarded atomic.Int64
+		// If the slate plays to the WHEP sessions, see playSlate
+		slatePlaying atomic.Bool
 
-		audioTrack           *webrtc.TrackLocalStaticRTP
-		audioPacketsReceived atomic.Uint64
+		audioTrack *webrtc.TrackLocalStaticRTP
+		// Audio continues across publishers
+		audioRewriter rtpRewriter
+		audioBitrate  bitrate
+
+		// Traffic of every publisher and layer of the stream
+		traffic trafficCounters
 
 		pliChan chan any
 
@@ -51,12 +66,22 @@ type (
 
 		whepSessionsLock sync.RWMutex
 		whepSessions     map[string]*whepSession
+		// WHEP sessions whose answer is gathered by viewer, guarded by
+		// streamMapLock. The stream isn't removed while there are any.
+		pendingWHEPSessions map[string]int
 	}
 
 	videoTrack struct {
 		rid              string
 		packetsReceived  atomic.Uint64
+		bytesReceived    atomic.Uint64
+		packetsLost      atomic.Uint64
+		packetsSent      atomic.Uint64
+		bytesSent        atomic.Uint64
+		bitrate          bitrate
 		lastKeyFrameSeen atomic.Value
+		// Nanoseconds between the last two key frames
+		keyframeInterval atomic.Int64
 	}
 
 	videoTrackCodec int
@@ -106,8 +131,10 @@ func getStream(username string, forWHIP bool) (*stream, error) {
 
 		foundStream = &stream{
 			audioTrack:              audioTrack,
+			audioRewriter:           rtpRewriter{clockRate: audioClockRate},
 			pliChan:                 make(chan any, 50),
 			whepSessions:            map[string]*whepSession{},
+			pendingWHEPSessions:     map[string]int{},
 			whipActiveContext:       whipActiveContext,
 			whipActiveContextCancel: whipActiveContextCancel,
 			firstSeenEpoch:          uint64(time.Now().Unix()),
@@ -116,13 +143,41 @@ func getStream(username string, forWHIP bool) (*stream, error) {
 	}
 
 	if forWHIP {
-		foundStream.hasWHIPClient.Store(true)
+		// A publisher replacing another one doesn't start the stream again
+		if !foundStream.hasWHIPClient.Swap(true) {
+			streamEvent(username, StreamEventStart)
+		}
+
+		foundStream.whepSessionsLock.RLock()
+		foundStream.notifyWHEPSessions()
+		foundStream.whepSessionsLock.RUnlock()
 	}
 
 	return foundStream, nil
 }
 
-func peerConnectionDisconnected(streamKey string, whepSessionId string) {
+// sessionDisconnect returns a function that removes a session from its stream
+// and closes its PeerConnection. It only does so on the first call, later calls
+// return right away. Close runs the ICE state handler that calls it again
+// before returning, so this can't be a sync.Once.
+func sessionDisconnect(peerConnection *webrtc.PeerConnection, streamKey, sessionId string) func() {
+	var disconnected atomic.Bool
+	return func() {
+		if disconnected.Swap(true) {
+			return
+		}
+
+		peerConnectionDisconnected(streamKey, sessionId)
+		if err := peerConnection.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// peerConnectionDisconnected removes the WHIP or WHEP session from its stream.
+// Sessions of publishers that have since been replaced are ignored, but the
+// stream is still removed if nothing uses it anymore.
+func peerConnectionDisconnected(streamKey string, sessionId string) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
@@ -134,15 +189,33 @@ func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	stream.whepSessionsLock.Lock()
 	defer stream.whepSessionsLock.Unlock()
 
-	if whepSessionId != "" {
-		delete(stream.whepSessions, whepSessionId)
-	} else {
+	switch {
+	case stream.whepSessions[sessionId] != nil:
+		close(stream.whepSessions[sessionId].subscribers.done)
+		delete(stream.whepSessions, sessionId)
+		stream.notifyWHEPSessions()
+		if len(stream.whepSessions) == 0 {
+			streamEvent(streamKey, StreamEventLastViewer)
+		}
+	case stream.standbySession != nil && stream.standbySession.id == sessionId:
+		stream.standbySession = nil
+	case stream.whipSession != nil && stream.whipSession.id == sessionId:
+		if stream.promoteStandby(streamKey) {
+			break
+		}
+
+		stream.whipSession = nil
 		stream.hasWHIPClient.Store(false)
 		stream.videoTracks = nil
+		stream.notifyWHEPSessions()
+		streamEvent(streamKey, StreamEventStop)
+		if len(stream.whepSessions) != 0 {
+			stream.startSlate()
+		}
 	}
 
 	// Only delete stream if all WHEP Sessions are gone and have no WHIP Client
-	if len(stream.whepSessions) != 0 || stream.hasWHIPClient.Load() {
+	if len(stream.whepSessions) != 0 || len(stream.pendingWHEPSessions) != 0 || stream.hasWHIPClient.Load() {
 		return
 	}
 
@@ -150,22 +223,53 @@ func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	delete(streamMap, streamKey)
 }
 
-func addTrack(stream *stream, rid string) (*videoTrack, error) {
+// addTrack adds a layer to a publisher session, it is a layer of the stream
+// while the session publishes to it.
+func addTrack(stream *stream, session *whipSession, rid string) (*videoTrack, error) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
-	for i := range stream.videoTracks {
-		if rid == stream.videoTracks[i].rid {
-			return stream.videoTracks[i], nil
+	for i := range session.videoTracks {
+		if rid == session.videoTracks[i].rid {
+			return session.videoTracks[i], nil
 		}
 	}
 
 	t := &videoTrack{rid: rid}
 	t.lastKeyFrameSeen.Store(time.Time{})
+	session.videoTracks = append(session.videoTracks, t)
+	if stream.whipSession != session {
+		return t, nil
+	}
 	stream.videoTracks = append(stream.videoTracks, t)
+
+	stream.whepSessionsLock.RLock()
+	stream.notifyWHEPSessions()
+	stream.whepSessionsLock.RUnlock()
+
 	return t, nil
 }
 
+// removeTrack removes a layer whose publisher stopped sending it.
+func removeTrack(stream *stream, session *whipSession, t *videoTrack) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if i := slices.Index(session.videoTracks, t); i != -1 {
+		session.videoTracks = slices.Delete(session.videoTracks, i, i+1)
+	}
+
+	i := slices.Index(stream.videoTracks, t)
+	if i == -1 {
+		return
+	}
+	stream.videoTracks = slices.Delete(stream.videoTracks, i, i+1)
+
+	stream.whepSessionsLock.RLock()
+	stream.notifyWHEPSessions()
+	stream.whepSessionsLock.RUnlock()
+}
+
 func getPublicIP() string {
 	req, err := http.Get("http://ip-api.com/json/")
 	if err != nil {
@@ -373,8 +477,12 @@ func newPeerConnection(api *webrtc.API) (*webrtc.PeerConnection, error) {
 
 func appendAnswer(in string) string {
 	if extraCandidate := os.Getenv("APPEND_CANDIDATE"); extraCandidate != "" {
-		index := strings.Index(in, "a=end-of-candidates")
-		in = in[:index] + extraCandidate + in[index:]
+		// Answers sent before gathering completed have no end-of-candidates
+		if index := strings.Index(in, "a=end-of-candidates"); index != -1 {
+			in = in[:index] + extraCandidate + in[index:]
+		} else {
+			in += extraCandidate
+		}
 	}
 
 	return in
@@ -395,12 +503,21 @@ func maybePrintOfferAnswer(sdp string, isOffer bool) string {
 func Configure() {
 	streamMap = map[string]*stream{}
 
+	if timeout := os.Getenv("TRICKLE_ICE_ANSWER_TIMEOUT"); timeout != "" {
+		var err error
+		if trickleAnswerTimeout, err = time.ParseDuration(timeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	mediaEngine := &webrtc.MediaEngine{}
 	if err := PopulateMediaEngine(mediaEngine); err != nil {
 		panic(err)
 	}
 
+	// Added first so it sees the NACKs of the interceptors after it
 	interceptorRegistry := &interceptor.Registry{}
+	interceptorRegistry.Add(nackCounterFactory{})
 	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
 		log.Fatal(err)
 	}
@@ -432,10 +549,10 @@ type StreamStatus struct {
 	FirstSeenEpoch       uint64              `json:"firstSeenEpoch"`
 	AudioPacketsReceived uint64              `json:"audioPacketsReceived"`
 	VideoStreams         []StreamStatusVideo `json:"videoStreams"`
-	WHEPSessions         []whepSessionStatus `json:"whepSessions"`
+	WHEPSessions         []WHEPSessionStatus `json:"whepSessions"`
 }
 
-type whepSessionStatus struct {
+type WHEPSessionStatus struct {
 	ID             string `json:"id"`
 	CurrentLayer   string `json:"currentLayer"`
 	SequenceNumber uint16 `json:"sequenceNumber"`
@@ -450,7 +567,7 @@ func GetStreamStatuses() []StreamStatus {
 	out := []StreamStatus{}
 
 	for streamKey, stream := range streamMap {
-		whepSessions := []whepSessionStatus{}
+		whepSessions := []WHEPSessionStatus{}
 		stream.whepSessionsLock.Lock()
 		for id, whepSession := range stream.whepSessions {
 			currentLayer, ok := whepSession.currentLayer.Load().(string)
@@ -458,7 +575,7 @@ func GetStreamStatuses() []StreamStatus {
 				continue
 			}
 
-			whepSessions = append(whepSessions, whepSessionStatus{
+			whepSessions = append(whepSessions, WHEPSessionStatus{
 				ID:             id,
 				CurrentLayer:   currentLayer,
 				SequenceNumber: whepSession.sequenceNumber,
@@ -485,7 +602,7 @@ func GetStreamStatuses() []StreamStatus {
 		out = append(out, StreamStatus{
 			StreamKey:            streamKey,
 			FirstSeenEpoch:       stream.firstSeenEpoch,
-			AudioPacketsReceived: stream.audioPacketsReceived.Load(),
+			AudioPacketsReceived: stream.traffic.audioPacketsReceived.Load(),
 			VideoStreams:         streamStatusVideo,
 			WHEPSessions:         whepSessions,
 		})
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"sync"
 	"sync/atomic"
 
 	"github.com/google/uuid"
@@ -13,14 +14,33 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+var ErrTooManyWHEPSessions = errors.New("viewer has too many WHEP sessions")
+
 type (
 	whepSession struct {
+		// Name of the user that started the session, empty for anonymous viewers
+		viewer string
+
+		ice *iceSession
+		// Closes the PeerConnection and removes the session from its stream, safe
+		// to call more than once
+		disconnect func()
+		// Server-sent event subscribers, see WHEPSubscribe
+		subscribers *whepSubscribers
+
 		videoTrack         *trackMultiCodec
 		currentLayer       atomic.Value
 		waitingForKeyframe atomic.Bool
-		sequenceNumber     uint16
-		timestamp          uint32
-		packetsWritten     uint64
+
+		// Guards the fields below, the slate writes video too
+		videoLock      sync.Mutex
+		sequenceNumber uint16
+		timestamp      uint32
+		packetsWritten uint64
+		// If the session gets the slate instead of the video of the publisher,
+		// see sendSlateFrame
+		onSlate            bool
+		slateFrameDuration uint32
 	}
 
 	simulcastLayerResponse struct {
@@ -32,74 +52,153 @@ func WHEPLayers(whepSessionId string) ([]byte, error) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
-	layers := []simulcastLayerResponse{}
+	rids := []string{}
 	for streamKey := range streamMap {
 		streamMap[streamKey].whepSessionsLock.Lock()
 		defer streamMap[streamKey].whepSessionsLock.Unlock()
 
 		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
 			for i := range streamMap[streamKey].videoTracks {
-				layers = append(layers, simulcastLayerResponse{EncodingId: streamMap[streamKey].videoTracks[i].rid})
+				rids = append(rids, streamMap[streamKey].videoTracks[i].rid)
 			}
 
 			break
 		}
 	}
 
-	resp := map[string]map[string][]simulcastLayerResponse{
+	return json.Marshal(layersResponse(rids))
+}
+
+func layersResponse(rids []string) map[string]map[string][]simulcastLayerResponse {
+	layers := []simulcastLayerResponse{}
+	for _, rid := range rids {
+		layers = append(layers, simulcastLayerResponse{EncodingId: rid})
+	}
+
+	return map[string]map[string][]simulcastLayerResponse{
 		"1": map[string][]simulcastLayerResponse{
 			"layers": layers,
 		},
 	}
-
-	return json.Marshal(resp)
 }
 
 func WHEPChangeLayer(whepSessionId, layer string) error {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
-	for streamKey := range streamMap {
-		streamMap[streamKey].whepSessionsLock.Lock()
-		defer streamMap[streamKey].whepSessionsLock.Unlock()
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		session, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+		if !ok {
+			continue
+		}
 
-		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			streamMap[streamKey].whepSessions[whepSessionId].currentLayer.Store(layer)
-			streamMap[streamKey].whepSessions[whepSessionId].waitingForKeyframe.Store(true)
-			streamMap[streamKey].pliChan <- true
+		session.currentLayer.Store(layer)
+		session.waitingForKeyframe.Store(true)
+		// Streams without a publisher don't read PLIs
+		select {
+		case stream.pliChan <- true:
+		default:
 		}
+		session.subscribers.notify()
+		return nil
 	}
 
 	return nil
 }
 
-func WHEP(offer, username string) (string, string, error) {
-	maybePrintOfferAnswer(offer, true)
-
+// WHEPSessionViewer returns the stream and viewer of a WHEP session.
+func WHEPSessionViewer(whepSessionId string) (streamKey string, viewer string, ok bool) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
-	stream, err := getStream(username, false)
-	if err != nil {
-		return "", "", err
+
+	for streamKey := range streamMap {
+		streamMap[streamKey].whepSessionsLock.RLock()
+		session, ok := streamMap[streamKey].whepSessions[whepSessionId]
+		streamMap[streamKey].whepSessionsLock.RUnlock()
+
+		if ok {
+			return streamKey, session.viewer, true
+		}
 	}
 
-	whepSessionId := uuid.New().String()
+	return "", "", false
+}
+
+// whepSessionCount returns the number of WHEP sessions of viewer on the
+// stream, including the ones whose answer is gathered. streamMapLock must be
+// held.
+func (s *stream) whepSessionCount(viewer string) int {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	count := s.pendingWHEPSessions[viewer]
+	for _, session := range s.whepSessions {
+		if session.viewer == viewer {
+			count++
+		}
+	}
 
-	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
+	return count
+}
+
+// WHEP starts watching the stream of username and returns the answer and the
+// ID of the new WHEP session. viewer may have at most maxSessions sessions on
+// the stream, 0 is unlimited.
+func WHEP(offer, username, viewer string, maxSessions int) (answer string, whepSessionId string, err error) {
+	maybePrintOfferAnswer(offer, true)
 
 	peerConnection, err := newPeerConnection(apiWhep)
 	if err != nil {
 		return "", "", err
 	}
 
-	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
-		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
-			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
-			}
+	whepSessionId = uuid.New().String()
+	disconnect := sessionDisconnect(peerConnection, username, whepSessionId)
 
+	// Streams aren't locked while the answer is gathered, the stream is kept
+	// until the session is added to it
+	streamMapLock.Lock()
+	stream, err := getStream(username, false)
+	switch {
+	case err != nil:
+	case maxSessions != 0 && stream.whepSessionCount(viewer) >= maxSessions:
+		err = ErrTooManyWHEPSessions
+	default:
+		stream.pendingWHEPSessions[viewer]++
+	}
+	streamMapLock.Unlock()
+	if err != nil {
+		disconnect()
+		return "", "", err
+	}
+
+	defer func() {
+		streamMapLock.Lock()
+		if stream.pendingWHEPSessions[viewer]--; stream.pendingWHEPSessions[viewer] == 0 {
+			delete(stream.pendingWHEPSessions, viewer)
+		}
+		streamMapLock.Unlock()
+
+		if err != nil {
+			disconnect()
+			// Removes the stream again if it was only kept for this session
 			peerConnectionDisconnected(username, whepSessionId)
 		}
+	}()
+
+	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
+
+	countDTLSFailures(peerConnection, &whepFailures)
+	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		if i == webrtc.ICEConnectionStateFailed {
+			whepFailures.ice.Add(1)
+		}
+
+		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
+			disconnect()
+		}
 	})
 
 	if _, err = peerConnection.AddTrack(stream.audioTrack); err != nil {
@@ -119,17 +218,21 @@ func WHEP(offer, username string) (string, string, error) {
 			}
 
 			for _, r := range rtcpPackets {
-				if _, isPLI := r.(*rtcp.PictureLossIndication); isPLI {
+				switch r.(type) {
+				case *rtcp.PictureLossIndication:
+					stream.countTraffic(func(c *trafficCounters) { c.plisReceived.Add(1) })
 					select {
 					case stream.pliChan <- true:
 					default:
 					}
+				case *rtcp.TransportLayerNack:
+					stream.countTraffic(func(c *trafficCounters) { c.nacksReceived.Add(1) })
 				}
 			}
 		}
 	}()
 
-	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		SDP:  offer,
 		Type: webrtc.SDPTypeOffer,
 	}); err != nil {
@@ -137,42 +240,119 @@ func WHEP(offer, username string) (string, string, error) {
 	}
 
 	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	answer, err := peerConnection.CreateAnswer(nil)
+	sdpAnswer, err := peerConnection.CreateAnswer(nil)
 
 	if err != nil {
 		return "", "", err
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+	} else if err = peerConnection.SetLocalDescription(sdpAnswer); err != nil {
 		return "", "", err
 	}
 
-	<-gatherComplete
+	ice := newICESession(peerConnection)
+	answer = ice.answer(offer, gatherComplete)
 
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
 	stream.whepSessionsLock.Lock()
 	defer stream.whepSessionsLock.Unlock()
 
+	// The connection failed while the answer was gathered
+	if state := peerConnection.ICEConnectionState(); state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateClosed {
+		return "", "", ErrSessionNotFound
+	}
+
 	stream.whepSessions[whepSessionId] = &whepSession{
-		videoTrack: videoTrack,
-		timestamp:  50000,
+		viewer:      viewer,
+		ice:         ice,
+		disconnect:  disconnect,
+		subscribers: newWHEPSubscribers(),
+		videoTrack:  videoTrack,
+		timestamp:   50000,
 	}
 	stream.whepSessions[whepSessionId].currentLayer.Store("")
 	stream.whepSessions[whepSessionId].waitingForKeyframe.Store(false)
+	stream.notifyWHEPSessions()
+	if !stream.hasWHIPClient.Load() {
+		stream.startSlate()
+	}
+	if len(stream.whepSessions) == 1 {
+		streamEvent(username, StreamEventFirstViewer)
+	}
+
+	return maybePrintOfferAnswer(appendAnswer(answer), false), whepSessionId, nil
+}
+
+// WHEPDelete ends a WHEP session of a stream, it returns false if the stream
+// has no session with that ID.
+func WHEPDelete(streamKey, whepSessionId string) bool {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok {
+		streamMapLock.Unlock()
+		return false
+	}
+
+	stream.whepSessionsLock.RLock()
+	session, ok := stream.whepSessions[whepSessionId]
+	stream.whepSessionsLock.RUnlock()
+	streamMapLock.Unlock()
+
+	if ok {
+		session.disconnect()
+	}
+
+	return ok
+}
+
+// WHEPPatch applies a trickle ICE or ICE restart SDP fragment to a WHEP
+// session of a stream, see iceSession.patch.
+func WHEPPatch(streamKey, whepSessionId, ifMatch, fragment string) (string, error) {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok {
+		streamMapLock.Unlock()
+		return "", ErrSessionNotFound
+	}
+
+	stream.whepSessionsLock.RLock()
+	session, ok := stream.whepSessions[whepSessionId]
+	stream.whepSessionsLock.RUnlock()
+	streamMapLock.Unlock()
+
+	if !ok {
+		return "", ErrSessionNotFound
+	}
 
-	return maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false), whepSessionId, nil
+	return session.ice.patch(ifMatch, fragment)
 }
 
-func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff int64, sequenceDiff int, codec videoTrackCodec, isKeyframe bool) {
+// sendVideoPacket writes a packet of layer to the session, it reports if the
+// session watches the layer and got it.
+func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff int64, sequenceDiff int, codec videoTrackCodec, isKeyframe bool) bool {
 	if w.currentLayer.Load() == "" {
 		w.currentLayer.Store(layer)
+		w.subscribers.notify()
 	} else if layer != w.currentLayer.Load() {
-		return
-	} else if w.waitingForKeyframe.Load() {
+		return false
+	}
+
+	w.videoLock.Lock()
+	defer w.videoLock.Unlock()
+
+	if w.waitingForKeyframe.Load() {
 		if !isKeyframe {
-			return
+			// The timestamp keeps up, so the key frame plays at its time. The
+			// slate keeps it up itself.
+			if !w.onSlate {
+				w.timestamp = uint32(int64(w.timestamp) + timeDiff)
+			}
+			return false
 		}
 
 		w.waitingForKeyframe.Store(false)
 	}
 
+	w.onSlate = false
 	w.packetsWritten += 1
 	w.sequenceNumber = uint16(int(w.sequenceNumber) + sequenceDiff)
 	w.timestamp = uint32(int64(w.timestamp) + timeDiff)
@@ -182,5 +362,8 @@ func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff
 
 	if err := w.videoTrack.WriteRTP(rtpPkt, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
 		log.Println(err)
+		return false
 	}
+
+	return true
 }
@@ -0,0 +1,51 @@
+package webrtc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWHEPMaxSessions(t *testing.T) {
+	Configure()
+
+	streamMapLock.Lock()
+	s, err := getStream("limited", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A session of the viewer whose answer is still gathered
+	s.pendingWHEPSessions["token"] = 1
+	streamMapLock.Unlock()
+
+	if _, _, err = WHEP("", "limited", "token", 1); !errors.Is(err, ErrTooManyWHEPSessions) {
+		t.Fatalf("viewer got more sessions than allowed: %v", err)
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+	if streamMap["limited"] != s {
+		t.Error("stream with a pending session was removed")
+	}
+}
+
+func TestWHEPChangeLayerWithoutPublisher(t *testing.T) {
+	streamMapLock.Lock()
+	s, err := getStream("slate", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &whepSession{subscribers: newWHEPSubscribers()}
+	s.whepSessions["viewer"] = session
+	streamMapLock.Unlock()
+
+	// Nothing reads the PLIs of a stream without a publisher
+	for range 2 * cap(s.pliChan) {
+		if err = WHEPChangeLayer("viewer", "low"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if session.currentLayer.Load() != "low" || !session.waitingForKeyframe.Load() {
+		t.Error("layer was not changed")
+	}
+}
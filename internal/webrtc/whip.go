@@ -6,16 +6,58 @@ import (
 	"log"
 	"math"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
 )
 
-func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream) {
+type whipSession struct {
+	id string
+	// Who created the session, see WHIPSessionPublisher. Empty for publishers
+	// that don't use WHIP.
+	publisher string
+	// nil for publishers that don't use WebRTC, see Publish
+	ice *iceSession
+	// Get the media of the session once it is active, see AddSinkFactory
+	sinks []Sink
+	// PLIs of the stream the session publishes to
+	pliChan chan any
+	// Closes the PeerConnection and removes the session from its stream, safe
+	// to call more than once
+	disconnect func()
+
+	// Only the publisher of a stream forwards its media, not its backup or a
+	// publisher that was replaced. See activate.
+	active    atomic.Bool
+	activated chan struct{}
+	endLock   sync.Mutex
+	ended     bool
+	done      chan struct{}
+	// Layers the session sends, guarded by streamMapLock
+	videoTracks []*videoTrack
+}
+
+func newWHIPSession(id string) *whipSession {
+	return &whipSession{id: id, activated: make(chan struct{}), done: make(chan struct{})}
+}
+
+// requestKeyframe asks the publisher for a key frame like WHEP sessions do. It
+// is only called once the session publishes.
+func (s *whipSession) requestKeyframe() {
+	select {
+	case s.pliChan <- true:
+	default:
+	}
+}
+
+func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream, session *whipSession) {
 	rtpBuf := make([]byte, 1500)
+	rtpPkt := &rtp.Packet{}
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
@@ -26,32 +68,67 @@ func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream) {
 			return
 		}
 
-		stream.audioPacketsReceived.Add(1)
-		if _, writeErr := stream.audioTrack.Write(rtpBuf[:rtpRead]); writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
-			log.Println(writeErr)
+		if !session.active.Load() {
+			continue
+		}
+
+		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
+			log.Println(err)
 			return
 		}
+
+		if err = stream.writeAudio(session, rtpPkt); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// writeAudio forwards an audio packet of a session that publishes to the
+// stream, it rewrites the packet.
+func (s *stream) writeAudio(session *whipSession, pkt *rtp.Packet) error {
+	s.receivedAudio(pkt.MarshalSize())
+	for _, sink := range session.sinks {
+		sink.WriteAudio(pkt)
+	}
+
+	s.audioRewriter.rewrite(session, pkt)
+	if err := s.audioTrack.WriteRTP(pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return err
 	}
+
+	return nil
 }
 
-func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection *webrtc.PeerConnection, s *stream) {
+func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection *webrtc.PeerConnection, session *whipSession) {
 	id := remoteTrack.RID()
 	if id == "" {
 		id = videoTrackLabelDefault
 	}
 
-	videoTrack, err := addTrack(s, id)
+	videoTrack, err := addTrack(stream, session, id)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	defer removeTrack(stream, session, videoTrack)
 
 	go func() {
+		if !session.waitForKeyframeRequests(stream) {
+			return
+		}
+
 		for {
 			select {
 			case <-stream.whipActiveContext.Done():
 				return
+			case <-session.done:
+				return
 			case <-stream.pliChan:
+				if !session.keyframeRequested() {
+					return
+				}
+
 				if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
 					&rtcp.PictureLossIndication{
 						MediaSSRC: uint32(remoteTrack.SSRC()),
@@ -59,29 +136,14 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 				}); sendErr != nil {
 					return
 				}
+				stream.countTraffic(func(c *trafficCounters) { c.plisSent.Add(1) })
 			}
 		}
 	}()
 
 	rtpBuf := make([]byte, 1500)
 	rtpPkt := &rtp.Packet{}
-	codec := getVideoTrackCodec(remoteTrack.Codec().RTPCodecCapability.MimeType)
-
-	var depacketizer rtp.Depacketizer
-	switch codec {
-	case videoTrackCodecH264:
-		depacketizer = &codecs.H264Packet{}
-	case videoTrackCodecVP8:
-		depacketizer = &codecs.VP8Packet{}
-	case videoTrackCodecVP9:
-		depacketizer = &codecs.VP9Packet{}
-	}
-
-	lastTimestamp := uint32(0)
-	lastTimestampSet := false
-
-	lastSequenceNumber := uint16(0)
-	lastSequenceNumberSet := false
+	layer := newLayerWriter(stream, session, videoTrack, remoteTrack.Codec().RTPCodecCapability.MimeType)
 
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
@@ -93,101 +155,273 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 			return
 		}
 
+		if !session.active.Load() {
+			continue
+		}
+
 		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
 			log.Println(err)
 			return
 		}
 
-		videoTrack.packetsReceived.Add(1)
+		layer.write(rtpPkt)
+	}
+}
 
-		// Keyframe detection has only been implemented for H264
-		isKeyframe := isKeyframe(rtpPkt, codec, depacketizer)
-		if isKeyframe && codec == videoTrackCodecH264 {
-			videoTrack.lastKeyFrameSeen.Store(time.Now())
-		}
+// layerWriter forwards the packets of a video layer of a publisher session to
+// its sinks and the WHEP sessions of its stream.
+type layerWriter struct {
+	stream       *stream
+	session      *whipSession
+	track        *videoTrack
+	mimeType     string
+	codec        videoTrackCodec
+	depacketizer rtp.Depacketizer
 
-		rtpPkt.Extension = false
-		rtpPkt.Extensions = nil
+	lastTimestamp    uint32
+	lastTimestampSet bool
 
-		timeDiff := int64(rtpPkt.Timestamp) - int64(lastTimestamp)
-		switch {
-		case !lastTimestampSet:
-			timeDiff = 0
-			lastTimestampSet = true
-		case timeDiff < -(math.MaxUint32 / 10):
-			timeDiff += (math.MaxUint32 + 1)
-		}
+	lastSequenceNumber    uint16
+	lastSequenceNumberSet bool
 
-		sequenceDiff := int(rtpPkt.SequenceNumber) - int(lastSequenceNumber)
-		switch {
-		case !lastSequenceNumberSet:
-			lastSequenceNumberSet = true
-			sequenceDiff = 0
-		case sequenceDiff < -(math.MaxUint16 / 10):
-			sequenceDiff += (math.MaxUint16 + 1)
-		}
+	loss lossCounter
+	// Traffic of the layers with the RID of this one, of every stream
+	layerTraffic *trafficCounters
+	// RTP timestamp of the last key frame, its packets all have the same one
+	lastKeyframeTimestamp    uint32
+	lastKeyframeTimestampSet bool
+}
+
+func newLayerWriter(s *stream, session *whipSession, track *videoTrack, mimeType string) *layerWriter {
+	codec := getVideoTrackCodec(mimeType)
+
+	return &layerWriter{
+		stream:       s,
+		session:      session,
+		track:        track,
+		mimeType:     mimeType,
+		codec:        codec,
+		depacketizer: newDepacketizer(codec),
+		layerTraffic: layerTraffic(track.rid),
+	}
+}
+
+// write forwards a packet of the active session, it strips its header
+// extensions.
+func (l *layerWriter) write(rtpPkt *rtp.Packet) {
+	id := l.track.rid
+	size := rtpPkt.MarshalSize()
+	lost := l.loss.add(rtpPkt.SequenceNumber)
+	l.track.packetsReceived.Add(1)
+	l.track.bytesReceived.Add(uint64(size))
+	l.track.bitrate.add(size)
+	l.track.packetsLost.Add(lost)
+	l.countTraffic(func(c *trafficCounters) {
+		c.videoPacketsReceived.Add(1)
+		c.videoBytesReceived.Add(uint64(size))
+		c.videoPacketsLost.Add(lost)
+	})
 
-		lastTimestamp = rtpPkt.Timestamp
-		lastSequenceNumber = rtpPkt.SequenceNumber
+	isKeyframe := isKeyframe(rtpPkt, l.codec, l.depacketizer)
+	if isKeyframe {
+		l.track.lastKeyFrameSeen.Store(time.Now())
+		l.keyframeSeen(rtpPkt.Timestamp)
+	}
+
+	for _, sink := range l.session.sinks {
+		sink.WriteVideo(id, l.mimeType, rtpPkt)
+	}
+
+	rtpPkt.Extension = false
+	rtpPkt.Extensions = nil
 
-		s.whepSessionsLock.RLock()
-		for i := range s.whepSessions {
-			s.whepSessions[i].sendVideoPacket(rtpPkt, id, timeDiff, sequenceDiff, codec, isKeyframe)
+	// The first packet of a layer continues after the video the stream
+	// forwarded before, possibly from another publisher
+	timeDiff := int64(rtpPkt.Timestamp) - int64(l.lastTimestamp)
+	switch {
+	case !l.lastTimestampSet:
+		timeDiff = l.stream.elapsedVideoTimestamp()
+		l.lastTimestampSet = true
+	case timeDiff < -(math.MaxUint32 / 10):
+		timeDiff += (math.MaxUint32 + 1)
+	}
+
+	sequenceDiff := int(rtpPkt.SequenceNumber) - int(l.lastSequenceNumber)
+	switch {
+	case !l.lastSequenceNumberSet:
+		l.lastSequenceNumberSet = true
+		sequenceDiff = 1
+	case sequenceDiff < -(math.MaxUint16 / 10):
+		sequenceDiff += (math.MaxUint16 + 1)
+	}
+
+	l.lastTimestamp = rtpPkt.Timestamp
+	l.lastSequenceNumber = rtpPkt.SequenceNumber
+
+	sent := uint64(0)
+	l.stream.whepSessionsLock.RLock()
+	for i := range l.stream.whepSessions {
+		if l.stream.whepSessions[i].sendVideoPacket(rtpPkt, id, timeDiff, sequenceDiff, l.codec, isKeyframe) {
+			sent++
 		}
-		s.whepSessionsLock.RUnlock()
+	}
+	l.stream.whepSessionsLock.RUnlock()
+
+	l.track.packetsSent.Add(sent)
+	l.track.bytesSent.Add(sent * uint64(rtpPkt.MarshalSize()))
+	l.countTraffic(func(c *trafficCounters) {
+		c.videoPacketsSent.Add(sent)
+		c.videoBytesSent.Add(sent * uint64(rtpPkt.MarshalSize()))
+	})
+}
 
+// keyframeSeen updates the key frame interval of the layer with the RTP
+// timestamp of a key frame packet.
+func (l *layerWriter) keyframeSeen(timestamp uint32) {
+	if l.lastKeyframeTimestampSet && timestamp != l.lastKeyframeTimestamp {
+		elapsed := time.Duration(timestamp-l.lastKeyframeTimestamp) * time.Second / videoClockRate
+		l.track.keyframeInterval.Store(int64(elapsed))
 	}
+
+	l.lastKeyframeTimestamp, l.lastKeyframeTimestampSet = timestamp, true
 }
 
-func WHIP(offer, username string) (string, error) {
+// WHIP starts publishing to the stream of username and returns the answer and
+// the ID of the new WHIP session. policy decides what happens if the stream
+// already has a publisher, see publisher.PolicyReject. publisher identifies who
+// created the session, for WHIPSessionPublisher.
+func WHIP(offer, username, policy, publisher string) (answer string, whipSessionId string, err error) {
 	maybePrintOfferAnswer(offer, true)
 
 	peerConnection, err := newPeerConnection(apiWhip)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	whipSessionId = uuid.New().String()
+	session := newWHIPSession(whipSessionId)
+	session.publisher = publisher
+	session.ice = newICESession(peerConnection)
+	disconnect := sessionDisconnect(peerConnection, username, whipSessionId)
+	session.disconnect = func() {
+		disconnect()
+		session.end()
 	}
 
+	var (
+		stream    *stream
+		replaced  *whipSession
+		publishes bool
+	)
+	// Streams aren't locked while the answer is gathered, the session is
+	// activated once it is ready
+	defer func() {
+		switch {
+		case err != nil:
+			session.disconnect()
+		case publishes:
+			session.activate(username, stream)
+		}
+
+		if replaced != nil {
+			replaced.disconnect()
+		}
+	}()
+
 	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
-	stream, err := getStream(username, true)
+	stream, replaced, publishes, err = addPublisher(username, session, policy)
+	streamMapLock.Unlock()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
 		if strings.HasPrefix(remoteTrack.Codec().RTPCodecCapability.MimeType, "audio") {
-			audioWriter(remoteTrack, stream)
+			audioWriter(remoteTrack, stream, session)
 		} else {
-			videoWriter(remoteTrack, stream, peerConnection, stream)
-
+			videoWriter(remoteTrack, stream, peerConnection, session)
 		}
 	})
 
+	countDTLSFailures(peerConnection, &whipFailures)
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		if i == webrtc.ICEConnectionStateFailed {
+			whipFailures.ice.Add(1)
+		}
+
 		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
-			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
-			}
-			peerConnectionDisconnected(username, "")
+			session.disconnect()
 		}
 	})
 
-	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		SDP:  string(offer),
 		Type: webrtc.SDPTypeOffer,
 	}); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	answer, err := peerConnection.CreateAnswer(nil)
+	sdpAnswer, err := peerConnection.CreateAnswer(nil)
 
 	if err != nil {
-		return "", err
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", err
+		return "", "", err
+	} else if err = peerConnection.SetLocalDescription(sdpAnswer); err != nil {
+		return "", "", err
+	}
+
+	return maybePrintOfferAnswer(appendAnswer(session.ice.answer(offer, gatherComplete)), false), whipSessionId, nil
+}
+
+// WHIPPatch applies a trickle ICE or ICE restart SDP fragment to the WHIP
+// session of a stream, see iceSession.patch.
+func WHIPPatch(streamKey, whipSessionId, ifMatch, fragment string) (string, error) {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	var session *whipSession
+	if ok {
+		session = stream.publisherSession(whipSessionId)
+	}
+	streamMapLock.Unlock()
+
+	// Publishers that don't use WebRTC have no ICE to patch
+	if session == nil || session.ice == nil {
+		return "", ErrSessionNotFound
+	}
+
+	return session.ice.patch(ifMatch, fragment)
+}
+
+// WHIPSessionPublisher returns the stream of a WHIP session and who created
+// it, the session may be the backup of the stream.
+func WHIPSessionPublisher(whipSessionId string) (streamKey string, publisher string, ok bool) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for streamKey, stream := range streamMap {
+		if session := stream.publisherSession(whipSessionId); session != nil && session.ice != nil {
+			return streamKey, session.publisher, true
+		}
+	}
+
+	return "", "", false
+}
+
+// WHIPDelete ends the WHIP session of a stream or its backup, it returns false
+// if the stream has no session with that ID.
+func WHIPDelete(streamKey, whipSessionId string) bool {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	var session *whipSession
+	if ok {
+		session = stream.publisherSession(whipSessionId)
+	}
+	streamMapLock.Unlock()
+
+	if session == nil {
+		return false
 	}
 
-	<-gatherComplete
-	return maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false), nil
+	session.disconnect()
+	return true
 }
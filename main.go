@@ -1,28 +1,45 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"database/sql"
-	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"time"
 
-	_ "modernc.org/sqlite"
-
 	"github.com/glimesh/broadcast-box/internal/auth"
 	"github.com/glimesh/broadcast-box/internal/database"
+	legacydb "github.com/glimesh/broadcast-box/internal/db"
+	"github.com/glimesh/broadcast-box/internal/hls"
+	"github.com/glimesh/broadcast-box/internal/ingest"
+	"github.com/glimesh/broadcast-box/internal/metrics"
 	"github.com/glimesh/broadcast-box/internal/networktest"
+	"github.com/glimesh/broadcast-box/internal/publisher"
+	"github.com/glimesh/broadcast-box/internal/recording"
+	"github.com/glimesh/broadcast-box/internal/restream"
+	"github.com/glimesh/broadcast-box/internal/rtmp"
+	"github.com/glimesh/broadcast-box/internal/srt"
+	"github.com/glimesh/broadcast-box/internal/webhook"
 	"github.com/glimesh/broadcast-box/internal/webrtc"
 	"github.com/joho/godotenv"
 )
@@ -31,15 +48,28 @@ const (
 	envFileProd = ".env.production"
 	envFileDev  = ".env.development"
 
+	defaultDatabasePath  = "broadcast-box.db"
+	defaultAdminUsername = "admin"
+
+	sdpFragmentContentType = "application/trickle-ice-sdpfrag"
+	sseHeartbeatInterval   = 15 * time.Second
+
 	networkTestIntroMessage   = "\033[0;33mNETWORK_TEST_ON_START is enabled. If the test fails Broadcast Box will exit.\nSee the README for how to debug or disable NETWORK_TEST_ON_START\033[0m"
 	networkTestSuccessMessage = "\033[0;32mNetwork Test passed.\nHave fun using Broadcast Box.\033[0m"
 	networkTestFailedMessage  = "\033[0;31mNetwork Test failed.\n%s\nPlease see the README and join Discord for help\033[0m"
+
+	firstRunCredentialsMessage = "\033[0;33mGenerated credentials for admin `%s`, they will not be shown again:\n%s\033[0m\n"
 )
 
 var errNoBuildDirectoryErr = errors.New("\033[0;31mBuild directory does not exist, run `npm install` and `npm run build` in the web directory.\033[0m")
 
-//go:embed internal/database/schema.sql
-var ddl string
+var (
+	databasePathFlag   = flag.String("database", "", "Path of the SQLite database, overrides DATABASE_PATH")
+	adminUsernameFlag  = flag.String("admin-username", "", "Username of the admin created on first run, overrides ADMIN_USERNAME")
+	adminPasswordFlag  = flag.String("admin-password", "", "Password of the admin created on first run, overrides ADMIN_PASSWORD")
+	adminStreamKeyFlag = flag.String("admin-stream-key", "", "Stream key of the admin created on first run, overrides ADMIN_STREAM_KEY")
+	importUsersFlag    = flag.String("import-users", "", "Import users from a legacy JSON user database before starting")
+)
 
 type (
 	whepLayerRequestJSON struct {
@@ -53,9 +83,271 @@ func logHTTPError(w http.ResponseWriter, err string, code int) {
 	http.Error(w, err, code)
 }
 
-func validateStreamKey(ctx context.Context, queries *database.Queries, username, streamKey string) bool {
-	u, _ := auth.GetUser(ctx, queries, username)
-	return u.VerifyStreamKey(streamKey)
+func validateStreamKey(ctx context.Context, queries *database.Queries, username, streamKey string) (bool, string) {
+	// Every rejection takes as long as a wrong stream key, so it doesn't
+	// reveal if the user exists
+	u, err := auth.GetUser(ctx, queries, username)
+	switch {
+	case err != nil:
+		return auth.VerifyUnknownUser(streamKey), "unknown user"
+	case !u.VerifyStreamKey(streamKey):
+		return false, "invalid stream key"
+	case !u.Can(auth.PermissionPublish):
+		return false, "not allowed to publish"
+	}
+
+	return true, ""
+}
+
+// flagOrEnv returns the value of a command line flag, falling back to the
+// environment variable and then to the default.
+func flagOrEnv(flagValue, envName, defaultValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+
+	if val := os.Getenv(envName); val != "" {
+		return val
+	}
+
+	return defaultValue
+}
+
+func durationFromEnv(envName string, defaultValue time.Duration) time.Duration {
+	val := os.Getenv(envName)
+	if val == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatalf("%s is not a valid duration: %s", envName, err)
+	}
+
+	return d
+}
+
+// sessionKeys returns the keys in SESSION_KEY, the first signs new sessions
+// and the rest are accepted while rotating keys.
+func sessionKeys() [][]byte {
+	if os.Getenv("SESSION_KEY") == "" {
+		log.Println("SESSION_KEY is not set, everyone will be logged out after a restart")
+		return [][]byte{[]byte(auth.GenerateStreamKey())}
+	}
+
+	keys := [][]byte{}
+	for _, k := range strings.Split(os.Getenv("SESSION_KEY"), "|") {
+		keys = append(keys, []byte(k))
+	}
+
+	return keys
+}
+
+// secureCookies reports if cookies are only sent over HTTPS, which is the case
+// when the server serves TLS unless SECURE_COOKIES says otherwise. Set it when
+// behind a TLS terminating proxy.
+func secureCookies() bool {
+	val := os.Getenv("SECURE_COOKIES")
+	if val == "" {
+		return os.Getenv("SSL_KEY") != "" && os.Getenv("SSL_CERT") != ""
+	}
+
+	secure, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Fatalf("SECURE_COOKIES is not a valid boolean: %s", err)
+	}
+
+	return secure
+}
+
+// prefixesFromEnv returns the IPs and CIDR ranges in the environment variable
+// name, delineated by '|'.
+func prefixesFromEnv(name string) []netip.Prefix {
+	prefixes := []netip.Prefix{}
+	if os.Getenv(name) == "" {
+		return prefixes
+	}
+
+	for _, entry := range strings.Split(os.Getenv(name), "|") {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			log.Fatalf("%s entry %q is not an IP or CIDR range", name, entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes
+}
+
+// oidcConfigFromEnv returns the OpenID Connect settings, ok is false if
+// OIDC_ISSUER is not set.
+func oidcConfigFromEnv() (cfg auth.OIDCConfig, ok bool) {
+	if os.Getenv("OIDC_ISSUER") == "" {
+		return cfg, false
+	}
+
+	cfg = auth.OIDCConfig{
+		Issuer:        os.Getenv("OIDC_ISSUER"),
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.Split(flagOrEnv("", "OIDC_SCOPES", "profile|email"), "|"),
+		UsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+		RoleClaim:     os.Getenv("OIDC_ROLE_CLAIM"),
+		RoleMap:       map[string]string{},
+		DefaultRole:   os.Getenv("OIDC_DEFAULT_ROLE"),
+		SecureCookies: secureCookies(),
+	}
+
+	if os.Getenv("OIDC_ROLE_MAP") != "" {
+		for _, mapping := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), "|") {
+			claim, role, found := strings.Cut(mapping, "=")
+			if !found {
+				log.Fatalf("OIDC_ROLE_MAP entry %q is not in the form claim=role", mapping)
+			}
+			cfg.RoleMap[claim] = role
+		}
+	}
+
+	return cfg, true
+}
+
+// recorderFromEnv returns the recorder configured with RECORDINGS_PATH, ok is
+// false if it is not set.
+func recorderFromEnv(queries *database.Queries) (recorder *recording.Recorder, ok bool) {
+	if os.Getenv("RECORDINGS_PATH") == "" {
+		return nil, false
+	}
+
+	maxSize := int64(0)
+	if val := os.Getenv("RECORDING_MAX_SIZE_MB"); val != "" {
+		megabytes, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			log.Fatalf("RECORDING_MAX_SIZE_MB is not a valid number: %s", err)
+		}
+		maxSize = megabytes * 1024 * 1024
+	}
+
+	av1Format := recording.FormatWebM
+	if val := os.Getenv("RECORDING_AV1_FORMAT"); val != "" {
+		av1Format = val
+	}
+
+	recorder, err := recording.New(queries, os.Getenv("RECORDINGS_PATH"), maxSize, durationFromEnv("RECORDING_MAX_DURATION", 0), av1Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recorder.Layer = os.Getenv("RECORDING_LAYER")
+
+	return recorder, true
+}
+
+// authorizerFromEnv returns the Authorizer of publish requests and, if
+// AUTH_CALLBACK_WHEP is set, watch requests. pluginAuthorizer takes precedence
+// over AUTH_CALLBACK_URL, ok is false without either.
+func authorizerFromEnv() (authorizer auth.Authorizer, whep bool, ok bool) {
+	authorizer = pluginAuthorizer
+	if authorizer == nil {
+		url := os.Getenv("AUTH_CALLBACK_URL")
+		if url == "" {
+			return nil, false, false
+		}
+
+		authorizer = auth.NewHTTPAuthorizer(url, durationFromEnv("AUTH_CALLBACK_TIMEOUT", 2*time.Second))
+	}
+
+	return auth.NewCachedAuthorizer(authorizer, durationFromEnv("AUTH_CALLBACK_CACHE_TTL", 30*time.Second)), os.Getenv("AUTH_CALLBACK_WHEP") != "", true
+}
+
+// hlsPackagerFromEnv returns the HLS packager, ok is false if DISABLE_HLS is
+// set.
+func hlsPackagerFromEnv() (packager *hls.Packager, ok bool) {
+	if os.Getenv("DISABLE_HLS") != "" {
+		return nil, false
+	}
+
+	segmentCount := 7
+	if val := os.Getenv("HLS_SEGMENT_COUNT"); val != "" {
+		var err error
+		if segmentCount, err = strconv.Atoi(val); err != nil || segmentCount < 1 {
+			log.Fatalf("HLS_SEGMENT_COUNT is not a valid number: %s", val)
+		}
+	}
+
+	return hls.New(durationFromEnv("HLS_SEGMENT_DURATION", 2*time.Second), durationFromEnv("HLS_PART_DURATION", 200*time.Millisecond), segmentCount), true
+}
+
+// bootstrapAdmin creates the initial admin if the database has no admin yet.
+// Credentials that were not configured are generated and printed once.
+func bootstrapAdmin(ctx context.Context, queries *database.Queries) error {
+	users, err := queries.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	username := flagOrEnv(*adminUsernameFlag, "ADMIN_USERNAME", defaultAdminUsername)
+	for _, u := range users {
+		if u.Role == auth.RoleAdmin {
+			return nil
+		}
+	}
+
+	// Imported users aren't admins, one of them may have the name of the admin
+	for _, u := range users {
+		if u.Name == username {
+			return fmt.Errorf("there is no admin and user %q already exists, set ADMIN_USERNAME to create the admin with another name", username)
+		}
+	}
+	password := flagOrEnv(*adminPasswordFlag, "ADMIN_PASSWORD", "")
+	streamKey := flagOrEnv(*adminStreamKeyFlag, "ADMIN_STREAM_KEY", "")
+
+	generated := []string{}
+	if password == "" {
+		password = auth.GenerateStreamKey()
+		generated = append(generated, "password: "+password)
+	}
+
+	if streamKey == "" {
+		streamKey = auth.GenerateStreamKey()
+		generated = append(generated, "stream key: "+streamKey)
+	}
+
+	if _, err = auth.NewUser(ctx, queries, username, password, streamKey, auth.RoleAdmin); err != nil {
+		return err
+	}
+
+	log.Printf("Created admin user `%s`", username)
+	if len(generated) != 0 {
+		fmt.Printf(firstRunCredentialsMessage, username, strings.Join(generated, "\n")) //nolint
+	}
+
+	return nil
+}
+
+// importUsers copies the users of a legacy JSON user database into the SQLite
+// database and reports users that could not be imported.
+func importUsers(ctx context.Context, db *sql.DB, path string) error {
+	legacy, err := legacydb.Open(path)
+	if err != nil {
+		return err
+	}
+
+	report, err := legacydb.Import(ctx, db, legacy)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d users from `%s`", len(report.Imported), path)
+	for _, c := range report.Conflicts {
+		log.Printf("Skipped user %s", c)
+	}
+
+	return nil
 }
 
 func extractBearerToken(authHeader string) (string, bool) {
@@ -66,32 +358,155 @@ func extractBearerToken(authHeader string) (string, bool) {
 	return "", false
 }
 
+// pluginAuthorizer decides about publish and watch requests in place of
+// AUTH_CALLBACK_URL. In-process authorizers set it from an init function in a
+// file added to this package.
+var pluginAuthorizer auth.Authorizer
+
 type WhipContext struct {
 	queries *database.Queries
+	authCtx *auth.AuthContext
+	// Decides about publish requests instead of the stream key alone, nil
+	// without AUTH_CALLBACK_URL
+	authorizer auth.Authorizer
 }
 
-func (ctx *WhipContext) whipHandler(res http.ResponseWriter, r *http.Request) {
-	username := r.PathValue("username")
-	if r.Method == "DELETE" {
-		return
-	}
-
+// authorizePublish checks the stream key in the Authorization header of the
+// request against the stream of username, or asks the authorizer with offer if
+// there is one. It returns the stream the request is for, which the authorizer
+// may have rewritten. WHIP sessions are only authorized when they are created,
+// see authorizeWHIPSession.
+func (ctx *WhipContext) authorizePublish(res http.ResponseWriter, r *http.Request, username, offer string) (string, bool) {
 	streamKeyHeader := r.Header.Get("Authorization")
 	if streamKeyHeader == "" {
 		logHTTPError(res, "Authorization was not set", http.StatusUnauthorized)
-		return
+		return "", false
 	}
 
 	streamKey, ok := extractBearerToken(streamKeyHeader)
 
 	if !ok {
 		logHTTPError(res, "Authorization header was empty", http.StatusUnauthorized)
-		return
+		return "", false
+	}
+
+	throttleKeys := []string{"ip:" + ctx.authCtx.ClientIP(r), "stream:" + username}
+	if wait, ok := ctx.authCtx.Throttle.Allow(throttleKeys...); !ok {
+		auth.TooManyAttempts(res, wait)
+		return "", false
+	}
+
+	stream := username
+	ok, reason := validateStreamKey(r.Context(), ctx.queries, username, streamKey)
+	if ctx.authorizer != nil {
+		decision, err := ctx.authorizer.Authorize(r.Context(), auth.AuthorizeRequest{
+			Action:       auth.AuthorizeActionPublish,
+			Protocol:     "whip",
+			Stream:       username,
+			StreamKey:    streamKey,
+			LocalAllowed: ok,
+			ClientIP:     ctx.authCtx.ClientIP(r),
+			SDP:          summarizeOffer(offer),
+		})
+		if err != nil {
+			// Not the publisher's fault, so not throttled
+			ctx.authCtx.Audit(r, auth.AuditPublishRejected, username, username, "authorization callback failed")
+			logHTTPError(res, err.Error(), http.StatusServiceUnavailable)
+			return "", false
+		}
+
+		ok, reason = decision.Allow, cmp.Or(decision.Reason, "denied by authorization callback")
+		stream = cmp.Or(decision.Stream, username)
 	}
 
-	ok = validateStreamKey(r.Context(), ctx.queries, username, streamKey)
 	if !ok {
+		ctx.authCtx.Audit(r, auth.AuditPublishRejected, username, username, reason)
+		ctx.authCtx.FailAttempt(r.Context(), ctx.authCtx.ClientIP(r), auth.AuditPublishRejected, username, throttleKeys...)
 		logHTTPError(res, "Invalid streamkey", http.StatusUnauthorized)
+		return "", false
+	}
+	ctx.authCtx.Throttle.Reset(throttleKeys...)
+
+	return stream, true
+}
+
+// summarizeOffer returns the SDP summary of an offer for an Authorizer, nil
+// for requests without one.
+func summarizeOffer(offer string) *auth.SDPSummary {
+	if offer == "" {
+		return nil
+	}
+
+	return auth.SummarizeSDP(offer)
+}
+
+// authorizeRTMP checks the stream key of an RTMP broadcast from ip like
+// authorizePublish does for WHIP.
+func (ctx *WhipContext) authorizeRTMP(c context.Context, ip, username, streamKey string) bool {
+	return ctx.authorizeIngest(c, ip, username, streamKey, auth.AuditRTMPPublish, auth.AuditRTMPPublishRejected)
+}
+
+// authorizeSRT is authorizeRTMP for SRT broadcasts.
+func (ctx *WhipContext) authorizeSRT(c context.Context, ip, username, streamKey string) bool {
+	return ctx.authorizeIngest(c, ip, username, streamKey, auth.AuditSRTPublish, auth.AuditSRTPublishRejected)
+}
+
+func (ctx *WhipContext) authorizeIngest(c context.Context, ip, username, streamKey, publishAction, rejectedAction string) bool {
+	throttleKeys := []string{"ip:" + ip, "stream:" + username}
+	if _, ok := ctx.authCtx.Throttle.Allow(throttleKeys...); !ok {
+		return false
+	}
+
+	ok, reason := validateStreamKey(c, ctx.queries, username, streamKey)
+	if !ok {
+		ctx.authCtx.AuditIP(c, ip, rejectedAction, username, username, reason)
+		ctx.authCtx.FailAttempt(c, ip, rejectedAction, username, throttleKeys...)
+		return false
+	}
+	ctx.authCtx.Throttle.Reset(throttleKeys...)
+	ctx.authCtx.AuditIP(c, ip, publishAction, username, username, "")
+
+	return true
+}
+
+// publisherPolicy returns what happens when the stream of username already has
+// a publisher, streams without a user take over.
+func (ctx *WhipContext) publisherPolicy(c context.Context, username string) (string, error) {
+	owner, err := auth.GetUser(c, ctx.queries, username)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return publisher.PolicyTakeover, nil
+	case err != nil:
+		return "", err
+	}
+
+	policy, err := auth.GetStreamPolicy(c, ctx.queries, owner)
+	if err != nil {
+		return "", err
+	}
+
+	return policy.PublisherPolicy, nil
+}
+
+// publishIngest starts a broadcast of RTMP or SRT to the stream of username.
+func (ctx *WhipContext) publishIngest(username string) (ingest.Publisher, error) {
+	policy, err := ctx.publisherPolicy(context.Background(), username)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := webrtc.Publish(username, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (ctx *WhipContext) whipHandler(res http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if r.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -101,26 +516,167 @@ func (ctx *WhipContext) whipHandler(res http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer, err := webrtc.WHIP(string(offer), username)
+	stream, ok := ctx.authorizePublish(res, r, username, string(offer))
+	if !ok {
+		return
+	}
+
+	policy, err := ctx.publisherPolicy(r.Context(), stream)
 	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	answer, whipSessionId, err := webrtc.WHIP(string(offer), stream, policy, publisherKey(r))
+	switch {
+	case errors.Is(err, webrtc.ErrStreamHasPublisher):
+		ctx.authCtx.Audit(r, auth.AuditPublishRejected, username, stream, "stream already has a publisher")
+		logHTTPError(res, "Stream already has a publisher", http.StatusConflict)
+		return
+	case err != nil:
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
+	ctx.authCtx.Audit(r, auth.AuditPublish, username, stream, "")
 
-	res.Header().Add("Location", "/api/whip")
+	res.Header().Add("Location", "/api/whip/"+url.PathEscape(stream)+"/"+whipSessionId)
+	res.Header().Add("ETag", webrtc.ICEETag(answer))
+	res.Header().Add("Accept-Patch", sdpFragmentContentType)
 	res.Header().Add("Content-Type", "application/sdp")
 	res.WriteHeader(http.StatusCreated)
 	fmt.Fprint(res, answer)
 }
 
-func whepHandler(res http.ResponseWriter, req *http.Request) {
+// publisherKey returns what identifies the publisher of a WHIP session, a hash
+// of the stream key in the Authorization header of the request.
+func publisherKey(r *http.Request) string {
+	streamKey, _ := extractBearerToken(r.Header.Get("Authorization"))
+	hash := sha256.Sum256([]byte(streamKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// authorizeWHIPSession checks that the WHIP session in the request path is on
+// the stream of the path and was created with the stream key of the request.
+// It doesn't ask the authorizer again, that happened when it was created. It
+// returns the stream of the session.
+func (ctx *WhipContext) authorizeWHIPSession(res http.ResponseWriter, r *http.Request) (string, bool) {
+	stream, publisher, ok := webrtc.WHIPSessionPublisher(r.PathValue("whipSessionId"))
+	if !ok || r.PathValue("username") != stream {
+		logHTTPError(res, "WHIP session does not exist", http.StatusNotFound)
+		return "", false
+	}
+
+	if _, ok = extractBearerToken(r.Header.Get("Authorization")); !ok {
+		logHTTPError(res, "Authorization was not set", http.StatusUnauthorized)
+		return "", false
+	}
+
+	throttleKeys := []string{"ip:" + ctx.authCtx.ClientIP(r), "stream:" + stream}
+	if wait, ok := ctx.authCtx.Throttle.Allow(throttleKeys...); !ok {
+		auth.TooManyAttempts(res, wait)
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(publisherKey(r)), []byte(publisher)) != 1 {
+		ctx.authCtx.FailAttempt(r.Context(), ctx.authCtx.ClientIP(r), auth.AuditPublishRejected, stream, throttleKeys...)
+		logHTTPError(res, "Invalid streamkey", http.StatusUnauthorized)
+		return "", false
+	}
+
+	return stream, true
+}
+
+// whipDeleteHandler ends a WHIP session, its resource URL is the Location
+// returned by whipHandler.
+func (ctx *WhipContext) whipDeleteHandler(res http.ResponseWriter, r *http.Request) {
+	stream, ok := ctx.authorizeWHIPSession(res, r)
+	if !ok {
+		return
+	}
+
+	if !webrtc.WHIPDelete(stream, r.PathValue("whipSessionId")) {
+		logHTTPError(res, "WHIP session does not exist", http.StatusNotFound)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// whipPatchHandler trickles ICE candidates to a WHIP session or restarts ICE.
+func (ctx *WhipContext) whipPatchHandler(res http.ResponseWriter, r *http.Request) {
+	stream, ok := ctx.authorizeWHIPSession(res, r)
+	if !ok {
+		return
+	}
+
+	patchICE(res, r, func(ifMatch, fragment string) (string, error) {
+		return webrtc.WHIPPatch(stream, r.PathValue("whipSessionId"), ifMatch, fragment)
+	})
+}
+
+type WhepContext struct {
+	queries *database.Queries
+	authCtx *auth.AuthContext
+	hls     *hls.Packager
+	// Decides about watch requests the stream's policy let through, nil
+	// without AUTH_CALLBACK_WHEP
+	authorizer auth.Authorizer
+}
+
+// authorizeWatch checks that the stream of username exists and that its policy
+// lets the requesting user watch it.
+func (ctx *WhepContext) authorizeWatch(res http.ResponseWriter, req *http.Request, username string) bool {
+	owner, err := auth.GetUser(req.Context(), ctx.queries, username)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		logHTTPError(res, "Stream does not exist", http.StatusNotFound)
+		return false
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	viewer := auth.UserFromRequest(req)
+	allowed, err := auth.CanWatch(req.Context(), ctx.queries, viewer, owner)
+	switch {
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	case !allowed && viewer.ID() == "":
+		logHTTPError(res, "Please log in", http.StatusUnauthorized)
+		return false
+	case !allowed:
+		logHTTPError(res, "You are not allowed to watch this stream", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (ctx *WhepContext) whepHandler(res http.ResponseWriter, req *http.Request) {
 	username := req.PathValue("username")
-	if username == "" {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if username == "" {
 		logHTTPError(res, "Stream does not exist", http.StatusBadRequest)
 		return
 	}
 
-	//TODO: check if user exists
+	// Viewer tokens grant access to one stream regardless of its policy, API
+	// tokens were already resolved to their user by MaybeAuthHandler
+	viewer, maxSessions := auth.UserFromRequest(req).Name(), 0
+	if token, ok := viewerToken(req, false); ok {
+		t, err := ctx.authCtx.VerifyViewerToken(req.Context(), token, username)
+		if err != nil {
+			logHTTPError(res, "Invalid viewer token", http.StatusUnauthorized)
+			return
+		}
+
+		viewer, maxSessions = t.Viewer(), int(t.MaxUses)
+	} else if !ctx.authorizeWatch(res, req, username) {
+		return
+	}
 
 	offer, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -128,60 +684,231 @@ func whepHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	answer, whepSessionId, err := webrtc.WHEP(string(offer), username)
-	if err != nil {
+	stream := username
+	if ctx.authorizer != nil {
+		decision, err := ctx.authorizer.Authorize(req.Context(), auth.AuthorizeRequest{
+			Action:       auth.AuthorizeActionWatch,
+			Protocol:     "whep",
+			Stream:       username,
+			User:         viewer,
+			LocalAllowed: true,
+			ClientIP:     ctx.authCtx.ClientIP(req),
+			SDP:          summarizeOffer(string(offer)),
+		})
+		switch {
+		case err != nil:
+			logHTTPError(res, err.Error(), http.StatusServiceUnavailable)
+			return
+		case !decision.Allow:
+			logHTTPError(res, "You are not allowed to watch this stream", http.StatusForbidden)
+			return
+		}
+
+		stream = cmp.Or(decision.Stream, username)
+	}
+
+	answer, whepSessionId, err := webrtc.WHEP(string(offer), stream, viewer, maxSessions)
+	switch {
+	case errors.Is(err, webrtc.ErrTooManyWHEPSessions):
+		logHTTPError(res, "Viewer token is in use by too many viewers", http.StatusForbidden)
+		return
+	case err != nil:
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	apiPath := req.Host + strings.TrimSuffix(req.URL.RequestURI(), "whep/"+username+"/")
-	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers"`)
+	apiPath := requestBaseURL(req, ctx.authCtx) + strings.TrimSuffix(req.URL.Path, "whep/"+username+"/")
+	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers,active-layer,viewer-count,stream-online,stream-offline"`)
 	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:layer"`)
-	res.Header().Add("Location", "/api/whep/"+username+"/")
+	res.Header().Add("Location", "/api/whep/"+url.PathEscape(stream)+"/"+whepSessionId)
+	res.Header().Add("ETag", webrtc.ICEETag(answer))
+	res.Header().Add("Accept-Patch", sdpFragmentContentType)
 	res.Header().Add("Content-Type", "application/sdp")
 	res.WriteHeader(http.StatusCreated)
 	fmt.Fprint(res, answer)
 }
 
-func whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
-	res.Header().Set("Content-Type", "text/event-stream")
-	res.Header().Set("Cache-Control", "no-cache")
-	res.Header().Set("Connection", "keep-alive")
+// hlsHandler serves the HLS stream of username to viewers allowed to watch it.
+// Viewer tokens may also be passed as the token query parameter, as players
+// can't always send headers. They don't limit HLS viewers to maxUses.
+func (ctx *WhepContext) hlsHandler(res http.ResponseWriter, req *http.Request) {
+	username := req.PathValue("username")
 
-	vals := strings.Split(req.URL.RequestURI(), "/")
-	whepSessionId := vals[len(vals)-1]
+	if token, ok := viewerToken(req, true); ok {
+		if _, err := ctx.authCtx.VerifyViewerToken(req.Context(), token, username); err != nil {
+			logHTTPError(res, "Invalid viewer token", http.StatusUnauthorized)
+			return
+		}
+	} else if !ctx.authorizeWatch(res, req, username) {
+		return
+	}
 
-	layers, err := webrtc.WHEPLayers(whepSessionId)
+	ctx.hls.ServeHTTP(res, req)
+}
+
+// viewerToken returns the viewer token of a request, API tokens are not viewer
+// tokens. If fromQuery is set it may also be the token query parameter, for
+// clients that can't send headers like players and EventSource.
+func viewerToken(req *http.Request, fromQuery bool) (string, bool) {
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if !ok && fromQuery {
+		token = req.URL.Query().Get("token")
+		ok = token != ""
+	}
+
+	return token, ok && !auth.IsAPIToken(token)
+}
+
+// authorizeWHEPSession checks that the WHEP session in the request path was
+// started by the requesting user, or that they may control every session, and
+// that the stream's policy still lets them watch. Sessions of viewer tokens
+// need the token, from the token query parameter too if queryToken is set.
+func (ctx *WhepContext) authorizeWHEPSession(res http.ResponseWriter, req *http.Request, queryToken bool) (string, bool) {
+	whepSessionId := req.PathValue("whepSessionId")
+
+	streamKey, viewer, ok := webrtc.WHEPSessionViewer(whepSessionId)
+	if !ok || (req.PathValue("username") != "" && req.PathValue("username") != streamKey) {
+		logHTTPError(res, "WHEP session does not exist", http.StatusNotFound)
+		return "", false
+	}
+
+	if token, ok := viewerToken(req, queryToken); ok {
+		if t, err := ctx.authCtx.VerifyViewerToken(req.Context(), token, streamKey); err != nil || t.Viewer() != viewer {
+			logHTTPError(res, "Invalid viewer token", http.StatusUnauthorized)
+			return "", false
+		}
+
+		return whepSessionId, true
+	}
+
+	user := auth.UserFromRequest(req)
+	if viewer != user.Name() && !user.Can(auth.PermissionWatchAll) {
+		logHTTPError(res, "WHEP session belongs to another viewer", http.StatusForbidden)
+		return "", false
+	}
+
+	return whepSessionId, ctx.authorizeWatch(res, req, streamKey)
+}
+
+// whepDeleteHandler ends a WHEP session, its resource URL is the Location
+// returned by whepHandler.
+func (ctx *WhepContext) whepDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	whepSessionId, ok := ctx.authorizeWHEPSession(res, req, false)
+	if !ok {
+		return
+	}
+
+	if !webrtc.WHEPDelete(req.PathValue("username"), whepSessionId) {
+		logHTTPError(res, "WHEP session does not exist", http.StatusNotFound)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// whepPatchHandler trickles ICE candidates to a WHEP session or restarts ICE.
+func (ctx *WhepContext) whepPatchHandler(res http.ResponseWriter, req *http.Request) {
+	whepSessionId, ok := ctx.authorizeWHEPSession(res, req, false)
+	if !ok {
+		return
+	}
+
+	patchICE(res, req, func(ifMatch, fragment string) (string, error) {
+		return webrtc.WHEPPatch(req.PathValue("username"), whepSessionId, ifMatch, fragment)
+	})
+}
+
+// whepServerSentEventsHandler streams the events of a WHEP session until it
+// ends or the client goes away.
+func (ctx *WhepContext) whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
+	whepSessionId, ok := ctx.authorizeWHEPSession(res, req, true)
+	if !ok {
+		return
+	}
+
+	events, err := webrtc.WHEPSubscribe(req.Context(), whepSessionId)
 	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		logHTTPError(res, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	fmt.Fprint(res, "event: layers\n")
-	fmt.Fprintf(res, "data: %s\n", string(layers))
-	fmt.Fprint(res, "\n\n")
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(res)
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Name, event.Data)
+		case <-heartbeat.C:
+			// Comments are ignored by clients but keep proxies from closing the connection
+			fmt.Fprint(res, ": heartbeat\n\n")
+		}
+	}
 }
 
-func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
+func (ctx *WhepContext) whepLayerHandler(res http.ResponseWriter, req *http.Request) {
+	whepSessionId, ok := ctx.authorizeWHEPSession(res, req, false)
+	if !ok {
+		return
+	}
+
 	var r whepLayerRequestJSON
 	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	vals := strings.Split(req.URL.RequestURI(), "/")
-	whepSessionId := vals[len(vals)-1]
-
 	if err := webrtc.WHEPChangeLayer(whepSessionId, r.EncodingId); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 }
 
-func statusHandler(res http.ResponseWriter, req *http.Request) {
+// statusHandler lists all streams for users that may see every status. Other
+// users get their own stream and the listed streams they may watch, without
+// WHEP sessions.
+func (ctx *WhepContext) statusHandler(res http.ResponseWriter, req *http.Request) {
 	res.Header().Add("Content-Type", "application/json")
 
-	if err := json.NewEncoder(res).Encode(webrtc.GetStreamStatuses()); err != nil {
+	user := auth.UserFromRequest(req)
+	statuses := []webrtc.StreamStatus{}
+	for _, status := range webrtc.GetStreamStatuses() {
+		if user.Can(auth.PermissionViewAllStatus) || (user.ID() != "" && status.StreamKey == user.Name()) {
+			statuses = append(statuses, status)
+			continue
+		}
+
+		owner, err := auth.GetUser(req.Context(), ctx.queries, status.StreamKey)
+		if err != nil {
+			continue
+		}
+
+		policy, err := auth.GetStreamPolicy(req.Context(), ctx.queries, owner)
+		if err != nil || !policy.Listed() {
+			continue
+		}
+
+		if allowed, err := auth.CanWatch(req.Context(), ctx.queries, user, owner); err == nil && allowed {
+			status.WHEPSessions = []webrtc.WHEPSessionStatus{}
+			statuses = append(statuses, status)
+		}
+	}
+
+	if err := json.NewEncoder(res).Encode(statuses); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 	}
 }
@@ -200,6 +927,59 @@ func indexHTMLWhenNotFound(fs http.FileSystem) http.HandlerFunc {
 	}
 }
 
+// patchICE handles a PATCH with an SDP fragment as specified by WHIP and WHEP.
+// The response has the local candidates the client doesn't know yet, and new
+// credentials after an ICE restart.
+func patchICE(res http.ResponseWriter, req *http.Request, patch func(ifMatch, fragment string) (string, error)) {
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != sdpFragmentContentType {
+		logHTTPError(res, "Content-Type must be "+sdpFragmentContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fragment, err := patch(req.Header.Get("If-Match"), string(body))
+	switch {
+	case errors.Is(err, webrtc.ErrSessionNotFound):
+		logHTTPError(res, "Session does not exist", http.StatusNotFound)
+		return
+	case errors.Is(err, webrtc.ErrICESessionMismatch):
+		logHTTPError(res, err.Error(), http.StatusPreconditionFailed)
+		return
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	case fragment == "":
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	res.Header().Add("ETag", webrtc.ICEETag(fragment))
+	res.Header().Add("Content-Type", sdpFragmentContentType)
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprint(res, fragment)
+}
+
+// requestBaseURL returns the scheme and host a request was made to, as seen
+// by the client when behind a TLS terminating proxy. X-Forwarded-Proto is only
+// taken from trusted proxies.
+func requestBaseURL(req *http.Request, authCtx *auth.AuthContext) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	if proto := req.Header.Get("X-Forwarded-Proto"); (proto == "http" || proto == "https") && authCtx.FromTrustedProxy(req) {
+		scheme = proto
+	}
+
+	return scheme + "://" + req.Host
+}
+
 func corsHandler(next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Access-Control-Allow-Origin", "*")
@@ -214,6 +994,8 @@ func corsHandler(next func(w http.ResponseWriter, r *http.Request)) http.Handler
 }
 
 func main() {
+	flag.Parse()
+
 	loadConfigs := func() error {
 		if os.Getenv("APP_ENV") == "development" {
 			log.Println("Loading `" + envFileDev + "`")
@@ -249,15 +1031,86 @@ func main() {
 		}
 	}
 
+	ctx := context.Background()
+
+	databasePath := flagOrEnv(*databasePathFlag, "DATABASE_PATH", defaultDatabasePath)
+	db, err := database.Open(ctx, databasePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	log.Println("Using database `" + databasePath + "`")
+
+	switch {
+	case flag.Arg(0) == "import-users":
+		if flag.NArg() != 2 {
+			log.Fatal("Usage: broadcast-box import-users <path to users.json>")
+		}
+
+		if err = importUsers(ctx, db, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *importUsersFlag != "":
+		if err = importUsers(ctx, db, *importUsersFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	database := database.New(db)
+	if err = bootstrapAdmin(ctx, database); err != nil {
+		log.Fatal(err)
+	}
+
+	sessionStore := auth.NewSessionStore(
+		database,
+		durationFromEnv("SESSION_IDLE_TIMEOUT", auth.DefaultSessionIdleTimeout),
+		durationFromEnv("SESSION_MAX_AGE", auth.DefaultSessionMaxAge),
+		secureCookies(),
+		sessionKeys()...,
+	)
+
+	viewerTokenKey := []byte(os.Getenv("VIEWER_TOKEN_KEY"))
+	if len(viewerTokenKey) == 0 {
+		log.Println("VIEWER_TOKEN_KEY is not set, viewer tokens will be invalid after a restart")
+		viewerTokenKey = []byte(auth.GenerateStreamKey())
+	}
+
+	authCtx := auth.NewContext(database, sessionStore, viewerTokenKey)
+	authCtx.TrustedProxies = prefixesFromEnv("TRUSTED_PROXIES")
+	if cfg, ok := oidcConfigFromEnv(); ok {
+		if err = authCtx.EnableOIDC(ctx, cfg); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("OpenID Connect login enabled with `" + cfg.Issuer + "`")
+	}
+
+	whepCtx := WhepContext{queries: database, authCtx: &authCtx}
+	authorizer, authorizeWHEP, hasAuthorizer := authorizerFromEnv()
+	if hasAuthorizer {
+		if authorizeWHEP {
+			whepCtx.authorizer = authorizer
+		}
+		log.Println("Publish requests are authorized by a callback")
+	}
+
 	webrtc.Configure()
 
+	if slatePath := os.Getenv("SLATE_PATH"); slatePath != "" {
+		if err := webrtc.LoadSlate(slatePath); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Viewers of streams without a publisher get the slate from `" + slatePath + "`")
+	}
+
 	if os.Getenv("NETWORK_TEST_ON_START") == "true" {
 		fmt.Println(networkTestIntroMessage) //nolint
 
 		go func() {
 			time.Sleep(time.Second * 5)
 
-			if networkTestErr := networktest.Run(whepHandler); networkTestErr != nil {
+			if networkTestErr := networktest.Run(whepCtx.whepHandler); networkTestErr != nil {
 				fmt.Printf(networkTestFailedMessage, networkTestErr.Error())
 				os.Exit(1)
 			} else {
@@ -285,52 +1138,146 @@ func main() {
 		}()
 	}
 
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		log.Fatal(err)
+	whipCtx := WhipContext{queries: database, authCtx: &authCtx, authorizer: authorizer}
+
+	mux := http.NewServeMux()
+	if os.Getenv("DISABLE_FRONTEND") == "" {
+		mux.HandleFunc("/", indexHTMLWhenNotFound(http.Dir("./web/build")))
 	}
+	// Requests are only measured when metrics are served
+	instrument := func(_ string, next http.HandlerFunc) http.HandlerFunc { return next }
+	if metricsAddress := os.Getenv("METRICS_ADDRESS"); metricsAddress != "" {
+		var disabledLabels []string
+		if labels := os.Getenv("METRICS_DISABLE_LABELS"); labels != "" {
+			disabledLabels = strings.Split(labels, "|")
+		}
 
-	ctx := context.Background()
+		collector := metrics.New(disabledLabels)
+		instrument = collector.Instrument
 
-	// create tables
-	if _, err := db.ExecContext(ctx, ddl); err != nil {
-		log.Fatal(err)
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", collector.Handler())
+
+		go func() {
+			log.Println("Running Metrics Server at `" + metricsAddress + "`")
+			log.Fatal(http.ListenAndServe(metricsAddress, metricsMux))
+		}()
 	}
-	database := database.New(db)
-	users, err := database.ListUsers(ctx)
-	if err != nil {
-		log.Fatal(err)
+
+	mux.HandleFunc("/api/whip/{username}/", instrument("whip", corsHandler(whipCtx.whipHandler)))
+	mux.HandleFunc("DELETE /api/whip/{username}/{whipSessionId}", instrument("whip", corsHandler(whipCtx.whipDeleteHandler)))
+	mux.HandleFunc("PATCH /api/whip/{username}/{whipSessionId}", instrument("whip", corsHandler(whipCtx.whipPatchHandler)))
+	mux.HandleFunc("/api/whep/{username}/", instrument("whep", authCtx.MaybeAuthHandler(corsHandler(whepCtx.whepHandler))))
+	mux.HandleFunc("DELETE /api/whep/{username}/{whepSessionId}", instrument("whep", authCtx.MaybeAuthHandler(corsHandler(whepCtx.whepDeleteHandler))))
+	mux.HandleFunc("PATCH /api/whep/{username}/{whepSessionId}", instrument("whep", authCtx.MaybeAuthHandler(corsHandler(whepCtx.whepPatchHandler))))
+	mux.HandleFunc("/api/sse/{whepSessionId}", authCtx.MaybeAuthHandler(corsHandler(whepCtx.whepServerSentEventsHandler)))
+	mux.HandleFunc("/api/layer/{whepSessionId}", authCtx.MaybeAuthHandler(corsHandler(whepCtx.whepLayerHandler)))
+	mux.HandleFunc("POST /auth/login", corsHandler(authCtx.LoginHandler))
+	mux.HandleFunc("GET /auth/oidc/login", authCtx.OIDCLoginHandler)
+	mux.HandleFunc("GET /auth/oidc/callback", authCtx.OIDCCallbackHandler)
+	mux.HandleFunc("POST /auth/logout", authCtx.AuthHandler(corsHandler(authCtx.LogoutHandler)))
+	mux.HandleFunc("GET /user/info", authCtx.AuthHandler(corsHandler(authCtx.UserInfoHandler)))
+	mux.HandleFunc("POST /user/password", authCtx.AuthHandler(corsHandler(authCtx.ChangePasswordHandler)))
+	mux.HandleFunc("POST /user/streamkey", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(authCtx.RegenerateStreamKeyHandler)))
+	mux.HandleFunc("GET /user/stream", authCtx.AuthHandler(corsHandler(authCtx.GetStreamPolicyHandler)))
+	mux.HandleFunc("PUT /user/stream", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(authCtx.SetStreamPolicyHandler)))
+	mux.HandleFunc("GET /user/sessions", authCtx.AuthHandler(corsHandler(authCtx.ListSessionsHandler)))
+	mux.HandleFunc("DELETE /user/sessions", authCtx.AuthHandler(corsHandler(authCtx.EndAllSessionsHandler)))
+	mux.HandleFunc("DELETE /user/sessions/{id}", authCtx.AuthHandler(corsHandler(authCtx.EndSessionHandler)))
+	mux.HandleFunc("GET /user/tokens", authCtx.AuthHandler(corsHandler(authCtx.ListAPITokensHandler)))
+	mux.HandleFunc("POST /user/tokens", authCtx.AuthHandler(corsHandler(authCtx.CreateAPITokenHandler)))
+	mux.HandleFunc("DELETE /user/tokens/{id}", authCtx.AuthHandler(corsHandler(authCtx.RevokeAPITokenHandler)))
+	mux.HandleFunc("GET /user/viewer-tokens", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(authCtx.ListViewerTokensHandler)))
+	mux.HandleFunc("POST /user/viewer-tokens", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(authCtx.CreateViewerTokenHandler)))
+	mux.HandleFunc("DELETE /user/viewer-tokens/{id}", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(authCtx.RevokeViewerTokenHandler)))
+	mux.HandleFunc("GET /api/admin/audit", authCtx.AdminHandler(corsHandler(authCtx.AdminAuditLogHandler)))
+	mux.HandleFunc("GET /api/admin/users", authCtx.AdminHandler(corsHandler(authCtx.AdminListUsersHandler)))
+	mux.HandleFunc("POST /api/admin/users", authCtx.AdminHandler(corsHandler(authCtx.AdminCreateUserHandler)))
+	mux.HandleFunc("DELETE /api/admin/users/{username}", authCtx.AdminHandler(corsHandler(authCtx.AdminDeleteUserHandler)))
+	mux.HandleFunc("PUT /api/admin/users/{username}/password", authCtx.AdminHandler(corsHandler(authCtx.AdminResetPasswordHandler)))
+	mux.HandleFunc("POST /api/admin/users/{username}/streamkey", authCtx.AdminHandler(corsHandler(authCtx.AdminRotateStreamKeyHandler)))
+	mux.HandleFunc("PUT /api/admin/users/{username}/role", authCtx.AdminHandler(corsHandler(authCtx.AdminChangeRoleHandler)))
+	mux.HandleFunc("PUT /api/admin/users/{username}/groups", authCtx.AdminHandler(corsHandler(authCtx.AdminSetGroupsHandler)))
+	mux.HandleFunc("GET /api/admin/users/{username}/viewer-tokens", authCtx.AdminHandler(corsHandler(authCtx.AdminListViewerTokensHandler)))
+	mux.HandleFunc("POST /api/admin/users/{username}/viewer-tokens", authCtx.AdminHandler(corsHandler(authCtx.AdminCreateViewerTokenHandler)))
+	mux.HandleFunc("DELETE /api/admin/users/{username}/viewer-tokens/{id}", authCtx.AdminHandler(corsHandler(authCtx.AdminRevokeViewerTokenHandler)))
+
+	webhooks := webhook.New(database)
+	webrtc.AddStreamListener(webhooks.StreamEvent)
+	authCtx.OnStreamKeyRotate = webhooks.StreamKeyRotated
+	mux.HandleFunc("GET /api/admin/webhooks", authCtx.AdminHandler(corsHandler(webhooks.ListHandler)))
+	mux.HandleFunc("POST /api/admin/webhooks", authCtx.AdminHandler(corsHandler(webhooks.CreateHandler)))
+	mux.HandleFunc("DELETE /api/admin/webhooks/{id}", authCtx.AdminHandler(corsHandler(webhooks.DeleteHandler)))
+	mux.HandleFunc("GET /api/admin/webhooks/{id}/deliveries", authCtx.AdminHandler(corsHandler(webhooks.DeliveriesHandler)))
+
+	if recorder, ok := recorderFromEnv(database); ok {
+		recorder.OnFinish = webhooks.RecordingFinished
+		webrtc.AddSinkFactory(recorder.Sink)
+		log.Println("Recording streams to `" + os.Getenv("RECORDINGS_PATH") + "`")
+
+		mux.HandleFunc("GET /user/recordings", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(recorder.ListHandler)))
+		mux.HandleFunc("GET /user/recordings/{name}", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(recorder.DownloadHandler)))
+		mux.HandleFunc("DELETE /user/recordings/{name}", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(recorder.DeleteHandler)))
+		mux.HandleFunc("GET /api/admin/users/{username}/recordings", authCtx.AdminHandler(corsHandler(recorder.ListHandler)))
+		mux.HandleFunc("GET /api/admin/users/{username}/recordings/{name}", authCtx.AdminHandler(corsHandler(recorder.DownloadHandler)))
+		mux.HandleFunc("DELETE /api/admin/users/{username}/recordings/{name}", authCtx.AdminHandler(corsHandler(recorder.DeleteHandler)))
 	}
-	if len(users) == 0 {
-		_, err := auth.NewUser(ctx, database, "admin", "admin", "admin123")
-		if err != nil {
-			log.Fatal(err)
+
+	if packager, ok := hlsPackagerFromEnv(); ok {
+		whepCtx.hls = packager
+		webrtc.AddSinkFactory(packager.Sink)
+		mux.HandleFunc("/api/hls/{username}/{path...}", authCtx.MaybeAuthHandler(corsHandler(whepCtx.hlsHandler)))
+	}
+
+	if os.Getenv("ENABLE_RESTREAM") != "" {
+		restreamer := restream.New(database)
+		restreamer.AllowedNetworks = prefixesFromEnv("RESTREAM_ALLOWED_NETWORKS")
+		webrtc.AddSinkFactory(restreamer.Sink)
+
+		mux.HandleFunc("GET /user/restream", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(restreamer.ListHandler)))
+		mux.HandleFunc("POST /user/restream", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(restreamer.CreateHandler)))
+		mux.HandleFunc("PUT /user/restream/{id}", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(restreamer.UpdateHandler)))
+		mux.HandleFunc("DELETE /user/restream/{id}", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(restreamer.DeleteHandler)))
+		mux.HandleFunc("POST /user/restream/{id}/start", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(restreamer.StartHandler)))
+		mux.HandleFunc("POST /user/restream/{id}/stop", authCtx.PermissionHandler(auth.PermissionPublish, corsHandler(restreamer.StopHandler)))
+	}
+
+	if os.Getenv("DISABLE_STATUS") == "" {
+		mux.HandleFunc("/api/status", authCtx.MaybeAuthHandler(corsHandler(whepCtx.statusHandler)))
+	}
+
+	if rtmpAddress := os.Getenv("RTMP_ADDRESS"); rtmpAddress != "" {
+		rtmpServer := &rtmp.Server{
+			Authorize: whipCtx.authorizeRTMP,
+			Publish:   whipCtx.publishIngest,
 		}
-		_, err = auth.NewUser(ctx, database, "lol", "rofl", "lol123")
+
+		rtmpListener, err := net.Listen("tcp", rtmpAddress)
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		go func() {
+			log.Println("Running RTMP Server at `" + rtmpAddress + "`")
+			log.Fatal(rtmpServer.Serve(rtmpListener))
+		}()
 	}
 
-	sessionKey := []byte(os.Getenv("SESSION_KEY"))
-	sessionKey = []byte("abcdefghabcdefghabcdefghabcdefgh") //TODO
-	authCtx := auth.NewContext(database, sessionKey)
-	whipCtx := WhipContext{queries: database}
+	if srtAddress := os.Getenv("SRT_ADDRESS"); srtAddress != "" {
+		srtServer := &srt.Server{
+			Authorize: whipCtx.authorizeSRT,
+			Publish:   whipCtx.publishIngest,
+		}
 
-	mux := http.NewServeMux()
-	if os.Getenv("DISABLE_FRONTEND") == "" {
-		mux.HandleFunc("/", indexHTMLWhenNotFound(http.Dir("./web/build")))
-	}
-	mux.HandleFunc("/api/whip/{username}/", corsHandler(whipCtx.whipHandler))
-	mux.HandleFunc("/api/whep/{username}/", authCtx.AuthHandler(corsHandler(whepHandler)))
-	mux.HandleFunc("/api/sse/", authCtx.AuthHandler(corsHandler(whepServerSentEventsHandler)))
-	mux.HandleFunc("/api/layer/", authCtx.AuthHandler(corsHandler(whepLayerHandler)))
-	mux.HandleFunc("POST /auth/login", corsHandler(authCtx.LoginHandler))
-	mux.HandleFunc("POST /auth/logout", authCtx.AuthHandler(corsHandler(authCtx.LogoutHandler)))
-	mux.HandleFunc("GET /user/info", authCtx.AuthHandler(corsHandler(authCtx.UserInfoHandler)))
+		srtListener, err := srt.Listen(srtAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if os.Getenv("DISABLE_STATUS") == "" {
-		mux.HandleFunc("/api/status", authCtx.AuthHandler(corsHandler(statusHandler)))
+		go func() {
+			log.Println("Running SRT Server at `" + srtAddress + "`")
+			log.Fatal(srtServer.Serve(srtListener))
+		}()
 	}
 
 	server := &http.Server{
@@ -68,6 +68,9 @@ function LoginPage() {
           <input className='appearance-none border w-full py-2 px-3 leading-tight focus:outline-hidden focus:shadow-outline bg-gray-700 border-gray-700 text-white rounded-sm shadow-md placeholder-gray-200' name='password' type='password' />
         </div>
         <button type='submit' className='py-2 px-4 bg-blue-500 text-white font-semibold rounded-lg shadow-md hover:bg-blue-700 focus:outline-hidden focus:ring-2 focus:ring-blue-400 focus:ring-opacity-75'>Submit</button>
+        {import.meta.env.VITE_OIDC_LOGIN === 'true' && (
+          <a href={`auth/oidc/login?redirectUrl=${encodeURIComponent(new URL(document.location).searchParams.get('redirectUrl') ?? '/')}`} className='ml-4 py-2 px-4 bg-gray-700 text-white font-semibold rounded-lg shadow-md hover:bg-gray-600'>Log in with SSO</a>
+        )}
         </form>
   )
 }
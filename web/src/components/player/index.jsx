@@ -66,6 +66,8 @@ function Player({ cinemaMode, peerConnectionDisconnected, setPeerConnectionDisco
 
   React.useEffect(() => {
     const peerConnection = new RTCPeerConnection() // eslint-disable-line
+    let whepSessionUrl = null
+    let evtSource = null
 
     peerConnection.ontrack = function (event) {
       setMediaSrcObject(event.streams[0])
@@ -100,9 +102,14 @@ function Player({ cinemaMode, peerConnectionDisconnected, setPeerConnectionDisco
       }).then(r => {
         console.log(`fetched: ${apiPath}/whep/${location.pathname.split('/').pop()}`)
         const parsedLinkHeader = parseLinkHeader(r.headers.get('Link'))
-        setLayerEndpoint(`${window.location.protocol}//${parsedLinkHeader['urn:ietf:params:whep:ext:core:layer'].url}`)
+        setLayerEndpoint(parsedLinkHeader['urn:ietf:params:whep:ext:core:layer'].url)
 
-        const evtSource = new EventSource(`${window.location.protocol}//${parsedLinkHeader['urn:ietf:params:whep:ext:core:server-sent-events'].url}`)
+        const resourceLocation = r.headers.get('Location')
+        if (resourceLocation) {
+          whepSessionUrl = new URL(resourceLocation, new URL(apiPath, document.location))
+        }
+
+        evtSource = new EventSource(parsedLinkHeader['urn:ietf:params:whep:ext:core:server-sent-events'].url)
         evtSource.onerror = err => evtSource.close();
 
         evtSource.addEventListener("layers", event => {
@@ -122,6 +129,14 @@ function Player({ cinemaMode, peerConnectionDisconnected, setPeerConnectionDisco
 
     return function cleanup() {
       peerConnection.close()
+
+      if (evtSource) {
+        evtSource.close()
+      }
+
+      if (whepSessionUrl) {
+        fetch(whepSessionUrl, { method: 'DELETE' })
+      }
     }
   }, [location.pathname, setPeerConnectionDisconnected])
 
@@ -25,6 +25,7 @@ function Player(props) {
   React.useEffect(() => {
     const peerConnection = new RTCPeerConnection() // eslint-disable-line
     let stream = null
+    let whipSessionUrl = null
 
     if (!navigator.mediaDevices) {
       setMediaAccessError({name: 'NoMediaDevices'})
@@ -93,6 +94,10 @@ function Player(props) {
             'Content-Type': 'application/sdp'
           }
         }).then(r => {
+          const resourceLocation = r.headers.get('Location')
+          if (resourceLocation !== null) {
+            whipSessionUrl = new URL(resourceLocation, new URL(apiPath, document.location))
+          }
           return r.text()
         }).then(answer => {
           peerConnection.setRemoteDescription({
@@ -104,6 +109,12 @@ function Player(props) {
     }, setMediaAccessError)
 
     return function cleanup() {
+      if (whipSessionUrl !== null) {
+        fetch(whipSessionUrl, {
+          method: 'DELETE',
+          headers: {Authorization: `Bearer ${location.pathname.split('/').pop()}`}
+        })
+      }
       peerConnection.close()
       if (stream !== null) {
         stream.getTracks().forEach(t => t.stop())